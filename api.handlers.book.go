@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -46,27 +52,50 @@ func (api *APIHandler) Status(w http.ResponseWriter, r *http.Request, _ httprout
 // @Consume		json
 // @Produce		json
 // @Param		Book		body		Book	true	"Book to create"
-// @Success		201		{object}		StatusResponse
+// @Success		201		{object}		APIResponse{data=Book}
 // @Failure		400		{object}		APIError
+// @Failure		413		{object}		APIError
 // @Failure		500		{object}		APIError
-// @Router		/api/v1/books	[POST]
+// @Failure		503		{object}		APIError
+// @Router		/books	[POST]
 func (api *APIHandler) CreateBook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	book := Book{}
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	stop := TrackTiming(r.Context(), api.clock, TimingValidation)
 	err := DecodeCreateOrUpdateBookRequestBody(r, &book)
+	stop()
 	if err != nil {
 		api.logger.Error("failed to create book", zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to create the book", book)
+		if IsRequestBodyTooLarge(err) {
+			api.WriteRequestBodyTooLarge(w, r)
+			return
+		}
+		if err == ErrEmptyRequestBody {
+			errResp := NewAPIError(requestID, http.StatusBadRequest, "request body is empty", book)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		var data interface{} = book
+		var fieldErr *RequestFieldError
+		if errors.As(err, &fieldErr) {
+			data = map[string]string{"field": fieldErr.Field, "reason": fieldErr.Reason}
+		}
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to create the book", data)
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
 
+	stop = TrackTiming(r.Context(), api.clock, TimingValidation)
 	err = ValidateCreateBookRequestBody(&book)
+	stop()
 	if err != nil {
 		api.logger.Error("failed to create book", zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to create the book", err.Error())
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to create the book", ValidationErrorData(err))
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
@@ -74,10 +103,26 @@ func (api *APIHandler) CreateBook(w http.ResponseWriter, r *http.Request, _ http
 	}
 
 	book.ID = api.idsHandler.Generate(BookIDPrefix)
-	book.CreatedAt = api.clock.Now().String()
-	book.UpdatedAt = api.clock.Now().String()
+	book.CreatedAt = FormatBookTime(api.clock.Now())
+	book.UpdatedAt = FormatBookTime(api.clock.Now())
 
 	err = api.bookService.Add(r.Context(), book.ID, book)
+	if errors.Is(err, ErrBackupRollback) {
+		api.logger.Error("failed to roll back book after backup storage failure", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to create the book into backup storage and to roll it back, the storages are inconsistent", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if errors.Is(err, ErrBackupWrite) {
+		api.logger.Error("failed to create book into backup storage", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusServiceUnavailable, "failed to create the book into backup storage, it was not created", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
 	if err != nil {
 		api.logger.Error("failed to create book", zap.String("request.id", requestID), zap.Error(err))
 		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to create the book", book)
@@ -92,18 +137,273 @@ func (api *APIHandler) CreateBook(w http.ResponseWriter, r *http.Request, _ http
 	}
 }
 
+// CreateBooks creates many books at once. Each book is reported by its index into
+// the request with its assigned id or its failure. The status is 201 when all books
+// were created and 207 (Multi-Status) when at least one failed.
+func (api *APIHandler) CreateBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var books []Book
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	stop := TrackTiming(r.Context(), api.clock, TimingValidation)
+	err := DecodeBulkCreateBooksRequestBody(r, &books)
+	stop()
+	if err != nil {
+		api.logger.Error("failed to create books", zap.String("request.id", requestID), zap.Error(err))
+		if IsRequestBodyTooLarge(err) {
+			api.WriteRequestBodyTooLarge(w, r)
+			return
+		}
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to create the books", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	for i := range books {
+		books[i].ID = api.idsHandler.Generate(BookIDPrefix)
+		books[i].CreatedAt = FormatBookTime(api.clock.Now())
+		books[i].UpdatedAt = FormatBookTime(api.clock.Now())
+	}
+
+	books, errs := api.bookService.AddMany(r.Context(), books)
+	results := make([]BulkItemResult, len(books))
+	status, failed := http.StatusCreated, 0
+	for i, book := range books {
+		results[i] = BulkItemResult{Index: i, ID: book.ID}
+		if errs[i] != nil {
+			results[i] = BulkItemResult{Index: i, Error: errs[i].Error()}
+			status = http.StatusMultiStatus
+			failed++
+		}
+	}
+	api.logger.Info("success to create books", zap.Int("created", len(books)-failed), zap.Int("failed", failed), zap.String("request.id", requestID))
+	total := len(results)
+	resp := GenericResponse(requestID, status, "Books creation processed.", &total, results)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// ImportBooks upserts the books of a NDJSON body, one book per line. The body is read
+// line by line so a large import is never buffered and each line is limited like a
+// single book request body. A book without ID is created with a new ID. The failed books
+// are reported by their line number and the status is 207 (Multi-Status) when at least
+// one failed. The `mode=replace` which clears all the books before the import is refused
+// with 403 since it is only served by ReplaceBooks behind the ops authentication.
+func (api *APIHandler) ImportBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	mode := r.URL.Query().Get("mode")
+	if mode == "replace" {
+		api.logger.Error("books import replace mode refused", zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusForbidden, "mode=replace is only allowed on the ops books import endpoint", mode)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if mode != "" {
+		api.logger.Error("invalid books import mode", zap.String("mode", mode), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "mode must be replace when provided", mode)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.importBooks(w, r, false)
+}
+
+// ReplaceBooks clears all the books then imports the books of a NDJSON body like
+// ImportBooks. It wipes the catalog so it is served behind the ops authentication.
+func (api *APIHandler) ReplaceBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	api.importBooks(w, r, true)
+}
+
+// importBooks upserts the books of the NDJSON body of the request, after clearing all
+// the books with replace.
+func (api *APIHandler) importBooks(w http.ResponseWriter, r *http.Request, replace bool) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(api.Config().Server.GetLongRequestWriteTimeout())); err != nil {
+		api.logger.Error("http: failed to update the read deadline", zap.String("request.id", requestID), zap.Error(err))
+	}
+	if err := rc.SetWriteDeadline(time.Now().Add(api.Config().Server.GetLongRequestWriteTimeout())); err != nil {
+		api.logger.Error("http: failed to update the write deadline", zap.String("request.id", requestID), zap.Error(err))
+	}
+
+	if replace {
+		if err := api.bookService.Clear(r.Context(), requestID); err != nil {
+			api.logger.Error("failed to clear books before import", zap.String("request.id", requestID), zap.Error(err))
+			errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to clear the books before the import", nil)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+	}
+
+	result := ImportResult{Failed: []ImportFailure{}}
+	if r.Body != nil {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), int(api.maxRequestBodyBytes()))
+		line := 0
+		for scanner.Scan() {
+			line++
+			if r.Context().Err() != nil {
+				break
+			}
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			created, err := api.importBook(r.Context(), scanner.Bytes())
+			switch {
+			case err != nil:
+				result.Failed = append(result.Failed, ImportFailure{Line: line, Error: err.Error()})
+			case created:
+				result.Created++
+			default:
+				result.Updated++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if err == bufio.ErrTooLong {
+				err = fmt.Errorf("line exceeds %d bytes", api.maxRequestBodyBytes())
+			}
+			result.Failed = append(result.Failed, ImportFailure{Line: line + 1, Error: err.Error()})
+		}
+	}
+	if err := r.Context().Err(); err != nil {
+		api.logger.Error("books import interrupted", zap.Int("created", result.Created), zap.Int("updated", result.Updated), zap.String("request.id", requestID), zap.Error(err))
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Failed) != 0 {
+		status = http.StatusMultiStatus
+	}
+	api.logger.Info("success to import books", zap.Int("created", result.Created), zap.Int("updated", result.Updated), zap.Int("failed", len(result.Failed)), zap.String("request.id", requestID))
+	total := result.Created + result.Updated + len(result.Failed)
+	resp := GenericResponse(requestID, status, "Books import processed.", &total, result)
+	if err := WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// importBook decodes and validates a line of a books import then upserts its book.
+// It reports whether the book was created.
+func (api *APIHandler) importBook(ctx context.Context, line []byte) (bool, error) {
+	var book Book
+	if err := DecodeBook(line, &book); err != nil {
+		return false, err
+	}
+	if err := ValidateCreateBookRequestBody(&book); err != nil {
+		return false, err
+	}
+	if book.ID == "" {
+		book.ID = api.idsHandler.Generate(BookIDPrefix)
+	} else if !api.idsHandler.IsValid(book.ID, BookIDPrefix) {
+		return false, errors.New("book id provided is not valid")
+	}
+	now := FormatBookTime(api.clock.Now())
+	if book.CreatedAt == "" {
+		book.CreatedAt = now
+	}
+	book.UpdatedAt = now
+	return api.bookService.Import(ctx, book)
+}
+
+// GetAllBooks lists the books page by page, each page sorted newest first. With the `sort`
+// or `order` query parameters, the whole catalog is sorted instead and its first `limit`
+// books are listed without next cursor, so the `cursor` query parameter is then refused.
+// @Summary		Get all books.
+// @Description	Lists the books page by page. The next page is requested with the returned cursor. With sort or order, the whole catalog is sorted and its first books are listed without cursor.
+// @ID			get-all-books
+// @Tags		Books
+// @Produce		json
+// @Param		limit		query		int		false	"Maximum number of books of the page"
+// @Param		cursor		query		string	false	"Cursor of the page to fetch"
+// @Param		priceMin	query		number	false	"Minimum price of the books"
+// @Param		priceMax	query		number	false	"Maximum price of the books"
+// @Param		sort		query		string	false	"Field to sort the books by"	Enums(title, author, createdAt, price)
+// @Param		order		query		string	false	"Sorting order"	Enums(asc, desc)
+// @Success		200		{object}		APIResponse{data=[]Book}
+// @Failure		400		{object}		APIError
+// @Failure		500		{object}		APIError
+// @Router		/books	[GET]
+//
 //nolint:bodyclose
 func (api *APIHandler) GetAllBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
 	// this block could be moved into the TimeoutMiddleware and remove SetWriteDeadline and
 	// ReadWriteDeadline methods from *CustomResponseWriter object because that middleware
-	// is called before the stats middleware which wraps the native ResponseWriter.
+	// is the one which wraps the native ResponseWriter.
 	rc := http.NewResponseController(w)
-	if err := rc.SetWriteDeadline(time.Now().Add(api.config.Server.LongRequestWriteTimeout)); err != nil {
+	if err := rc.SetWriteDeadline(time.Now().Add(api.Config().Server.GetLongRequestWriteTimeout())); err != nil {
 		api.logger.Error("http: failed to update the write deadline", zap.String("request.id", requestID), zap.Error(err))
 	}
 
-	books, err := api.bookService.GetAll(r.Context())
+	limit := int64(DefaultBooksPageLimit)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			api.logger.Error("invalid books page limit", zap.String("limit", value), zap.String("request.id", requestID))
+			errResp := NewAPIError(requestID, http.StatusBadRequest, "limit must be a positive integer", value)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		limit = min(n, MaxBooksPageLimit)
+	}
+	cursor := r.URL.Query().Get("cursor")
+
+	priceMin, priceMax, err := ParsePriceRange(r)
+	if err != nil {
+		api.logger.Error("invalid price range", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, err.Error(), []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	sorting, err := ParseBookSort(r)
+	if err != nil {
+		api.logger.Error("invalid books sort", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, err.Error(), []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	var books []Book
+	var next string
+	filter := func(page []Book) []Book {
+		return FilterBooksByPrice(page, priceMin, priceMax)
+	}
+	sorted := r.URL.Query().Has("sort") || r.URL.Query().Has("order")
+	if sorted {
+		if cursor != "" {
+			api.logger.Error("books sort with page cursor", zap.String("cursor", cursor), zap.String("request.id", requestID))
+			errResp := NewAPIError(requestID, http.StatusBadRequest, "sort cannot be combined with cursor", []Book{})
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		books, err = api.bookService.GetAllSorted(r.Context(), sorting, limit, filter)
+	} else {
+		books, next, err = api.bookService.GetAllFiltered(r.Context(), limit, cursor, sorting, filter)
+	}
+	if errors.Is(err, ErrInvalidCursor) {
+		api.logger.Error("invalid books page cursor", zap.String("cursor", cursor), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "cursor provided is not valid", cursor)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
 	if err != nil {
 		api.logger.Error("failed to get all books", zap.String("request.id", requestID), zap.Error(err))
 		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to get all books", books)
@@ -115,55 +415,108 @@ func (api *APIHandler) GetAllBooks(w http.ResponseWriter, r *http.Request, _ htt
 	api.logger.Info("success to get all books", zap.String("request.id", requestID))
 	total := len(books)
 	resp := GenericResponse(requestID, http.StatusOK, "All books fetched successfully.", &total, books)
+	resp.NextCursor = next
 	if err = WriteResponse(r.Context(), w, resp); err != nil {
 		api.logger.Error("failed to send response", zap.Error(err))
 	}
 }
 
-func (api *APIHandler) GetOneBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// SearchBooks provides the books whose title or author contains the `q` query parameter,
+// ignoring the case. The `field` query parameter restricts the search to `title` or
+// `author` and defaults to `all`. Each book comes with the names of its matched fields.
+func (api *APIHandler) SearchBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
-	id := ps.ByName("id")
-	if ok := api.idsHandler.IsValid(id, BookIDPrefix); !ok {
-		api.logger.Error("book id provided is not valid", zap.String("book.id", id), zap.String("request.id", requestID))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "book id provided is not valid", Book{})
-		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	fields, err := ParseSearchFields(r.URL.Query().Get("field"))
+	if err == nil && query == "" {
+		err = errors.New("q must not be empty")
+	}
+	if err != nil {
+		api.logger.Error("invalid books search", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, err.Error(), []BookMatch{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
-	book, err := api.bookService.GetOne(r.Context(), id)
-	if err == ErrBookNotFound {
-		api.logger.Error("book does not exist", zap.String("book.id", id), zap.String("request.id", requestID))
-		errResp := NewAPIError(requestID, http.StatusNotFound, "book does not exist", book)
+
+	books, err := api.bookService.Search(r.Context(), query, fields)
+	if err != nil {
+		api.logger.Error("failed to search books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to search books", []BookMatch{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	total := len(books)
+	resp := GenericResponse(requestID, http.StatusOK, "Books searched successfully.", &total, books)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// GetPopularBooks provides the most viewed books. The number of books
+// is set with the `limit` query parameter which defaults to 10.
+func (api *APIHandler) GetPopularBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	limit := int64(DefaultPopularBooksLimit)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 || n > MaxPopularBooksLimit {
+			api.logger.Error("invalid popular books limit", zap.String("limit", value), zap.String("request.id", requestID))
+			errResp := NewAPIError(requestID, http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %d", MaxPopularBooksLimit), value)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		limit = n
+	}
+
+	books, err := api.bookService.Popular(r.Context(), limit)
+	if err == ErrViewsNotSupported {
+		api.logger.Error("failed to get popular books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusNotImplemented, "books views are not enabled", []BookViews{})
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
 	if err != nil {
-		api.logger.Error("failed to get book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to create the book", book)
+		api.logger.Error("failed to get popular books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to get popular books", []BookViews{})
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
-	api.logger.Info("success to get book", zap.String("book.id", id), zap.String("request.id", requestID))
-	resp := GenericResponse(requestID, http.StatusOK, "Book fetched successfully.", nil, book)
+	api.logger.Info("success to get popular books", zap.String("request.id", requestID))
+	total := len(books)
+	resp := GenericResponse(requestID, http.StatusOK, "Popular books fetched successfully.", &total, books)
 	if err = WriteResponse(r.Context(), w, resp); err != nil {
 		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
 	}
 }
 
-func (api *APIHandler) DeleteOneBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// GetOneBook fetches a book by its ID. The ETag header tags the served payload while
+// the X-Book-ETag header carries the strong book tag expected by the conditional writes.
+// @Summary		Get a book.
+// @Description	Fetches a book by its ID.
+// @ID			get-one-book
+// @Tags		Books
+// @Produce		json
+// @Param		id		path		string	true	"Book ID"
+// @Success		200		{object}		APIResponse{data=Book}
+// @Success		304
+// @Failure		400		{object}		APIError
+// @Failure		404		{object}		APIError
+// @Failure		500		{object}		APIError
+// @Router		/books/{id}	[GET]
+func (api *APIHandler) GetOneBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
 	id := ps.ByName("id")
-	if ok := api.idsHandler.IsValid(id, BookIDPrefix); !ok {
-		api.logger.Error("book id provided is not valid", zap.String("book.id", id), zap.String("request.id", requestID))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "book id provided is not valid", Book{})
-		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
-			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
-		}
+	if ok := api.ValidateBookID(w, r, id); !ok {
 		return
 	}
 	book, err := api.bookService.GetOne(r.Context(), id)
@@ -176,15 +529,86 @@ func (api *APIHandler) DeleteOneBook(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 	if err != nil {
-		api.logger.Error("failed to check if the book exist", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to check if the book exist", book)
+		api.logger.Error("failed to get book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to create the book", book)
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
+	api.logger.Info("success to get book", zap.String("book.id", id), zap.String("request.id", requestID))
+	api.bookService.AddView(r.Context(), id)
+	// the tag covers the served payload so the views are revalidated as well.
+	var data interface{} = book
+	etag := book.ETag()
+	if api.Config() != nil && api.Config().Views.IncludeInResponse {
+		if views, verr := api.bookService.GetViews(r.Context(), id); verr != nil {
+			api.logger.Error("failed to get book views", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(verr))
+		} else {
+			bv := BookViews{Book: book, Views: views}
+			data, etag = bv, bv.ETag()
+		}
+	}
+	w.Header().Set("ETag", etag)
+	// the strong book tag stays available for the If-Match of the writes.
+	w.Header().Set(BookETagHeader, book.ETag())
+	if inm := r.Header.Get("If-None-Match"); inm != "" && MatchETag(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp := GenericResponse(requestID, http.StatusOK, "Book fetched successfully.", nil, data)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// DeleteAllBooks clears the whole catalog: the books from the primary and backup storages
+// and those pending into the queues. It requires the `confirm=true` query parameter so it
+// cannot be hit by accident. It is served behind the ops authentication since it wipes
+// the catalog. The clearing runs in background so it answers 202 Accepted at once and its
+// completion is logged along with the request id.
+func (api *APIHandler) DeleteAllBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	if r.URL.Query().Get("confirm") != "true" {
+		api.logger.Error("books deletion not confirmed", zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "confirm=true query parameter is required to delete all books", nil)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	go api.bookService.Clear(context.WithoutCancel(r.Context()), requestID)
+	api.logger.Info("started to delete all books", zap.String("request.id", requestID))
+	resp := GenericResponse(requestID, http.StatusAccepted, "Books deletion started. Check logs based on requestid.", nil, nil)
+	if err := WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
 
-	err = api.bookService.Delete(r.Context(), id)
+// DeleteOneBook deletes a book by its ID.
+// @Summary		Delete a book.
+// @Description	Deletes a book by its ID and returns it.
+// @ID			delete-one-book
+// @Tags		Books
+// @Produce		json
+// @Param		id		path		string	true	"Book ID"
+// @Success		200		{object}		APIResponse{data=Book}
+// @Failure		400		{object}		APIError
+// @Failure		404		{object}		APIError
+// @Failure		500		{object}		APIError
+// @Router		/books/{id}	[DELETE]
+func (api *APIHandler) DeleteOneBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+	book, err := api.bookService.DeleteIf(r.Context(), id, func(current Book) error {
+		if !IfMatch(r, current) {
+			return ErrBookModified
+		}
+		return nil
+	})
 	if err == ErrBookNotFound {
 		api.logger.Error("book does not exist", zap.String("book.id", id), zap.String("request.id", requestID))
 		errResp := NewAPIError(requestID, http.StatusNotFound, "book does not exist", book)
@@ -193,6 +617,10 @@ func (api *APIHandler) DeleteOneBook(w http.ResponseWriter, r *http.Request, ps
 		}
 		return
 	}
+	if err == ErrBookModified {
+		api.WriteBookModified(w, r, book)
+		return
+	}
 	if err != nil {
 		api.logger.Error("failed to delete book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
 		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to delete the book", book)
@@ -208,30 +636,120 @@ func (api *APIHandler) DeleteOneBook(w http.ResponseWriter, r *http.Request, ps
 	}
 }
 
-func (api *APIHandler) UpdateBook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+// UpdateBook replaces a book by its ID.
+// @Summary		Update a book.
+// @Description	Replaces a book by its ID. The book ID into the body is optional but must match the path.
+// @ID			update-book
+// @Tags		Books
+// @Consume		json
+// @Produce		json
+// @Param		id		path		string	true	"Book ID"
+// @Param		Book		body		Book	true	"Book to update"
+// @Success		200		{object}		APIResponse{data=Book}
+// @Failure		400		{object}		APIError
+// @Failure		404		{object}		APIError
+// @Failure		413		{object}		APIError
+// @Failure		500		{object}		APIError
+// @Failure		503		{object}		APIError
+// @Router		/books/{id}	[PUT]
+func (api *APIHandler) UpdateBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	var book Book
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	stop := TrackTiming(r.Context(), api.clock, TimingValidation)
 	err := DecodeCreateOrUpdateBookRequestBody(r, &book)
+	stop()
 	if err != nil {
 		api.logger.Error("failed to update book", zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to update the book", book)
+		if IsRequestBodyTooLarge(err) {
+			api.WriteRequestBodyTooLarge(w, r)
+			return
+		}
+		if err == ErrEmptyRequestBody {
+			errResp := NewAPIError(requestID, http.StatusBadRequest, "request body is empty", book)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		var data interface{} = book
+		var fieldErr *RequestFieldError
+		if errors.As(err, &fieldErr) {
+			data = map[string]string{"field": fieldErr.Field, "reason": fieldErr.Reason}
+		}
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to update the book", data)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	// the path id is the reference. the body id is optional
+	// but when provided it must target the same book.
+	if book.ID == "" {
+		book.ID = id
+	}
+	if book.ID != id {
+		api.logger.Error("book id mismatch", zap.String("book.id", id), zap.String("body.id", book.ID), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "book id in body does not match the path", book)
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
 
+	stop = TrackTiming(r.Context(), api.clock, TimingValidation)
 	err = ValidateUpdateBookRequestBody(&book)
+	stop()
 	if err != nil {
 		api.logger.Error("failed to update book", zap.String("request.id", requestID), zap.Error(err))
-		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to update the book", err.Error())
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to update the book", ValidationErrorData(err))
 		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
 			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 		}
 		return
 	}
 
-	book, err = api.bookService.Update(r.Context(), book.ID, book)
+	// the If-Match check and the write run under the book lock.
+	book, err = api.bookService.Modify(r.Context(), id, func(current Book) (Book, error) {
+		if !IfMatch(r, current) {
+			return current, ErrBookModified
+		}
+		return book, nil
+	})
+	if err == ErrBookNotFound {
+		api.logger.Error("book does not exist", zap.String("book.id", id), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusNotFound, "book does not exist", Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err == ErrBookModified {
+		api.WriteBookModified(w, r, book)
+		return
+	}
+	if errors.Is(err, ErrBackupRollback) {
+		api.logger.Error("failed to roll back book after backup storage failure", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to update the book into backup storage and to roll it back, the storages are inconsistent", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if errors.Is(err, ErrBackupWrite) {
+		api.logger.Error("failed to update book into backup storage", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusServiceUnavailable, "failed to update the book into backup storage, it was not updated", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
 	if err != nil {
 		api.logger.Error("failed to update book", zap.String("request.id", requestID), zap.Error(err))
 		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to update the book", book)
@@ -241,6 +759,288 @@ func (api *APIHandler) UpdateBook(w http.ResponseWriter, r *http.Request, _ http
 		return
 	}
 	api.logger.Info("success to update book", zap.String("book.id", book.ID), zap.String("request.id", requestID))
+	w.Header().Set("ETag", book.ETag())
+	resp := GenericResponse(requestID, http.StatusOK, "Book updated successfully.", nil, book)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// CountBooks provides the number of books without transferring them.
+func (api *APIHandler) CountBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	count, err := api.bookService.Count(r.Context())
+	if err != nil {
+		api.logger.Error("failed to count books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to count books", nil)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to count books", zap.String("request.id", requestID), zap.Int("count", count))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"count":     count,
+		},
+	); err != nil {
+		api.logger.Error("failed to send count response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// GetTrashBooks lists the books moved to the trash by soft-deletes.
+func (api *APIHandler) GetTrashBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	books, err := api.bookService.GetTrash(r.Context())
+	if err == ErrTrashNotSupported {
+		api.logger.Error("failed to get trashed books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusNotImplemented, "books trash is not enabled", []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err != nil {
+		api.logger.Error("failed to get trashed books", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to get trashed books", []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to get trashed books", zap.String("request.id", requestID))
+	total := len(books)
+	resp := GenericResponse(requestID, http.StatusOK, "Trashed books fetched successfully.", &total, books)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// GetBookHistory lists the prior versions of a book from the oldest.
+func (api *APIHandler) GetBookHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+	books, err := api.bookService.History(r.Context(), id)
+	if err == ErrHistoryNotSupported {
+		api.logger.Error("failed to get book history", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusNotImplemented, "books history is not enabled", []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err == ErrBookNotFound {
+		api.logger.Error("book does not exist", zap.String("book.id", id), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusNotFound, "book does not exist", []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err != nil {
+		api.logger.Error("failed to get book history", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to get the book history", []Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to get book history", zap.String("book.id", id), zap.String("request.id", requestID))
+	total := len(books)
+	resp := GenericResponse(requestID, http.StatusOK, "Book history fetched successfully.", &total, books)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// RestoreBook moves back a trashed book or cancels the pending delete
+// of a book so it is served again.
+func (api *APIHandler) RestoreBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+	book, err := api.bookService.Restore(r.Context(), id)
+	if err == ErrTrashNotSupported {
+		api.logger.Error("failed to restore book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusNotImplemented, "books trash is not enabled", Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err == ErrBookNotFound {
+		api.logger.Error("book is not into the trash nor pending delete", zap.String("book.id", id), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusNotFound, "book is not into the trash nor pending delete", Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err != nil {
+		api.logger.Error("failed to restore book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to restore the book", Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to restore book", zap.String("book.id", id), zap.String("request.id", requestID))
+	resp := GenericResponse(requestID, http.StatusOK, "Book restored successfully.", nil, book)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// ValidateBookID ensures a given book id is well-formed. If that is not the case, it
+// sends a 400 error response to the client and returns false. This keeps all handlers
+// consistent: 400 for malformed ids and 404 only for well-formed ids which do not exist.
+func (api *APIHandler) ValidateBookID(w http.ResponseWriter, r *http.Request, id string) bool {
+	if api.idsHandler.IsValid(id, BookIDPrefix) {
+		return true
+	}
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	api.logger.Error("book id provided is not valid", zap.String("book.id", id), zap.String("request.id", requestID))
+	errResp := NewAPIError(requestID, http.StatusBadRequest, "book id provided is not valid", Book{})
+	if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+		api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+	}
+	return false
+}
+
+// maxRequestBodyBytes returns the configured maximum size of the books requests body.
+func (api *APIHandler) maxRequestBodyBytes() int64 {
+	if api.Config() != nil {
+		return api.Config().Server.GetMaxRequestBodyBytes()
+	}
+	return DefaultMaxRequestBodyBytes
+}
+
+// WriteRequestBodyTooLarge sends a 413 error response with the maximum body size allowed.
+func (api *APIHandler) WriteRequestBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	limit := api.maxRequestBodyBytes()
+	errResp := NewAPIError(requestID, http.StatusRequestEntityTooLarge, "request body too large", map[string]int64{"maxbytes": limit})
+	if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+		api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// IfMatch reports whether the request has no `If-Match` header or lists the book ETag
+// with the strong comparison, so the weak tags served along with the views never match.
+// The strong book ETag is served into the BookETagHeader header along with the views.
+func IfMatch(r *http.Request, book Book) bool {
+	im := r.Header.Get("If-Match")
+	return im == "" || MatchStrongETag(im, book.ETag())
+}
+
+// WriteBookModified sends the 412 error response along with the current book ETag.
+func (api *APIHandler) WriteBookModified(w http.ResponseWriter, r *http.Request, book Book) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	api.logger.Error("book was modified", zap.String("book.id", book.ID), zap.String("request.id", requestID))
+	w.Header().Set("ETag", book.ETag())
+	errResp := NewAPIError(requestID, http.StatusPreconditionFailed, "book was modified", Book{})
+	if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+		api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// PatchBook updates only the fields provided into the request body. The
+// existing book is fetched then merged with those fields before storing.
+// Both steps run under the book lock, along with the If-Match check.
+func (api *APIHandler) PatchBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var patch BookPatch
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	stop := TrackTiming(r.Context(), api.clock, TimingValidation)
+	err := DecodePatchBookRequestBody(r, &patch)
+	stop()
+	if err == nil && patch.IsEmpty() {
+		err = errors.New("no field to update")
+	}
+	if err != nil {
+		api.logger.Error("failed to patch book", zap.String("request.id", requestID), zap.Error(err))
+		if IsRequestBodyTooLarge(err) {
+			api.WriteRequestBodyTooLarge(w, r)
+			return
+		}
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to patch the book", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	// the book is fetched, checked, patched and written under its lock so
+	// concurrent patches of distinct fields of the book are all kept.
+	var invalid error
+	book, err := api.bookService.Modify(r.Context(), id, func(current Book) (Book, error) {
+		if !IfMatch(r, current) {
+			return current, ErrBookModified
+		}
+		book := patch.Apply(current)
+		stop := TrackTiming(r.Context(), api.clock, TimingValidation)
+		invalid = ValidateUpdateBookRequestBody(&book)
+		stop()
+		return book, invalid
+	})
+	if err == ErrBookNotFound {
+		api.logger.Error("book does not exist", zap.String("book.id", id), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusNotFound, "book does not exist", Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err == ErrBookModified {
+		api.WriteBookModified(w, r, book)
+		return
+	}
+	if invalid != nil {
+		api.logger.Error("failed to patch book", zap.String("request.id", requestID), zap.Error(invalid))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "failed to patch the book", ValidationErrorData(invalid))
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if errors.Is(err, ErrBackupRollback) {
+		api.logger.Error("failed to roll back book after backup storage failure", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to patch the book into backup storage and to roll it back, the storages are inconsistent", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if errors.Is(err, ErrBackupWrite) {
+		api.logger.Error("failed to patch book into backup storage", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusServiceUnavailable, "failed to patch the book into backup storage, it was not updated", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if err != nil {
+		api.logger.Error("failed to patch book", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to patch the book", book)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to patch book", zap.String("book.id", book.ID), zap.String("request.id", requestID))
+	w.Header().Set("ETag", book.ETag())
 	resp := GenericResponse(requestID, http.StatusOK, "Book updated successfully.", nil, book)
 	if err = WriteResponse(r.Context(), w, resp); err != nil {
 		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
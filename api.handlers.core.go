@@ -2,21 +2,43 @@ package main
 
 import (
 	"encoding/json"
+	"html/template"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"go.uber.org/zap"
 )
 
 // APIHandler defines the API handler.
 type APIHandler struct {
 	logger      *zap.Logger
-	config      *Config
+	config      atomic.Pointer[Config] // swapped on configuration reload. use Config().
+	loadConfig  func() (*Config, error)
+	reloading   sync.Mutex
+	logLevel    *zap.AtomicLevel
+	bodies      atomic.Bool // whether the request and response bodies are logged.
 	stats       *Statistics
 	mode        *Maintenance
 	clock       Clocker
 	idsHandler  UIDHandler
 	bookService BookServiceProvider
+	routes      []RouteDoc
+	quota       *QuotaLimiter
+	captures    CaptureStore
+	handler     http.Handler // the router serving all routes. used to replay requests.
+	audit       *AuditLog
+	prints      *FingerprintTracker
+	metrics     *Metrics
+	limiter     *RateLimiter
+	breaker     *ErrorBreaker
+	gc          *Cooldown
+	pages       *template.Template // nil if the HTML error pages are disabled.
+	deadLetters *DeadLetters
+	queue       Queuer
+	health      *HealthChecker
 }
 
 // NewAPIHandler provides a new instance of APIHandler.
@@ -24,33 +46,182 @@ func NewAPIHandler(logger *zap.Logger, config *Config, stats *Statistics, ck Clo
 	m := &Maintenance{}
 	m.enabled.Store(false)
 	stats.status = make(map[int]uint64)
+	stats.opsStatus = make(map[int]uint64)
+	stats.routes = make(map[string]uint64)
 	stats.mu = &sync.RWMutex{}
-	return &APIHandler{logger: logger, config: config, stats: stats, mode: m, clock: ck, idsHandler: idsHandler, bookService: bs}
+	var gcCooldown time.Duration
+	if config != nil {
+		gcCooldown = config.Ops.GC.Cooldown
+	}
+	api := &APIHandler{logger: logger, stats: stats, mode: m, clock: ck, idsHandler: idsHandler, bookService: bs, metrics: NewMetrics(stats, m, ck), gc: NewCooldown(gcCooldown)}
+	api.config.Store(config)
+	if config != nil {
+		api.bodies.Store(config.Debug.Bodies.Enable)
+	}
+	api.loadConfig = func() (*Config, error) {
+		return LoadAndInitConfigs(GitCommit, GitTag, BuildTime)
+	}
+	return api
 }
 
-// NotFound is a custom handler used to serve inexistant requested routes.
-func (api *APIHandler) NotFound() http.Handler {
+// Config returns the configuration in use. It is replaced as a whole on reload so
+// a caller sees consistent settings as long as it keeps the returned one.
+func (api *APIHandler) Config() *Config {
+	return api.config.Load()
+}
+
+// SetLogLevel sets the level of the app logger, changed on configuration reload.
+func (api *APIHandler) SetLogLevel(level zap.AtomicLevel) {
+	api.logLevel = &level
+}
+
+// SetQuotaLimiter sets the limiter used to enforce clients requests budgets.
+func (api *APIHandler) SetQuotaLimiter(ql *QuotaLimiter) {
+	api.quota = ql
+}
+
+// SetCaptureStore sets the store used to record requests for replay.
+func (api *APIHandler) SetCaptureStore(cs CaptureStore) {
+	api.captures = cs
+}
+
+// SetAuditLog sets the log used to record ops requests.
+func (api *APIHandler) SetAuditLog(al *AuditLog) {
+	api.audit = al
+}
+
+// SetRateLimiter sets the per-client limiter of the public requests rate.
+func (api *APIHandler) SetRateLimiter(rl *RateLimiter) {
+	api.limiter = rl
+}
+
+// SetErrorBreaker sets the per-client breaker tripped by repeated client errors.
+func (api *APIHandler) SetErrorBreaker(eb *ErrorBreaker) {
+	api.breaker = eb
+}
+
+// SetFingerprintTracker sets the tracker used to spot requests spikes.
+func (api *APIHandler) SetFingerprintTracker(ft *FingerprintTracker) {
+	api.prints = ft
+}
+
+// SetDeadLetters sets the mover of the dead letter queues books back into their queues.
+func (api *APIHandler) SetDeadLetters(dl *DeadLetters) {
+	api.deadLetters = dl
+}
+
+// SetQueue sets the queue inspected by the ops users.
+func (api *APIHandler) SetQueue(q Queuer) {
+	api.queue = q
+}
+
+// SetHealthChecker sets the checker of the subsystems summarized by the health endpoint.
+// The maintenance mode and the uptime checks of the handler are added to its checks.
+func (api *APIHandler) SetHealthChecker(hc *HealthChecker) {
+	hc.Add(api.MaintenanceCheck(), api.UptimeCheck())
+	api.health = hc
+}
+
+// SetErrorPages sets the template of the HTML error pages sent to browsers.
+func (api *APIHandler) SetErrorPages(pages *template.Template) {
+	api.pages = pages
+}
+
+// WriteNegotiatedError sends the error as an HTML page to the clients which prefer HTML when
+// the error pages are enabled. Otherwise it sends the error as JSON with WriteErrorResponse.
+func (api *APIHandler) WriteNegotiatedError(w http.ResponseWriter, r *http.Request, errResp *APIError) error {
+	if api.pages != nil && AcceptsHTML(r) {
+		return WriteHTMLError(r.Context(), w, api.pages, errResp, r.Method+" "+r.URL.Path)
+	}
+	return WriteErrorResponse(r.Context(), w, errResp)
+}
+
+// NotFound is a custom handler used to serve inexistant requested routes. It runs
+// through the middlewares chain so the requests are identified, counted and logged
+// then reflected into the statistics like the ones of the existing routes.
+func (api *APIHandler) NotFound(chain MiddlewareFunc) http.Handler {
+	handle := chain(api.RouteNotFound)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := api.idsHandler.Generate(RequestIDPrefix)
-		logger := api.logger.With(
-			zap.String("request.id", requestID),
-			zap.String("request.method", r.Method),
-			zap.String("request.path", r.URL.Path),
-			zap.String("request.ip", GetRequestSourceIP(r)),
-			zap.String("request.agent", r.UserAgent()),
-			zap.String("request.referer", r.Referer()),
-		)
-		logger.Warn("unknown route")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusNotFound)
-		if err := json.NewEncoder(w).Encode(
-			map[string]string{
-				"requestid": requestID,
-				"message":   "route does not exist",
-				"path":      r.Method + " " + r.URL.Path,
-			},
-		); err != nil {
-			api.logger.Error("failed to send response", zap.String("request.id", requestID))
+		handle(w, r, nil)
+	})
+}
+
+// MethodNotAllowed is the handler of the requests whose route exists with other methods.
+// It runs through the middlewares chain like NotFound so the requests are identified.
+// The router sets the allowed methods into the `Allow` header beforehand.
+func (api *APIHandler) MethodNotAllowed(chain MiddlewareFunc) http.Handler {
+	handle := chain(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+		errResp := NewAPIError(requestID, http.StatusMethodNotAllowed, "method not allowed", w.Header().Get("Allow"))
+		if err := api.WriteNegotiatedError(w, r, errResp); err != nil {
+			api.GetLoggerFromContext(r.Context()).Error("failed to send error response", zap.Error(err))
 		}
 	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, nil)
+	})
+}
+
+// Options is the handler of the OPTIONS requests of the existing routes, answered with 204
+// and the allowed methods into the `Allow` header set by the router. Its chain is limited
+// to the cors middleware and the requests identification so the preflight requests get
+// their cors headers without reaching the book handlers, even during the maintenance.
+// No OPTIONS route is registered so the router never redirects them on trailing slash
+// since browsers reject redirected preflight requests.
+func (api *APIHandler) Options() http.Handler {
+	chain := Middlewares{
+		api.PanicRecoveryMiddleware,
+		api.RequestIDMiddleware,
+		api.AddLoggerMiddleware,
+		api.CORSMiddleware,
+	}
+	handle := chain.Chain(func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, nil)
+	})
+}
+
+// RouteNotFound responds to a request whose route does not exist. The request
+// id is generated if the middlewares chain did not set it.
+func (api *APIHandler) RouteNotFound(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	logger := api.GetLoggerFromContext(r.Context())
+	if requestID == "" {
+		requestID = api.idsHandler.Generate(RequestIDPrefix)
+		logger = logger.With(zap.String("request.id", requestID))
+	}
+	logger.Warn("unknown route", zap.String("request.ip", GetRequestSourceIP(r)))
+	if api.pages != nil && AcceptsHTML(r) {
+		errResp := NewAPIError(requestID, http.StatusNotFound, "route does not exist", nil)
+		if err := WriteHTMLError(r.Context(), w, api.pages, errResp, r.Method+" "+r.URL.Path); err != nil {
+			logger.Error("failed to send response", zap.Error(err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusNotFound)
+	if err := json.NewEncoder(w).Encode(
+		map[string]string{
+			"requestid": requestID,
+			"message":   "route does not exist",
+			"path":      r.Method + " " + r.URL.Path,
+		},
+	); err != nil {
+		logger.Error("failed to send response", zap.Error(err))
+	}
+}
+
+// GetOpenAPISpec serves the OpenAPI 3 document derived from the registered routes.
+func (api *APIHandler) GetOpenAPISpec(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	version := api.stats.version
+	if version == "" {
+		version = "1.0"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(BuildOpenAPISpec("Book Store API", version, api.routes)); err != nil {
+		api.logger.Error("failed to send openapi spec response", zap.String("request.id", requestID), zap.Error(err))
+	}
 }
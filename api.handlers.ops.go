@@ -1,19 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/pprof"
 	"runtime"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // export goroutines to be used by expvar handler.
@@ -25,17 +33,149 @@ type Statistics struct {
 	container bool
 	runtime   string
 	platform  string
-	called    uint64
-	started   time.Time
-	status    map[int]uint64
+	called    uint64            // number of public requests.
+	opsCalled uint64            // number of ops requests.
+	inflight  int64             // number of requests being handled.
+	started   time.Time         // process start.
+	service   time.Time         // first ever start of the service. zero if not persisted.
+	status    map[int]uint64    // number of public responses per status code.
+	opsStatus map[int]uint64    // number of ops responses per status code.
+	routes    map[string]uint64 // number of requests per route method and path.
 	mu        *sync.RWMutex
 }
 
-// Maintenance holds app maintenance mode infos.
+// Reset zeroes the requests counters and clears the status codes counters.
+func (s *Statistics) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.StoreUint64(&s.called, 0)
+	atomic.StoreUint64(&s.opsCalled, 0)
+	s.status = make(map[int]uint64)
+	s.opsStatus = make(map[int]uint64)
+	s.routes = make(map[string]uint64)
+}
+
+// InFlight returns the number of requests being handled.
+func (s *Statistics) InFlight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// Maintenance holds app maintenance mode infos. The `enabled` flag and the bounds
+// of the scheduled window (unix nanoseconds, zero if none) are atomic so the
+// middleware check is lock-free while the other infos are only accessed under
+// the mutex. All fields are updated together under the lock.
 type Maintenance struct {
-	enabled atomic.Bool
-	reason  string
-	started time.Time
+	enabled     atomic.Bool
+	windowStart atomic.Int64
+	windowEnd   atomic.Int64
+	mu          sync.RWMutex
+	reason      string
+	started     time.Time
+	window      MaintenanceWindow
+}
+
+// MaintenanceWindow is a maintenance period scheduled in advance.
+type MaintenanceWindow struct {
+	Reason string
+	Start  time.Time
+	End    time.Time
+}
+
+// IsZero reports whether no window is scheduled.
+func (mw MaintenanceWindow) IsZero() bool {
+	return mw.End.IsZero()
+}
+
+// Status returns `active` when now falls into the window, `upcoming` before it
+// and an empty string once it is over or when no window is scheduled.
+func (mw MaintenanceWindow) Status(now time.Time) string {
+	switch {
+	case mw.IsZero() || !now.Before(mw.End):
+		return ""
+	case now.Before(mw.Start):
+		return "upcoming"
+	}
+	return "active"
+}
+
+// Enable turns on the maintenance mode with its reason and starting time.
+func (m *Maintenance) Enable(reason string, started time.Time) {
+	m.mu.Lock()
+	m.reason = reason
+	m.started = started
+	m.enabled.Store(true)
+	m.mu.Unlock()
+}
+
+// Disable turns off the maintenance mode, cancels the scheduled window and resets their infos.
+func (m *Maintenance) Disable(zero time.Time) {
+	m.mu.Lock()
+	m.enabled.Store(false)
+	m.windowStart.Store(0)
+	m.windowEnd.Store(0)
+	m.reason = ""
+	m.started = zero
+	m.window = MaintenanceWindow{}
+	m.mu.Unlock()
+}
+
+// Schedule plans the maintenance window, replacing the one scheduled before if any.
+// The manual mode is not changed so the window only adds to it.
+func (m *Maintenance) Schedule(window MaintenanceWindow) {
+	m.mu.Lock()
+	m.window = window
+	m.windowStart.Store(window.Start.UnixNano())
+	m.windowEnd.Store(window.End.UnixNano())
+	m.mu.Unlock()
+}
+
+// Active reports whether the maintenance mode is enabled or now falls into the
+// scheduled window. It is lock-free to stay cheap on each request.
+func (m *Maintenance) Active(now time.Time) bool {
+	if m.enabled.Load() {
+		return true
+	}
+	end := m.windowEnd.Load()
+	return end != 0 && now.UnixNano() >= m.windowStart.Load() && now.UnixNano() < end
+}
+
+// State returns a consistent snapshot of the manual maintenance mode infos.
+func (m *Maintenance) State() (enabled bool, reason string, started time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled.Load(), m.reason, m.started
+}
+
+// Window returns the scheduled maintenance window. It is zero if none.
+func (m *Maintenance) Window() MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.window
+}
+
+// Until returns the end of the active scheduled window. It is zero if the maintenance
+// is not active or was enabled manually, whose end is unknown.
+func (m *Maintenance) Until(now time.Time) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.enabled.Load() || m.window.Status(now) != "active" {
+		return time.Time{}
+	}
+	return m.window.End
+}
+
+// Current returns whether the maintenance is active at now with its reason and the
+// time since when it is. The manual mode prevails over the scheduled window.
+func (m *Maintenance) Current(now time.Time) (active bool, reason string, since time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.enabled.Load() {
+		return true, m.reason, m.started
+	}
+	if m.window.Status(now) == "active" {
+		return true, m.window.Reason, m.window.Start
+	}
+	return false, "", time.Time{}
 }
 
 func NewStatistics(tag, commit, runtime, platform string, iscontainer bool, starttime time.Time) *Statistics {
@@ -52,6 +192,11 @@ func NewStatistics(tag, commit, runtime, platform string, iscontainer bool, star
 	}
 }
 
+// SetServiceStarted sets the persisted first start time of the service.
+func (s *Statistics) SetServiceStarted(t time.Time) {
+	s.service = t
+}
+
 // OpsHandlerWrapper takes an http.Handler function and provides httprouter.Handle.
 func (api *APIHandler) OpsHandlerWrapper(h http.Handler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -65,83 +210,449 @@ func GetMemStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	expvar.Handler().ServeHTTP(w, r)
 }
 
-// RunGC forces the run of the garbage collector asynchronously.
-func (api *APIHandler) RunGC(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
-	go runtime.GC()
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	if err := json.NewEncoder(w).Encode(
-		map[string]string{
-			"called": "go runtime.GC()",
-		},
-	); err != nil {
-		api.logger.Error("failed to send run gc response", zap.String("request.id", requestID), zap.Error(err))
+// DefaultGCTimeout is the maximum time to wait for a forced garbage collection
+// when no timeout is configured.
+const DefaultGCTimeout = 30 * time.Second
+
+// Cooldown enforces a minimum interval between the runs of an expensive operation.
+type Cooldown struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+// NewCooldown provides a cooldown of the given interval. A zero interval never throttles.
+func NewCooldown(interval time.Duration) *Cooldown {
+	return &Cooldown{interval: interval}
+}
+
+// Acquire records a run at `now` and returns true if the interval elapsed since the
+// last accepted run. Otherwise it returns false with the remaining cooldown.
+func (c *Cooldown) Acquire(now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.last.IsZero() {
+		if remaining := c.interval - now.Sub(c.last); remaining > 0 {
+			return remaining, false
+		}
 	}
+	c.last = now
+	return 0, true
+}
+
+// RunGC forces the run of the garbage collector and waits for its completion.
+func (api *APIHandler) RunGC(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	api.forceGC(w, r, "runtime.GC()", runtime.GC)
 }
 
-// FreeOSMemory forces the garbage collector to and tries to returns the memory
-// back to the operating system in an asynchronous fashion.
+// FreeOSMemory forces the garbage collector to run and tries to return the memory
+// back to the operating system then waits for its completion.
 func (api *APIHandler) FreeOSMemory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	api.forceGC(w, r, "debug.FreeOSMemory()", debug.FreeOSMemory)
+}
+
+// forceGC runs the `gc` function unless it was called during the cooldown shared by the
+// gc endpoints, in which case it responds with 429 and the remaining cooldown. It waits
+// up to the configured timeout so the response reflects the completion of the run.
+func (api *APIHandler) forceGC(w http.ResponseWriter, r *http.Request, called string, gc func()) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
-	go debug.FreeOSMemory()
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if remaining, ok := api.gc.Acquire(api.clock.Now()); !ok {
+		retryAfter := int64(math.Ceil(remaining.Seconds()))
+		api.logger.Warn("forced gc called during cooldown", zap.String("request.id", requestID), zap.Duration("gc.cooldown.remaining", remaining))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"requestid":  requestID,
+			"message":    "forced gc cooldown not elapsed",
+			"remaining":  remaining.String(),
+			"retryafter": retryAfter,
+		}); err != nil {
+			api.logger.Error("failed to send gc cooldown response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	timeout := DefaultGCTimeout
+	if api.Config() != nil && api.Config().Ops.GC.Timeout > 0 {
+		timeout = api.Config().Ops.GC.Timeout
+	}
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		gc()
+		close(done)
+	}()
+
+	completed := true
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		completed = false
+	case <-r.Context().Done():
+		completed = false
+	}
+
+	if !completed {
+		api.logger.Warn("forced gc not completed in time", zap.String("request.id", requestID), zap.String("gc.called", called), zap.Duration("gc.timeout", timeout))
+		w.WriteHeader(http.StatusAccepted)
+	}
 	if err := json.NewEncoder(w).Encode(
-		map[string]string{
-			"called": "go debug.FreeOSMemory()",
+		map[string]interface{}{
+			"called":    called,
+			"completed": completed,
+			"duration":  time.Since(start).String(),
 		},
 	); err != nil {
-		api.logger.Error("failed to send free os memory response", zap.String("request.id", requestID), zap.Error(err))
+		api.logger.Error("failed to send forced gc response", zap.String("request.id", requestID), zap.Error(err))
 	}
 }
 
 // GetStatistics provides useful details about the application to the internal ops users.
-// The stats returns by this handler do not contain the ops request which triggered that.
-// That is why we remove 1 from the called field value in order to match the status stats.
+// The public and ops requests are counted separately so the `called` value only reflects
+// the public traffic whatever the number of ops requests, including the one triggering it.
+// The uptime is the process one. With the persisted service start time, the service uptime
+// across restarts is reported as well.
 func (api *APIHandler) GetStatistics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	api.stats.mu.RLock()
-	maintenanceModeStartedTime := api.mode.started.String()
-	if api.mode.started.IsZero() {
+	now := api.clock.Now()
+	enabled, reason, started := api.mode.State()
+	maintenanceModeStartedTime := started.String()
+	if started.IsZero() {
 		maintenanceModeStartedTime = ""
 	}
-	err := json.NewEncoder(w).Encode(
-		map[string]interface{}{
-			"requestid":     requestID,
-			"app.version":   api.stats.version,
-			"app.container": api.stats.container,
-			"app.platform":  api.stats.platform,
-			"go.version":    api.stats.runtime,
-			"called":        atomic.LoadUint64(&api.stats.called) - 1,
-			"started":       api.stats.started.Format(time.RFC1123),
-			"uptime":        fmt.Sprintf("%.0f mins", api.clock.Now().Sub(api.stats.started).Minutes()),
-			"maintenance": map[string]interface{}{
-				"enabled": api.mode.enabled.Load(),
-				"started": maintenanceModeStartedTime,
-				"reason":  api.mode.reason,
-			},
-			"status": api.stats.status,
-		},
-	)
+	maintenance := map[string]interface{}{
+		"enabled": enabled,
+		"started": maintenanceModeStartedTime,
+		"reason":  reason,
+	}
+	if window := api.mode.Window(); window.Status(now) != "" {
+		maintenance["window"] = map[string]interface{}{
+			"status": window.Status(now),
+			"start":  window.Start.Format(time.RFC3339),
+			"end":    window.End.Format(time.RFC3339),
+			"reason": window.Reason,
+		}
+	}
+	var breaker map[string]interface{}
+	if p, ok := api.bookService.(PrimaryBreakerProvider); ok && p.PrimaryBreaker() != nil {
+		state, failures, opened := p.PrimaryBreaker().State()
+		breaker = map[string]interface{}{
+			"state":    state,
+			"failures": failures,
+			"opened":   "",
+		}
+		if !opened.IsZero() {
+			breaker["opened"] = opened.Format(time.RFC3339)
+		}
+	}
+	var shadow map[string]interface{}
+	if p, ok := api.bookService.(ShadowReaderProvider); ok && p.ShadowReader() != nil {
+		compared, mismatches, failures := p.ShadowReader().Stats()
+		shadow = map[string]interface{}{
+			"compared":   compared,
+			"mismatches": mismatches,
+			"failures":   failures,
+		}
+	}
+	api.stats.mu.RLock()
+	stats := map[string]interface{}{
+		"requestid":     requestID,
+		"app.version":   api.stats.version,
+		"app.container": api.stats.container,
+		"app.platform":  api.stats.platform,
+		"go.version":    api.stats.runtime,
+		"called":        atomic.LoadUint64(&api.stats.called),
+		"ops.called":    atomic.LoadUint64(&api.stats.opsCalled),
+		"inflight":      api.stats.InFlight(),
+		"started":       api.stats.started.Format(time.RFC1123),
+		"uptime":        fmt.Sprintf("%.0f mins", now.Sub(api.stats.started).Minutes()),
+		"maintenance":   maintenance,
+		"breaker":       breaker,
+		"shadow":        shadow,
+		"status":        api.stats.status,
+		"ops.status":    api.stats.opsStatus,
+	}
+	if !api.stats.service.IsZero() {
+		stats["service.started"] = api.stats.service.Format(time.RFC1123)
+		stats["service.uptime"] = fmt.Sprintf("%.0f mins", now.Sub(api.stats.service).Minutes())
+	}
+	err := json.NewEncoder(w).Encode(stats)
 	api.stats.mu.RUnlock()
 	if err != nil {
 		api.logger.Error("failed to send statistics response", zap.String("request.id", requestID), zap.Error(err))
 	}
 }
 
+// GetOpenMetrics exports the statistics in OpenMetrics text format for the scrapers which
+// do not rely on the Prometheus client library. Besides the requests counters, it reports
+// the requests per route, the in-process cache hits, the backup queues depth and the
+// maintenance mode. A queue whose depth cannot be read is left out of the exposition.
+func (api *APIHandler) GetOpenMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	now := api.clock.Now()
+	maintenance := 0.0
+	if api.mode.Active(now) {
+		maintenance = 1
+	}
+	families := []MetricFamily{
+		{Name: "requests_called", Type: "counter", Help: "Number of public requests received.", Samples: []MetricSample{{Value: float64(atomic.LoadUint64(&api.stats.called))}}},
+		{Name: "ops_requests_called", Type: "counter", Help: "Number of ops requests received.", Samples: []MetricSample{{Value: float64(atomic.LoadUint64(&api.stats.opsCalled))}}},
+		{Name: "requests_inflight", Type: "gauge", Help: "Number of requests being handled.", Samples: []MetricSample{{Value: float64(api.stats.InFlight())}}},
+		{Name: "uptime_seconds", Type: "gauge", Help: "Duration since the process start.", Samples: []MetricSample{{Value: now.Sub(api.stats.started).Seconds()}}},
+		{Name: "maintenance_enabled", Type: "gauge", Help: "Whether the maintenance mode is enabled or its window active (1) or not (0).", Samples: []MetricSample{{Value: maintenance}}},
+	}
+
+	api.stats.mu.RLock()
+	responses := MetricFamily{Name: "responses", Type: "counter", Help: "Number of responses sent by status code."}
+	for code, count := range api.stats.status {
+		responses.Samples = append(responses.Samples, MetricSample{Labels: [][2]string{{"code", strconv.Itoa(code)}}, Value: float64(count)})
+	}
+	routes := MetricFamily{Name: "route_requests", Type: "counter", Help: "Number of requests handled by route."}
+	for route, count := range api.stats.routes {
+		method, path, _ := strings.Cut(route, " ")
+		routes.Samples = append(routes.Samples, MetricSample{Labels: [][2]string{{"method", method}, {"route", path}}, Value: float64(count)})
+	}
+	api.stats.mu.RUnlock()
+	slices.SortFunc(responses.Samples, func(a, b MetricSample) int { return strings.Compare(a.Labels[0][1], b.Labels[0][1]) })
+	slices.SortFunc(routes.Samples, func(a, b MetricSample) int {
+		return strings.Compare(a.Labels[1][1]+" "+a.Labels[0][1], b.Labels[1][1]+" "+b.Labels[0][1])
+	})
+	families = append(families, responses, routes)
+
+	if p, ok := api.bookService.(BookCacheProvider); ok && p.BookCache() != nil {
+		hits, misses := p.BookCache().Stats()
+		ratio := 0.0
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+		families = append(families,
+			MetricFamily{Name: "cache_hits", Type: "counter", Help: "Number of books found into the in-process cache.", Samples: []MetricSample{{Value: float64(hits)}}},
+			MetricFamily{Name: "cache_misses", Type: "counter", Help: "Number of books not found into the in-process cache.", Samples: []MetricSample{{Value: float64(misses)}}},
+			MetricFamily{Name: "cache_hit_ratio", Type: "gauge", Help: "Ratio of the in-process cache lookups which found the book.", Samples: []MetricSample{{Value: ratio}}},
+			MetricFamily{Name: "cache_entries", Type: "gauge", Help: "Number of books into the in-process cache.", Samples: []MetricSample{{Value: float64(p.BookCache().Len())}}},
+		)
+	}
+
+	if api.queue != nil {
+		depth := MetricFamily{Name: "queue_depth", Type: "gauge", Help: "Number of books waiting into the backup queues."}
+		for _, qid := range BackupQueues {
+			length, err := api.queue.Len(r.Context(), qid)
+			if err != nil {
+				api.logger.Error("failed to read queue length", zap.String("qid", qid), zap.String("request.id", requestID), zap.Error(err))
+				continue
+			}
+			depth.Samples = append(depth.Samples, MetricSample{Labels: [][2]string{{"queue", qid}}, Value: float64(length)})
+		}
+		families = append(families, depth)
+	}
+
+	w.Header().Set("Content-Type", OpenMetricsContentType)
+	if err := WriteOpenMetrics(w, families); err != nil {
+		api.logger.Error("failed to send openmetrics response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// GetAdminUI serves the static ops admin page. Its chain is limited to the requests
+// identification and skips the ops authentication so a browser can load the page, which
+// holds no data. The page then calls the ops endpoints with the bearer token typed by the
+// user when the ops authentication is enabled.
+func (api *APIHandler) GetAdminUI(page []byte) httprouter.Handle {
+	chain := Middlewares{
+		api.PanicRecoveryMiddleware,
+		api.RequestIDMiddleware,
+		api.AddLoggerMiddleware,
+	}
+	return chain.Chain(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(page); err != nil {
+			api.logger.Error("failed to send admin page", zap.String("request.id", GetValueFromContext(r.Context(), RequestIDContextKey)), zap.Error(err))
+		}
+	})
+}
+
 // GetConfigs serves current in-use configurations/settings.
 func (api *APIHandler) GetConfigs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	if err := json.NewEncoder(w).Encode(
 		map[string]interface{}{
-			"configs": api.config,
+			"configs": api.Config(),
 		},
 	); err != nil {
 		api.logger.Error("failed to send settings response", zap.String("request.id", requestID), zap.Error(err))
 	}
 }
 
+// ReloadConfig loads again the configuration from its file and environment then swaps in the
+// new one when only the settings of ReloadableConfigFields changed. The changes of the other
+// settings require a restart so the reload is rejected with 409 and the list of these changes.
+func (api *APIHandler) ReloadConfig(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	api.reloading.Lock()
+	defer api.reloading.Unlock()
+
+	config, err := api.loadConfig()
+	if err != nil {
+		api.logger.Error("failed to reload configuration", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to reload configuration", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	var changes, restart []string
+	for _, field := range ConfigChanges(api.Config(), config) {
+		if slices.Contains(ReloadableConfigFields, field) {
+			changes = append(changes, field)
+		} else {
+			restart = append(restart, field)
+		}
+	}
+	if len(restart) > 0 {
+		api.logger.Warn("configuration changes require a restart", zap.String("request.id", requestID), zap.Strings("config.fields", restart))
+		errResp := NewAPIError(requestID, http.StatusConflict, "configuration changes require a restart: "+strings.Join(restart, ", "), restart)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	if api.logLevel != nil && slices.Contains(changes, "log_level") {
+		api.logLevel.SetLevel(config.LogLevel)
+	}
+	if api.limiter != nil {
+		api.limiter.SetLimits(config.Server.RateLimit.Rate, config.Server.RateLimit.Burst)
+	}
+	if slices.Contains(changes, "debug.bodies.enable") {
+		api.bodies.Store(config.Debug.Bodies.Enable)
+	}
+	if slices.Contains(changes, "debug.verbose_books") {
+		SetVerboseBookLogs(config.Debug.VerboseBooks)
+	}
+	api.config.Store(config)
+	api.logger.Info("configuration reloaded", zap.String("request.id", requestID), zap.Strings("config.fields", changes))
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"changes":   changes,
+			"message":   "Configuration reloaded successfully.",
+		},
+	); err != nil {
+		api.logger.Error("failed to send reload response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// LogLevels lists the levels the app logger can be set to at runtime.
+var LogLevels = []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel}
+
+// LogLevelRequest is the body of the request changing the app logger level.
+type LogLevelRequest struct {
+	Level string `json:"level"` // one of debug, info, warn or error.
+}
+
+// GetLogLevel returns the current level of the app logger.
+func (api *APIHandler) GetLogLevel(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"level":     api.logLevel.Level().String(),
+		},
+	); err != nil {
+		api.logger.Error("failed to send log level response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// UpdateLogLevel changes the level of the app logger to the one of the request body without
+// redeploy. It is kept until changed again or until a configuration reload changes it.
+// It responds with the effective level.
+func (api *APIHandler) UpdateLogLevel(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	var req LogLevelRequest
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	err := json.NewDecoder(r.Body).Decode(&req)
+	i := slices.IndexFunc(LogLevels, func(l zapcore.Level) bool { return l.String() == req.Level })
+	if err == nil && i < 0 {
+		err = fmt.Errorf("unsupported level %q", req.Level)
+	}
+	if err != nil {
+		api.logger.Error("invalid log level", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "level must be one of debug, info, warn or error", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	previous, level := api.logLevel.Level(), LogLevels[i]
+	api.logLevel.SetLevel(level)
+	api.logger.Warn("log level changed", zap.String("request.id", requestID), zap.Stringer("previous", previous), zap.Stringer("level", level))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"previous":  previous.String(),
+			"level":     api.logLevel.Level().String(),
+		},
+	); err != nil {
+		api.logger.Error("failed to send log level response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// BodiesLoggingRequest is the body of the request toggling the bodies logging.
+type BodiesLoggingRequest struct {
+	Enable bool `json:"enable"`
+}
+
+// GetBodiesLogging returns whether the public requests and responses bodies are logged.
+func (api *APIHandler) GetBodiesLogging(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	api.writeBodiesLogging(w, requestID)
+}
+
+// UpdateBodiesLogging toggles the logging of the public requests and responses bodies without
+// redeploy. They are only logged at debug level so the log level may need to be changed too.
+func (api *APIHandler) UpdateBodiesLogging(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	var req BodiesLoggingRequest
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.logger.Error("invalid bodies logging toggle", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, `body must be like {"enable": true}`, err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.bodies.Store(req.Enable)
+	api.logger.Warn("bodies logging toggled", zap.String("request.id", requestID), zap.Bool("enable", req.Enable))
+	api.writeBodiesLogging(w, requestID)
+}
+
+// writeBodiesLogging sends the bodies logging state along with whether the current log
+// level lets the bodies be logged.
+func (api *APIHandler) writeBodiesLogging(w http.ResponseWriter, requestID string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"enable":    api.bodies.Load(),
+			"logged":    api.bodies.Load() && api.logger.Core().Enabled(zap.DebugLevel),
+		},
+	); err != nil {
+		api.logger.Error("failed to send bodies logging response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
 // Maintenance handles request to enable or disable the maintenance mode of the service and respond
 // to client requests with predefined message when the service is in maintenance mode.
 // Enable the maintenance mode : /ops/maintenance?status=enable&msg=message-to-be-displayed-to-users
@@ -160,34 +671,54 @@ func (api *APIHandler) Maintenance(w http.ResponseWriter, r *http.Request, ps ht
 
 	switch mstatus {
 	case "enable":
-		api.mode.reason = q.Get("msg")
-		api.mode.started = api.clock.Now()
-		api.mode.enabled.Store(true)
+		if q.Has("start") || q.Has("end") {
+			api.scheduleMaintenance(w, r)
+			return
+		}
+		reason, started := q.Get("msg"), api.clock.Now()
+		api.mode.Enable(reason, started)
 		response = map[string]interface{}{
 			"requestid":           requestID,
-			"maintenance.started": api.mode.started.Format(time.RFC1123),
-			"maintenance.reason":  api.mode.reason,
+			"maintenance.started": started.Format(time.RFC1123),
+			"maintenance.reason":  reason,
 			"message":             "Maintenance mode enabled successfully.",
 		}
 		logger = api.logger.With(zap.String("request.id", requestID))
 
 	case "disable":
-		api.mode.enabled.Store(false)
-		api.mode.started = api.clock.Zero()
-		api.mode.reason = ""
+		api.mode.Disable(api.clock.Zero())
 		response = map[string]interface{}{
 			"requestid": requestID,
 			"message":   "Maintenance mode disabled successfully.",
 		}
 		logger = api.logger.With(zap.String("request.id", requestID))
+		// opt-in fresh statistics baseline after the maintenance.
+		if reset, _ := strconv.ParseBool(q.Get("reset")); reset {
+			api.stats.Reset()
+			response["stats.reset"] = true
+			logger.Info("statistics reset on maintenance disable")
+		}
 
 	case "show":
+		now := api.clock.Now()
+		_, reason, started := api.mode.Current(now)
+		// clients retry once the scheduled window ends or else after the estimate.
+		until := api.mode.Until(now)
+		if until.IsZero() {
+			estimate := DefaultMaintenanceRetryAfter
+			if api.Config() != nil {
+				estimate = api.Config().Maintenance.GetRetryAfter()
+			}
+			until = now.Add(estimate)
+		}
 		response = map[string]interface{}{
-			"requestid": requestID,
-			"message":   "service currently unvailable.",
-			"reason":    api.mode.reason,
-			"since":     api.mode.started.Format(time.RFC1123),
+			"requestid":         requestID,
+			"message":           "service currently unvailable.",
+			"reason":            reason,
+			"since":             started.Format(time.RFC1123),
+			"maintenance_until": until.Format(time.RFC3339),
 		}
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(until.Sub(now).Seconds())), 10))
 		w.WriteHeader(http.StatusServiceUnavailable)
 	}
 
@@ -199,6 +730,47 @@ func (api *APIHandler) Maintenance(w http.ResponseWriter, r *http.Request, ps ht
 	}
 }
 
+// scheduleMaintenance plans the maintenance window from the `start` to the `end` RFC3339
+// times of the request, which must be ordered and end in the future. The public requests
+// are then answered with 503 during the window, as with the manual maintenance mode.
+func (api *APIHandler) scheduleMaintenance(w http.ResponseWriter, r *http.Request) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	q := r.URL.Query()
+	start, err := time.Parse(time.RFC3339, q.Get("start"))
+	var end time.Time
+	if err == nil {
+		end, err = time.Parse(time.RFC3339, q.Get("end"))
+	}
+	if err == nil && !start.Before(end) {
+		err = errors.New("start is not before end")
+	}
+	if err == nil && !api.clock.Now().Before(end) {
+		err = errors.New("end is in the past")
+	}
+	if err != nil {
+		api.logger.Error("invalid maintenance window", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "start and end must be RFC3339 times with start before end and end in the future", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	window := MaintenanceWindow{Reason: q.Get("msg"), Start: start, End: end}
+	api.mode.Schedule(window)
+	api.logger.Info("maintenance window scheduled", zap.String("request.id", requestID), zap.Time("maintenance.start", start), zap.Time("maintenance.end", end))
+	if err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"requestid":          requestID,
+		"maintenance.start":  start.Format(time.RFC3339),
+		"maintenance.end":    end.Format(time.RFC3339),
+		"maintenance.reason": window.Reason,
+		"maintenance.status": window.Status(api.clock.Now()),
+		"message":            "Maintenance window scheduled successfully.",
+	}); err != nil {
+		api.logger.Error("failed to send maintenance response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
 // ClearBooksCache deletes all books entries from the primary storage (cache).
 func (api *APIHandler) ClearBooksCache(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
@@ -214,10 +786,11 @@ func (api *APIHandler) ClearBooksCache(w http.ResponseWriter, r *http.Request, _
 	}
 }
 
-// GetProfilerIndexPage displays pprof index page.
-// func (api *APIHandler) GetProfilerIndexPage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-//	pprof.Index(w, r)
-// }
+// GetProfilerIndexPage displays pprof index page. The index links to the
+// profiles with relative paths so it works under the `/ops` prefix.
+func (api *APIHandler) GetProfilerIndexPage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pprof.Index(w, r)
+}
 
 // GetCPUProfile returns a snapshot of the pprof-formatted CPU profile.
 func (api *APIHandler) GetCPUProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -238,3 +811,364 @@ func (api *APIHandler) GetSymbol(w http.ResponseWriter, r *http.Request, _ httpr
 func (api *APIHandler) GetCmdLine(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	pprof.Cmdline(w, r)
 }
+
+// ListCaptures serves all captured requests from the oldest to the most recent.
+func (api *APIHandler) ListCaptures(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	captures := api.captures.List()
+	total := len(captures)
+	resp := GenericResponse(requestID, http.StatusOK, "Captured requests fetched successfully.", &total, captures)
+	if err := WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// GetCapture serves a captured request based on its ID.
+func (api *APIHandler) GetCapture(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	capture, found := api.captures.Get(ps.ByName("id"))
+	if !found {
+		errResp := NewAPIError(requestID, http.StatusNotFound, "captured request does not exist", ps.ByName("id"))
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	resp := GenericResponse(requestID, http.StatusOK, "Captured request fetched successfully.", nil, capture)
+	if err := WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// ReplayCapture sends again a captured request to the running service and provides the
+// replay outcome along with the originally recorded status. The replayed request goes
+// through all the public middlewares and is marked with the header `X-Replay-Of`.
+func (api *APIHandler) ReplayCapture(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	capture, found := api.captures.Get(ps.ByName("id"))
+	if !found {
+		errResp := NewAPIError(requestID, http.StatusNotFound, "captured request does not exist", ps.ByName("id"))
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	if capture.Truncated {
+		errResp := NewAPIError(requestID, http.StatusUnprocessableEntity, "captured request body was truncated", capture.ID)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), capture.Method, capture.URI, strings.NewReader(capture.Body))
+	if err != nil {
+		api.logger.Error("failed to build replay request", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to replay the captured request", capture.ID)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	req.Header = capture.Header.Clone()
+	req.Header.Del("X-Capture")
+	req.Header.Set("X-Replay-Of", capture.ID)
+	InjectTraceContext(r.Context(), req.Header)
+	req.RemoteAddr = r.RemoteAddr
+
+	rw := &replayResponseWriter{header: http.Header{}, code: http.StatusOK}
+	api.handler.ServeHTTP(rw, req)
+	api.logger.Info("captured request replayed", zap.String("request.id", requestID), zap.String("capture.id", capture.ID), zap.Int("replay.status", rw.code))
+
+	var body interface{} = rw.body.String()
+	if json.Valid(rw.body.Bytes()) {
+		body = json.RawMessage(rw.body.Bytes())
+	}
+	resp := GenericResponse(requestID, http.StatusOK, "Captured request replayed successfully.", nil, map[string]interface{}{
+		"capture":    capture.ID,
+		"original":   capture.Status,
+		"status":     rw.code,
+		"reproduced": rw.code == capture.Status,
+		"header":     rw.header,
+		"body":       body,
+	})
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// replayResponseWriter records in memory the response of a replayed request.
+type replayResponseWriter struct {
+	header http.Header
+	code   int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (rw *replayResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *replayResponseWriter) WriteHeader(code int) {
+	if !rw.wrote {
+		rw.code, rw.wrote = code, true
+	}
+}
+
+func (rw *replayResponseWriter) Write(b []byte) (int, error) {
+	rw.wrote = true
+	return rw.body.Write(b)
+}
+
+// hasOpsToken reports whether the request carries the bearer token of an ops endpoint. When
+// the ops requests are authenticated with a JWT, the authenticated subject is enough.
+func (api *APIHandler) hasOpsToken(r *http.Request, token string) bool {
+	if GetValueFromContext(r.Context(), SubjectContextKey) != "" {
+		return true
+	}
+	return HasBearerToken(r, token)
+}
+
+// ExportAudit streams as NDJSON the ops audit entries recorded within the time range set
+// with the RFC3339 `from` and `to` query parameters. Both are optional and default to the
+// beginning of the log and to now. It requires the configured bearer export token.
+func (api *APIHandler) ExportAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	if !api.hasOpsToken(r, api.Config().Ops.Audit.ExportToken) {
+		api.logger.Warn("unauthorized audit export", zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusUnauthorized, "invalid or missing audit export token", nil)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	from, to := time.Time{}, api.clock.Now()
+	var err error
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		from, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("to"); err == nil && v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+	}
+	if err == nil && from.After(to) {
+		err = errors.New("from is after to")
+	}
+	if err != nil {
+		api.logger.Error("invalid audit export range", zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "from and to must be RFC3339 times with from before to", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	count, err := api.audit.Export(r.Context(), from, to, w)
+	if err != nil {
+		api.logger.Error("failed to export audit entries", zap.String("request.id", requestID), zap.Int("exported", count), zap.Error(err))
+		return
+	}
+	api.logger.Info("success to export audit entries", zap.String("request.id", requestID), zap.Int("exported", count))
+}
+
+// RenameBookRequest is the body of a book rename request.
+type RenameBookRequest struct {
+	ID string `json:"id"` // the new ID of the book.
+}
+
+// RenameBook moves a book to the new valid ID provided into the request body across
+// primary and backup storages. It requires the configured bearer rename token and
+// responds with 409 if the new ID is already used by another book.
+func (api *APIHandler) RenameBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	if !api.hasOpsToken(r, api.Config().Ops.Rename.Token) {
+		api.logger.Warn("unauthorized book rename", zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusUnauthorized, "invalid or missing rename token", nil)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	id := ps.ByName("id")
+	if ok := api.ValidateBookID(w, r, id); !ok {
+		return
+	}
+
+	var req RenameBookRequest
+	LimitRequestBody(w, r, api.maxRequestBodyBytes())
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req.ID == id {
+		err = errors.New("new id is the current id")
+	}
+	if err == nil && !api.idsHandler.IsValid(req.ID, BookIDPrefix) {
+		err = fmt.Errorf("new id %q is not valid", req.ID)
+	}
+	if err != nil {
+		api.logger.Error("failed to rename book", zap.String("book.id", id), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusBadRequest, "new book id provided is not valid", err.Error())
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	book, err := api.bookService.Rename(r.Context(), id, req.ID)
+	if err != nil {
+		status, message := http.StatusInternalServerError, "failed to rename the book"
+		switch err {
+		case ErrBookNotFound:
+			status, message = http.StatusNotFound, "book not found"
+		case ErrBookExists:
+			status, message = http.StatusConflict, "new book id is already used"
+		case ErrRenameNotSupported:
+			status, message = http.StatusNotImplemented, "books renaming is not supported"
+		}
+		api.logger.Error("failed to rename book", zap.String("book.id", id), zap.String("book.newid", req.ID), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, status, message, Book{})
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	api.logger.Info("success to rename book", zap.String("book.id", id), zap.String("book.newid", req.ID), zap.String("request.id", requestID))
+	resp := GenericResponse(requestID, http.StatusOK, "Book renamed successfully.", nil, book)
+	if err = WriteResponse(r.Context(), w, resp); err != nil {
+		api.logger.Error("failed to send response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// RetryFailedQueues drains the dead letter queues back into their queues so the books
+// which failed to reach the backup storages go again through the consumer.
+func (api *APIHandler) RetryFailedQueues(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	moved, err := api.deadLetters.Requeue(r.Context())
+	total := 0
+	for _, n := range moved {
+		total += n
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err != nil {
+		api.logger.Error("failed to requeue dead letters", zap.String("request.id", requestID), zap.Int("requeued", total), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		api.logger.Info("success to requeue dead letters", zap.String("request.id", requestID), zap.Int("requeued", total))
+	}
+	if err = json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"requeued":  moved,
+			"total":     total,
+		},
+	); err != nil {
+		api.logger.Error("failed to send retry failed queues response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// DefaultQueuePeekSize and MaxQueuePeekSize bound the number of books listed by InspectQueue.
+const (
+	DefaultQueuePeekSize = 10
+	MaxQueuePeekSize     = 100
+)
+
+// InspectQueue returns the length and the first `n` books of one of the backup queues or
+// of their dead letter queues like `failed:creation`, without removing them.
+func (api *APIHandler) InspectQueue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	qid := ps.ByName("qid")
+	if !IsKnownQueue(qid) {
+		api.logger.Error("unknown queue id", zap.String("qid", qid), zap.String("request.id", requestID))
+		errResp := NewAPIError(requestID, http.StatusNotFound, "queue does not exist", qid)
+		if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+
+	n := DefaultQueuePeekSize
+	if value := r.URL.Query().Get("n"); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v <= 0 {
+			api.logger.Error("invalid queue peek size", zap.String("n", value), zap.String("request.id", requestID))
+			errResp := NewAPIError(requestID, http.StatusBadRequest, "n must be a positive integer", value)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		n = min(v, MaxQueuePeekSize)
+	}
+
+	length, err := api.queue.Len(r.Context(), qid)
+	var books []Book
+	if err == nil {
+		books, err = api.queue.Peek(r.Context(), qid, n)
+	}
+	if err != nil {
+		api.logger.Error("failed to inspect queue", zap.String("qid", qid), zap.String("request.id", requestID), zap.Error(err))
+		errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to inspect the queue", qid)
+		if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+			api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid": requestID,
+			"qid":       qid,
+			"length":    length,
+			"books":     books,
+		},
+	); err != nil {
+		api.logger.Error("failed to send queue inspection response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
+
+// MaintenanceCheck reports the app as degraded while the maintenance mode is enabled.
+func (api *APIHandler) MaintenanceCheck() HealthCheck {
+	return HealthCheck{Name: "maintenance", Run: func(ctx context.Context) (string, error) {
+		active, reason, since := api.mode.Current(api.clock.Now())
+		if active {
+			return "", fmt.Errorf("enabled since %s: %s", since.Format(time.RFC1123), reason)
+		}
+		if window := api.mode.Window(); window.Status(api.clock.Now()) == "upcoming" {
+			return "disabled, scheduled from " + window.Start.Format(time.RFC1123), nil
+		}
+		return "disabled", nil
+	}}
+}
+
+// UptimeCheck reports for how long the app is running. It never fails.
+func (api *APIHandler) UptimeCheck() HealthCheck {
+	return HealthCheck{Name: "uptime", Run: func(ctx context.Context) (string, error) {
+		return api.clock.Now().Sub(api.stats.started).Round(time.Second).String(), nil
+	}}
+}
+
+// GetHealth summarizes the health of all subsystems. The app status is `healthy` when all
+// checks passed, `unhealthy` with 503 when a critical one failed, otherwise `degraded`.
+func (api *APIHandler) GetHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+	report := api.health.Check(r.Context())
+	if report.Status != HealthStatusHealthy {
+		api.logger.Warn("app is not healthy", zap.String("request.id", requestID), zap.String("status", report.Status), zap.Any("components", report.Components))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if report.Status == HealthStatusUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"requestid":  requestID,
+			"status":     report.Status,
+			"components": report.Components,
+			"checkedAt":  report.CheckedAt,
+		},
+	); err != nil {
+		api.logger.Error("failed to send health response", zap.String("request.id", requestID), zap.Error(err))
+	}
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -29,29 +42,86 @@ type MiddlewareMap struct {
 
 // StatsMiddleware is a middleware that logs the duration it takes to handle each request,
 // then update the number of http status codes returned for internal ops statistics purposes.
+// The status code and the duration are recorded into the Prometheus metrics as well. It
+// also tracks the number of requests in flight which are reported while draining on shutdown.
+// A connection write deadline extended by the handler is reset once the handler returned.
+// With the OpenMetrics export enabled, the requests are counted per route as well.
 func (api *APIHandler) StatsMiddleware(next httprouter.Handle) httprouter.Handle {
+	return api.statsMiddleware(next, false)
+}
+
+// OpsStatsMiddleware is the StatsMiddleware of the ops requests. Their status codes are
+// counted apart and they are left out of the Prometheus metrics and the routes counters,
+// so the stats polling, the health probes and the metrics scrapes do not skew the public
+// numbers. They are still tracked in flight and their write deadline is reset as well.
+func (api *APIHandler) OpsStatsMiddleware(next httprouter.Handle) httprouter.Handle {
+	return api.statsMiddleware(next, true)
+}
+
+// statsMiddleware records the statistics of the public requests or of the ops ones.
+func (api *APIHandler) statsMiddleware(next httprouter.Handle, ops bool) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		logger := api.GetLoggerFromContext(r.Context())
-		conn := GetConnFromContext(r.Context())
-		nw := NewCustomResponseWriter(w, conn)
+		conn := GetRequestConn(r)
+		nw, ok := w.(*CustomResponseWriter)
+		if !ok {
+			nw = NewCustomResponseWriter(w, conn)
+		}
+		atomic.AddInt64(&api.stats.inflight, 1)
+		defer atomic.AddInt64(&api.stats.inflight, -1)
 		start := api.clock.Now()
 		next(nw, r, ps)
+		nw.Finish()
+		duration := api.clock.Now().Sub(start)
+		if nw.WriteDeadlineChanged() {
+			api.resetWriteDeadline(logger, conn)
+		}
+		status := nw.Status()
 		logger.Info(
 			"stats",
-			zap.Int("request.status", nw.Status()),
+			zap.Int("request.status", status),
 			zap.Int("bytes.sent", nw.Bytes()),
-			zap.Duration("request.duration", api.clock.Now().Sub(start)),
+			zap.Duration("request.duration", duration),
 		)
+		if ops {
+			api.stats.mu.Lock()
+			api.stats.opsStatus[status]++
+			api.stats.mu.Unlock()
+			return
+		}
+		api.metrics.Observe(status, duration)
+		var route string
+		if api.Config() != nil && api.Config().Ops.Stats.OpenMetrics {
+			if doc, found := api.Route(r.Method, r.URL.Path); found {
+				route = doc.Method + " " + doc.Path
+			}
+		}
 		api.stats.mu.Lock()
-		if num, found := api.stats.status[nw.code]; !found {
-			api.stats.status[nw.code] = 1
+		if num, found := api.stats.status[status]; !found {
+			api.stats.status[status] = 1
 		} else {
-			api.stats.status[nw.code] = num + 1
+			api.stats.status[status] = num + 1
+		}
+		if route != "" {
+			api.stats.routes[route]++
 		}
 		api.stats.mu.Unlock()
 	}
 }
 
+// resetWriteDeadline restores the server write timeout on the connection whose deadline was
+// extended by a handler, so it does not bleed into the next requests of a kept-alive
+// connection. Without configuration, the deadline is cleared.
+func (api *APIHandler) resetWriteDeadline(logger *zap.Logger, conn net.Conn) {
+	var deadline time.Time
+	if api.Config() != nil {
+		deadline = time.Now().Add(api.Config().Server.GetWriteTimeout())
+	}
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		logger.Error("http: failed to reset the write deadline", zap.Error(err))
+	}
+}
+
 // AddLoggerMiddleware creates a logger with pre-populated fields for each request.
 func (api *APIHandler) AddLoggerMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -66,6 +136,9 @@ func (api *APIHandler) AddLoggerMiddleware(next httprouter.Handle) httprouter.Ha
 			zap.String("request.agent", r.UserAgent()),
 			zap.String("request.referer", r.Referer()),
 		)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With(zap.String("trace.id", sc.TraceID().String()), zap.String("span.id", sc.SpanID().String()))
+		}
 
 		ctx := context.WithValue(r.Context(), LoggerContextKey, logger)
 		r = r.WithContext(ctx)
@@ -74,10 +147,16 @@ func (api *APIHandler) AddLoggerMiddleware(next httprouter.Handle) httprouter.Ha
 }
 
 // MaintenanceModeMiddleware responds to client with maintenance message along with 503 code
-// when the app field `Mode.enabled` is set to true. Otherwise it forwards the request.
+// when the app field `Mode.enabled` is set to true or during the scheduled maintenance window.
+// Otherwise it forwards the request. The requests from allowlisted sources are always forwarded.
 func (api *APIHandler) MaintenanceModeMiddleware(next httprouter.Handle) httprouter.Handle {
+	// lists are validated during the config initialization.
+	var trusted []*net.IPNet
+	if api.Config() != nil {
+		trusted, _ = ParseCIDRs(api.Config().Server.TrustedProxies)
+	}
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		if api.mode.enabled.Load() {
+		if api.mode.Active(api.clock.Now()) && !api.isMaintenanceAllowed(GetTrustedSourceIP(r, trusted)) {
 			api.Maintenance(w, r, httprouter.Params{
 				httprouter.Param{
 					Key:   "status",
@@ -90,6 +169,35 @@ func (api *APIHandler) MaintenanceModeMiddleware(next httprouter.Handle) httprou
 	}
 }
 
+// FingerprintMiddleware tracks the requests rate per fingerprint and logs a warning
+// when a fingerprint spikes. It is purely observational and never blocks requests.
+func (api *APIHandler) FingerprintMiddleware(next httprouter.Handle) httprouter.Handle {
+	var trusted []*net.IPNet
+	if api.Config() != nil {
+		trusted, _ = ParseCIDRs(api.Config().Server.TrustedProxies)
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.prints == nil {
+			next(w, r, ps)
+			return
+		}
+		template := RouteTemplate(r.URL.Path, ps)
+		ip := GetTrustedSourceIP(r, trusted)
+		fingerprint := Fingerprint(r.Method, template, r.UserAgent(), ip)
+		if count, spike := api.prints.Observe(fingerprint); spike {
+			api.GetLoggerFromContext(r.Context()).Warn("requests fingerprint spike",
+				zap.String("fingerprint", fingerprint),
+				zap.String("method", r.Method),
+				zap.String("route", template),
+				zap.String("user.agent", r.UserAgent()),
+				zap.String("source.ip", ip),
+				zap.Int64("count", count),
+			)
+		}
+		next(w, r, ps)
+	}
+}
+
 // RequestsCounterMiddleware increments the number of received requests statistics and add this
 // new value to the request context to be used during logging as `request.num` field.
 func (api *APIHandler) RequestsCounterMiddleware(next httprouter.Handle) httprouter.Handle {
@@ -100,22 +208,483 @@ func (api *APIHandler) RequestsCounterMiddleware(next httprouter.Handle) httprou
 	}
 }
 
-// RequestIDMiddleware generates and add a unique id to the request context.
+// OpsRequestsCounterMiddleware is the RequestsCounterMiddleware of ops requests. They have their
+// own counter so the public requests statistics are not affected by the ops traffic.
+func (api *APIHandler) OpsRequestsCounterMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := context.WithValue(r.Context(), RequestNumberContextKey, atomic.AddUint64(&api.stats.opsCalled, 1))
+		r = r.WithContext(ctx)
+		next(w, r, ps)
+	}
+}
+
+// RequestIDMiddleware adds a unique id to the request context and the response header.
+// With the passthrough enabled, the well-formed id of the request header is reused,
+// otherwise a fresh one is generated.
 func (api *APIHandler) RequestIDMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		requestID := api.idsHandler.Generate(RequestIDPrefix)
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || api.Config() == nil || !api.Config().Server.RequestIDPassthrough || !api.idsHandler.IsValid(requestID, RequestIDPrefix) {
+			requestID = api.idsHandler.Generate(RequestIDPrefix)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
 		ctx := context.WithValue(r.Context(), RequestIDContextKey, requestID)
 		r = r.WithContext(ctx)
 		next(w, r, ps)
 	}
 }
 
-// CORSMiddleware intercepts each incoming HTTP calls then apply cors headers on it.
-func CORSMiddleware(next httprouter.Handle) httprouter.Handle {
+// isMaintenanceAllowed reports whether the source ip is allowlisted to reach the service
+// during the maintenance. The allowlist is read from the configuration in use since it
+// can be reloaded, which only costs while the maintenance is active.
+func (api *APIHandler) isMaintenanceAllowed(ip string) bool {
+	config := api.Config()
+	if config == nil {
+		return false
+	}
+	allowed, _ := ParseCIDRs(config.Maintenance.AllowedIPs)
+	return ContainsIP(allowed, ip)
+}
+
+// RateLimitMiddleware limits the requests rate of each client (source IP) with a token
+// bucket. When the client bucket is empty it responds with 429 and the time to wait. The
+// forwarding headers are only honored from the trusted proxies so they cannot be spoofed
+// to get a fresh bucket.
+func (api *APIHandler) RateLimitMiddleware(next httprouter.Handle) httprouter.Handle {
+	var trusted []*net.IPNet
+	if api.Config() != nil {
+		trusted, _ = ParseCIDRs(api.Config().Server.TrustedProxies)
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.limiter == nil {
+			next(w, r, ps)
+			return
+		}
+		client := GetTrustedSourceIP(r, trusted)
+		allowed, wait := api.limiter.Allow(client)
+		if allowed {
+			next(w, r, ps)
+			return
+		}
+
+		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+		logger := api.GetLoggerFromContext(r.Context())
+		retryAfter := int64(math.Ceil(wait.Seconds()))
+		logger.Warn("client rate limit exceeded", zap.String("client", client))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"requestid":  requestID,
+			"message":    "too many requests",
+			"retryafter": retryAfter,
+		}); err != nil {
+			logger.Error("failed to send rate limit response", zap.String("request.id", requestID), zap.Error(err))
+		}
+	}
+}
+
+// ErrorBreakerMiddleware short-circuits with 429 the requests of a client whose circuit is
+// tripped by repeated client errors. Otherwise it forwards the request and records its 4xx
+// response, except the 429 ones sent by the other limiters.
+func (api *APIHandler) ErrorBreakerMiddleware(next httprouter.Handle) httprouter.Handle {
+	var trusted []*net.IPNet
+	if api.Config() != nil {
+		trusted, _ = ParseCIDRs(api.Config().Server.TrustedProxies)
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.breaker == nil {
+			next(w, r, ps)
+			return
+		}
+		client := GetTrustedSourceIP(r, trusted)
+		logger := api.GetLoggerFromContext(r.Context())
+		allowed, wait := api.breaker.Allow(client)
+		if allowed {
+			sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+			next(sw, r, ps)
+			if sw.code >= 400 && sw.code < 500 && sw.code != http.StatusTooManyRequests && api.breaker.Record(client) {
+				logger.Warn("client error breaker tripped", zap.String("client", client))
+			}
+			return
+		}
+
+		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+		retryAfter := int64(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"requestid":  requestID,
+			"message":    "too many client errors",
+			"retryafter": retryAfter,
+		}); err != nil {
+			logger.Error("failed to send error breaker response", zap.String("request.id", requestID), zap.Error(err))
+		}
+	}
+}
+
+// QuotaMiddleware consumes one request from the client budgets and exposes the remaining
+// quota into the response headers. When a budget is exhausted it responds with 429 along
+// with the reset time. Counting errors are logged and the request is let through. The
+// client is the source IP which honors the forwarding headers of the trusted proxies only.
+func (api *APIHandler) QuotaMiddleware(next httprouter.Handle) httprouter.Handle {
+	var trusted []*net.IPNet
+	if api.Config() != nil {
+		trusted, _ = ParseCIDRs(api.Config().Server.TrustedProxies)
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.quota == nil {
+			next(w, r, ps)
+			return
+		}
+		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+		logger := api.GetLoggerFromContext(r.Context())
+		client := GetTrustedSourceIP(r, trusted)
+		result, err := api.quota.Check(r.Context(), client)
+		if err != nil {
+			logger.Error("failed to check client quota", zap.String("client", client), zap.Error(err))
+			next(w, r, ps)
+			return
+		}
+
+		if result.Limit > 0 {
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(result.Limit, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(result.Remaining, 10))
+			w.Header().Set("X-Quota-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+		}
+		if result.Allowed {
+			next(w, r, ps)
+			return
+		}
+
+		retryAfter := int64(math.Ceil(result.Reset.Sub(api.clock.Now()).Seconds()))
+		logger.Warn("client quota exhausted", zap.String("client", client), zap.Int64("quota.limit", result.Limit))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"requestid":  requestID,
+			"message":    "requests quota exhausted",
+			"limit":      result.Limit,
+			"reset":      result.Reset.Format(time.RFC1123),
+			"retryafter": retryAfter,
+		}); err != nil {
+			logger.Error("failed to send quota response", zap.String("request.id", requestID), zap.Error(err))
+		}
+	}
+}
+
+// ServerTimingMiddleware measures the phases of the request and reports them into the
+// `Server-Timing` response header and the debug logs. In on-demand mode, only requests
+// with the header `X-Server-Timing: true` are measured to avoid any overhead. The feature
+// overrides of the request take precedence.
+func (api *APIHandler) ServerTimingMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		measured := !api.Config().Debug.Timing.OnDemand || strings.EqualFold(r.Header.Get("X-Server-Timing"), "true")
+		if !FeatureEnabled(r.Context(), FeatureTiming, measured) {
+			next(w, r, ps)
+			return
+		}
+		timing := NewServerTiming()
+		r = r.WithContext(context.WithValue(r.Context(), ServerTimingContextKey, timing))
+		next(&timingResponseWriter{ResponseWriter: w, timing: timing}, r, ps)
+		api.GetLoggerFromContext(r.Context()).Debug("server timing", timing.Fields()...)
+	}
+}
+
+// DegradedMiddleware signals the responses served in degraded mode, ie: from the backup
+// storage because the primary storage failed, with the configured header whose value is
+// the storage which served them. The data may be slightly stale since the backup storage
+// lags the primary storage by the time the changes go through the queues.
+func (api *APIHandler) DegradedMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		degradation := &Degradation{}
+		r = r.WithContext(context.WithValue(r.Context(), DegradedContextKey, degradation))
+		next(&degradedResponseWriter{ResponseWriter: w, header: api.Config().Degraded.Header, degradation: degradation}, r, ps)
+		if source := degradation.Source(); source != "" {
+			api.GetLoggerFromContext(r.Context()).Warn("served in degraded mode", zap.String("degraded.source", source))
+		}
+	}
+}
+
+// TracingMiddleware starts the server span of the request named by its method and route,
+// as child of the span of the caller sent into the `traceparent` header if any. The span
+// carries the request id to correlate it with the logs, and is set into the `traceparent`
+// header of the response.
+func (api *APIHandler) TracingMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := RouteTemplate(r.URL.Path, ps)
+		ctx, span := otel.Tracer(TracerName).Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("request.id", GetValueFromContext(ctx, RequestIDContextKey)),
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+		InjectTraceContext(ctx, w.Header())
+		tw := &tracingResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next(tw, r.WithContext(ctx), ps)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(tw.code))
+		if tw.code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(tw.code))
+		}
+	}
+}
+
+// CaptureMiddleware records the request (method, uri, headers and body) with the status it was
+// answered with into the capture store. Only sampled requests and those with the header
+// `X-Capture: true` are recorded. Replayed requests are never recorded again.
+func (api *APIHandler) CaptureMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.captures == nil || r.Header.Get("X-Replay-Of") != "" {
+			next(w, r, ps)
+			return
+		}
+		config := api.Config().Debug.Capture
+		if !strings.EqualFold(r.Header.Get("X-Capture"), "true") && rand.Float64() >= config.SampleRate {
+			next(w, r, ps)
+			return
+		}
+
+		var body []byte
+		truncated := false
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, config.MaxBodyBytes+1))
+			if err != nil {
+				api.GetLoggerFromContext(r.Context()).Error("failed to read body for capture", zap.Error(err))
+			}
+			if int64(len(body)) > config.MaxBodyBytes {
+				body, truncated = body[:config.MaxBodyBytes], true
+			}
+			// give back the full body to the next handlers.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+
+		cw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next(cw, r, ps)
+
+		capture := CapturedRequest{
+			ID:         GetValueFromContext(r.Context(), RequestIDContextKey),
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			Header:     RedactHeader(r.Header, append(DefaultRedactedHeaders, config.RedactHeaders...)),
+			Body:       string(RedactJSONBody(body, config.RedactFields)),
+			Truncated:  truncated,
+			Status:     cw.code,
+			CapturedAt: api.clock.Now(),
+		}
+		if err := api.captures.Save(capture); err != nil {
+			api.GetLoggerFromContext(r.Context()).Error("failed to save request capture", zap.Error(err))
+		}
+	}
+}
+
+// FeatureOverridesMiddleware applies to the request the feature overrides of its signed
+// header. An unsigned, tampered or expired header is ignored with a warning so the request
+// is served with the global features.
+func (api *APIHandler) FeatureOverridesMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if value := r.Header.Get(FeatureOverridesHeader); value != "" {
+			logger := api.GetLoggerFromContext(r.Context())
+			overrides, err := ParseFeatureOverrides(api.Config().Overrides.Secret, value, api.clock.Now())
+			if err != nil {
+				logger.Warn("ignored feature overrides", zap.Error(err))
+			} else {
+				logger.Info("applied feature overrides", zap.Any("overrides", overrides))
+				r = r.WithContext(context.WithValue(r.Context(), FeatureOverridesContextKey, overrides))
+			}
+		}
+		next(w, r, ps)
+	}
+}
+
+// BodiesLoggingMiddleware debug logs the request and response bodies, up to the configured
+// size each, when the bodies logging is toggled on, or overridden for the request, and the
+// debug level enabled. The request body is teed so the next handlers still read it in full.
+// The configured JSON fields are masked, and so is a truncated body which cannot be parsed
+// to mask them.
+func (api *APIHandler) BodiesLoggingMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE, PATCH, HEAD")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers, Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, User-Agent, Accept-Language, Referer, DNT, Connection, Pragma, Cache-Control, TE")
+		logger := api.GetLoggerFromContext(r.Context())
+		if !FeatureEnabled(r.Context(), FeatureBodies, api.bodies.Load()) || !logger.Core().Enabled(zap.DebugLevel) {
+			next(w, r, ps)
+			return
+		}
+		var config BodiesConfig
+		if c := api.Config(); c != nil {
+			config = c.Debug.Bodies
+		}
+		limit := config.GetMaxBytes()
+
+		var body []byte
+		truncated := false
+		if r.Body != nil {
+			read, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err != nil {
+				logger.Error("failed to read body for logging", zap.Error(err))
+			}
+			body, truncated = read[:min(int64(len(read)), limit)], int64(len(read)) > limit
+			// give back the full body, including the byte read past the limit, to the next handlers.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(read), r.Body), r.Body}
+		}
+
+		bw := &bodyResponseWriter{statusResponseWriter: statusResponseWriter{ResponseWriter: w, code: http.StatusOK}, max: int(limit)}
+		next(bw, r, ps)
+
+		logger.Debug("http: bodies",
+			zap.ByteString("request.body", redactLoggedBody(body, truncated, config.RedactFields)),
+			zap.Bool("request.body.truncated", truncated),
+			zap.Int("response.status", bw.code),
+			zap.ByteString("response.body", redactLoggedBody(bw.body.Bytes(), bw.truncated, config.RedactFields)),
+			zap.Bool("response.body.truncated", bw.truncated),
+		)
+	}
+}
+
+// MaxValidatedResponseBytes is the size above which the responses are not validated.
+const MaxValidatedResponseBytes = 4 << 20
+
+// ResponseSchemaMiddleware checks in development the successful JSON responses against
+// the schema of their route, like a book with an empty title or a missing field, and
+// loudly logs the violations found so handler bugs get caught early. The response is
+// sent untouched.
+func (api *APIHandler) ResponseSchemaMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		route, found := api.Route(r.Method, r.URL.Path)
+		if !found || (route.Data == nil && route.Response == nil) {
+			next(w, r, ps)
+			return
+		}
+		bw := &bodyResponseWriter{statusResponseWriter: statusResponseWriter{ResponseWriter: w, code: http.StatusOK}, max: MaxValidatedResponseBytes}
+		next(bw, r, ps)
+		if bw.code < 200 || bw.code > 299 || bw.truncated || bw.body.Len() == 0 ||
+			!strings.HasPrefix(bw.Header().Get("Content-Type"), "application/json") {
+			return
+		}
+		logger := api.GetLoggerFromContext(r.Context())
+		violations, err := ResponseSchemaViolations(bw.body.Bytes(), route)
+		if err != nil {
+			logger.Error("schema: response is not valid json", zap.String("route", route.Method+" "+route.Path), zap.Error(err))
+			return
+		}
+		if len(violations) > 0 {
+			logger.Error("schema: response does not match the route schema", zap.String("route", route.Method+" "+route.Path), zap.Int("response.status", bw.code), zap.Strings("violations", violations))
+		}
+	}
+}
+
+// redactLoggedBody masks the fields values of the logged body. The body is entirely masked
+// when truncated since the fields cannot be found into an incomplete JSON.
+func redactLoggedBody(body []byte, truncated bool, fields []string) []byte {
+	if len(fields) > 0 && truncated {
+		return []byte(RedactedValue)
+	}
+	return RedactJSONBody(body, fields)
+}
+
+// AuthMiddleware authenticates the ops requests with the HS256 JWT of their bearer token. The
+// token subject is added to the request context. It responds with 401 when the token is
+// missing, malformed, wrongly signed or expired.
+func (api *APIHandler) AuthMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			api.logger.Warn("unauthenticated ops request", zap.String("request.id", requestID), zap.String("request.ip", GetRequestSourceIP(r)))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ops"`)
+			errResp := NewAPIError(requestID, http.StatusUnauthorized, "missing bearer token", nil)
+			if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		claims, err := ParseToken(api.Config().Auth.Secret, token, api.clock.Now())
+		if err != nil {
+			api.logger.Warn("unauthenticated ops request", zap.String("request.id", requestID), zap.String("request.ip", GetRequestSourceIP(r)), zap.Error(err))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ops", error="invalid_token"`)
+			errResp := NewAPIError(requestID, http.StatusUnauthorized, err.Error(), nil)
+			if err = WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
+			}
+			return
+		}
+		ctx := context.WithValue(r.Context(), SubjectContextKey, claims.Subject)
+		next(w, r.WithContext(ctx), ps)
+	}
+}
+
+// AuditMiddleware records each ops request with the status it was answered with into the audit log.
+func (api *APIHandler) AuditMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.audit == nil {
+			next(w, r, ps)
+			return
+		}
+		sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next(sw, r, ps)
+		entry := AuditEntry{
+			Time:      api.clock.Now(),
+			RequestID: GetValueFromContext(r.Context(), RequestIDContextKey),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Source:    GetRequestSourceIP(r),
+			Status:    sw.code,
+		}
+		if err := api.audit.Append(entry); err != nil {
+			api.GetLoggerFromContext(r.Context()).Error("failed to record ops audit entry", zap.Error(err))
+		}
+	}
+}
+
+// CORSMiddleware applies the cors headers on the requests from the allowed origins.
+// The request origin is echoed back, except when only allowed by the `*` pattern which
+// is answered as is and never with credentials, so no site can make credentialed reads.
+// The preflight requests are answered with 204 without going further.
+func (api *APIHandler) CORSMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var config CORSConfig
+		if api.Config() != nil {
+			config = api.Config().CORS
+		}
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		allowed, wildcard := config.MatchOrigin(origin)
+		if origin != "" && allowed {
+			if wildcard {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if config.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.GetAllowedMethods(), ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.GetAllowedHeaders(), ", "))
+				if config.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.FormatInt(int64(config.MaxAge.Seconds()), 10))
+				}
+			} else {
+				w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+			}
+		}
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 		next(w, r, ps)
 	}
 }
@@ -129,7 +698,7 @@ func (api *APIHandler) PanicRecoveryMiddleware(next httprouter.Handle) httproute
 				requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
 				api.logger.Error("panic occurred", zap.String("request.id", requestID), zap.Any("error", err))
 				errResp := NewAPIError(requestID, http.StatusInternalServerError, "failed to process the request.", struct{}{})
-				if err := WriteErrorResponse(r.Context(), w, errResp); err != nil {
+				if err := api.WriteNegotiatedError(w, r, errResp); err != nil {
 					api.logger.Error("failed to send error response", zap.String("request.id", requestID), zap.Error(err))
 				}
 			}
@@ -139,9 +708,13 @@ func (api *APIHandler) PanicRecoveryMiddleware(next httprouter.Handle) httproute
 	}
 }
 
-// TimeoutMiddleware returns a Handler which sets X-Timeout-Reached header to instruct the final handler to not
-// respond to client because timeout response was already sent. Similarly it sets X-Request-Cancelled into the
-// header to notify the final handler to not perform any action towards the client.
+// TimeoutMiddleware returns a Handler which aborts the response of the final handler once the request
+// processing timed out or the client cancelled it. The response writer is wrapped here so the final
+// handler and this middleware share the same CustomResponseWriter, which guarantees the timeout
+// response and a late handler write never interleave. This is the only timeout mechanism: the router
+// must not be wrapped with http.TimeoutHandler which replaces the writer and answers with 503, so the
+// StatsMiddleware would record a status code the client never received. The headers of a handler
+// which returned without writing are sent along with the status code once it returned.
 func (api *APIHandler) TimeoutMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		requestID := GetValueFromContext(r.Context(), RequestIDContextKey)
@@ -150,29 +723,37 @@ func (api *APIHandler) TimeoutMiddleware(next httprouter.Handle) httprouter.Hand
 		ctx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 		r = r.WithContext(ctx)
+		nw := NewCustomResponseWriter(w, GetRequestConn(r))
 		done := make(chan struct{})
 		go func() {
-			next(w, r, ps)
+			next(nw, r, ps)
 			close(done)
 		}()
 
 		select {
 		case <-done:
+			nw.Finish()
 		case <-ctx.Done():
+			var aborted bool
 			if cerr := ctx.Err(); errors.Is(cerr, context.Canceled) {
-				w.Header().Set("X-DRAP-ABORTED", "C")
-				w.WriteHeader(499)
+				aborted = nw.Abort(func(w http.ResponseWriter) {
+					w.WriteHeader(499)
+				})
 			} else if errors.Is(cerr, context.DeadlineExceeded) {
-				w.Header().Set("X-DRAP-ABORTED", "T")
-				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-				w.WriteHeader(http.StatusGatewayTimeout)
-				if err := json.NewEncoder(w).Encode(map[string]interface{}{
-					"requestid": requestID,
-					"message":   "request handling timed out",
-					"timeout":   fmt.Sprintf("%.0f secs", timeout.Seconds()),
-				}); err != nil {
-					logger.Error("failed to send timeout response", zap.String("request.id", requestID), zap.Error(err))
-				}
+				aborted = nw.Abort(func(w http.ResponseWriter) {
+					w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+					w.WriteHeader(http.StatusGatewayTimeout)
+					if err := json.NewEncoder(w).Encode(map[string]interface{}{
+						"requestid": requestID,
+						"message":   "request handling timed out",
+						"timeout":   fmt.Sprintf("%.0f secs", timeout.Seconds()),
+					}); err != nil {
+						logger.Error("failed to send timeout response", zap.String("request.id", requestID), zap.Error(err))
+					}
+				})
+			}
+			if !aborted {
+				logger.Warn("request aborted after the response started", zap.String("request.id", requestID))
 			}
 		}
 	}
@@ -183,9 +764,11 @@ func (api *APIHandler) TimeoutMiddleware(next httprouter.Handle) httprouter.Hand
 func (api *APIHandler) GetTimeout(r *http.Request) time.Duration {
 	switch {
 	case r.Method == "GET" && r.URL.Path == "/v1/books":
-		return api.config.Server.LongRequestProcessingTimeout
+		return api.Config().Server.GetLongRequestProcessingTimeout()
+	case r.Method == "POST" && r.URL.Path == "/v1/books/import":
+		return api.Config().Server.GetLongRequestProcessingTimeout()
 	default:
-		return api.config.Server.RequestTimeout
+		return api.Config().Server.GetRequestTimeout()
 	}
 }
 
@@ -210,22 +793,70 @@ func (api *APIHandler) MiddlewaresStacks() (*Middlewares, *Middlewares) {
 	middlewaresPublic := Middlewares{
 		api.PanicRecoveryMiddleware,
 		api.RequestIDMiddleware,
+	}
+	if api.Config() != nil && api.Config().Tracing.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.TracingMiddleware)
+	}
+	middlewaresPublic = append(middlewaresPublic,
 		api.MaintenanceModeMiddleware,
 		api.RequestsCounterMiddleware,
 		api.AddLoggerMiddleware,
-		CORSMiddleware,
+	)
+	if api.Config() != nil && api.Config().Overrides.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.FeatureOverridesMiddleware)
+	}
+	if api.Config() != nil && api.Config().Debug.Capture.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.CaptureMiddleware)
+	}
+	middlewaresPublic = append(middlewaresPublic, api.BodiesLoggingMiddleware)
+	if api.Config() != nil && api.Config().Fingerprint.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.FingerprintMiddleware)
+	}
+	if api.Config() != nil && api.Config().Server.ErrorBreaker.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.ErrorBreakerMiddleware)
+	}
+	if api.Config() != nil && api.Config().Server.RateLimit.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.RateLimitMiddleware)
+	}
+	if api.Config() != nil && api.Config().Quota.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.QuotaMiddleware)
+	}
+	if api.Config() != nil && api.Config().Debug.Timing.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.ServerTimingMiddleware)
+	}
+	if api.Config() != nil && api.Config().Degraded.Enable {
+		middlewaresPublic = append(middlewaresPublic, api.DegradedMiddleware)
+	}
+	middlewaresPublic = append(middlewaresPublic,
+		api.CORSMiddleware,
 		api.TimeoutMiddleware,
 		api.StatsMiddleware,
+	)
+	if api.Config() != nil && !api.Config().IsProduction {
+		middlewaresPublic = append(middlewaresPublic, api.ResponseSchemaMiddleware)
 	}
 
 	middlewaresOps := Middlewares{
 		api.PanicRecoveryMiddleware,
 		api.RequestIDMiddleware,
-		api.RequestsCounterMiddleware,
+	}
+	if api.Config() != nil && api.Config().Tracing.Enable {
+		middlewaresOps = append(middlewaresOps, api.TracingMiddleware)
+	}
+	middlewaresOps = append(middlewaresOps,
+		api.OpsRequestsCounterMiddleware,
 		api.AddLoggerMiddleware,
-		CORSMiddleware,
-		api.TimeoutMiddleware,
-		api.StatsMiddleware,
+	)
+	if api.Config() != nil && api.Config().Ops.Audit.Enable {
+		middlewaresOps = append(middlewaresOps, api.AuditMiddleware)
+	}
+	if api.Config() != nil && api.Config().Auth.Enable {
+		middlewaresOps = append(middlewaresOps, api.AuthMiddleware)
 	}
+	middlewaresOps = append(middlewaresOps,
+		api.CORSMiddleware,
+		api.TimeoutMiddleware,
+		api.OpsStatsMiddleware,
+	)
 	return &middlewaresPublic, &middlewaresOps
 }
@@ -1,17 +1,43 @@
 package main
 
 import (
+	"errors"
+	"net/http"
+
 	"github.com/julienschmidt/httprouter"
 )
 
 // SetupBookRoutes injects book related the api endpoints.
-func (api *APIHandler) SetupBookRoutes(router *httprouter.Router, m *MiddlewareMap) {
+func (api *APIHandler) SetupBookRoutes(router *httprouter.Router, m *MiddlewareMap) error {
+	var errs []error
 	router.RedirectTrailingSlash = true
-	router.GET("/", m.public(api.Index))
-	router.GET("/status", m.public(api.Status))
-	router.POST("/v1/books", m.public(api.CreateBook))
-	router.GET("/v1/books", m.public(api.GetAllBooks))
-	router.GET("/v1/books/:id", m.public(api.GetOneBook))
-	router.PUT("/v1/books/:id", m.public(api.UpdateBook))
-	router.DELETE("/v1/books/:id", m.public(api.DeleteOneBook))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/", Tag: "Books", Summary: "Redirect to the app status"}, m.public(api.Index)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/status", Tag: "Books", Summary: "Get the app status", Response: StatusResponse{}}, m.public(api.Status)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/v1/books", Tag: "Books", Summary: "Create a new book", Body: Book{}, Data: Book{}}, m.public(api.CreateBook)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/v1/books", Tag: "Books", Summary: "Get all books", Query: []string{"limit", "cursor", "priceMin", "priceMax", "sort", "order"}, Data: []Book{}}, m.public(api.GetAllBooks)))
+	api.document(RouteDoc{Method: http.MethodGet, Path: "/v1/books/count", Tag: "Books", Summary: "Count the books", Response: map[string]interface{}{}})
+	api.document(RouteDoc{Method: http.MethodGet, Path: "/v1/books/popular", Tag: "Books", Summary: "Get the most viewed books", Query: []string{"limit"}, Data: []BookViews{}})
+	api.document(RouteDoc{Method: http.MethodGet, Path: "/v1/books/search", Tag: "Books", Summary: "Search books by title or author", Query: []string{"q", "field"}, Data: []BookMatch{}})
+	api.document(RouteDoc{Method: http.MethodGet, Path: "/v1/books/trash", Tag: "Books", Summary: "Get the trashed books", Data: []Book{}})
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/v1/books/:id", Tag: "Books", Summary: "Get a book", Data: Book{}}, m.public(dispatch("id", map[string]httprouter.Handle{
+		"count":   api.CountBooks,
+		"popular": api.GetPopularBooks,
+		"search":  api.SearchBooks,
+		"trash":   api.GetTrashBooks,
+	}, api.GetOneBook))))
+	// `/v1/books/bulk` and `/v1/books/import` are served through `/v1/books/:id` which is not
+	// a route on its own, since httprouter cannot register them next to `/v1/books/:id/restore`.
+	api.document(RouteDoc{Method: http.MethodPost, Path: "/v1/books/bulk", Tag: "Books", Summary: "Create many books", Body: []Book{}, Data: []BulkItemResult{}})
+	api.document(RouteDoc{Method: http.MethodPost, Path: "/v1/books/import", Tag: "Books", Summary: "Import books from NDJSON", Data: ImportResult{}})
+	errs = append(errs, handle(router, http.MethodPost, "/v1/books/:id", m.public(dispatch("id", map[string]httprouter.Handle{
+		"bulk":   api.CreateBooks,
+		"import": api.ImportBooks,
+	}, api.RouteNotFound))))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/v1/books/:id/history", Tag: "Books", Summary: "Get the prior versions of a book", Data: []Book{}}, m.public(api.GetBookHistory)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/v1/books/:id/restore", Tag: "Books", Summary: "Restore a trashed or pending delete book", Data: Book{}}, m.public(api.RestoreBook)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPut, Path: "/v1/books/:id", Tag: "Books", Summary: "Update a book", Body: Book{}, Data: Book{}}, m.public(api.UpdateBook)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPatch, Path: "/v1/books/:id", Tag: "Books", Summary: "Partially update a book", Body: BookPatch{}, Data: Book{}}, m.public(api.PatchBook)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodDelete, Path: "/v1/books", Tag: "Books", Summary: "Delete all books", Query: []string{"confirm"}}, m.ops(api.DeleteAllBooks)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodDelete, Path: "/v1/books/:id", Tag: "Books", Summary: "Delete a book", Data: Book{}}, m.public(api.DeleteOneBook)))
+	return errors.Join(errs...)
 }
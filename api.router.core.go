@@ -1,19 +1,31 @@
 package main
 
 import (
+	"errors"
+	"net/http"
+
 	_ "github.com/jeamon/demo-redis/docs"
 	"github.com/julienschmidt/httprouter"
 	httpswagger "github.com/swaggo/http-swagger/v2"
 )
 
-// SetupRoutes injects book and ops related endpoints if required.
-func (api *APIHandler) SetupRoutes(router *httprouter.Router, m *MiddlewareMap) *httprouter.Router {
+// SetupRoutes injects book and ops related endpoints if required. It reports all the
+// routes which could not be registered, like the ones registered twice.
+func (api *APIHandler) SetupRoutes(router *httprouter.Router, m *MiddlewareMap) (*httprouter.Router, error) {
+	api.routes = nil
+	api.handler = router
 	router.RedirectTrailingSlash = true
-	router.NotFound = api.NotFound()
-	api.SetupBookRoutes(router, m)
-	if api.config.OpsEndpointsEnable {
-		api.SetupOpsRoutes(router, m)
+	router.NotFound = api.NotFound(m.public)
+	router.MethodNotAllowed = api.MethodNotAllowed(m.public)
+	router.GlobalOPTIONS = api.Options()
+	errs := []error{api.SetupBookRoutes(router, m)}
+	if api.Config().OpsEndpointsEnable {
+		errs = append(errs, api.SetupOpsRoutes(router, m))
+		// serves the swagger spec at `/swagger/doc.json` and its UI at `/swagger/index.html`.
+		errs = append(errs, handle(router, http.MethodGet, "/swagger/*any", m.public(api.OpsHandlerWrapper(httpswagger.WrapHandler))))
+	}
+	if api.Config().OpenAPIEndpointEnable {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/docs/openapi.json", Tag: "Docs", Summary: "Get the OpenAPI document", Response: map[string]interface{}{}}, m.public(api.GetOpenAPISpec)))
 	}
-	router.GET("/swagger/", m.public(api.OpsHandlerWrapper(httpswagger.WrapHandler)))
-	return router
+	return router, errors.Join(errs...)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"net/http/pprof"
 
@@ -8,26 +9,85 @@ import (
 )
 
 // SetupOpsRoutes injects internal operations related endpoints.
-func (api *APIHandler) SetupOpsRoutes(router *httprouter.Router, m *MiddlewareMap) {
-	router.GET("/ops/configs", m.ops(api.GetConfigs))
-	router.GET("/ops/stats", m.ops(api.GetStatistics))
-	router.GET("/ops/maintenance", m.ops(api.Maintenance))
-	router.DELETE("/ops/cache/books/clear", m.ops(api.ClearBooksCache))
-	router.GET("/ops/debug/vars", m.ops(GetMemStats))
-	router.GET("/ops/debug/gc", m.ops(api.RunGC))
-	router.GET("/ops/debug/fos", m.ops(api.FreeOSMemory))
-
-	if api.config.ProfilerEndpointsEnable {
-		router.GET("/ops/debug/pprof/", m.ops(api.OpsHandlerWrapper(http.HandlerFunc(pprof.Index))))
-		router.GET("/ops/debug/pprof/profile", m.ops(api.GetCPUProfile))
-		router.GET("/ops/debug/pprof/trace", m.ops(api.GetTraceProfile))
-		router.GET("/ops/debug/pprof/symbol", m.ops(api.GetSymbol))
-		router.GET("/ops/debug/pprof/cmdline", m.ops(api.GetCmdLine))
-		router.GET("/ops/debug/pprof/heap", m.ops(api.OpsHandlerWrapper(pprof.Handler("heap"))))
-		router.GET("/ops/debug/pprof/allocs", m.ops(api.OpsHandlerWrapper(pprof.Handler("allocs"))))
-		router.GET("/ops/debug/pprof/goroutine", m.ops(api.OpsHandlerWrapper(pprof.Handler("goroutine"))))
-		router.GET("/ops/debug/pprof/threadcreate", m.ops(api.OpsHandlerWrapper(pprof.Handler("threadcreate"))))
-		router.GET("/ops/debug/pprof/block", m.ops(api.OpsHandlerWrapper(pprof.Handler("block"))))
-		router.GET("/ops/debug/pprof/mutex", m.ops(api.OpsHandlerWrapper(pprof.Handler("mutex"))))
+func (api *APIHandler) SetupOpsRoutes(router *httprouter.Router, m *MiddlewareMap) error {
+	var errs []error
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/configs", Tag: "Ops", Summary: "Get in-use configurations", Response: map[string]interface{}{}}, m.ops(api.GetConfigs)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/ops/config/reload", Tag: "Ops", Summary: "Reload the configurations which can change without restart", Response: map[string]interface{}{}}, m.ops(api.ReloadConfig)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/stats", Tag: "Ops", Summary: "Get app statistics", Response: map[string]interface{}{}}, m.ops(api.GetStatistics)))
+	if api.Config().Ops.Stats.OpenMetrics {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/stats/openmetrics", Tag: "Ops", Summary: "Get app statistics in OpenMetrics text format"}, m.ops(api.GetOpenMetrics)))
 	}
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/metrics", Tag: "Ops", Summary: "Get Prometheus metrics"}, m.ops(api.OpsHandlerWrapper(api.metrics.Handler()))))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/maintenance", Tag: "Ops", Summary: "Enable, schedule or disable the maintenance mode", Query: []string{"status", "msg", "reset", "start", "end"}, Response: map[string]interface{}{}}, m.ops(api.Maintenance)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodDelete, Path: "/ops/cache/books/clear", Tag: "Ops", Summary: "Clear the books cache", Response: map[string]string{}}, m.ops(api.ClearBooksCache)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/debug/vars", Tag: "Ops", Summary: "Get memory statistics"}, m.ops(GetMemStats)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/debug/bodies", Tag: "Ops", Summary: "Get whether the requests and responses bodies are logged", Response: map[string]interface{}{}}, m.ops(api.GetBodiesLogging)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPut, Path: "/ops/debug/bodies", Tag: "Ops", Summary: "Toggle the logging of the requests and responses bodies", Body: BodiesLoggingRequest{}, Response: map[string]interface{}{}}, m.ops(api.UpdateBodiesLogging)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/debug/gc", Tag: "Ops", Summary: "Run the garbage collector", Response: map[string]string{}}, m.ops(api.RunGC)))
+	errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/debug/fos", Tag: "Ops", Summary: "Free memory to the OS", Response: map[string]string{}}, m.ops(api.FreeOSMemory)))
+
+	if page := AdminUI(); api.Config().Ops.UI.Enable && page != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/ui", Tag: "Ops", Summary: "Get the ops admin page"}, api.GetAdminUI(page)))
+	}
+
+	if api.health != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/health", Tag: "Ops", Summary: "Get the health summary of all subsystems", Response: HealthReport{}}, m.ops(api.GetHealth)))
+	}
+
+	if api.logLevel != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/loglevel", Tag: "Ops", Summary: "Get the app log level", Response: map[string]interface{}{}}, m.ops(api.GetLogLevel)))
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPut, Path: "/ops/loglevel", Tag: "Ops", Summary: "Change the app log level", Body: LogLevelRequest{}, Response: map[string]interface{}{}}, m.ops(api.UpdateLogLevel)))
+	}
+
+	if api.audit != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/audit/export", Tag: "Ops", Summary: "Export the ops audit log as NDJSON", Query: []string{"from", "to"}}, m.ops(api.ExportAudit)))
+	}
+
+	if api.deadLetters != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/ops/queues/retry-failed", Tag: "Ops", Summary: "Move back the dead letter queues books into their queues", Response: map[string]interface{}{}}, m.ops(api.RetryFailedQueues)))
+	}
+
+	if api.queue != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/queues/:qid", Tag: "Ops", Summary: "Get the length and the first books of a queue", Query: []string{"n"}, Response: map[string]interface{}{}}, m.ops(api.InspectQueue)))
+	}
+
+	// `/ops/books/import` is served through `/ops/books/:id` since httprouter cannot
+	// register it next to `/ops/books/:id/rename`.
+	api.document(RouteDoc{Method: http.MethodPost, Path: "/ops/books/import", Tag: "Ops", Summary: "Replace all the books by the NDJSON imported ones", Data: ImportResult{}})
+	errs = append(errs, handle(router, http.MethodPost, "/ops/books/:id", m.ops(dispatch("id", map[string]httprouter.Handle{
+		"import": api.ReplaceBooks,
+	}, api.RouteNotFound))))
+
+	if api.Config().Ops.Rename.Enable {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/ops/books/:id/rename", Tag: "Ops", Summary: "Move a book to another ID", Body: RenameBookRequest{}, Data: Book{}}, m.ops(api.RenameBook)))
+	}
+
+	if api.captures != nil {
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/captures", Tag: "Ops", Summary: "List the captured requests", Response: []CapturedRequest{}}, m.ops(api.ListCaptures)))
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: "/ops/captures/:id", Tag: "Ops", Summary: "Get a captured request", Response: CapturedRequest{}}, m.ops(api.GetCapture)))
+		errs = append(errs, api.register(router, RouteDoc{Method: http.MethodPost, Path: "/ops/captures/:id/replay", Tag: "Ops", Summary: "Replay a captured request", Response: map[string]interface{}{}}, m.ops(api.ReplayCapture)))
+	}
+
+	if api.Config().ProfilerEndpointsEnable {
+		profiles := []struct {
+			path   string
+			handle httprouter.Handle
+		}{
+			{"/ops/debug/pprof/", api.GetProfilerIndexPage},
+			{"/ops/debug/pprof/profile", api.GetCPUProfile},
+			{"/ops/debug/pprof/trace", api.GetTraceProfile},
+			{"/ops/debug/pprof/symbol", api.GetSymbol},
+			{"/ops/debug/pprof/cmdline", api.GetCmdLine},
+			{"/ops/debug/pprof/heap", api.OpsHandlerWrapper(pprof.Handler("heap"))},
+			{"/ops/debug/pprof/allocs", api.OpsHandlerWrapper(pprof.Handler("allocs"))},
+			{"/ops/debug/pprof/goroutine", api.OpsHandlerWrapper(pprof.Handler("goroutine"))},
+			{"/ops/debug/pprof/threadcreate", api.OpsHandlerWrapper(pprof.Handler("threadcreate"))},
+			{"/ops/debug/pprof/block", api.OpsHandlerWrapper(pprof.Handler("block"))},
+			{"/ops/debug/pprof/mutex", api.OpsHandlerWrapper(pprof.Handler("mutex"))},
+		}
+		for _, p := range profiles {
+			errs = append(errs, api.register(router, RouteDoc{Method: http.MethodGet, Path: p.path, Tag: "Profiler"}, m.ops(p.handle)))
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RouteDoc describes an endpoint registered on the router. All routes
+// are recorded into the api handler registry during the setup so the
+// OpenAPI document reflects exactly what the server exposes.
+type RouteDoc struct {
+	Method   string
+	Path     string
+	Tag      string
+	Summary  string
+	Query    []string    // names of the supported query parameters.
+	Body     interface{} // sample value of the request body type. nil if none.
+	Data     interface{} // sample value of the `data` field when the response is an APIResponse.
+	Response interface{} // sample value of the response when it is not an APIResponse.
+}
+
+// RouteError is returned when a route cannot be injected into the router because
+// the same method and path is already registered or conflicts with a registered path.
+type RouteError struct {
+	Method string
+	Path   string
+	Reason string
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("failed to register route %s %s: %s", e.Method, e.Path, e.Reason)
+}
+
+// handle injects the handle for the route method and path into the router. The
+// panic of httprouter on a duplicate or conflicting route is turned into a RouteError
+// so the misconfiguration is reported instead of crashing the setup.
+func handle(router *httprouter.Router, method, path string, h httprouter.Handle) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &RouteError{Method: method, Path: path, Reason: fmt.Sprint(r)}
+		}
+	}()
+	router.Handle(method, path, h)
+	return nil
+}
+
+// register injects the handle for the route method and path into the router
+// and records the route details into the registry for documentation. A route
+// which cannot be injected is not recorded.
+func (api *APIHandler) register(router *httprouter.Router, doc RouteDoc, h httprouter.Handle) error {
+	if err := handle(router, doc.Method, doc.Path, h); err != nil {
+		return err
+	}
+	api.routes = append(api.routes, doc)
+	return nil
+}
+
+// document records a route into the registry without injecting it into the router.
+// It is used for routes served by another registered handle (see `dispatch`).
+func (api *APIHandler) document(doc RouteDoc) {
+	api.routes = append(api.routes, doc)
+}
+
+// dispatch provides a handle which serves the static segments found at the position
+// of the named parameter with their dedicated handles and all others values with the
+// fallback handle. It allows paths like `/v1/books/popular` next to `/v1/books/:id`
+// which httprouter cannot register as distinct routes.
+func dispatch(param string, handles map[string]httprouter.Handle, fallback httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if handle, found := handles[ps.ByName(param)]; found {
+			handle(w, r, ps)
+			return
+		}
+		fallback(w, r, ps)
+	}
+}
+
+// Routes returns the list of all registered routes.
+func (api *APIHandler) Routes() []RouteDoc {
+	return api.routes
+}
+
+// Route returns the registered or documented route serving the method and the path. The
+// static segments prevail over the named parameters, like for `/v1/books/count` which is
+// served through `/v1/books/:id`.
+func (api *APIHandler) Route(method, path string) (RouteDoc, bool) {
+	var route RouteDoc
+	found, best := false, -1
+	segments := strings.Split(path, "/")
+	for _, doc := range api.routes {
+		if doc.Method != method {
+			continue
+		}
+		if static, ok := matchRoute(strings.Split(doc.Path, "/"), segments); ok && static > best {
+			route, found, best = doc, true, static
+		}
+	}
+	return route, found
+}
+
+// matchRoute reports whether the path segments match the route ones along with the
+// number of static segments matched.
+func matchRoute(route, path []string) (int, bool) {
+	static := 0
+	for i, segment := range route {
+		if strings.HasPrefix(segment, "*") {
+			return static, i < len(path)
+		}
+		if i >= len(path) {
+			return 0, false
+		}
+		if strings.HasPrefix(segment, ":") {
+			if path[i] == "" {
+				return 0, false
+			}
+			continue
+		}
+		if segment != path[i] {
+			return 0, false
+		}
+		static++
+	}
+	return static, len(route) == len(path)
+}
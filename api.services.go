@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -24,11 +29,27 @@ import (
 // @externalDocs.url          https://swagger.io/resources/open-api/
 type BookServiceProvider interface {
 	Add(ctx context.Context, id string, book Book) error
+	AddMany(ctx context.Context, books []Book) ([]Book, []error)
 	GetOne(ctx context.Context, id string) (Book, error)
 	Delete(ctx context.Context, id string) error
+	DeleteIf(ctx context.Context, id string, check func(current Book) error) (Book, error)
 	Update(ctx context.Context, id string, book Book) (Book, error)
-	GetAll(ctx context.Context) ([]Book, error)
-	DeleteAll(ctx context.Context, requestid string)
+	Modify(ctx context.Context, id string, change func(current Book) (Book, error)) (Book, error)
+	GetAll(ctx context.Context, limit int64, cursor string, sorting BookSort) ([]Book, string, error)
+	GetAllFiltered(ctx context.Context, limit int64, cursor string, sorting BookSort, filter func([]Book) []Book) ([]Book, string, error)
+	GetAllSorted(ctx context.Context, sorting BookSort, limit int64, filter func([]Book) []Book) ([]Book, error)
+	Count(ctx context.Context) (int, error)
+	Search(ctx context.Context, query string, fields []string) ([]BookMatch, error)
+	DeleteAll(ctx context.Context, requestid string) error
+	Clear(ctx context.Context, requestid string) error
+	Import(ctx context.Context, book Book) (bool, error)
+	AddView(ctx context.Context, id string)
+	GetViews(ctx context.Context, id string) (int64, error)
+	Popular(ctx context.Context, limit int64) ([]BookViews, error)
+	GetTrash(ctx context.Context) ([]Book, error)
+	Restore(ctx context.Context, id string) (Book, error)
+	Rename(ctx context.Context, id, newID string) (Book, error)
+	History(ctx context.Context, id string) ([]Book, error)
 }
 
 type BookService struct {
@@ -38,10 +59,53 @@ type BookService struct {
 	pstorage BookStorage // primary storage
 	bstorage BookStorage // backup storage
 	queue    Queuer
+	views    BookViewsCounter    // nil if views counting is disabled or not supported.
+	cache    *BookCache          // nil if the in-process cache is disabled.
+	fills    chan struct{}       // bounds the concurrent re-caching of books into pstorage.
+	absents  BookTombstoner      // nil if the negative caching is disabled or not supported.
+	outbox   BookOutboxWriter    // nil if the transactional outbox is disabled or not supported.
+	trash    BookTrasher         // nil if the soft-delete is disabled or not supported.
+	renamer  BookRenamer         // nil if the renaming is not supported.
+	breaker  *StorageBreaker     // nil if the primary storage circuit breaker is disabled.
+	deletes  BookDeleteScheduler // nil if the delayed deletes are disabled or not supported.
+	sync     bool                // whether Add and Update write into backup storage within the request.
+	history  BookHistorian       // nil if the books history is disabled or not supported.
+	shadow   *ShadowReader       // nil if the backup storage shadow reads are disabled.
+	locks    *KeyedMutex
 }
 
+// Write modes of the books creations and updates. With `async` the backup storage is fed
+// only through the queues. With `sync` it is written within the request as well and the
+// queues feed the other backup storages.
+const (
+	WriteModeAsync = "async"
+	WriteModeSync  = "sync"
+)
+
+// ShadowReaderProvider is implemented by the book services which verify
+// their backup storage with shadow reads.
+type ShadowReaderProvider interface {
+	ShadowReader() *ShadowReader
+}
+
+// BookCacheProvider is implemented by the book services which cache
+// the books in process.
+type BookCacheProvider interface {
+	BookCache() *BookCache
+}
+
+// PrimaryBreakerProvider is implemented by the book services which guard
+// their primary storage reads with a circuit breaker.
+type PrimaryBreakerProvider interface {
+	PrimaryBreaker() *StorageBreaker
+}
+
+// DefaultCacheFillConcurrency is the default maximum number of concurrent
+// writes into primary storage of books found only into backup storage.
+const DefaultCacheFillConcurrency = 4
+
 func NewBookService(logger *zap.Logger, config *Config, clock Clocker, pstorage BookStorage, bstorage BookStorage, queue Queuer) BookServiceProvider {
-	return &BookService{
+	bs := &BookService{
 		logger:   logger,
 		config:   config,
 		clock:    clock,
@@ -49,94 +113,957 @@ func NewBookService(logger *zap.Logger, config *Config, clock Clocker, pstorage
 		bstorage: bstorage,
 		queue:    queue,
 	}
+	fillConcurrency := DefaultCacheFillConcurrency
+	if config != nil && config.Cache.FillConcurrency > 0 {
+		fillConcurrency = config.Cache.FillConcurrency
+	}
+	bs.fills = make(chan struct{}, fillConcurrency)
+	if views, ok := pstorage.(BookViewsCounter); ok && config != nil && config.Views.Enable {
+		bs.views = views
+	}
+	if absents, ok := pstorage.(BookTombstoner); ok && config != nil && config.Cache.NegativeTTL > 0 {
+		bs.absents = absents
+	}
+	if trash, ok := pstorage.(BookTrasher); ok && config != nil && config.Trash.Enable {
+		bs.trash = trash
+	}
+	if renamer, ok := pstorage.(BookRenamer); ok {
+		bs.renamer = renamer
+	}
+	if outbox, ok := pstorage.(BookOutboxWriter); ok && config != nil && config.Outbox.Enable {
+		bs.outbox = outbox
+	}
+	if deletes, ok := pstorage.(BookDeleteScheduler); ok && config != nil && config.Deletes.Enable {
+		bs.deletes = deletes
+	}
+	if history, ok := pstorage.(BookHistorian); ok && config != nil && config.History.Enable {
+		bs.history = history
+	}
+	bs.sync = config != nil && config.Backup.WriteMode == WriteModeSync
+	shards := 0
+	if config != nil {
+		shards = config.Locks.Shards
+	}
+	bs.locks = NewKeyedMutex(shards)
+	if config != nil && config.Cache.Enable && config.Cache.Size > 0 && config.Cache.TTL > 0 {
+		bs.cache = NewBookCache(clock, config.Cache.Size, config.Cache.TTL)
+	}
+	if config != nil && config.Redis.Breaker.Enable {
+		bs.breaker = NewStorageBreaker(logger, clock, "redis", config.Redis.Breaker.Threshold, config.Redis.Breaker.Cooldown)
+	}
+	if config != nil && config.Backup.Shadow.Enable {
+		bs.shadow = NewShadowReader(logger, clock, bstorage, config.Backup.Shadow.SampleRate, config.Backup.Shadow.Timeout, config.Backup.Shadow.Lag)
+	}
+	return bs
+}
+
+// PrimaryBreaker returns the primary storage circuit breaker. It is nil if disabled.
+func (bs *BookService) PrimaryBreaker() *StorageBreaker {
+	return bs.breaker
+}
+
+// ShadowReader returns the backup storage shadow reader. It is nil if disabled.
+func (bs *BookService) ShadowReader() *ShadowReader {
+	return bs.shadow
 }
 
+// lockBooks serializes the read-modify-write operations of the books within the instance.
+// It returns the function releasing the books.
+func (bs *BookService) lockBooks(ids ...string) (unlock func()) {
+	return bs.locks.Lock(ids...)
+}
+
+// BookCache returns the in-process books cache. It is nil if disabled.
+func (bs *BookService) BookCache() *BookCache {
+	return bs.cache
+}
+
+// guardPrimary runs the call to primary storage through the circuit breaker if enabled.
+// It fails fast with ErrCircuitOpen while the circuit is open.
+func (bs *BookService) guardPrimary(call func() error) error {
+	if bs.breaker == nil {
+		return call()
+	}
+	if !bs.breaker.Allow() {
+		return ErrCircuitOpen
+	}
+	err := call()
+	bs.breaker.Record(err)
+	return err
+}
+
+// Add inserts the book into primary storage and pushes it to the creation queue.
+// With the transactional outbox, the push is left to the outbox relay. With the
+// sync write mode, the book is inserted into backup storage before the push and
+// removed from primary storage if that failed.
 func (bs *BookService) Add(ctx context.Context, id string, book Book) error {
+	ctx, span := StartSpan(ctx, "bookService.Add", attribute.String("book.id", id))
+	defer span.End()
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	if bs.outbox != nil {
+		defer stop()
+		return bs.outbox.SetWithOutbox(ctx, CreateQueue, id, book)
+	}
 	err := bs.pstorage.Add(ctx, id, book)
+	stop()
 	if err != nil {
 		return err
 	}
+	if bs.sync {
+		err = bs.writeBackup(ctx, id, func() error {
+			return bs.bstorage.Add(ctx, id, book)
+		}, func(ctx context.Context) error {
+			return bs.pstorage.Delete(ctx, id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
 	if perr := bs.queue.Push(ctx, CreateQueue, book); perr != nil {
 		bs.logger.Error("service: failed to push book to queue", zap.String("qid", CreateQueue), zap.Error(perr))
 	}
+	stop()
 	return err
 }
 
+// Import upserts an imported book and reports whether it was created. Like with Add
+// and Update, the book is pushed to the creation or the update queue.
+func (bs *BookService) Import(ctx context.Context, book Book) (bool, error) {
+	ctx, span := StartSpan(ctx, "bookService.Import", attribute.String("book.id", book.ID))
+	defer span.End()
+	defer bs.lockBooks(book.ID)()
+	_, found, err := bs.storedBook(ctx, book.ID)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		_, err = bs.update(ctx, book.ID, book)
+		return false, err
+	}
+	return true, bs.Add(ctx, book.ID, book)
+}
+
+// AddMany validates and inserts the books into primary storage in a single batch
+// when supported. Each inserted book is pushed to the creation queue. The errors
+// are aligned with the books and a nil entry means the book was created.
+func (bs *BookService) AddMany(ctx context.Context, books []Book) ([]Book, []error) {
+	ctx, span := StartSpan(ctx, "bookService.AddMany")
+	defer span.End()
+	errs := make([]error, len(books))
+	valid := make([]Book, 0, len(books))
+	positions := make([]int, 0, len(books))
+	stop := TrackTiming(ctx, bs.clock, TimingValidation)
+	for i := range books {
+		if errs[i] = ValidateCreateBookRequestBody(&books[i]); errs[i] == nil {
+			valid = append(valid, books[i])
+			positions = append(positions, i)
+		}
+	}
+	stop()
+
+	stop = TrackTiming(ctx, bs.clock, TimingStorage)
+	var addErrs []error
+	if adder, ok := bs.pstorage.(BookBulkAdder); ok {
+		addErrs = adder.AddMany(ctx, valid)
+	} else {
+		addErrs = make([]error, len(valid))
+		for i, book := range valid {
+			addErrs[i] = bs.pstorage.Add(ctx, book.ID, book)
+		}
+	}
+	stop()
+
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
+	defer stop()
+	for i, book := range valid {
+		if errs[positions[i]] = addErrs[i]; addErrs[i] != nil {
+			continue
+		}
+		if perr := bs.queue.Push(ctx, CreateQueue, book); perr != nil {
+			bs.logger.Error("service: failed to push book to queue", zap.String("qid", CreateQueue), zap.Error(perr))
+		}
+	}
+	return books, errs
+}
+
+// GetOne fetches a book from the in-process cache if enabled, then from
+// the primary storage and finally from the backup storage. A book served
+// from the backup storage because the primary storage failed is marked as
+// served in degraded mode. The times of the books stored with the legacy
+// format are served as RFC3339. With negative caching, a book found nowhere
+// is tombstoned into the primary storage so next lookups fail fast without
+// reaching the backup storage. While the primary storage circuit is open,
+// the book is fetched straight from the backup storage. A book pending its
+// delayed delete is not found.
 func (bs *BookService) GetOne(ctx context.Context, id string) (Book, error) {
-	book, err := bs.pstorage.GetOne(ctx, id)
+	ctx, span := StartSpan(ctx, "bookService.GetOne", attribute.String("book.id", id))
+	defer span.End()
+	defer TrackTiming(ctx, bs.clock, TimingStorage)()
+	if bs.cache != nil && FeatureEnabled(ctx, FeatureCache, true) {
+		if book, found := bs.cache.Get(id); found {
+			return book, nil
+		}
+	}
+
+	var book Book
+	err := bs.guardPrimary(func() (err error) {
+		book, err = bs.pstorage.GetOne(ctx, id)
+		return err
+	})
 	if err == nil {
+		if bs.deletes != nil && bs.config.Deletes.DelayPrimary && bs.deletePending(ctx, id) {
+			return Book{}, ErrBookNotFound
+		}
+		book, _ = book.WithRFC3339Times()
+		if bs.shadow != nil {
+			bs.shadow.Verify(ctx, id, book)
+		}
+		bs.cacheBook(id, book)
 		return book, err
 	}
+	degraded := err != ErrBookNotFound
+	// the tombstones and the trash live into the primary storage.
+	open := err == ErrCircuitOpen
+
+	if bs.absents != nil && !open {
+		if absent, terr := bs.absents.HasTombstone(ctx, id); terr != nil {
+			bs.logger.Error("service: failed to check book tombstone", zap.String("id", id), zap.Error(terr))
+		} else if absent {
+			return Book{}, ErrBookNotFound
+		}
+	}
+
+	if bs.trash != nil && !open {
+		// the backup storage may still hold a book being trashed.
+		if trashed, terr := bs.trash.InTrash(ctx, id); terr != nil {
+			bs.logger.Error("service: failed to check book trash", zap.String("id", id), zap.Error(terr))
+		} else if trashed {
+			return Book{}, ErrBookNotFound
+		}
+	}
+
+	// the backup storage still holds the book until its delayed delete runs.
+	if !open && bs.deletePending(ctx, id) {
+		return Book{}, ErrBookNotFound
+	}
 
 	book, err = bs.bstorage.GetOne(ctx, id)
+	if err == ErrBookNotFound && bs.absents != nil && !open {
+		if terr := bs.absents.SetTombstone(ctx, id, bs.config.Cache.NegativeTTL); terr != nil {
+			bs.logger.Error("service: failed to set book tombstone", zap.String("id", id), zap.Error(terr))
+		}
+	}
 	if err != nil {
 		return book, err
 	}
+	if degraded {
+		MarkDegraded(ctx, DegradedSourceBackup)
+	}
+	book, _ = book.WithRFC3339Times()
 
-	if perr := bs.pstorage.Add(ctx, id, book); perr != nil {
-		bs.logger.Error("service: failed to cache book into pstorage", zap.String("id", id), zap.Error(perr))
+	if !open {
+		bs.fillPrimary(ctx, id, book)
 	}
+	bs.cacheBook(id, book)
 	return book, err
 }
 
+// fillPrimary re-caches into primary storage a book found into backup storage. The
+// write is best-effort and runs in background so the book is returned immediately.
+// The number of concurrent writes is bounded and extra fills are skipped, so a burst
+// of misses does not flood the primary storage and contend with foreground writes.
+func (bs *BookService) fillPrimary(ctx context.Context, id string, book Book) {
+	select {
+	case bs.fills <- struct{}{}:
+	default:
+		bs.logger.Debug("service: skipped caching book into pstorage", zap.String("id", id))
+		return
+	}
+	go func() {
+		defer func() { <-bs.fills }()
+		fCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if perr := bs.pstorage.Add(fCtx, id, book); perr != nil {
+			bs.logger.Error("service: failed to cache book into pstorage", zap.String("id", id), zap.Error(perr))
+		}
+	}()
+}
+
+// deletePending reports whether the book has a scheduled delete if the delayed
+// deletes are enabled. A failed check is logged and the book is not considered
+// as deleted.
+func (bs *BookService) deletePending(ctx context.Context, id string) bool {
+	if bs.deletes == nil {
+		return false
+	}
+	pending, err := bs.deletes.DeletePending(ctx, id)
+	if err != nil {
+		bs.logger.Error("service: failed to check book pending delete", zap.String("id", id), zap.Error(err))
+	}
+	return pending
+}
+
+// cacheBook stores the book into the in-process cache if enabled.
+func (bs *BookService) cacheBook(id string, book Book) {
+	if bs.cache != nil {
+		bs.cache.Put(id, book)
+	}
+}
+
+// uncacheBook invalidates the book into the in-process cache if enabled.
+func (bs *BookService) uncacheBook(id string) {
+	if bs.cache != nil {
+		bs.cache.Remove(id)
+	}
+}
+
+// Delete removes the book from primary storage and pushes it to the deletion queue.
+// With the soft-delete, the book is moved to the trash and pushed to the trashing
+// queue instead. With the delayed deletes, the delete of a found book is scheduled
+// after the grace period and the book is removed from primary storage at once unless
+// delayed as well. Otherwise with the transactional outbox, the push is left to the
+// outbox relay.
 func (bs *BookService) Delete(ctx context.Context, id string) error {
+	ctx, span := StartSpan(ctx, "bookService.Delete", attribute.String("book.id", id))
+	defer span.End()
+	defer bs.lockBooks(id)()
+	return bs.delete(ctx, id)
+}
+
+// DeleteIf deletes the book `id` like Delete once its current version passed the check.
+// The read, the check and the delete run under the book lock so a version updated after
+// the check is never deleted. The current version is returned along with the check error
+// if it failed, in which case the book is not deleted.
+func (bs *BookService) DeleteIf(ctx context.Context, id string, check func(current Book) error) (Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.DeleteIf", attribute.String("book.id", id))
+	defer span.End()
+	defer bs.lockBooks(id)()
+	current, err := bs.GetOne(ctx, id)
+	if err != nil {
+		return current, err
+	}
+	if err = check(current); err != nil {
+		return current, err
+	}
+	return current, bs.delete(ctx, id)
+}
+
+// delete removes the book once locked by the caller.
+func (bs *BookService) delete(ctx context.Context, id string) error {
+	// invalidate again after the write in case a concurrent
+	// read cached the book before the write completed.
+	bs.uncacheBook(id)
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	if bs.trash != nil {
+		book, err := bs.trash.Trash(ctx, id, bs.clock.Now())
+		stop()
+		bs.uncacheBook(id)
+		if err != nil {
+			return err
+		}
+		stop = TrackTiming(ctx, bs.clock, TimingQueue)
+		if perr := bs.queue.Push(ctx, TrashQueue, book); perr != nil {
+			bs.logger.Error("service: failed to push to queue", zap.String("qid", TrashQueue), zap.Error(perr))
+		}
+		stop()
+		return nil
+	}
+	if bs.deletes != nil {
+		if err := bs.checkDeletable(ctx, id); err != nil {
+			stop()
+			return err
+		}
+		at := bs.clock.Now().Add(bs.config.Deletes.Grace)
+		err := bs.deletes.ScheduleDelete(ctx, id, at, !bs.config.Deletes.DelayPrimary)
+		stop()
+		bs.uncacheBook(id)
+		return err
+	}
+	if bs.outbox != nil {
+		err := bs.outbox.DeleteWithOutbox(ctx, id)
+		stop()
+		bs.uncacheBook(id)
+		return err
+	}
 	err := bs.pstorage.Delete(ctx, id)
+	stop()
+	bs.uncacheBook(id)
 	if err != nil {
 		return err
 	}
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
 	if perr := bs.queue.Push(ctx, DeleteQueue, Book{ID: id}); perr != nil {
 		bs.logger.Error("service: failed to push to queue", zap.String("qid", DeleteQueue), zap.Error(perr))
 	}
+	stop()
+	return err
+}
+
+// checkDeletable fails with ErrBookNotFound, like the immediate delete, if the book is
+// found neither into primary storage nor into backup storage or if its delete is already
+// pending. Unlike GetOne, the book found into backup storage is not cached again so it
+// cannot be written back into primary storage once its delete purged it.
+func (bs *BookService) checkDeletable(ctx context.Context, id string) error {
+	if bs.deletePending(ctx, id) {
+		return ErrBookNotFound
+	}
+	_, err := bs.pstorage.GetOne(ctx, id)
+	if err == ErrBookNotFound {
+		_, err = bs.bstorage.GetOne(ctx, id)
+	}
 	return err
 }
 
+// Update replaces the book into primary storage and pushes it to the update queue. The
+// creation time is immutable so the stored one is kept whatever the client sent. With
+// the sync write mode, the book is replaced into backup storage before the push and the
+// previous primary storage book is put back if that failed. With the history, the replaced
+// book is appended to it once updated. With the locks, the concurrent updates of the book
+// are serialized so each one replaces and records the version written by the previous one.
 func (bs *BookService) Update(ctx context.Context, id string, book Book) (Book, error) {
-	book.UpdatedAt = bs.clock.Now().String()
+	ctx, span := StartSpan(ctx, "bookService.Update", attribute.String("book.id", id))
+	defer span.End()
+	defer bs.lockBooks(id)()
+	return bs.update(ctx, id, book)
+}
+
+// Modify replaces the book `id` with the result of the change applied to its current
+// version. The read, the change and the write run under the book lock so a concurrent
+// modification of the book is never lost nor slips between a precondition check and the
+// write. If the change fails, the book is not updated and the current version is returned
+// along with that error.
+func (bs *BookService) Modify(ctx context.Context, id string, change func(current Book) (Book, error)) (Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.Modify", attribute.String("book.id", id))
+	defer span.End()
+	defer bs.lockBooks(id)()
+	current, err := bs.GetOne(ctx, id)
+	if err != nil {
+		return current, err
+	}
+	book, err := change(current)
+	if err != nil {
+		return current, err
+	}
+	return bs.update(ctx, id, book)
+}
+
+// update replaces the book once locked by the caller.
+func (bs *BookService) update(ctx context.Context, id string, book Book) (Book, error) {
+	book.UpdatedAt = FormatBookTime(bs.clock.Now())
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	stored, found, err := bs.storedBook(ctx, id)
+	if err != nil {
+		stop()
+		return book, err
+	}
+	if found {
+		book.CreatedAt = stored.CreatedAt
+	}
+	book, _ = book.WithRFC3339Times()
+	bs.uncacheBook(id)
+	if bs.outbox != nil {
+		err := bs.outbox.SetWithOutbox(ctx, UpdateQueue, id, book)
+		stop()
+		bs.uncacheBook(id)
+		if err == nil && found {
+			bs.recordHistory(ctx, id, stored)
+		}
+		return book, err
+	}
+	var rollback func(ctx context.Context) error
+	if bs.sync {
+		if rollback, err = bs.primaryRollback(ctx, id); err != nil {
+			stop()
+			return book, err
+		}
+	}
 	b, err := bs.pstorage.Update(ctx, id, book)
+	stop()
+	bs.uncacheBook(id)
 	if err != nil {
 		return b, err
 	}
+	if bs.sync {
+		err = bs.writeBackup(ctx, id, func() (err error) {
+			_, err = bs.bstorage.Update(ctx, id, book)
+			return err
+		}, rollback)
+		bs.uncacheBook(id)
+		if err != nil {
+			return b, err
+		}
+	}
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
 	if perr := bs.queue.Push(ctx, UpdateQueue, book); perr != nil {
 		bs.logger.Error("service: failed to push to queue", zap.String("qid", UpdateQueue), zap.Error(perr))
 	}
+	stop()
+	if found {
+		bs.recordHistory(ctx, id, stored)
+	}
 	return b, err
 }
 
-// GetAll fetches all books from backup storage. In case there is nothing
-// or an error occurred, it fallback to primary storage results.
-func (bs *BookService) GetAll(ctx context.Context) ([]Book, error) {
-	bbooks, berr := bs.bstorage.GetAll(ctx)
-	if berr != nil || len(bbooks) == 0 {
-		return bs.pstorage.GetAll(ctx)
+// recordHistory appends the replaced version of the book to its history if enabled.
+// The history is best-effort so a failure is only logged.
+func (bs *BookService) recordHistory(ctx context.Context, id string, previous Book) {
+	if bs.history == nil {
+		return
+	}
+	if err := bs.history.AppendHistory(ctx, id, previous, bs.config.History.Size); err != nil {
+		bs.logger.Error("service: failed to append book history", zap.String("id", id), zap.Error(err))
 	}
-	return bbooks, berr
+}
+
+// History fetches the prior versions of the book from the oldest. A book without prior
+// versions has an empty history as long as it exists, otherwise it is not found.
+func (bs *BookService) History(ctx context.Context, id string) ([]Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.History", attribute.String("book.id", id))
+	defer span.End()
+	if bs.history == nil {
+		return nil, ErrHistoryNotSupported
+	}
+	books, err := bs.history.GetHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		if _, err = bs.GetOne(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return books, nil
+}
+
+// primaryRollback returns how to undo the update of the book into primary storage: put
+// back the stored book or remove the book if it did not exist.
+func (bs *BookService) primaryRollback(ctx context.Context, id string) (func(ctx context.Context) error, error) {
+	previous, err := bs.pstorage.GetOne(ctx, id)
+	if err == ErrBookNotFound {
+		return func(ctx context.Context) error {
+			return bs.pstorage.Delete(ctx, id)
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		_, err := bs.pstorage.Update(ctx, id, previous)
+		return err
+	}, nil
+}
+
+// writeBackup runs the write of the book into backup storage of the sync write mode. On
+// failure, the primary storage write is rolled back, even if the request was cancelled,
+// so both storages stay consistent. The error wraps ErrBackupWrite, and ErrBackupRollback
+// along with the rollback error if the rollback failed and left the storages inconsistent.
+func (bs *BookService) writeBackup(ctx context.Context, id string, write func() error, rollback func(ctx context.Context) error) error {
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	defer stop()
+	err := write()
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%w: %v", ErrBackupWrite, err)
+	if rerr := rollback(context.WithoutCancel(ctx)); rerr != nil {
+		bs.logger.Error("service: failed to roll back primary write", zap.String("id", id), zap.Error(rerr))
+		return errors.Join(err, fmt.Errorf("%w: %w", ErrBackupRollback, rerr))
+	}
+	return err
+}
+
+// storedBook returns the stored book which the update replaces. A cached book is as good
+// as the primary storage one, which is itself looked up before the backup storage. It is
+// not found when the book does not exist yet so the update inserts it with the provided
+// creation time.
+func (bs *BookService) storedBook(ctx context.Context, id string) (Book, bool, error) {
+	if bs.cache != nil {
+		if book, found := bs.cache.Get(id); found {
+			return book, true, nil
+		}
+	}
+	book, err := bs.pstorage.GetOne(ctx, id)
+	if err == ErrBookNotFound && bs.bstorage != nil {
+		book, err = bs.bstorage.GetOne(ctx, id)
+	}
+	if err == ErrBookNotFound {
+		return Book{}, false, nil
+	}
+	return book, err == nil, err
+}
+
+// Storages preferences of the books listings. With `backup` the pages are fetched from the
+// backup storage first. With `primary` they are fetched from the primary storage first.
+const (
+	ListsPreferBackup  = "backup"
+	ListsPreferPrimary = "primary"
+)
+
+// GetAll fetches a page of books along with the cursor of the next page. The first page is
+// fetched from the preferred storage then, if that failed, from the other one. The primary
+// storage is skipped while its circuit is open, and an empty primary collection falls back
+// to the backup storage as well since the cache may have been flushed. An empty backup
+// collection is a valid result and is returned as is. Next pages are fetched from the
+// storage which issued their cursor. Since none of the storages orders the books, those of
+// a page are ordered per the sort, the same way whatever the storage which served them.
+func (bs *BookService) GetAll(ctx context.Context, limit int64, cursor string, sorting BookSort) ([]Book, string, error) {
+	ctx, span := StartSpan(ctx, "bookService.GetAll")
+	defer span.End()
+	defer TrackTiming(ctx, bs.clock, TimingStorage)()
+	primary := func() (books []Book, next string, err error) {
+		err = bs.guardPrimary(func() (err error) {
+			books, next, err = bs.pstorage.GetAll(ctx, limit, cursor)
+			return err
+		})
+		return books, next, err
+	}
+	backup := func() ([]Book, string, error) {
+		return bs.bstorage.GetAll(ctx, limit, cursor)
+	}
+	first, second, firstName := backup, primary, "bstorage"
+	preferPrimary := bs.config != nil && bs.config.Lists.Prefer == ListsPreferPrimary
+	if preferPrimary {
+		first, second, firstName = primary, backup, "pstorage"
+	}
+
+	books, next, err := first()
+	switch {
+	case cursor != "":
+		if err == ErrInvalidCursor {
+			books, next, err = second()
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	case err != nil:
+		bs.logger.Error("service: failed to get all books from "+firstName, zap.Error(err))
+		if books, next, err = second(); err != nil {
+			return nil, "", err
+		}
+	case preferPrimary && len(books) == 0:
+		if fallback, fallbackNext, ferr := second(); ferr != nil {
+			bs.logger.Error("service: failed to get all books from bstorage", zap.Error(ferr))
+		} else {
+			books, next = fallback, fallbackNext
+		}
+	}
+	if bs.deletes != nil {
+		books = bs.withoutPendingDeletes(ctx, books)
+	}
+	if books == nil {
+		books = []Book{}
+	}
+	SortBooks(books, sorting)
+	return books, next, nil
+}
+
+// GetAllFiltered fetches like GetAll a page of `limit` books among those selected by the
+// filter. The storage pages are fetched until the page is filled or the books exhausted.
+// Each storage page is requested with the number of books still missing so the cursor of
+// the last one is the position right after the returned books.
+func (bs *BookService) GetAllFiltered(ctx context.Context, limit int64, cursor string, sorting BookSort, filter func([]Book) []Book) ([]Book, string, error) {
+	ctx, span := StartSpan(ctx, "bookService.GetAllFiltered")
+	defer span.End()
+	books := []Book{}
+	for {
+		page, next, err := bs.GetAll(ctx, limit-int64(len(books)), cursor, sorting)
+		if err != nil {
+			return nil, "", err
+		}
+		books = append(books, filter(page)...)
+		cursor = next
+		if next == "" || int64(len(books)) >= limit {
+			break
+		}
+	}
+	SortBooks(books, sorting)
+	return books, cursor, nil
+}
+
+// GetAllSorted scans all the pages of books and returns the first `limit` ones of the whole
+// catalog per the sort. Unlike GetAll, which sorts each page on its own since the storages
+// do not order the books, the books of the whole catalog are ordered. Only a page and the
+// first limit books are held at once so a large catalog is not loaded. The filter, if any,
+// selects the books of each page which are candidates.
+func (bs *BookService) GetAllSorted(ctx context.Context, sorting BookSort, limit int64, filter func([]Book) []Book) ([]Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.GetAllSorted")
+	defer span.End()
+	top := NewTopBooks(sorting, int(limit))
+	cursor := ""
+	for {
+		page, next, err := bs.GetAll(ctx, MaxBooksPageLimit, cursor, sorting)
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			page = filter(page)
+		}
+		for _, book := range page {
+			top.Add(book)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return top.Books(), nil
+}
+
+// withoutPendingDeletes removes the books pending their delayed delete. A failed
+// lookup is logged and the books are returned as is.
+func (bs *BookService) withoutPendingDeletes(ctx context.Context, books []Book) []Book {
+	ids := make([]string, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+	ids, err := bs.deletes.PendingDeletes(ctx, ids...)
+	if err != nil {
+		bs.logger.Error("service: failed to get pending deletes", zap.Error(err))
+		return books
+	}
+	if len(ids) == 0 {
+		return books
+	}
+	return slices.DeleteFunc(books, func(book Book) bool {
+		return slices.Contains(ids, book.ID)
+	})
+}
+
+// Count returns the number of books from backup storage without fetching them.
+// In case an error occurred, it fallback to primary storage.
+func (bs *BookService) Count(ctx context.Context) (int, error) {
+	ctx, span := StartSpan(ctx, "bookService.Count")
+	defer span.End()
+	defer TrackTiming(ctx, bs.clock, TimingStorage)()
+	n, err := bs.bstorage.Count(ctx)
+	if err != nil {
+		bs.logger.Error("service: failed to count books from bstorage", zap.Error(err))
+		return bs.pstorage.Count(ctx)
+	}
+	return n, nil
+}
+
+// Search finds the books whose fields contain the query, ignoring the case, from
+// backup storage. In case an error occurred, it fallback to primary storage. Each
+// book is provided with the names of its matched fields.
+func (bs *BookService) Search(ctx context.Context, query string, fields []string) ([]BookMatch, error) {
+	ctx, span := StartSpan(ctx, "bookService.Search")
+	defer span.End()
+	query = strings.ToLower(strings.TrimSpace(query))
+	defer TrackTiming(ctx, bs.clock, TimingStorage)()
+	books, err := bs.bstorage.Search(ctx, query, fields)
+	if err != nil {
+		bs.logger.Error("service: failed to search books from bstorage", zap.Error(err))
+		if books, err = bs.pstorage.Search(ctx, query, fields); err != nil {
+			return nil, err
+		}
+	}
+	matches := make([]BookMatch, 0, len(books))
+	for _, book := range books {
+		matches = append(matches, BookMatch{Book: book, Matches: book.Match(query, fields)})
+	}
+	return matches, nil
+}
+
+// GetTrash fetches the trashed books from primary storage ordered by ID.
+func (bs *BookService) GetTrash(ctx context.Context) ([]Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.GetTrash")
+	defer span.End()
+	if bs.trash == nil {
+		return nil, ErrTrashNotSupported
+	}
+	defer TrackTiming(ctx, bs.clock, TimingStorage)()
+	books, err := bs.trash.GetTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	SortBooksByID(books)
+	return books, nil
+}
+
+// Restore moves back a trashed book into primary storage and pushes it
+// to the restoring queue so the backup storage restores it as well. With
+// the delayed deletes, it cancels the pending delete of the book instead.
+func (bs *BookService) Restore(ctx context.Context, id string) (Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.Restore", attribute.String("book.id", id))
+	defer span.End()
+	defer bs.lockBooks(id)()
+	if bs.deletes != nil {
+		return bs.cancelDelete(ctx, id)
+	}
+	if bs.trash == nil {
+		return Book{}, ErrTrashNotSupported
+	}
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	book, err := bs.trash.Restore(ctx, id)
+	stop()
+	if err != nil {
+		return book, err
+	}
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
+	if perr := bs.queue.Push(ctx, RestoreQueue, book); perr != nil {
+		bs.logger.Error("service: failed to push to queue", zap.String("qid", RestoreQueue), zap.Error(perr))
+	}
+	stop()
+	return book, nil
+}
+
+// cancelDelete cancels the pending delete of the book and returns it. It fails with
+// ErrBookNotFound if no delete is pending, including once the delete was carried out.
+// A book removed from primary storage at once is served from the backup storage.
+func (bs *BookService) cancelDelete(ctx context.Context, id string) (Book, error) {
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	cancelled, err := bs.deletes.CancelDelete(ctx, id)
+	stop()
+	if err != nil {
+		return Book{}, err
+	}
+	if !cancelled {
+		return Book{}, ErrBookNotFound
+	}
+	return bs.GetOne(ctx, id)
+}
+
+// Rename moves the book `id` to the ID `newID` into primary storage then pushes the
+// renamed book to the creation queue and the old ID to the deletion queue so the backup
+// storage follows. It fails with ErrBookExists if `newID` is already used by a book.
+func (bs *BookService) Rename(ctx context.Context, id, newID string) (Book, error) {
+	ctx, span := StartSpan(ctx, "bookService.Rename", attribute.String("book.id", id))
+	defer span.End()
+	if bs.renamer == nil {
+		return Book{}, ErrRenameNotSupported
+	}
+	defer bs.lockBooks(id, newID)()
+	book, err := bs.GetOne(ctx, id)
+	if err != nil {
+		return book, err
+	}
+
+	stop := TrackTiming(ctx, bs.clock, TimingStorage)
+	// the primary storage only checks the books it holds so the backup is checked first.
+	_, err = bs.bstorage.GetOne(ctx, newID)
+	if err == nil {
+		err = ErrBookExists
+	} else if err == ErrBookNotFound {
+		book.ID = newID
+		book.UpdatedAt = FormatBookTime(bs.clock.Now())
+		err = bs.renamer.Rename(ctx, id, book)
+	}
+	stop()
+	bs.uncacheBook(id)
+	bs.uncacheBook(newID)
+	if err != nil {
+		return Book{}, err
+	}
+
+	stop = TrackTiming(ctx, bs.clock, TimingQueue)
+	if perr := bs.queue.Push(ctx, CreateQueue, book); perr != nil {
+		bs.logger.Error("service: failed to push to queue", zap.String("qid", CreateQueue), zap.Error(perr))
+	}
+	if perr := bs.queue.Push(ctx, DeleteQueue, Book{ID: id}); perr != nil {
+		bs.logger.Error("service: failed to push to queue", zap.String("qid", DeleteQueue), zap.Error(perr))
+	}
+	stop()
+	return book, nil
 }
 
 // DeleteAll removes all books from primary storage (cache). This cleanup operation
 // is decoupled from the request context and uses a timeout of 10 mins.
-func (bs *BookService) DeleteAll(_ context.Context, rid string) {
+func (bs *BookService) DeleteAll(_ context.Context, rid string) error {
+	return bs.runClearing(rid, "books cache", func(ctx context.Context) error {
+		if bs.cache != nil {
+			bs.cache.Purge()
+		}
+		return bs.pstorage.DeleteAll(ctx)
+	})
+}
+
+// Clear removes all books from the catalog. The books pending into the backup queues
+// and the outbox are dropped first so they do not repopulate the storages, then all
+// books are removed from the cache, the backup storage and the primary storage. Like
+// DeleteAll, it is decoupled from the request context and uses a timeout of 10 mins.
+func (bs *BookService) Clear(_ context.Context, rid string) error {
+	return bs.runClearing(rid, "books catalog", func(ctx context.Context) error {
+		if purger, ok := bs.queue.(QueuePurger); ok {
+			if err := purger.Purge(ctx, append(append([]string{}, BackupQueues...), OutboxQueue)...); err != nil {
+				return fmt.Errorf("failed to purge queues: %v", err)
+			}
+		}
+		if bs.cache != nil {
+			bs.cache.Purge()
+		}
+		if err := bs.bstorage.DeleteAll(ctx); err != nil {
+			return fmt.Errorf("failed to clear backup storage: %v", err)
+		}
+		if err := bs.pstorage.DeleteAll(ctx); err != nil {
+			return fmt.Errorf("failed to clear primary storage: %v", err)
+		}
+		return nil
+	})
+}
+
+// runClearing runs the clearing of the target with a timeout of 10 mins and logs its
+// progress every 30 secs until it completed. It returns the clearing error if any.
+func (bs *BookService) runClearing(rid, target string, clear func(ctx context.Context) error) error {
 	opsCtx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 	start := bs.clock.Now()
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- bs.pstorage.DeleteAll(opsCtx)
+		errChan <- clear(opsCtx)
 	}()
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-opsCtx.Done():
-			bs.logger.Error("service: timeout clearing books cache", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid), zap.Error(opsCtx.Err()))
+			bs.logger.Error("service: timeout clearing "+target, zap.Duration("duration", time.Since(start)), zap.String("request.id", rid), zap.Error(opsCtx.Err()))
+			return opsCtx.Err()
 		case <-ticker.C:
-			bs.logger.Info("service: books cache clearing still running ", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid))
+			bs.logger.Info("service: "+target+" clearing still running", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid))
 		case err := <-errChan:
 			if err != nil {
-				bs.logger.Error("service: error clearing books cache", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid), zap.Error(err))
+				bs.logger.Error("service: error clearing "+target, zap.Duration("duration", time.Since(start)), zap.String("request.id", rid), zap.Error(err))
 			} else {
-				bs.logger.Info("service: books cache clearing completed", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid))
+				bs.logger.Info("service: "+target+" clearing completed", zap.Duration("duration", time.Since(start)), zap.String("request.id", rid))
 			}
-			return
+			return err
+		}
+	}
+}
+
+// AddView counts one view of the book. The increment runs in background
+// so it stays off the request critical path and its failure is only logged.
+func (bs *BookService) AddView(ctx context.Context, id string) {
+	if bs.views == nil {
+		return
+	}
+	go func() {
+		vCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := bs.views.IncrViews(vCtx, id); err != nil {
+			bs.logger.Error("service: failed to count book view", zap.String("id", id), zap.Error(err))
 		}
+	}()
+}
+
+// GetViews returns the number of views of a book.
+func (bs *BookService) GetViews(ctx context.Context, id string) (int64, error) {
+	ctx, span := StartSpan(ctx, "bookService.GetViews", attribute.String("book.id", id))
+	defer span.End()
+	if bs.views == nil {
+		return 0, ErrViewsNotSupported
+	}
+	return bs.views.GetViews(ctx, id)
+}
+
+// Popular returns at most `limit` books ordered by their number of views.
+func (bs *BookService) Popular(ctx context.Context, limit int64) ([]BookViews, error) {
+	ctx, span := StartSpan(ctx, "bookService.Popular")
+	defer span.End()
+	if bs.views == nil {
+		return nil, ErrViewsNotSupported
 	}
+	return bs.views.TopViewed(ctx, limit)
 }
@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/redis/go-redis/v9"
@@ -26,9 +30,42 @@ type App struct {
 	logger         *zap.Logger
 	config         *Config
 	server         *http.Server
+	stats          *Statistics
 	redisClient    *redis.Client
 	cleanups       []func() error
 	queueConsumers []func(context.Context) error
+	flushers       []Flusher // run in order once the server stopped, before closing redis.
+}
+
+// Flusher writes out the data buffered by a subsystem, like the batched queue pushes
+// or the traces spans, so it is not lost on shutdown.
+type Flusher struct {
+	Name  string
+	Flush func(context.Context) error
+}
+
+// TokenCommand prints an ops JWT signed with the configured auth secret to test locally the
+// authenticated ops endpoints. It runs with `app token -subject <name> -ttl <duration>`.
+func TokenCommand(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	subject := flags.String("subject", "ops", "subject of the token")
+	ttl := flags.Duration("ttl", time.Hour, "validity duration of the token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	config, err := LoadAndInitConfigs(GitCommit, GitTag, BuildTime)
+	if err != nil {
+		return fmt.Errorf("failed to setup app configuration: %s", err)
+	}
+	if config.Auth.Secret == "" {
+		return errors.New("make sure to set auth secret")
+	}
+	token, err := GenerateToken(config.Auth.Secret, *subject, time.Now(), *ttl)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, token)
+	return err
 }
 
 // NewApp provides an instance of App.
@@ -46,7 +83,29 @@ func NewApp() (AppProvider, error) {
 	}
 	clock := NewClock(config.IsProduction)
 	rswriter := NewRSyncWriter(config, clock)
-	logger, logsFlusher := SetupLogging(config, rswriter, NewTickClock(clock))
+	logLevel := zap.NewAtomicLevelAt(config.LogLevel)
+	logger, logsFlusher := SetupLogging(config, logLevel, rswriter, NewTickClock(clock))
+	SetVerboseBookLogs(config.Debug.VerboseBooks)
+	for _, warning := range config.Server.TimeoutWarnings() {
+		logger.Warn("config: " + warning)
+	}
+
+	var tlsConfig *tls.Config
+	if config.Server.TLSEnabled() {
+		if tlsConfig, err = NewServerTLSConfig(config.Server.CertsFile, config.Server.KeyFile); err != nil {
+			return app, err
+		}
+	}
+
+	var flushers []Flusher
+	var tracingFlusher *Flusher
+	if config.Tracing.Enable {
+		tracerProvider, err := NewTracerProvider(context.Background(), &config.Tracing, config.GitTag)
+		if err != nil {
+			return app, fmt.Errorf("failed to setup tracing: %s", err)
+		}
+		tracingFlusher = &Flusher{Name: "tracing", Flush: tracerProvider.Shutdown}
+	}
 
 	// Setup the connection to redis and boltDB servers.
 	redisClient, err := NewRedisClient(config)
@@ -61,48 +120,165 @@ func NewApp() (AppProvider, error) {
 	boltBookStorage := NewBoltBookStorage(logger, &config.BoltDB, boltDBClient)
 
 	// Setup the repository and api services and routing.
-	redisBookStorage := NewRedisBookStorage(logger, redisClient)
-	redisQueue := NewRedisQueue(redisClient)
-	boltDBConsumer := NewBoltDBConsumer(logger, redisQueue, boltBookStorage)
+	redisBookStorage := NewRedisBookStorage(logger, &config.Redis, clock, redisClient)
+	redisQueue := NewVersionedRedisQueue(redisClient, config.Backup.MessageVersion, config.Backup.GetConsumerName())
+	cleanups := []func() error{logsFlusher, rswriter.Close}
+	sinks := []BackupSink{{Name: config.BoltDB.FilePath, Repo: boltBookStorage}}
+	for i := range config.Backup.Sinks {
+		sinkConfig := &config.Backup.Sinks[i]
+		sinkClient, err := OpenBoltDB(sinkConfig)
+		if err != nil {
+			return app, fmt.Errorf("failed to open backup storage %s: %s", sinkConfig.FilePath, err)
+		}
+		cleanups = append(cleanups, sinkClient.Close)
+		sinks = append(sinks, BackupSink{Name: sinkConfig.FilePath, Repo: NewBoltBookStorage(logger, sinkConfig, sinkClient)})
+	}
+	if config.Migrations.RedisLayout {
+		previous := config.Redis
+		previous.Layout = RedisLayoutKeys
+		if config.Redis.Layout == RedisLayoutKeys {
+			previous.Layout = RedisLayoutHash
+		}
+		moved, err := MigrateRedisLayout(context.Background(), NewRedisBookStorage(logger, &previous, clock, redisClient), redisBookStorage)
+		if err != nil {
+			return app, fmt.Errorf("failed to migrate redis books from %s layout: %s", previous.Layout, err)
+		}
+		logger.Info("moved books into the redis layout", zap.String("from", previous.Layout), zap.Int("count", moved))
+	}
+	if config.Migrations.BookTimes {
+		for _, sink := range append([]BackupSink{{Name: "redis", Repo: redisBookStorage}}, sinks...) {
+			migrated, err := MigrateBookTimes(context.Background(), sink.Repo)
+			if err != nil {
+				return app, fmt.Errorf("failed to migrate %s books times: %s", sink.Name, err)
+			}
+			logger.Info("migrated books times to RFC3339", zap.String("storage", sink.Name), zap.Int("count", migrated))
+		}
+	}
+	heartbeat := NewHeartbeat(clock)
+	boltDBConsumer := NewBackupConsumer(logger, redisQueue, config.Backup, heartbeat, sinks...)
 
-	bookService := NewBookService(logger, config, clock, redisBookStorage, boltBookStorage, redisQueue)
+	var serviceQueue Queuer = redisQueue
+	if config.Backup.Batch.Enable {
+		batchQueue := NewBatchQueue(logger, redisClient, redisQueue, config.Backup.Batch.Interval, config.Backup.Batch.Size, config.Backup.Batch.GetMaxPending(), config.Backup.MessageVersion)
+		serviceQueue = batchQueue
+		flushers = append(flushers, Flusher{Name: "batch queue", Flush: batchQueue.Flush})
+	}
+	bookService := NewBookService(logger, config, clock, redisBookStorage, boltBookStorage, serviceQueue)
 	stats := NewStatistics(config.GitTag, config.GitCommit, runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH, IsAppRunningInDocker(), clock.Now())
+	if config.Ops.Stats.PersistStart {
+		started, err := PersistServiceStart(context.Background(), redisClient, stats.started)
+		if err != nil {
+			return app, fmt.Errorf("failed to persist service start time: %s", err)
+		}
+		stats.SetServiceStarted(started)
+	}
 	apiService := NewAPIHandler(logger, config, stats, clock, NewIDsHandler(), bookService)
+	apiService.SetLogLevel(logLevel)
+	if config.Ops.Audit.Enable {
+		auditLog, err := NewAuditLog(config.Ops.Audit.FilePath)
+		if err != nil {
+			return app, fmt.Errorf("failed to open ops audit log: %s", err)
+		}
+		apiService.SetAuditLog(auditLog)
+		cleanups = append(cleanups, auditLog.Close)
+	}
+	apiService.SetDeadLetters(NewDeadLetters(redisClient, BackupQueues...))
+	apiService.SetQueue(redisQueue)
+	apiService.SetHealthChecker(NewHealthChecker(clock, config.Ops.Health.GetTimeout(),
+		RedisCheck(redisClient),
+		BoltDBCheck(boltDBClient, config.BoltDB.BucketName),
+		QueuesCheck(redisQueue, config.Ops.Health.QueueThreshold, BackupQueues...),
+		HeartbeatCheck(heartbeat, config.Ops.Health.GetHeartbeatTimeout()),
+	))
+	if config.Debug.Capture.Enable {
+		apiService.SetCaptureStore(NewMemoryCaptureStore(config.Debug.Capture.MaxEntries))
+	}
+	if config.Server.RateLimit.Enable {
+		apiService.SetRateLimiter(NewRateLimiter(clock, config.Server.RateLimit.Rate, config.Server.RateLimit.Burst))
+	}
+	if b := config.Server.ErrorBreaker; b.Enable {
+		apiService.SetErrorBreaker(NewErrorBreaker(clock, b.Threshold, b.Window, b.Cooldown))
+	}
+	if config.Fingerprint.Enable {
+		apiService.SetFingerprintTracker(NewFingerprintTracker(clock, config.Fingerprint.Window, config.Fingerprint.Threshold, config.Fingerprint.SpikeFactor))
+	}
+	if config.Server.ErrorPages.Enable {
+		pages, err := NewErrorPages(config.Server.ErrorPages.Template)
+		if err != nil {
+			return app, fmt.Errorf("failed to load error pages template: %s", err)
+		}
+		apiService.SetErrorPages(pages)
+	}
+	if config.Quota.Enable {
+		apiService.SetQuotaLimiter(NewQuotaLimiter(&config.Quota, clock, NewRedisQuotaStore(redisClient)))
+	}
 
 	// Build the map of middlewares stacks.
 	middlewaresPublic, middlewaresOps := apiService.MiddlewaresStacks()
 
 	// Configure the endpoints with their handlers and middlewares.
-	router := apiService.SetupRoutes(httprouter.New(),
+	router, err := apiService.SetupRoutes(httprouter.New(),
 		&MiddlewareMap{
 			public: middlewaresPublic.Chain,
 			ops:    middlewaresOps.Chain,
 		},
 	)
+	if err != nil {
+		return app, fmt.Errorf("failed to setup routes: %s", err)
+	}
 
 	// Build the api server definition.
 	srv := &http.Server{
 		Addr:           fmt.Sprintf("%s:%s", config.Server.Host, config.Server.Port),
 		Handler:        router,
-		ReadTimeout:    config.Server.ReadTimeout,
-		WriteTimeout:   config.Server.WriteTimeout,
+		ReadTimeout:    config.Server.GetReadTimeout(),
+		WriteTimeout:   config.Server.GetWriteTimeout(),
 		MaxHeaderBytes: 1 << 20,           // Max headers size : 1MB
 		ConnContext:    SaveConnInContext, // add underlying connection into the request context
+		TLSConfig:      tlsConfig,         // nil to serve plaintext.
 	}
 
 	boltDBConsume := func(ctx context.Context) error {
-		return boltDBConsumer.Consume(ctx, CreateQueue, UpdateQueue, DeleteQueue)
+		return boltDBConsumer.Consume(ctx, BackupQueues...)
+	}
+	queueConsumers := []func(ctx context.Context) error{boltDBConsume}
+	if batchQueue, ok := serviceQueue.(*BatchQueue); ok {
+		queueConsumers = append(queueConsumers, batchQueue.Run)
+	}
+	if config.Outbox.Enable {
+		queueConsumers = append(queueConsumers, NewOutboxRelay(logger, redisClient, redisQueue, config.Outbox.Interval).Run)
+	}
+	if config.Trash.Enable {
+		stores := []BookTrasher{redisBookStorage.(BookTrasher)}
+		for _, sink := range sinks {
+			if trasher, ok := sink.Repo.(BookTrasher); ok {
+				stores = append(stores, trasher)
+			}
+		}
+		purger := NewTrashPurger(logger, clock, config.Trash.Retention, config.Trash.PurgeInterval, stores...)
+		queueConsumers = append(queueConsumers, purger.Run)
+	}
+	if config.Deletes.Enable {
+		var primary BookStorage
+		if config.Deletes.DelayPrimary {
+			primary = redisBookStorage
+		}
+		scheduler := NewDeleteScheduler(logger, clock, redisBookStorage.(BookDeleteScheduler), primary, redisQueue, config.Deletes.Interval)
+		queueConsumers = append(queueConsumers, scheduler.Run)
+	}
+	// the traces go last to export the spans of the other flushes.
+	if tracingFlusher != nil {
+		flushers = append(flushers, *tracingFlusher)
 	}
 	return &App{
-		logger:      logger,
-		config:      config,
-		server:      srv,
-		redisClient: redisClient,
-		cleanups: []func() error{
-			logsFlusher,
-			rswriter.Close,
-		},
-		queueConsumers: []func(ctx context.Context) error{boltDBConsume},
+		logger:         logger,
+		config:         config,
+		server:         srv,
+		stats:          stats,
+		redisClient:    redisClient,
+		cleanups:       cleanups,
+		queueConsumers: queueConsumers,
+		flushers:       flushers,
 	}, nil
 }
 
@@ -137,15 +313,33 @@ func (app *App) Clean() error {
 	return errs
 }
 
-// Serve starts the api web server. It returned error
-// will be caught by the errorgroup.
+// NewServerTLSConfig loads the certificate and key pair served by the api server. It fails
+// if the files cannot be read or do not make a valid pair. The HTTP/2 protocol is enabled
+// by the server on top of it.
+func NewServerTLSConfig(certsFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certsFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server tls certificate and key: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Serve starts the api web server, over TLS with HTTP/2 when
+// configured. It returned error will be caught by the errorgroup.
 func (app *App) Serve() func() error {
 	return func() error {
 		app.logger.Info("api server starting",
 			zap.String("app.host", app.config.Server.Host),
 			zap.String("app.port", app.config.Server.Port),
+			zap.Bool("app.tls", app.server.TLSConfig != nil),
 		)
-		err := app.server.ListenAndServe()
+		var err error
+		if app.server.TLSConfig != nil {
+			// the certificate is already loaded into the tls config.
+			err = app.server.ListenAndServeTLS("", "")
+		} else {
+			err = app.server.ListenAndServe()
+		}
 		if err == http.ErrServerClosed {
 			err = nil
 		}
@@ -167,14 +361,14 @@ func (app *App) Stop(nCtx, gCtx context.Context) func() error {
 			app.logger.Info("api server stopping. reason: errored at running")
 		}
 
-		sCtx, cancel := context.WithTimeout(context.Background(), app.config.Server.ShutdownTimeout)
+		sCtx, cancel := context.WithTimeout(context.Background(), app.config.Server.GetShutdownTimeout())
 		defer cancel()
-		err := app.server.Shutdown(sCtx)
+		err := app.drain(sCtx)
 		switch err {
 		case nil, http.ErrServerClosed:
 			app.logger.Info("api server graceful shutdown succeeded")
 		case context.DeadlineExceeded:
-			app.logger.Info("api server graceful shutdown timed out")
+			app.logger.Info("api server graceful shutdown timed out", zap.Int64("requests.terminated", app.stats.InFlight()))
 		default:
 			app.logger.Info("api server graceful shutdown failed", zap.Error(err))
 		}
@@ -183,6 +377,9 @@ func (app *App) Stop(nCtx, gCtx context.Context) func() error {
 			app.logger.Info("api server going to force shutdown", zap.Error(app.server.Close()))
 		}
 
+		// the requests handled while draining may have buffered some writes.
+		app.flush()
+
 		if err := app.redisClient.Close(); err != nil {
 			app.logger.Info("error closing redis client", zap.Error(err))
 		}
@@ -190,6 +387,47 @@ func (app *App) Stop(nCtx, gCtx context.Context) func() error {
 	}
 }
 
+// flush runs in order the flushers of the buffered subsystems. Each one is bounded by
+// the flush timeout and abandoned once it elapsed, even if it ignores its context, so
+// a stuck subsystem neither blocks the shutdown nor prevents the next ones to flush.
+func (app *App) flush() {
+	for _, flusher := range app.flushers {
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.Server.GetFlushTimeout())
+		done := make(chan error, 1)
+		go func(flush func(context.Context) error) {
+			done <- flush(ctx)
+		}(flusher.Flush)
+		select {
+		case err := <-done:
+			if err != nil {
+				app.logger.Info("error flushing buffered writes", zap.String("flusher", flusher.Name), zap.Error(err))
+			}
+		case <-ctx.Done():
+			app.logger.Info("flushing buffered writes timed out", zap.String("flusher", flusher.Name), zap.Duration("timeout", app.config.Server.GetFlushTimeout()))
+		}
+		cancel()
+	}
+}
+
+// drain runs the server graceful shutdown and logs every second the number
+// of requests still being handled until it completed or the context is done.
+func (app *App) drain(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- app.server.Shutdown(ctx)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			app.logger.Info("api server draining requests", zap.Int64("requests.inflight", app.stats.InFlight()))
+		}
+	}
+}
+
 // ConsumeQueues runs all queue consumers into separate controlled goroutines.
 func (app *App) ConsumeQueues(gCtx context.Context, g *errgroup.Group) func() error {
 	return func() error {
@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -12,33 +16,177 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// Config defines the structure of the configuration file.
+// Config defines the structure of the configuration file. The durations settings, from
+// the file or the environment, are numbers with their unit like `30s` (see ParseDuration).
 type Config struct {
-	GitCommit               string        `yaml:"git_commit" envconfig:"DRAP_GIT_COMMIT"`
-	GitTag                  string        `yaml:"git_tag" envconfig:"DRAP_GIT_TAG"`
-	BuildTime               string        `yaml:"build_time" envconfig:"DRAP_BUILD_TIME"`
-	IsProduction            bool          `yaml:"is_production" envconfig:"DRAP_IS_PRODUCTION"`
-	LogLevel                zapcore.Level `yaml:"log_level" envconfig:"DRAP_LOG_LEVEL"`
-	LogFolder               string        `yaml:"log_folder" envconfig:"DRAP_LOG_FOLDER"`
-	LogMaxSize              int           `yaml:"log_max_size" envconfig:"DRAP_LOG_MAX_SIZE"`
-	ProfilerEndpointsEnable bool          `yaml:"profiler_endpoints_enable" envconfig:"DRAP_PROFILER_ENDPOINTS_ENABLE"`
-	OpsEndpointsEnable      bool          `yaml:"ops_endpoints_enable" envconfig:"DRAP_OPS_ENDPOINTS_ENABLE"`
-	Server                  ServerConfig  `yaml:"server"`
-	Redis                   RedisConfig   `yaml:"redis"`
-	BoltDB                  BoltDBConfig  `yaml:"boltdb"`
+	GitCommit               string            `yaml:"git_commit" envconfig:"DRAP_GIT_COMMIT"`
+	GitTag                  string            `yaml:"git_tag" envconfig:"DRAP_GIT_TAG"`
+	BuildTime               string            `yaml:"build_time" envconfig:"DRAP_BUILD_TIME"`
+	IsProduction            bool              `yaml:"is_production" envconfig:"DRAP_IS_PRODUCTION"`
+	LogLevel                zapcore.Level     `yaml:"log_level" envconfig:"DRAP_LOG_LEVEL"`
+	LogFolder               string            `yaml:"log_folder" envconfig:"DRAP_LOG_FOLDER"`
+	LogMaxSize              int               `yaml:"log_max_size" envconfig:"DRAP_LOG_MAX_SIZE"`
+	ProfilerEndpointsEnable bool              `yaml:"profiler_endpoints_enable" envconfig:"DRAP_PROFILER_ENDPOINTS_ENABLE"`
+	OpsEndpointsEnable      bool              `yaml:"ops_endpoints_enable" envconfig:"DRAP_OPS_ENDPOINTS_ENABLE"`
+	OpenAPIEndpointEnable   bool              `yaml:"openapi_endpoint_enable" envconfig:"DRAP_OPENAPI_ENDPOINT_ENABLE"`
+	Server                  ServerConfig      `yaml:"server"`
+	Redis                   RedisConfig       `yaml:"redis"`
+	BoltDB                  BoltDBConfig      `yaml:"boltdb"`
+	Backup                  BackupConfig      `yaml:"backup"`
+	Quota                   QuotaConfig       `yaml:"quota"`
+	Views                   ViewsConfig       `yaml:"views"`
+	Cache                   CacheConfig       `yaml:"cache"`
+	Debug                   DebugConfig       `yaml:"debug"`
+	Maintenance             MaintenanceConfig `yaml:"maintenance"`
+	Ops                     OpsConfig         `yaml:"ops"`
+	Fingerprint             FingerprintConfig `yaml:"fingerprint"`
+	Outbox                  OutboxConfig      `yaml:"outbox"`
+	Trash                   TrashConfig       `yaml:"trash"`
+	Deletes                 DeletesConfig     `yaml:"deletes"`
+	Overrides               OverridesConfig   `yaml:"overrides"`
+	Lists                   ListsConfig       `yaml:"lists"`
+	History                 HistoryConfig     `yaml:"history"`
+	Locks                   LocksConfig       `yaml:"locks"`
+	Auth                    AuthConfig        `yaml:"auth"`
+	Degraded                DegradedConfig    `yaml:"degraded"`
+	Migrations              MigrationsConfig  `yaml:"migrations"`
+	Tracing                 TracingConfig     `yaml:"tracing"`
+	CORS                    CORSConfig        `yaml:"cors"`
 }
 
 type ServerConfig struct {
-	Host                         string        `yaml:"host" envconfig:"DRAP_SERVER_HOST"`
-	Port                         string        `yaml:"port" envconfig:"DRAP_SERVER_PORT"`
-	CertsFile                    string        `yaml:"certs_file" envconfig:"DRAP_SERVER_CERTS_FILE"`
-	KeyFile                      string        `yaml:"key_file" envconfig:"DRAP_SERVER_KEY_FILE"`
-	ReadTimeout                  time.Duration `yaml:"read_timeout" envconfig:"DRAP_SERVER_READ_TIMEOUT"`
-	WriteTimeout                 time.Duration `yaml:"write_timeout" envconfig:"DRAP_SERVER_WRITE_TIMEOUT"`
-	LongRequestProcessingTimeout time.Duration `yaml:"long_request_processing_timeout" envconfig:"DRAP_SERVER_LONG_REQUEST_PROCESSING_TIMEOUT"`
-	LongRequestWriteTimeout      time.Duration `yaml:"long_request_write_timeout" envconfig:"DRAP_SERVER_LONG_REQUEST_WRITE_TIMEOUT"`
-	RequestTimeout               time.Duration `yaml:"request_timeout" envconfig:"DRAP_SERVER_REQUEST_TIMEOUT"` // Time to wait for a request to finish
-	ShutdownTimeout              time.Duration `yaml:"shutdown_timeout" envconfig:"DRAP_SERVER_SHUTDOWN_TIMEOUT"`
+	Host                         string             `yaml:"host" envconfig:"DRAP_SERVER_HOST"`
+	Port                         string             `yaml:"port" envconfig:"DRAP_SERVER_PORT"`
+	CertsFile                    string             `yaml:"certs_file" envconfig:"DRAP_SERVER_CERTS_FILE"`
+	KeyFile                      string             `yaml:"key_file" envconfig:"DRAP_SERVER_KEY_FILE"`
+	ReadTimeout                  time.Duration      `yaml:"read_timeout" envconfig:"DRAP_SERVER_READ_TIMEOUT"`
+	WriteTimeout                 time.Duration      `yaml:"write_timeout" envconfig:"DRAP_SERVER_WRITE_TIMEOUT"`
+	LongRequestProcessingTimeout time.Duration      `yaml:"long_request_processing_timeout" envconfig:"DRAP_SERVER_LONG_REQUEST_PROCESSING_TIMEOUT"`
+	LongRequestWriteTimeout      time.Duration      `yaml:"long_request_write_timeout" envconfig:"DRAP_SERVER_LONG_REQUEST_WRITE_TIMEOUT"`
+	RequestTimeout               time.Duration      `yaml:"request_timeout" envconfig:"DRAP_SERVER_REQUEST_TIMEOUT"` // Time to wait for a request to finish
+	ShutdownTimeout              time.Duration      `yaml:"shutdown_timeout" envconfig:"DRAP_SERVER_SHUTDOWN_TIMEOUT"`
+	FlushTimeout                 time.Duration      `yaml:"flush_timeout" envconfig:"DRAP_SERVER_FLUSH_TIMEOUT"`                   // Time to wait each buffered subsystem flush on shutdown
+	TrustedProxies               []string           `yaml:"trusted_proxies" envconfig:"DRAP_SERVER_TRUSTED_PROXIES"`               // CIDRs allowed to set forwarding headers
+	MaxRequestBodyBytes          int64              `yaml:"max_request_body_bytes" envconfig:"DRAP_SERVER_MAX_REQUEST_BODY_BYTES"` // Size limit of books requests body
+	RequestIDPassthrough         bool               `yaml:"request_id_passthrough" envconfig:"DRAP_SERVER_REQUEST_ID_PASSTHROUGH"` // Reuse the well-formed inbound X-Request-ID
+	RateLimit                    RateLimitConfig    `yaml:"rate_limit"`
+	ErrorBreaker                 ErrorBreakerConfig `yaml:"error_breaker"`
+	ErrorPages                   ErrorPagesConfig   `yaml:"error_pages"`
+}
+
+// Default server settings used when a setting is unset (zero) like into the default config.yml.
+const (
+	DefaultServerReadTimeout                  = 5 * time.Second
+	DefaultServerWriteTimeout                 = 17 * time.Second
+	DefaultServerRequestTimeout               = 15 * time.Second
+	DefaultServerLongRequestProcessingTimeout = 55 * time.Second
+	DefaultServerLongRequestWriteTimeout      = 60 * time.Second
+	DefaultServerShutdownTimeout              = 90 * time.Second
+	DefaultServerFlushTimeout                 = 10 * time.Second
+)
+
+// orDefault returns the duration d or the default value if d is not set.
+func orDefault(d, value time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return value
+}
+
+// GetReadTimeout returns the server read timeout or DefaultServerReadTimeout if unset.
+func (sc ServerConfig) GetReadTimeout() time.Duration {
+	return orDefault(sc.ReadTimeout, DefaultServerReadTimeout)
+}
+
+// GetWriteTimeout returns the server write timeout or DefaultServerWriteTimeout if unset.
+func (sc ServerConfig) GetWriteTimeout() time.Duration {
+	return orDefault(sc.WriteTimeout, DefaultServerWriteTimeout)
+}
+
+// GetRequestTimeout returns the requests processing timeout or DefaultServerRequestTimeout if unset.
+func (sc ServerConfig) GetRequestTimeout() time.Duration {
+	return orDefault(sc.RequestTimeout, DefaultServerRequestTimeout)
+}
+
+// GetLongRequestProcessingTimeout returns the long requests processing timeout or
+// DefaultServerLongRequestProcessingTimeout if unset.
+func (sc ServerConfig) GetLongRequestProcessingTimeout() time.Duration {
+	return orDefault(sc.LongRequestProcessingTimeout, DefaultServerLongRequestProcessingTimeout)
+}
+
+// GetLongRequestWriteTimeout returns the long requests write timeout or
+// DefaultServerLongRequestWriteTimeout if unset.
+func (sc ServerConfig) GetLongRequestWriteTimeout() time.Duration {
+	return orDefault(sc.LongRequestWriteTimeout, DefaultServerLongRequestWriteTimeout)
+}
+
+// TimeoutWarnings describes the long requests timeouts which are unset and fall back
+// to their defaults, or which would cut the long requests responses before the end of
+// their processing. The server still starts with them but they should be fixed.
+func (sc ServerConfig) TimeoutWarnings() []string {
+	var warnings []string
+	if sc.LongRequestProcessingTimeout <= 0 {
+		warnings = append(warnings, fmt.Sprintf("server long request processing timeout unset, using %s", DefaultServerLongRequestProcessingTimeout))
+	}
+	if sc.LongRequestWriteTimeout <= 0 {
+		warnings = append(warnings, fmt.Sprintf("server long request write timeout unset, using %s", DefaultServerLongRequestWriteTimeout))
+	}
+	if sc.GetLongRequestWriteTimeout() <= sc.GetLongRequestProcessingTimeout() {
+		warnings = append(warnings, fmt.Sprintf("server long request write timeout %s should exceed the processing timeout %s", sc.GetLongRequestWriteTimeout(), sc.GetLongRequestProcessingTimeout()))
+	}
+	return warnings
+}
+
+// GetShutdownTimeout returns the graceful shutdown timeout or DefaultServerShutdownTimeout if unset.
+func (sc ServerConfig) GetShutdownTimeout() time.Duration {
+	return orDefault(sc.ShutdownTimeout, DefaultServerShutdownTimeout)
+}
+
+// GetFlushTimeout returns the shutdown flush timeout of each buffered subsystem or
+// DefaultServerFlushTimeout if unset.
+func (sc ServerConfig) GetFlushTimeout() time.Duration {
+	return orDefault(sc.FlushTimeout, DefaultServerFlushTimeout)
+}
+
+// GetMaxRequestBodyBytes returns the books requests body size limit or
+// DefaultMaxRequestBodyBytes if unset.
+func (sc ServerConfig) GetMaxRequestBodyBytes() int64 {
+	if sc.MaxRequestBodyBytes > 0 {
+		return sc.MaxRequestBodyBytes
+	}
+	return DefaultMaxRequestBodyBytes
+}
+
+// TLSEnabled reports whether both the certificate and the key files are set, in which
+// case the server is served over TLS with HTTP/2.
+func (sc ServerConfig) TLSEnabled() bool {
+	return sc.CertsFile != "" && sc.KeyFile != ""
+}
+
+// RateLimitConfig defines the per-client (source IP) requests rate on public endpoints.
+// Each client can send Burst requests at once then Rate requests per second.
+type RateLimitConfig struct {
+	Enable bool    `yaml:"enable" envconfig:"DRAP_SERVER_RATE_LIMIT_ENABLE"`
+	Rate   float64 `yaml:"rate" envconfig:"DRAP_SERVER_RATE_LIMIT_RATE"`
+	Burst  int     `yaml:"burst" envconfig:"DRAP_SERVER_RATE_LIMIT_BURST"`
+}
+
+// ErrorBreakerConfig defines the per-client (source IP) circuit breaker on public endpoints.
+// Once a client got Threshold 4xx responses within Window, its requests are rejected with
+// 429 for Cooldown.
+type ErrorBreakerConfig struct {
+	Enable    bool          `yaml:"enable" envconfig:"DRAP_SERVER_ERROR_BREAKER_ENABLE"`
+	Threshold int           `yaml:"threshold" envconfig:"DRAP_SERVER_ERROR_BREAKER_THRESHOLD"`
+	Window    time.Duration `yaml:"window" envconfig:"DRAP_SERVER_ERROR_BREAKER_WINDOW"`
+	Cooldown  time.Duration `yaml:"cooldown" envconfig:"DRAP_SERVER_ERROR_BREAKER_COOLDOWN"`
+}
+
+// ErrorPagesConfig defines the HTML pages sent instead of the JSON not-found and server
+// errors to the clients which prefer HTML like browsers. Template is the path of a custom
+// html/template file executed with an ErrorPage value. The default page is used if empty.
+type ErrorPagesConfig struct {
+	Enable   bool   `yaml:"enable" envconfig:"DRAP_SERVER_ERROR_PAGES_ENABLE"`
+	Template string `yaml:"template" envconfig:"DRAP_SERVER_ERROR_PAGES_TEMPLATE"`
 }
 
 type RedisConfig struct {
@@ -52,6 +200,27 @@ type RedisConfig struct {
 	Username      string        `yaml:"username" envconfig:"DRAP_REDIS_USERNAME"`
 	Password      string        `yaml:"password" envconfig:"DRAP_REDIS_PASSWORD"`
 	DatabaseIndex int           `yaml:"db_index" envconfig:"DRAP_REDIS_DATABASE_INDEX"`
+	CacheTTL      time.Duration `yaml:"cache_ttl" envconfig:"DRAP_REDIS_CACHE_TTL"`     // 0 means books never expire
+	SlidingTTL    bool          `yaml:"sliding_ttl" envconfig:"DRAP_REDIS_SLIDING_TTL"` // reads extend books expiry
+	ScanCount     int64         `yaml:"scan_count" envconfig:"DRAP_REDIS_SCAN_COUNT"`   // books per HSCAN batch. 0 means DefaultScanCount
+	Layout        string        `yaml:"layout" envconfig:"DRAP_REDIS_LAYOUT"`           // `hash` (default) or `keys`
+	Breaker       BreakerConfig `yaml:"breaker"`
+}
+
+// Layouts of the books into redis. With `hash` the books are the fields of a single hash.
+// With `keys` each book has its own key, indexed by a set, read with GET and MGET.
+const (
+	RedisLayoutHash = "hash"
+	RedisLayoutKeys = "keys"
+)
+
+// BreakerConfig defines the circuit breaker around the redis reads. Once Threshold reads failed
+// in a row, the reads are served straight from the backup storage for Cooldown before a single
+// read probes whether redis recovered.
+type BreakerConfig struct {
+	Enable    bool          `yaml:"enable" envconfig:"DRAP_REDIS_BREAKER_ENABLE"`
+	Threshold int           `yaml:"threshold" envconfig:"DRAP_REDIS_BREAKER_THRESHOLD"`
+	Cooldown  time.Duration `yaml:"cooldown" envconfig:"DRAP_REDIS_BREAKER_COOLDOWN"`
 }
 
 type BoltDBConfig struct {
@@ -60,6 +229,418 @@ type BoltDBConfig struct {
 	BucketName string        `yaml:"bucket_name" envconfig:"DRAP_BOLTDB_BUCKET_NAME"`
 }
 
+// BackupConfig defines the additional backup storages fed along with the boltdb one
+// and the write policy (`all` or `quorum`) which decides when a book is committed.
+// A zero quorum means the majority of backup storages. MessageVersion is the format of
+// the messages pushed to the backup queues: 0 for the legacy bare books, 1 for the
+// versioned envelope. The messages of both formats are always consumed. One out of
+// LogSampling books applied is logged at info, none when zero. WriteMode is `async` to
+// feed the boltdb storage only through the queues or `sync` to write it within the books
+// creations and updates requests as well. Shadow verifies the boltdb storage consistency.
+// ConsumerName names the processing lists of the instance consumer so the instances do
+// not recover the books being processed by one another.
+type BackupConfig struct {
+	Policy         string         `yaml:"policy" envconfig:"DRAP_BACKUP_POLICY"`
+	WriteMode      string         `yaml:"write_mode" envconfig:"DRAP_BACKUP_WRITE_MODE"`
+	Quorum         int            `yaml:"quorum" envconfig:"DRAP_BACKUP_QUORUM"`
+	MessageVersion int            `yaml:"message_version" envconfig:"DRAP_BACKUP_MESSAGE_VERSION"`
+	LogSampling    int            `yaml:"log_sampling" envconfig:"DRAP_BACKUP_LOG_SAMPLING"`
+	ConsumerName   string         `yaml:"consumer_name" envconfig:"DRAP_BACKUP_CONSUMER_NAME"`
+	Retry          RetryConfig    `yaml:"retry"`
+	Fatal          FatalConfig    `yaml:"fatal"`
+	Batch          BatchConfig    `yaml:"batch"`
+	Shadow         ShadowConfig   `yaml:"shadow"`
+	Sinks          []BoltDBConfig `yaml:"sinks" ignored:"true"`
+}
+
+// BatchConfig defines the buffered push of the books changes to the backup queues. The
+// buffered books are pushed in a single redis pipeline every Interval or as soon as Size
+// books are buffered. A disabled batch pushes each change immediately. At most MaxPending
+// books are buffered while the flushes fail and the books beyond are dropped.
+type BatchConfig struct {
+	Enable     bool          `yaml:"enable" envconfig:"DRAP_BACKUP_BATCH_ENABLE"`
+	Interval   time.Duration `yaml:"interval" envconfig:"DRAP_BACKUP_BATCH_INTERVAL"`
+	Size       int           `yaml:"size" envconfig:"DRAP_BACKUP_BATCH_SIZE"`
+	MaxPending int           `yaml:"max_pending" envconfig:"DRAP_BACKUP_BATCH_MAX_PENDING"`
+}
+
+// GetConsumerName returns the name of the instance consumer. It defaults to the hostname,
+// which must then be stable across restarts, or to DefaultConsumerName if not available.
+func (bc BackupConfig) GetConsumerName() string {
+	if bc.ConsumerName != "" {
+		return bc.ConsumerName
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return DefaultConsumerName
+}
+
+// DefaultBatchMaxPending is the number of books buffered at most when not configured.
+const DefaultBatchMaxPending = 10000
+
+// GetMaxPending returns the number of books buffered at most or DefaultBatchMaxPending
+// if unset. It is never lower than Size so a full batch can always be buffered.
+func (bc BatchConfig) GetMaxPending() int {
+	if bc.MaxPending <= 0 {
+		return max(DefaultBatchMaxPending, bc.Size)
+	}
+	return max(bc.MaxPending, bc.Size)
+}
+
+// ShadowConfig defines the shadow reads which verify the backup storage under real
+// traffic. A SampleRate fraction of the books read from redis are read again in
+// background from boltdb within Timeout and the mismatches are logged and counted.
+// The books updated within the last Lag are not verified since the async write mode
+// may not have replicated them yet. A zero Lag verifies them all, as fits the sync mode.
+type ShadowConfig struct {
+	Enable     bool          `yaml:"enable" envconfig:"DRAP_BACKUP_SHADOW_ENABLE"`
+	SampleRate float64       `yaml:"sample_rate" envconfig:"DRAP_BACKUP_SHADOW_SAMPLE_RATE"`
+	Timeout    time.Duration `yaml:"timeout" envconfig:"DRAP_BACKUP_SHADOW_TIMEOUT"`
+	Lag        time.Duration `yaml:"lag" envconfig:"DRAP_BACKUP_SHADOW_LAG"`
+}
+
+// RetryConfig defines how many times a backup write is attempted before the book is
+// routed to the dead letter queue. The delay between attempts doubles from Delay.
+// Zero or one attempt means no retry.
+type RetryConfig struct {
+	Attempts int           `yaml:"attempts" envconfig:"DRAP_BACKUP_RETRY_ATTEMPTS"`
+	Delay    time.Duration `yaml:"delay" envconfig:"DRAP_BACKUP_RETRY_DELAY"`
+}
+
+// FatalConfig defines how the backup consumer handles the errors which cannot go away by
+// themselves, like a closed storage. It waits Delay then twice longer, up to a minute, after
+// each consecutive fatal error and stops with the error after Attempts of them so the app
+// shuts down. Zero attempts means it never stops. The delay defaults to one second.
+type FatalConfig struct {
+	Attempts int           `yaml:"attempts" envconfig:"DRAP_BACKUP_FATAL_ATTEMPTS"`
+	Delay    time.Duration `yaml:"delay" envconfig:"DRAP_BACKUP_FATAL_DELAY"`
+}
+
+// QuotaConfig defines the requests budgets of clients over time windows. Each
+// tier holds a list of windows. Clients are mapped to a tier by their identity
+// (source IP) and fallback to the `default` tier when not explicitly mapped.
+type QuotaConfig struct {
+	Enable  bool                     `yaml:"enable" envconfig:"DRAP_QUOTA_ENABLE"`
+	Tiers   map[string][]QuotaWindow `yaml:"tiers" ignored:"true"`
+	Clients map[string]string        `yaml:"clients" envconfig:"DRAP_QUOTA_CLIENTS"`
+}
+
+type QuotaWindow struct {
+	Period time.Duration `yaml:"period"`
+	Limit  int64         `yaml:"limit"`
+}
+
+// ViewsConfig defines the counting of books views. Counters are kept
+// into redis and used to rank the most viewed books.
+type ViewsConfig struct {
+	Enable            bool `yaml:"enable" envconfig:"DRAP_VIEWS_ENABLE"`
+	IncludeInResponse bool `yaml:"include_in_response" envconfig:"DRAP_VIEWS_INCLUDE_IN_RESPONSE"`
+}
+
+// CacheConfig defines the in-process LRU cache of books checked before redis.
+// FillConcurrency bounds the background writes into redis of books only found into boltdb.
+// NegativeTTL is the lifetime of the tombstones kept into redis for books found nowhere.
+type CacheConfig struct {
+	Enable          bool          `yaml:"enable" envconfig:"DRAP_CACHE_ENABLE"`
+	Size            int           `yaml:"size" envconfig:"DRAP_CACHE_SIZE"`
+	TTL             time.Duration `yaml:"ttl" envconfig:"DRAP_CACHE_TTL"`
+	FillConcurrency int           `yaml:"fill_concurrency" envconfig:"DRAP_CACHE_FILL_CONCURRENCY"`
+	NegativeTTL     time.Duration `yaml:"negative_ttl" envconfig:"DRAP_CACHE_NEGATIVE_TTL"` // 0 disables absent books tombstones
+}
+
+// MaintenanceConfig defines the sources (CIDRs or IPs) which can still
+// reach the service while the maintenance mode is enabled. RetryAfter is
+// the estimated duration of a maintenance enabled without window, which
+// the clients are told to wait before retrying.
+type MaintenanceConfig struct {
+	AllowedIPs []string      `yaml:"allowed_ips" envconfig:"DRAP_MAINTENANCE_ALLOWED_IPS"`
+	RetryAfter time.Duration `yaml:"retry_after" envconfig:"DRAP_MAINTENANCE_RETRY_AFTER"`
+}
+
+// DefaultMaintenanceRetryAfter is the estimated duration of a maintenance
+// enabled without window when none is configured.
+const DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+// GetRetryAfter returns the estimated maintenance duration or
+// DefaultMaintenanceRetryAfter if unset.
+func (mc MaintenanceConfig) GetRetryAfter() time.Duration {
+	return orDefault(mc.RetryAfter, DefaultMaintenanceRetryAfter)
+}
+
+// AuthConfig defines the authentication of the ops requests. Once enabled, they must carry
+// the `Authorization: Bearer <jwt>` header with an unexpired HS256 token signed with Secret.
+type AuthConfig struct {
+	Enable bool   `yaml:"enable" envconfig:"DRAP_AUTH_ENABLE"`
+	Secret string `yaml:"secret" envconfig:"DRAP_AUTH_SECRET"`
+}
+
+// OpsConfig groups the settings of the ops features.
+type OpsConfig struct {
+	Audit  AuditConfig  `yaml:"audit"`
+	GC     GCConfig     `yaml:"gc"`
+	Rename RenameConfig `yaml:"rename"`
+	Health HealthConfig `yaml:"health"`
+	Stats  StatsConfig  `yaml:"stats"`
+	UI     UIConfig     `yaml:"ui"`
+}
+
+// UIConfig defines the ops admin UI. Once enabled, a static page served at `/ops/ui`
+// renders the ops endpoints data and controls. The page itself is not authenticated and
+// sends the typed token to the endpoints. It is missing from the builds with the `minimal`
+// tag whatever the setting.
+type UIConfig struct {
+	Enable bool `yaml:"enable" envconfig:"DRAP_OPS_UI_ENABLE"`
+}
+
+// StatsConfig defines the statistics settings. With PersistStart, the first start time
+// of the service is kept into redis so the service uptime survives the restarts. With
+// OpenMetrics, the requests are counted per route and the statistics are exported in
+// OpenMetrics text format without the Prometheus client library.
+type StatsConfig struct {
+	PersistStart bool `yaml:"persist_start" envconfig:"DRAP_OPS_STATS_PERSIST_START"`
+	OpenMetrics  bool `yaml:"openmetrics" envconfig:"DRAP_OPS_STATS_OPENMETRICS"`
+}
+
+// HealthConfig defines the health summary of the subsystems. Each check is bounded to
+// Timeout. The app is degraded once QueueThreshold books or more are waiting into the
+// backup queues (0 means no threshold) or the consumer was not seen for HeartbeatTimeout.
+type HealthConfig struct {
+	Timeout          time.Duration `yaml:"timeout" envconfig:"DRAP_OPS_HEALTH_TIMEOUT"`
+	QueueThreshold   int64         `yaml:"queue_threshold" envconfig:"DRAP_OPS_HEALTH_QUEUE_THRESHOLD"`
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout" envconfig:"DRAP_OPS_HEALTH_HEARTBEAT_TIMEOUT"`
+}
+
+// Default health settings used when a setting is unset (zero).
+const (
+	DefaultHealthTimeout          = 2 * time.Second
+	DefaultHealthHeartbeatTimeout = 30 * time.Second
+)
+
+// GetTimeout returns the health check timeout or DefaultHealthTimeout if unset.
+func (hc HealthConfig) GetTimeout() time.Duration {
+	return orDefault(hc.Timeout, DefaultHealthTimeout)
+}
+
+// GetHeartbeatTimeout returns the consumer heartbeat timeout or
+// DefaultHealthHeartbeatTimeout if unset.
+func (hc HealthConfig) GetHeartbeatTimeout() time.Duration {
+	return orDefault(hc.HeartbeatTimeout, DefaultHealthHeartbeatTimeout)
+}
+
+// RenameConfig defines the endpoint moving a book to another ID. It requires the
+// `Authorization: Bearer <token>` header and cannot be enabled without a token.
+type RenameConfig struct {
+	Enable bool   `yaml:"enable" envconfig:"DRAP_OPS_RENAME_ENABLE"`
+	Token  string `yaml:"token" envconfig:"DRAP_OPS_RENAME_TOKEN"`
+}
+
+// GCConfig defines the minimum interval between two forced garbage collections
+// shared by the gc endpoints and the maximum time their responses wait for it.
+type GCConfig struct {
+	Cooldown time.Duration `yaml:"cooldown" envconfig:"DRAP_OPS_GC_COOLDOWN"`
+	Timeout  time.Duration `yaml:"timeout" envconfig:"DRAP_OPS_GC_TIMEOUT"`
+}
+
+// AuditConfig defines the recording of ops requests into a JSON lines file. The
+// export endpoint requires the `Authorization: Bearer <export_token>` header and
+// is refused when no token is configured.
+type AuditConfig struct {
+	Enable      bool   `yaml:"enable" envconfig:"DRAP_OPS_AUDIT_ENABLE"`
+	FilePath    string `yaml:"filepath" envconfig:"DRAP_OPS_AUDIT_FILE_PATH"`
+	ExportToken string `yaml:"export_token" envconfig:"DRAP_OPS_AUDIT_EXPORT_TOKEN"`
+}
+
+// FingerprintConfig defines the tracking of requests per fingerprint (method, route,
+// user-agent and source IP). A warning is logged when a fingerprint reaches Threshold
+// requests within a Window while exceeding SpikeFactor times its previous window count.
+type FingerprintConfig struct {
+	Enable      bool          `yaml:"enable" envconfig:"DRAP_FINGERPRINT_ENABLE"`
+	Window      time.Duration `yaml:"window" envconfig:"DRAP_FINGERPRINT_WINDOW"`
+	Threshold   int64         `yaml:"threshold" envconfig:"DRAP_FINGERPRINT_THRESHOLD"`
+	SpikeFactor float64       `yaml:"spike_factor" envconfig:"DRAP_FINGERPRINT_SPIKE_FACTOR"`
+}
+
+// OutboxConfig defines the transactional outbox. Books writes are recorded into redis
+// along with an outbox entry and a relay moves the entries to the queues every Interval.
+type OutboxConfig struct {
+	Enable   bool          `yaml:"enable" envconfig:"DRAP_OUTBOX_ENABLE"`
+	Interval time.Duration `yaml:"interval" envconfig:"DRAP_OUTBOX_INTERVAL"`
+}
+
+// TrashConfig defines the soft-delete of books. Deleted books are moved to the trash
+// from where they can be restored. Every PurgeInterval, the books trashed for longer
+// than Retention are permanently removed.
+type TrashConfig struct {
+	Enable        bool          `yaml:"enable" envconfig:"DRAP_TRASH_ENABLE"`
+	Retention     time.Duration `yaml:"retention" envconfig:"DRAP_TRASH_RETENTION"`
+	PurgeInterval time.Duration `yaml:"purge_interval" envconfig:"DRAP_TRASH_PURGE_INTERVAL"`
+}
+
+// DeletesConfig defines the delayed deletes of books. A deleted book is not served anymore
+// but its delete from the backup storage is scheduled after the Grace period, during which
+// the book can be restored. Its primary storage copy is removed at once unless DelayPrimary
+// is set. Every Interval, the due deletes are carried out.
+type DeletesConfig struct {
+	Enable       bool          `yaml:"enable" envconfig:"DRAP_DELETES_ENABLE"`
+	Grace        time.Duration `yaml:"grace" envconfig:"DRAP_DELETES_GRACE"`
+	DelayPrimary bool          `yaml:"delay_primary" envconfig:"DRAP_DELETES_DELAY_PRIMARY"`
+	Interval     time.Duration `yaml:"interval" envconfig:"DRAP_DELETES_INTERVAL"`
+}
+
+// HistoryConfig defines the versions log of books. Each update appends the replaced
+// version of the book to its history which keeps only the last Size versions.
+type HistoryConfig struct {
+	Enable bool  `yaml:"enable" envconfig:"DRAP_HISTORY_ENABLE"`
+	Size   int64 `yaml:"size" envconfig:"DRAP_HISTORY_SIZE"`
+}
+
+// LocksConfig defines the in-process locks of the books. The updates, the imports, the
+// deletes, the restores and the renames of a same book are always serialized within the
+// instance over Shards mutexes. It complements the redis transactions which protect the
+// single storage writes across instances.
+type LocksConfig struct {
+	Shards int `yaml:"shards" envconfig:"DRAP_LOCKS_SHARDS"`
+}
+
+// ListsConfig defines the storage the books listings are fetched from first: `backup`
+// (default) or `primary`. The other storage is the fallback.
+type ListsConfig struct {
+	Prefer string `yaml:"prefer" envconfig:"DRAP_LISTS_PREFER"`
+}
+
+// OverridesConfig defines the per-request feature overrides. Once enabled, a public request
+// can flip some features for itself with the X-Feature-Overrides header signed with Secret.
+type OverridesConfig struct {
+	Enable bool   `yaml:"enable" envconfig:"DRAP_OVERRIDES_ENABLE"`
+	Secret string `yaml:"secret" envconfig:"DRAP_OVERRIDES_SECRET"`
+}
+
+// DebugConfig groups the opt-in features used to investigate issues.
+type DebugConfig struct {
+	Capture      CaptureConfig `yaml:"capture"`
+	Timing       TimingConfig  `yaml:"timing"`
+	Bodies       BodiesConfig  `yaml:"bodies"`
+	VerboseBooks bool          `yaml:"verbose_books" envconfig:"DRAP_DEBUG_VERBOSE_BOOKS"` // log all books fields
+}
+
+// BodiesConfig defines the debug logging of the public requests and responses bodies, up
+// to MaxBytes each, with the values of the RedactFields masked in JSON bodies. It can also
+// be toggled at runtime. The bodies are logged at debug level only.
+type BodiesConfig struct {
+	Enable       bool     `yaml:"enable" envconfig:"DRAP_DEBUG_BODIES_ENABLE"`
+	MaxBytes     int64    `yaml:"max_bytes" envconfig:"DRAP_DEBUG_BODIES_MAX_BYTES"`
+	RedactFields []string `yaml:"redact_fields" envconfig:"DRAP_DEBUG_BODIES_REDACT_FIELDS"`
+}
+
+// DefaultDebugBodiesMaxBytes is the size of the logged bodies when not configured.
+const DefaultDebugBodiesMaxBytes = 4096
+
+// GetMaxBytes returns the size of the logged bodies or DefaultDebugBodiesMaxBytes if unset.
+func (bc BodiesConfig) GetMaxBytes() int64 {
+	if bc.MaxBytes > 0 {
+		return bc.MaxBytes
+	}
+	return DefaultDebugBodiesMaxBytes
+}
+
+// TimingConfig defines the measure of the validation, storage and queue phases of
+// public requests which are reported into the `Server-Timing` response header and
+// debug logged. With OnDemand, only requests with `X-Server-Timing: true` are measured.
+type TimingConfig struct {
+	Enable   bool `yaml:"enable" envconfig:"DRAP_DEBUG_TIMING_ENABLE"`
+	OnDemand bool `yaml:"on_demand" envconfig:"DRAP_DEBUG_TIMING_ON_DEMAND"`
+}
+
+// DegradedConfig defines the signaling of the responses served in degraded mode, ie:
+// from the backup storage because the primary storage failed, into the Header.
+type DegradedConfig struct {
+	Enable bool   `yaml:"enable" envconfig:"DRAP_DEGRADED_ENABLE"`
+	Header string `yaml:"header" envconfig:"DRAP_DEGRADED_HEADER"`
+}
+
+// MigrationsConfig defines the data migrations run on startup before serving requests.
+// BookTimes rewrites the books times stored with the legacy format as RFC3339. RedisLayout
+// moves the books stored with the other redis layout into the configured one.
+type MigrationsConfig struct {
+	BookTimes   bool `yaml:"book_times" envconfig:"DRAP_MIGRATIONS_BOOK_TIMES"`
+	RedisLayout bool `yaml:"redis_layout" envconfig:"DRAP_MIGRATIONS_REDIS_LAYOUT"`
+}
+
+// TracingConfig defines the export of the requests traces to an OTLP/HTTP collector at
+// Endpoint (like `http://localhost:4318`). SampleRatio is the fraction of the requests
+// traced when the caller did not decide it through the `traceparent` header.
+type TracingConfig struct {
+	Enable      bool    `yaml:"enable" envconfig:"DRAP_TRACING_ENABLE"`
+	Endpoint    string  `yaml:"endpoint" envconfig:"DRAP_TRACING_ENDPOINT"`
+	ServiceName string  `yaml:"service_name" envconfig:"DRAP_TRACING_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" envconfig:"DRAP_TRACING_SAMPLE_RATIO"`
+}
+
+// CORSConfig defines the cross-origin requests allowed. AllowedOrigins are exact origins
+// like `https://app.example.com` or patterns with one `*` like `https://*.example.com`
+// and `*` for any origin. Requests from other origins get no CORS headers. The `*` origin
+// cannot be combined with AllowCredentials.
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" envconfig:"DRAP_CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string      `yaml:"allowed_methods" envconfig:"DRAP_CORS_ALLOWED_METHODS"`
+	AllowedHeaders   []string      `yaml:"allowed_headers" envconfig:"DRAP_CORS_ALLOWED_HEADERS"`
+	AllowCredentials bool          `yaml:"allow_credentials" envconfig:"DRAP_CORS_ALLOW_CREDENTIALS"`
+	MaxAge           time.Duration `yaml:"max_age" envconfig:"DRAP_CORS_MAX_AGE"` // how long preflight responses are cached
+}
+
+// Default CORS methods and headers allowed when unset.
+var (
+	DefaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	DefaultCORSHeaders = []string{"Origin", "Accept", "Content-Type", "Content-Length", "Accept-Encoding", "Accept-Language", "Authorization", "X-CSRF-Token", "Cache-Control"}
+)
+
+// GetAllowedMethods returns the allowed methods or DefaultCORSMethods if unset.
+func (cc CORSConfig) GetAllowedMethods() []string {
+	if len(cc.AllowedMethods) > 0 {
+		return cc.AllowedMethods
+	}
+	return DefaultCORSMethods
+}
+
+// GetAllowedHeaders returns the allowed headers or DefaultCORSHeaders if unset.
+func (cc CORSConfig) GetAllowedHeaders() []string {
+	if len(cc.AllowedHeaders) > 0 {
+		return cc.AllowedHeaders
+	}
+	return DefaultCORSHeaders
+}
+
+// MatchOrigin reports whether origin is allowed and whether only the `*` pattern did it.
+func (cc CORSConfig) MatchOrigin(origin string) (allowed, wildcard bool) {
+	for _, pattern := range cc.AllowedOrigins {
+		if pattern == "*" {
+			wildcard = true
+			continue
+		}
+		if strings.EqualFold(pattern, origin) {
+			return true, false
+		}
+		prefix, suffix, found := strings.Cut(pattern, "*")
+		if found && len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true, false
+		}
+	}
+	return wildcard, wildcard
+}
+
+// CaptureConfig defines the recording of a sampled subset of requests. Requests
+// with the header `X-Capture: true` are always recorded. Recorded requests can
+// be replayed against the running service through the ops endpoints.
+type CaptureConfig struct {
+	Enable        bool     `yaml:"enable" envconfig:"DRAP_DEBUG_CAPTURE_ENABLE"`
+	SampleRate    float64  `yaml:"sample_rate" envconfig:"DRAP_DEBUG_CAPTURE_SAMPLE_RATE"`
+	MaxEntries    int      `yaml:"max_entries" envconfig:"DRAP_DEBUG_CAPTURE_MAX_ENTRIES"`
+	MaxBodyBytes  int64    `yaml:"max_body_bytes" envconfig:"DRAP_DEBUG_CAPTURE_MAX_BODY_BYTES"`
+	RedactHeaders []string `yaml:"redact_headers" envconfig:"DRAP_DEBUG_CAPTURE_REDACT_HEADERS"`
+	RedactFields  []string `yaml:"redact_fields" envconfig:"DRAP_DEBUG_CAPTURE_REDACT_FIELDS"`
+}
+
 // LoadConfigFile provides an instance of config structure for the all application.
 func LoadConfigFile(configFile string) (*Config, error) {
 	file, err := os.Open(configFile)
@@ -68,20 +649,110 @@ func LoadConfigFile(configFile string) (*Config, error) {
 	}
 	defer file.Close()
 	cfg := &Config{}
+	var root yaml.Node
 	yd := yaml.NewDecoder(file)
-	err = yd.Decode(cfg)
-
+	err = yd.Decode(&root)
 	if err != nil {
 		return nil, err
 	}
+	if len(root.Content) == 0 {
+		return cfg, nil
+	}
+	if err = checkYAMLDurations(root.Content[0], reflect.TypeOf(*cfg), ""); err != nil {
+		return nil, err
+	}
+	if err = root.Decode(cfg); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
 // LoadConfigEnv reads the environments variables and provides an instance of the App config.
 func LoadConfigEnvs(prefix string, config *Config) error {
+	if err := checkEnvDurations(prefix, reflect.TypeOf(*config)); err != nil {
+		return err
+	}
 	return envconfig.Process(prefix, config)
 }
 
+// durationType is the type of the durations settings.
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ParseDuration parses a duration setting. It must be a sequence of numbers with their
+// unit like `300ms`, `30s`, `5m` or `1h30m` (units: ns, us, ms, s, m, h). A number without
+// unit like `30` is ambiguous so it is rejected. Only `0` can omit it.
+func ParseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: use numbers with units like 30s, 5m or 1h30m", value)
+	}
+	return d, nil
+}
+
+// checkYAMLDurations ensures the values of the durations settings held into the yaml
+// mapping node are strings accepted by ParseDuration. Unitless numbers are otherwise
+// reported by the yaml decoder without the setting name.
+func checkYAMLDurations(node *yaml.Node, t reflect.Type, path string) error {
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		for j := 0; j < t.NumField(); j++ {
+			field := t.Field(j)
+			if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != key {
+				continue
+			}
+			if field.Type != durationType {
+				if err := checkYAMLDurations(value, field.Type, path+key+"."); err != nil {
+					return err
+				}
+				break
+			}
+			if value.Kind != yaml.ScalarNode || value.Tag != "!!str" && value.Value != "0" {
+				return fmt.Errorf("config file setting %s%s: invalid duration %q: use numbers with units like 30s, 5m or 1h30m", path, key, value.Value)
+			}
+			if _, err := ParseDuration(value.Value); err != nil {
+				return fmt.Errorf("config file setting %s%s: %v", path, key, err)
+			}
+			// the yaml decoder only reads durations from strings.
+			value.Tag = "!!str"
+			break
+		}
+	}
+	return nil
+}
+
+// checkEnvDurations ensures the environment variables of the durations settings, if set,
+// are accepted by ParseDuration. They are looked up the same way as envconfig does, with
+// the prefix then by their plain `envconfig` name.
+func checkEnvDurations(prefix string, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			if err := checkEnvDurations(prefix, field.Type); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("envconfig")
+		if field.Type != durationType || name == "" {
+			continue
+		}
+		value, found := os.LookupEnv(prefix + "_" + name)
+		if !found {
+			value, found = os.LookupEnv(name)
+		}
+		if !found {
+			continue
+		}
+		if _, err := ParseDuration(value); err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
 // InitConfig setup defaults values for non provided parameters
 // and configures build tags values to be used if provided.
 func InitConfig(config *Config, gitCommit, gitTag, buildTime string) error {
@@ -105,6 +776,168 @@ func InitConfig(config *Config, gitCommit, gitTag, buildTime string) error {
 		return errors.New("make sure to set valid redis address and port in configuration file")
 	}
 
+	if (config.Server.CertsFile == "") != (config.Server.KeyFile == "") {
+		return errors.New("make sure to set both the server certs and key files to serve over tls")
+	}
+
+	if config.Server.RateLimit.Enable && (config.Server.RateLimit.Rate <= 0 || config.Server.RateLimit.Burst <= 0) {
+		return errors.New("make sure to set positive server rate limit rate and burst")
+	}
+
+	if b := config.Server.ErrorBreaker; b.Enable && (b.Threshold <= 0 || b.Window <= 0 || b.Cooldown <= 0) {
+		return errors.New("make sure to set positive server error breaker threshold and window and cooldown")
+	}
+
+	if config.Redis.ScanCount < 0 {
+		return errors.New("make sure to set non-negative redis scan count")
+	}
+
+	if l := config.Redis.Layout; l != "" && l != RedisLayoutHash && l != RedisLayoutKeys {
+		return fmt.Errorf("make sure to set valid redis layout: %q", l)
+	}
+
+	if config.Redis.Layout == RedisLayoutKeys && (config.Trash.Enable || config.Deletes.Enable || config.Ops.Rename.Enable) {
+		return errors.New("make sure to use the redis hash layout with the trash or the delayed deletes or the books renaming")
+	}
+
+	if b := config.Redis.Breaker; b.Enable && (b.Threshold <= 0 || b.Cooldown <= 0) {
+		return errors.New("make sure to set positive redis breaker threshold and cooldown")
+	}
+
+	if p := config.Backup.Policy; p != "" && p != BackupPolicyAll && p != BackupPolicyQuorum {
+		return fmt.Errorf("make sure to set valid backup policy: %q", p)
+	}
+
+	if m := config.Backup.WriteMode; m != "" && m != WriteModeAsync && m != WriteModeSync {
+		return fmt.Errorf("make sure to set valid backup write mode: %q", m)
+	}
+
+	if config.Backup.WriteMode == WriteModeSync && config.Outbox.Enable {
+		return errors.New("make sure to not enable the outbox with the sync backup write mode")
+	}
+
+	if config.Backup.Quorum < 0 || config.Backup.Quorum > len(config.Backup.Sinks)+1 {
+		return errors.New("make sure to set backup quorum between 0 and the number of backup storages")
+	}
+
+	if config.Backup.Retry.Attempts < 0 || config.Backup.Retry.Delay < 0 {
+		return errors.New("make sure to set non-negative backup retry attempts and delay")
+	}
+
+	if config.Backup.Fatal.Attempts < 0 || config.Backup.Fatal.Delay < 0 {
+		return errors.New("make sure to set non-negative backup fatal attempts and delay")
+	}
+
+	if shadow := config.Backup.Shadow; shadow.Enable && (shadow.SampleRate <= 0 || shadow.SampleRate > 1 || shadow.Timeout <= 0 || shadow.Lag < 0) {
+		return errors.New("make sure to set backup shadow sample rate between 0 and 1, positive timeout and non-negative lag")
+	}
+
+	if config.Backup.MessageVersion < LegacyQueueMessageVersion || config.Backup.MessageVersion > CurrentQueueMessageVersion {
+		return fmt.Errorf("make sure to set backup message version between %d and %d", LegacyQueueMessageVersion, CurrentQueueMessageVersion)
+	}
+
+	if config.Backup.LogSampling < 0 {
+		return errors.New("make sure to set non-negative backup log sampling")
+	}
+
+	if config.Backup.Batch.Enable && (config.Backup.Batch.Interval <= 0 || config.Backup.Batch.Size <= 0) {
+		return errors.New("make sure to set positive backup batch interval and size")
+	}
+
+	if config.Fingerprint.Enable && (config.Fingerprint.Window <= 0 || config.Fingerprint.Threshold <= 0 || config.Fingerprint.SpikeFactor < 0) {
+		return errors.New("make sure to set positive fingerprint window and threshold and spike factor")
+	}
+
+	if config.Outbox.Enable && config.Outbox.Interval <= 0 {
+		return errors.New("make sure to set positive outbox interval")
+	}
+
+	if config.Trash.Enable && (config.Trash.Retention <= 0 || config.Trash.PurgeInterval <= 0) {
+		return errors.New("make sure to set positive trash retention and purge interval")
+	}
+
+	if config.Deletes.Enable && (config.Deletes.Grace <= 0 || config.Deletes.Interval <= 0) {
+		return errors.New("make sure to set positive deletes grace and interval")
+	}
+
+	if config.History.Enable && config.History.Size <= 0 {
+		return errors.New("make sure to set positive history size")
+	}
+
+	if config.Locks.Shards < 0 {
+		return errors.New("make sure to set non-negative locks shards")
+	}
+
+	if p := config.Lists.Prefer; p != "" && p != ListsPreferBackup && p != ListsPreferPrimary {
+		return fmt.Errorf("make sure to set valid lists preferred storage: %q", p)
+	}
+
+	if config.Overrides.Enable && config.Overrides.Secret == "" {
+		return errors.New("make sure to set the feature overrides secret")
+	}
+
+	if config.Deletes.Enable && config.Trash.Enable {
+		return errors.New("make sure to enable either the trash or the delayed deletes")
+	}
+
+	if config.Ops.Health.QueueThreshold < 0 {
+		return errors.New("make sure to set non-negative ops health queue threshold")
+	}
+
+	if config.Auth.Enable && config.Auth.Secret == "" {
+		return errors.New("make sure to set auth secret")
+	}
+
+	if config.Degraded.Enable && config.Degraded.Header == "" {
+		return errors.New("make sure to set degraded header")
+	}
+
+	if config.Tracing.Enable && (config.Tracing.Endpoint == "" || config.Tracing.ServiceName == "") {
+		return errors.New("make sure to set tracing endpoint and service name")
+	}
+
+	if config.Tracing.Enable && (config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1) {
+		return errors.New("make sure to set tracing sample ratio between 0 and 1")
+	}
+
+	for _, origin := range config.CORS.AllowedOrigins {
+		if origin == "" || strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("make sure to set valid cors allowed origin: %q", origin)
+		}
+	}
+
+	if config.CORS.AllowCredentials && slices.Contains(config.CORS.AllowedOrigins, "*") {
+		return errors.New("make sure to set explicit cors allowed origins instead of * when allowing credentials")
+	}
+
+	if config.CORS.MaxAge < 0 {
+		return errors.New("make sure to set non-negative cors max age")
+	}
+
+	if config.Ops.Rename.Enable && config.Ops.Rename.Token == "" {
+		return errors.New("make sure to set ops rename token")
+	}
+
+	if config.Debug.Bodies.MaxBytes < 0 {
+		return errors.New("make sure to set non-negative debug bodies max bytes")
+	}
+
+	if config.Server.MaxRequestBodyBytes < 0 {
+		return errors.New("make sure to set non-negative server max request body bytes")
+	}
+
+	if config.Ops.GC.Cooldown < 0 || config.Ops.GC.Timeout < 0 {
+		return errors.New("make sure to set non-negative ops gc cooldown and timeout")
+	}
+
+	if _, err := ParseCIDRs(config.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("make sure to set valid server trusted proxies: %v", err)
+	}
+
+	if _, err := ParseCIDRs(config.Maintenance.AllowedIPs); err != nil {
+		return fmt.Errorf("make sure to set valid maintenance allowed ips: %v", err)
+	}
+
 	return nil
 }
 
@@ -118,7 +951,7 @@ func LoadAndInitConfigs(gitCommit, gitTag, buildTime string) (*Config, error) {
 	}
 
 	// Set the environment configuration.
-	err = godotenv.Load("./config.env")
+	err = LoadEnvFile("./config.env")
 	if err != nil {
 		return config, fmt.Errorf("failed to set environment configurations: %s", err)
 	}
@@ -135,3 +968,82 @@ func LoadAndInitConfigs(gitCommit, gitTag, buildTime string) (*Config, error) {
 	}
 	return config, nil
 }
+
+// envFileKeys records the variables which were set from the env file rather than by
+// the process environment.
+var envFileKeys = struct {
+	sync.Mutex
+	set map[string]bool
+}{set: make(map[string]bool)}
+
+// LoadEnvFile sets the variables of the env file which are not set by the process
+// environment. Unlike godotenv.Load, the variables set by a previous load of the file
+// are overridden so a configuration reload picks up the edited values. A variable
+// removed from the file keeps its last value until restart.
+func LoadEnvFile(path string) error {
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return err
+	}
+	envFileKeys.Lock()
+	defer envFileKeys.Unlock()
+	for key, value := range values {
+		if _, found := os.LookupEnv(key); found && !envFileKeys.set[key] {
+			continue
+		}
+		if err = os.Setenv(key, value); err != nil {
+			return err
+		}
+		envFileKeys.set[key] = true
+	}
+	return nil
+}
+
+// ReloadableConfigFields lists the settings, by their configuration file path, which are
+// applied without restart when the configuration is reloaded.
+var ReloadableConfigFields = []string{
+	"log_level",
+	"server.request_timeout",
+	"server.long_request_processing_timeout",
+	"server.long_request_write_timeout",
+	"server.rate_limit.rate",
+	"server.rate_limit.burst",
+	"maintenance.allowed_ips",
+	"maintenance.retry_after",
+	"debug.bodies.enable",
+	"debug.bodies.max_bytes",
+	"debug.bodies.redact_fields",
+	"debug.verbose_books",
+	"cors.allowed_origins",
+	"cors.allowed_methods",
+	"cors.allowed_headers",
+	"cors.allow_credentials",
+	"cors.max_age",
+}
+
+// ConfigChanges returns the configuration file paths, like `server.port`, of the settings
+// whose values differ between the old and the new configurations.
+func ConfigChanges(old, new *Config) []string {
+	return configChanges(reflect.ValueOf(*old), reflect.ValueOf(*new), "")
+}
+
+// configChanges walks the fields of the structs old and new to compare their values.
+func configChanges(old, new reflect.Value, path string) []string {
+	var changes []string
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct {
+			changes = append(changes, configChanges(old.Field(i), new.Field(i), name)...)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changes = append(changes, name)
+		}
+	}
+	return changes
+}
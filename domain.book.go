@@ -1,16 +1,327 @@
 package main
 
-import "context"
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
 
-// Book represents a book entity.
+	"go.uber.org/zap/zapcore"
+)
+
+// Book represents a book entity. The required fields are checked by ValidateCreateBookRequestBody
+// and ValidateUpdateBookRequestBody only: title, description, author and price on creation while
+// the ID is generated, and additionally the ID and the creation time on update.
 type Book struct {
-	ID          string `json:"id" binding:"required"`
-	Title       string `json:"title" binding:"required"`
-	Description string `json:"description" binding:"required"`
-	Author      string `json:"author" binding:"required"`
-	Price       string `json:"price" binding:"required"`
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Price       Price  `json:"price"`
 	CreatedAt   string `json:"createdAt"`
 	UpdatedAt   string `json:"updatedAt"`
+	DeletedAt   string `json:"deletedAt,omitempty"` // RFC3339 time the book was moved to the trash.
+}
+
+// verboseBookLogs makes the books logged with all their fields instead of their summary.
+var verboseBookLogs atomic.Bool
+
+// SetVerboseBookLogs sets whether the logged books carry all their fields, like the long
+// description, or only their summary so the log lines stay bounded.
+func SetVerboseBookLogs(verbose bool) {
+	verboseBookLogs.Store(verbose)
+}
+
+// MarshalLogObject logs the summary of the book, its id, title and author, or all its
+// fields in verbose mode. It is used by zap.Any and zap.Object.
+func (b Book) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("id", b.ID)
+	enc.AddString("title", b.Title)
+	enc.AddString("author", b.Author)
+	if !verboseBookLogs.Load() {
+		return nil
+	}
+	enc.AddString("description", b.Description)
+	enc.AddString("price", b.Price.String())
+	enc.AddString("createdAt", b.CreatedAt)
+	enc.AddString("updatedAt", b.UpdatedAt)
+	if b.DeletedAt != "" {
+		enc.AddString("deletedAt", b.DeletedAt)
+	}
+	return nil
+}
+
+// Searchable fields of a book.
+const (
+	BookFieldTitle  = "title"
+	BookFieldAuthor = "author"
+)
+
+// Sortable fields of a book besides the searchable ones.
+const (
+	BookFieldCreatedAt = "createdAt"
+	BookFieldPrice     = "price"
+)
+
+// legacyBookTimeLayout is the layout of time.Time.String() used to store the books times
+// before they were formatted as RFC3339.
+const legacyBookTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// FormatBookTime formats a book creation or update time as RFC3339 with nanoseconds.
+func FormatBookTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// ParseBookTime reads a book time formatted as RFC3339 or, for the books stored before,
+// as time.Time.String() output ignoring the monotonic clock reading like ` m=+0.000123`.
+func ParseBookTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	value, _, _ = strings.Cut(value, " m=")
+	return time.Parse(legacyBookTimeLayout, value)
+}
+
+// CreatedTime returns the book creation time whatever the format it was stored with.
+func (b Book) CreatedTime() (time.Time, error) {
+	return ParseBookTime(b.CreatedAt)
+}
+
+// UpdatedTime returns the book last update time whatever the format it was stored with.
+func (b Book) UpdatedTime() (time.Time, error) {
+	return ParseBookTime(b.UpdatedAt)
+}
+
+// WithRFC3339Times returns the book with its creation and update times stored with the
+// legacy time.Time.String() format converted to RFC3339. It reports whether any was.
+// Empty or unparseable times are left as is.
+func (b Book) WithRFC3339Times() (Book, bool) {
+	converted := false
+	for _, value := range []*string{&b.CreatedAt, &b.UpdatedAt} {
+		if *value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, *value); err == nil {
+			continue
+		}
+		if t, err := ParseBookTime(*value); err == nil {
+			*value = FormatBookTime(t)
+			converted = true
+		}
+	}
+	return b, converted
+}
+
+// BookSort defines the ordering of listed books by a field in ascending or descending order.
+type BookSort struct {
+	Field string
+	Desc  bool
+}
+
+// DefaultBookSort lists the most recently created books first.
+var DefaultBookSort = BookSort{Field: BookFieldCreatedAt, Desc: true}
+
+// Less reports whether the book a comes before the book b. The titles and authors are
+// compared ignoring the case, the creation times chronologically and the prices by their
+// amount. Books with an unparseable creation time or price come after the others.
+func (s BookSort) Less(a, b Book) bool {
+	var c int
+	switch s.Field {
+	case BookFieldTitle:
+		c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case BookFieldAuthor:
+		c = strings.Compare(strings.ToLower(a.Author), strings.ToLower(b.Author))
+	case BookFieldCreatedAt:
+		ta, errA := a.CreatedTime()
+		tb, errB := b.CreatedTime()
+		if errA != nil || errB != nil {
+			return errA == nil && errB != nil
+		}
+		c = ta.Compare(tb)
+	case BookFieldPrice:
+		pa, errA := a.PriceValue()
+		pb, errB := b.PriceValue()
+		if errA != nil || errB != nil {
+			return errA == nil && errB != nil
+		}
+		c = cmp.Compare(pa, pb)
+	}
+	if s.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// Match returns the names of the fields which contain the query, ignoring the case.
+// The query is expected to be already trimmed and lowercased.
+func (b Book) Match(query string, fields []string) []string {
+	var matches []string
+	for _, field := range fields {
+		var value string
+		switch field {
+		case BookFieldTitle:
+			value = b.Title
+		case BookFieldAuthor:
+			value = b.Author
+		}
+		if value != "" && strings.Contains(strings.ToLower(value), query) {
+			matches = append(matches, field)
+		}
+	}
+	return matches
+}
+
+// BookMatch represents a book found by a search with the names of the matched fields.
+type BookMatch struct {
+	Book
+	Matches []string `json:"matches"`
+}
+
+// BookPatch represents a partial update of a book. A nil field is left unchanged
+// while a non-nil field replaces the book value, even when empty.
+type BookPatch struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Author      *string `json:"author"`
+	Price       *Price  `json:"price"`
+}
+
+// IsEmpty reports whether the patch does not change any field.
+func (p BookPatch) IsEmpty() bool {
+	return p.Title == nil && p.Description == nil && p.Author == nil && p.Price == nil
+}
+
+// Apply returns the book with the patched fields replaced.
+func (p BookPatch) Apply(book Book) Book {
+	if p.Title != nil {
+		book.Title = *p.Title
+	}
+	if p.Description != nil {
+		book.Description = *p.Description
+	}
+	if p.Author != nil {
+		book.Author = *p.Author
+	}
+	if p.Price != nil {
+		book.Price = *p.Price
+	}
+	return book
+}
+
+// Trashed returns the book moved to the trash at the deletedAt time.
+func (b Book) Trashed(deletedAt time.Time) Book {
+	b.DeletedAt = deletedAt.UTC().Format(time.RFC3339)
+	return b
+}
+
+// DeletedBefore reports whether the book was moved to the trash before the
+// given time. A book with a missing or unparseable deletion time is not.
+func (b Book) DeletedBefore(before time.Time) bool {
+	deletedAt, err := time.Parse(time.RFC3339, b.DeletedAt)
+	return err == nil && deletedAt.Before(before)
+}
+
+// ETag returns the strong entity tag of the book computed from its JSON encoding,
+// so any change of any field including the update time provides a new tag.
+func (b Book) ETag() string {
+	// a book has only string fields and a price so its encoding cannot fail.
+	bookBytes, _ := json.Marshal(b)
+	sum := sha256.Sum256(bookBytes)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// PriceValue returns the amount of the book price in currency units. The currencies
+// are not converted so books in different currencies are compared by their amounts.
+func (b Book) PriceValue() (float64, error) {
+	return b.Price.Value()
+}
+
+// BookViews represents a book with its number of views.
+type BookViews struct {
+	Book
+	Views int64 `json:"views"`
+}
+
+// ETag returns the weak entity tag of the book along with its views. The views change
+// with the reads so the tag only revalidates the cached payload with `If-None-Match`
+// and, being weak, never satisfies an `If-Match` precondition.
+func (bv BookViews) ETag() string {
+	// a book has only string fields and a price so its encoding cannot fail.
+	payload, _ := json.Marshal(bv)
+	sum := sha256.Sum256(payload)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// BookViewsCounter defines operations on books access counters. It is
+// optionally implemented by a BookStorage which supports counting views.
+type BookViewsCounter interface {
+	IncrViews(ctx context.Context, id string) error
+	GetViews(ctx context.Context, id string) (int64, error)
+	TopViewed(ctx context.Context, limit int64) ([]BookViews, error)
+}
+
+// BookTombstoner defines the negative caching of books known to be absent. It is
+// optionally implemented by a BookStorage. A tombstone expires after its TTL and
+// is removed as soon as a book with the same ID is written into the storage.
+type BookTombstoner interface {
+	SetTombstone(ctx context.Context, id string, ttl time.Duration) error
+	HasTombstone(ctx context.Context, id string) (bool, error)
+}
+
+// BookOutboxWriter defines the writes of books along with their outbox entry in a
+// single atomic operation. It is optionally implemented by a BookStorage so a book
+// written into the storage always reaches its queue even if the process crashed.
+type BookOutboxWriter interface {
+	SetWithOutbox(ctx context.Context, qid, id string, book Book) error
+	DeleteWithOutbox(ctx context.Context, id string) error
+}
+
+// BookTrasher defines the soft-delete of books. It is optionally implemented by a
+// BookStorage. A trashed book is moved aside with its deletion time so it is not
+// served anymore until restored or permanently purged once its retention elapsed.
+type BookTrasher interface {
+	Trash(ctx context.Context, id string, deletedAt time.Time) (Book, error)
+	Restore(ctx context.Context, id string) (Book, error)
+	InTrash(ctx context.Context, id string) (bool, error)
+	GetTrash(ctx context.Context) ([]Book, error)
+	PurgeTrash(ctx context.Context, before time.Time) (int, error)
+}
+
+// BookDeleteScheduler defines the delayed deletes of books. It is optionally implemented
+// by a BookStorage. A scheduled delete is kept with its execution time and can be cancelled
+// until it is claimed once due. With purge, the book is removed from the storage at once.
+type BookDeleteScheduler interface {
+	ScheduleDelete(ctx context.Context, id string, at time.Time, purge bool) error
+	CancelDelete(ctx context.Context, id string) (bool, error)
+	DeletePending(ctx context.Context, id string) (bool, error)
+	PendingDeletes(ctx context.Context, ids ...string) ([]string, error)
+	ClaimDueDeletes(ctx context.Context, now time.Time, limit int64) ([]string, error)
+}
+
+// BookHistorian defines the versions log of books. It is optionally implemented by a
+// BookStorage. The prior versions of a book are appended in chronological order and only
+// the last max ones are kept.
+type BookHistorian interface {
+	AppendHistory(ctx context.Context, id string, book Book, max int64) error
+	GetHistory(ctx context.Context, id string) ([]Book, error)
+}
+
+// BookRenamer defines the move of a book to another ID. It is optionally implemented
+// by a BookStorage. The book carries its new ID and replaces atomically the book `id`
+// along with its secondary indexes. It fails with ErrBookExists if the new ID is taken.
+type BookRenamer interface {
+	Rename(ctx context.Context, id string, book Book) error
+}
+
+// BookBulkAdder defines the insertion of many books at once. It is optionally
+// implemented by a BookStorage which can save round-trips. The returned errors
+// are aligned with the books and a nil entry means the book was inserted.
+type BookBulkAdder interface {
+	AddMany(ctx context.Context, books []Book) []error
 }
 
 // BookStorage defines possible operations on book entity.
@@ -19,6 +330,8 @@ type BookStorage interface {
 	GetOne(ctx context.Context, id string) (Book, error)
 	Delete(ctx context.Context, id string) error
 	Update(ctx context.Context, id string, book Book) (Book, error)
-	GetAll(ctx context.Context) ([]Book, error)
+	GetAll(ctx context.Context, limit int64, cursor string) ([]Book, string, error)
+	Count(ctx context.Context) (int, error)
+	Search(ctx context.Context, query string, fields []string) ([]Book, error)
 	DeleteAll(ctx context.Context) error
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of the legacy prices provided without currency like `12.5`.
+const DefaultCurrency = "USD"
+
+// knownCurrencies lists the ISO-4217 codes accepted for the books prices.
+var knownCurrencies = map[string]bool{
+	"USD": true, "EUR": true, "GBP": true, "JPY": true, "CHF": true, "CAD": true,
+	"AUD": true, "CNY": true, "INR": true, "XOF": true, "XAF": true, "NGN": true,
+}
+
+// currencySymbols maps the currency symbols accepted into legacy prices to their code.
+var currencySymbols = map[string]string{"$": "USD", "€": "EUR", "£": "GBP"}
+
+// legacyPricePattern matches a legacy price: an optional sign, an amount with optional
+// thousands separators and up to 2 decimals and a currency symbol before or after it or
+// a currency code after it. ie: `10$`, `$ 10.50`, `1,200 EUR`, `-5€` or `12.5`.
+var legacyPricePattern = regexp.MustCompile(`^(-?)([$€£]?)\s?(-?)(\d{1,3}(?:,\d{3})+|\d+)(?:\.(\d{1,2}))?(?:\s?([$€£])|\s([A-Z]{3}))?$`)
+
+// ErrInvalidPrice is returned when parsing a legacy price which does not match the pattern.
+var ErrInvalidPrice = errors.New("invalid price")
+
+// Price is the price of a book: an amount in cents of an ISO-4217 currency. It is encoded as
+// `{"amount":1050,"currency":"USD"}` and a zero price as `null`. During the transition, it can
+// still be decoded from legacy string prices like `"10.50$"`. A stored legacy string which can
+// not be parsed is kept as is so it is served and stored back unchanged but fails validation.
+type Price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	legacy   string
+}
+
+// ParsePrice reads a legacy string price. The amount is converted to cents without floating
+// point rounding and a price without currency is considered in DefaultCurrency.
+func ParsePrice(s string) (Price, error) {
+	match := legacyPricePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil || match[1] != "" && match[3] != "" || match[2] != "" && (match[6] != "" || match[7] != "") {
+		return Price{}, ErrInvalidPrice
+	}
+	units, err := strconv.ParseInt(strings.ReplaceAll(match[4], ",", ""), 10, 64)
+	if err != nil {
+		return Price{}, ErrInvalidPrice
+	}
+	cents, _ := strconv.ParseInt((match[5] + "00")[:2], 10, 64)
+	price := Price{Amount: units*100 + cents, Currency: DefaultCurrency}
+	if match[1] != "" || match[3] != "" {
+		price.Amount = -price.Amount
+	}
+	switch {
+	case match[2] != "":
+		price.Currency = currencySymbols[match[2]]
+	case match[6] != "":
+		price.Currency = currencySymbols[match[6]]
+	case match[7] != "":
+		price.Currency = match[7]
+	}
+	return price, nil
+}
+
+// IsZero reports whether the price was not provided.
+func (p Price) IsZero() bool {
+	return p.Amount == 0 && p.Currency == "" && p.legacy == ""
+}
+
+// IsLegacy reports whether the price is a legacy string which could not be parsed.
+func (p Price) IsLegacy() bool {
+	return p.legacy != ""
+}
+
+// Value returns the amount in currency units. It fails for a missing or unparsed price.
+func (p Price) Value() (float64, error) {
+	if p.IsZero() || p.IsLegacy() {
+		return 0, errors.New("price has no amount")
+	}
+	return float64(p.Amount) / 100, nil
+}
+
+// String formats the price like `10.50 USD`.
+func (p Price) String() string {
+	if p.IsLegacy() {
+		return p.legacy
+	}
+	sign, amount := "", p.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, p.Currency)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Price) MarshalJSON() ([]byte, error) {
+	if p.IsLegacy() {
+		return json.Marshal(p.legacy)
+	}
+	if p.IsZero() {
+		return []byte("null"), nil
+	}
+	type price Price
+	return json.Marshal(price(p))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts the structured price, `null`
+// and legacy string prices. An empty string is a zero price.
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*p = Price{}
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if strings.TrimSpace(s) == "" {
+			*p = Price{}
+			return nil
+		}
+		price, err := ParsePrice(s)
+		if err != nil {
+			price = Price{legacy: s}
+		}
+		*p = price
+		return nil
+	}
+	type price Price
+	var v price
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Price(v)
+	return nil
+}
@@ -1,22 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-var ErrBookNotFound = errors.New("book not found")
-
-type (
-	ContextKey        string
-	missingFieldError string
+var (
+	ErrBookNotFound        = errors.New("book not found")
+	ErrViewsNotSupported   = errors.New("books views are not enabled")
+	ErrInvalidCursor       = errors.New("invalid cursor")
+	ErrTrashNotSupported   = errors.New("books trash is not enabled")
+	ErrBookExists          = errors.New("book already exists")
+	ErrBookModified        = errors.New("book was modified")
+	ErrRenameNotSupported  = errors.New("books renaming is not supported")
+	ErrBackupWrite         = errors.New("failed to write book into backup storage")
+	ErrBackupRollback      = errors.New("failed to roll back book into primary storage")
+	ErrBatchQueueFull      = errors.New("batch queue is full")
+	ErrHistoryNotSupported = errors.New("books history is not enabled")
+	ErrEmptyRequestBody    = errors.New("request body is empty")
 )
 
+type ContextKey string
+
 const (
 	BookIDPrefix            string     = "b"
 	RequestIDPrefix         string     = "r"
@@ -25,8 +43,59 @@ const (
 	ConnContextKey          ContextKey = "http-conn"
 )
 
-func (m missingFieldError) Error() string {
-	return string(m) + " is required"
+// RequestIDHeader carries the request id on the responses and, when the passthrough
+// is enabled, the one to reuse on the requests.
+const RequestIDHeader = "X-Request-ID"
+
+// BookETagHeader carries the strong ETag of the book, to be sent into the `If-Match`
+// header of the writes, when the ETag header tags the book along with its views.
+const BookETagHeader = "X-Book-ETag"
+
+// Bounds of the number of most viewed books to provide.
+const (
+	DefaultPopularBooksLimit = 10
+	MaxPopularBooksLimit     = 100
+)
+
+// MaxSearchResults is the maximum number of books provided by a search.
+const MaxSearchResults = 100
+
+// MaxBulkBooks is the maximum number of books created by a single bulk request.
+const MaxBulkBooks = 500
+
+// Bounds of the number of books listed per page.
+const (
+	DefaultBooksPageLimit = 50
+	MaxBooksPageLimit     = 500
+)
+
+// MatchETag reports whether the etag is listed into the value of an `If-None-Match`
+// header. The value `*` matches any etag and weak tags are compared by their opaque
+// part, as the weak comparison of RFC 9110.
+func MatchETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchStrongETag reports whether the etag is listed into the value of an `If-Match`
+// header. The value `*` matches any etag. As the strong comparison of RFC 9110, a weak
+// tag never matches even when its opaque part is the same.
+func MatchStrongETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // GetValueFromContext returns the value of a given key in the context
@@ -47,50 +116,299 @@ func GetRequestNumberFromContext(ctx context.Context) uint64 {
 	return 0
 }
 
+// HasBearerToken reports whether the request carries the `Authorization: Bearer <token>`
+// header. It is always false when the expected token is empty.
+func HasBearerToken(r *http.Request, token string) bool {
+	provided, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// DefaultMaxRequestBodyBytes is the maximum size of a request body when none is configured.
+const DefaultMaxRequestBodyBytes int64 = 1 << 20
+
+// LimitRequestBody caps the body of the request to `limit` bytes. Reading beyond makes
+// the decoding fail with an error recognized by IsRequestBodyTooLarge.
+func LimitRequestBody(w http.ResponseWriter, r *http.Request, limit int64) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+}
+
+// IsRequestBodyTooLarge reports whether the error comes from reading a request body
+// beyond the limit set by LimitRequestBody.
+func IsRequestBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// RequestFieldError reports a field of a request body which is unknown or repeated.
+type RequestFieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *RequestFieldError) Error() string {
+	return fmt.Sprintf("%s field %q", e.Reason, e.Field)
+}
+
 // DecodeCreateOrUpdateBookRequestBody is a helper function to read the content of a book creation or update request.
+// The body must hold a single object without unknown nor repeated fields so misspelled fields are not ignored. Such
+// fields are reported with a RequestFieldError. A missing or blank body fails with ErrEmptyRequestBody.
 func DecodeCreateOrUpdateBookRequestBody(r *http.Request, book *Book) error {
 	if r.Body == nil {
-		return errors.New("invalid create book request body")
+		return ErrEmptyRequestBody
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ErrEmptyRequestBody
 	}
-	return json.NewDecoder(r.Body).Decode(book)
+	return DecodeBook(body, book)
 }
 
-// ValidateCreateBookRequestBody is a helper function to check if the content of a book creation request is valid.
-func ValidateCreateBookRequestBody(book *Book) error {
-	if len(book.Title) == 0 {
-		return missingFieldError("title")
+// DecodeBook reads a single book object without unknown nor repeated fields, like a
+// book creation or update request body or a line of a books import.
+func DecodeBook(body []byte, book *Book) error {
+	if field := findDuplicateField(body); field != "" {
+		return &RequestFieldError{Field: field, Reason: "duplicate"}
 	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(book); err != nil {
+		if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+			return &RequestFieldError{Field: strings.Trim(field, `"`), Reason: "unknown"}
+		}
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after the book object")
+	}
+	return nil
+}
 
-	if len(book.Description) == 0 {
-		return missingFieldError("description")
+// findDuplicateField returns the first field repeated into the top-level JSON object.
+// The names are compared without case like the decoding does. It returns an empty
+// string if there is none or if the body is not a valid object, which is left to the
+// decoding to report.
+func findDuplicateField(body []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return ""
+	}
+	seen := make(map[string]struct{})
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		field, _ := token.(string)
+		if _, found := seen[strings.ToLower(field)]; found {
+			return field
+		}
+		seen[strings.ToLower(field)] = struct{}{}
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return ""
+		}
 	}
+	return ""
+}
 
-	if len(book.Author) == 0 {
-		return missingFieldError("author")
+// DecodeBulkCreateBooksRequestBody is a helper function to read the list of books of a bulk creation request.
+func DecodeBulkCreateBooksRequestBody(r *http.Request, books *[]Book) error {
+	if r.Body == nil {
+		return errors.New("invalid bulk create books request body")
+	}
+	if err := json.NewDecoder(r.Body).Decode(books); err != nil {
+		return err
+	}
+	if len(*books) == 0 || len(*books) > MaxBulkBooks {
+		return fmt.Errorf("number of books must be between 1 and %d", MaxBulkBooks)
 	}
+	return nil
+}
 
-	if len(book.Price) == 0 {
-		return missingFieldError("price")
+// DecodePatchBookRequestBody is a helper function to read the content of a book patch
+// request. Unknown fields are rejected so misspelled or read-only fields are not ignored.
+func DecodePatchBookRequestBody(r *http.Request, patch *BookPatch) error {
+	if r.Body == nil {
+		return errors.New("invalid patch book request body")
 	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(patch)
+}
 
-	return nil
+// ParsePriceRange reads the optional `priceMin` and `priceMax` query parameters.
+// A nil bound means no filtering on that side.
+func ParsePriceRange(r *http.Request) (min, max *float64, err error) {
+	q := r.URL.Query()
+	for _, bound := range []struct {
+		name  string
+		value **float64
+	}{{"priceMin", &min}, {"priceMax", &max}} {
+		raw := q.Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		v, perr := strconv.ParseFloat(raw, 64)
+		if perr != nil || v < 0 {
+			return nil, nil, fmt.Errorf("%s must be a positive number", bound.name)
+		}
+		*bound.value = &v
+	}
+	if min != nil && max != nil && *min > *max {
+		return nil, nil, errors.New("priceMin must not be greater than priceMax")
+	}
+	return min, max, nil
 }
 
-// ValidateUpdateBookRequestBody is a helper function to check if the content of a book update request is valid.
-func ValidateUpdateBookRequestBody(book *Book) error {
-	if err := ValidateCreateBookRequestBody(book); err != nil {
-		return err
+// SortBooksByID orders in place the books by their ID. This is the order of the bolt
+// keys, so a page is listed the same way whatever the storage which served it.
+func SortBooksByID(books []Book) {
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+}
+
+// SortBooks orders in place the books per the sort. Tied books keep their ID order.
+func SortBooks(books []Book, s BookSort) {
+	SortBooksByID(books)
+	sort.SliceStable(books, func(i, j int) bool { return s.Less(books[i], books[j]) })
+}
+
+// TopBooks keeps the first books per a sort among the added ones, up to a limit. The books
+// are held into a heap whose root is the last kept one so a book ranked after it is skipped.
+type TopBooks struct {
+	sorting BookSort
+	limit   int
+	books   []Book
+}
+
+// NewTopBooks provides a TopBooks which keeps at most `limit` books ordered per the sort.
+func NewTopBooks(sorting BookSort, limit int) *TopBooks {
+	return &TopBooks{sorting: sorting, limit: limit}
+}
+
+// Add keeps the book if it ranks among the first ones, dropping the last kept one when the
+// limit is reached.
+func (tb *TopBooks) Add(book Book) {
+	if tb.limit <= 0 {
+		return
+	}
+	if len(tb.books) < tb.limit {
+		heap.Push(tb, book)
+		return
 	}
+	if tb.before(book, tb.books[0]) {
+		tb.books[0] = book
+		heap.Fix(tb, 0)
+	}
+}
+
+// Books returns the kept books ordered per the sort.
+func (tb *TopBooks) Books() []Book {
+	books := append([]Book{}, tb.books...)
+	SortBooks(books, tb.sorting)
+	return books
+}
 
-	if len(book.ID) == 0 {
-		return missingFieldError("id")
+// before reports whether the book a ranks before b per the sort then by their ID.
+func (tb *TopBooks) before(a, b Book) bool {
+	if tb.sorting.Less(a, b) {
+		return true
 	}
+	if tb.sorting.Less(b, a) {
+		return false
+	}
+	return a.ID < b.ID
+}
 
-	if len(book.CreatedAt) == 0 {
-		return missingFieldError("created_at")
+func (tb *TopBooks) Len() int           { return len(tb.books) }
+func (tb *TopBooks) Less(i, j int) bool { return tb.before(tb.books[j], tb.books[i]) }
+func (tb *TopBooks) Swap(i, j int)      { tb.books[i], tb.books[j] = tb.books[j], tb.books[i] }
+func (tb *TopBooks) Push(x interface{}) { tb.books = append(tb.books, x.(Book)) }
+func (tb *TopBooks) Pop() interface{} {
+	book := tb.books[len(tb.books)-1]
+	tb.books = tb.books[:len(tb.books)-1]
+	return book
+}
+
+// ParseBookSort reads the optional `sort` (title, author, createdAt or price) and `order`
+// (asc or desc) query parameters. It defaults to DefaultBookSort and to the ascending
+// order when only the field is provided.
+func ParseBookSort(r *http.Request) (BookSort, error) {
+	q := r.URL.Query()
+	field, order := q.Get("sort"), q.Get("order")
+	if field == "" && order == "" {
+		return DefaultBookSort, nil
+	}
+	s := BookSort{Field: field}
+	if field == "" {
+		s.Field = DefaultBookSort.Field
+	}
+	switch s.Field {
+	case BookFieldTitle, BookFieldAuthor, BookFieldCreatedAt, BookFieldPrice:
+	default:
+		return BookSort{}, errors.New("sort must be one of title, author, createdAt or price")
 	}
+	switch order {
+	case "", "asc":
+	case "desc":
+		s.Desc = true
+	default:
+		return BookSort{}, errors.New("order must be asc or desc")
+	}
+	return s, nil
+}
 
-	return nil
+// FilterBooksByPrice keeps the books with a price within the bounds. Books
+// with an unparseable price are excluded as soon as a bound is provided.
+func FilterBooksByPrice(books []Book, min, max *float64) []Book {
+	if min == nil && max == nil {
+		return books
+	}
+	filtered := make([]Book, 0, len(books))
+	for _, book := range books {
+		price, err := book.PriceValue()
+		if err != nil || (min != nil && price < *min) || (max != nil && price > *max) {
+			continue
+		}
+		filtered = append(filtered, book)
+	}
+	return filtered
+}
+
+// EncodeCursor builds an opaque pagination cursor from a storage position. The
+// kind identifies the storage so a cursor cannot be used against another one.
+func EncodeCursor(kind, position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + ":" + position))
+}
+
+// DecodeCursor returns the storage position held by an opaque cursor built by
+// EncodeCursor with the same kind. It fails with ErrInvalidCursor otherwise.
+func DecodeCursor(kind, cursor string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	position, found := strings.CutPrefix(string(raw), kind+":")
+	if !found || position == "" {
+		return "", ErrInvalidCursor
+	}
+	return position, nil
+}
+
+// ParseSearchFields converts the `field` query parameter of a search into the
+// list of fields to search. An empty value or `all` means all searchable fields.
+func ParseSearchFields(field string) ([]string, error) {
+	switch field {
+	case "", "all":
+		return []string{BookFieldTitle, BookFieldAuthor}, nil
+	case BookFieldTitle, BookFieldAuthor:
+		return []string{field}, nil
+	}
+	return nil, fmt.Errorf("field must be one of %s, %s or all", BookFieldTitle, BookFieldAuthor)
 }
 
 // GetRequestSourceIP helps find the source IP of the caller.
@@ -124,6 +442,64 @@ func GetRequestSourceIP(r *http.Request) string {
 	return ""
 }
 
+// ParseCIDRs converts a list of CIDRs or single IPs into networks.
+// A single IP is converted into a network containing only that IP.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address: %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// ContainsIP reports whether the ip belongs to one of the networks.
+func ContainsIP(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTrustedSourceIP helps find the source IP of the caller. The forwarding headers
+// are only honored when the direct peer is one of the trusted proxies. Otherwise the
+// peer address is used since those headers can be set by any client.
+func GetTrustedSourceIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if ContainsIP(trustedProxies, peer) {
+		return GetRequestSourceIP(r)
+	}
+	if net.ParseIP(peer) == nil {
+		return ""
+	}
+	return peer
+}
+
 // IsAppRunningInDocker checks the existence of the .dockerenv
 // file at the root directory and returns a boolean result. This
 // helps know if the App is running in a docker container or not.
@@ -141,7 +517,20 @@ func SaveConnInContext(ctx context.Context, c net.Conn) context.Context {
 	return context.WithValue(ctx, ConnContextKey, c)
 }
 
-// GetConnFromContext returns the connection saved into the context.
-func GetConnFromContext(ctx context.Context) net.Conn {
-	return ctx.Value(ConnContextKey).(net.Conn)
+// GetRequestConn returns the connection of the request whose deadlines can be changed.
+// It is nil for the HTTP/2 requests since their streams share the connection, so their
+// deadlines are left to the server which sets them per stream.
+func GetRequestConn(r *http.Request) net.Conn {
+	if r.ProtoMajor >= 2 {
+		return nil
+	}
+	conn, _ := GetConnFromContext(r.Context())
+	return conn
+}
+
+// GetConnFromContext returns the connection saved into the context and reports
+// whether it was found. It is missing when the server has no ConnContext hook.
+func GetConnFromContext(ctx context.Context) (net.Conn, bool) {
+	conn, ok := ctx.Value(ConnContextKey).(net.Conn)
+	return conn, ok
 }
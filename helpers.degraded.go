@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DegradedContextKey holds the Degradation of a request whose degraded service is signaled.
+const DegradedContextKey ContextKey = "degraded.mode"
+
+// DegradedSourceBackup is the degraded header value of responses served from the backup storage.
+const DegradedSourceBackup = "backup-storage"
+
+// Degradation records whether a request was served in degraded mode. It is safe for
+// concurrent use since the handler may still be running while the timeout response is sent.
+type Degradation struct {
+	source atomic.Value
+}
+
+// Source returns the storage which served the request in degraded mode, empty if none.
+func (d *Degradation) Source() string {
+	source, _ := d.source.Load().(string)
+	return source
+}
+
+// MarkDegraded records that the request of the context was served from the source
+// because the primary storage failed. It does nothing when degraded service is not
+// signaled for the request.
+func MarkDegraded(ctx context.Context, source string) {
+	if d, ok := ctx.Value(DegradedContextKey).(*Degradation); ok {
+		d.source.Store(source)
+	}
+}
+
+// degradedResponseWriter sets the degraded header right before the response header is
+// sent, so a response served in degraded mode until the handler responded is signaled.
+type degradedResponseWriter struct {
+	http.ResponseWriter
+	header      string
+	degradation *Degradation
+	once        sync.Once
+}
+
+func (dw *degradedResponseWriter) setHeader() {
+	dw.once.Do(func() {
+		if source := dw.degradation.Source(); source != "" {
+			dw.ResponseWriter.Header().Set(dw.header, source)
+		}
+	})
+}
+
+func (dw *degradedResponseWriter) WriteHeader(code int) {
+	dw.setHeader()
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *degradedResponseWriter) Write(b []byte) (int, error) {
+	dw.setHeader()
+	return dw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped response writer for the http.ResponseController.
+func (dw *degradedResponseWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
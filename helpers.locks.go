@@ -0,0 +1,50 @@
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+)
+
+// DefaultLockShards is the default number of mutexes of the books locks.
+const DefaultLockShards = 256
+
+// KeyedMutex serializes in process the holders of the same key. The keys are spread by
+// hash over a fixed number of mutexes so its memory is bounded whatever the number of
+// keys, at the cost of serializing the distinct keys which share a shard.
+type KeyedMutex struct {
+	shards []sync.Mutex
+}
+
+// NewKeyedMutex provides a KeyedMutex with `shards` mutexes or DefaultLockShards if unset.
+func NewKeyedMutex(shards int) *KeyedMutex {
+	if shards <= 0 {
+		shards = DefaultLockShards
+	}
+	return &KeyedMutex{shards: make([]sync.Mutex, shards)}
+}
+
+// Lock locks the keys and returns the function unlocking them. The shards are locked in
+// their order, each once, so the callers locking several keys cannot deadlock.
+func (km *KeyedMutex) Lock(keys ...string) (unlock func()) {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, km.shard(key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		km.shards[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			km.shards[i].Unlock()
+		}
+	}
+}
+
+func (km *KeyedMutex) shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(km.shards)))
+}
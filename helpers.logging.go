@@ -100,8 +100,9 @@ func (sw *SyncWrite) Write(p []byte) (n int, err error) {
 // the same logs are printed to standard output as well. It only adds
 // stacktrace to fatal level logs. All logs come with commit & tag value.
 // The custom clock provides timestamp in UTC for production environment
-// and timestamp in Local timezone in development setup.
-func SetupLogging(config *Config, w *RSyncWrite, clock TickerClocker) (*zap.Logger, func() error) {
+// and timestamp in Local timezone in development setup. The level can
+// be changed while running, like on configuration reload.
+func SetupLogging(config *Config, level zap.AtomicLevel, w *RSyncWrite, clock TickerClocker) (*zap.Logger, func() error) {
 	var logger *zap.Logger
 	if config.IsProduction {
 		zapConfig := zap.NewProductionEncoderConfig()
@@ -113,7 +114,7 @@ func SetupLogging(config *Config, w *RSyncWrite, clock TickerClocker) (*zap.Logg
 		zapConfig.CallerKey = "caller"
 		zapConfig.StacktraceKey = "skt"
 		fileEncoder := zapcore.NewJSONEncoder(zapConfig)
-		zapCore := zapcore.NewTee(zapcore.NewCore(fileEncoder, w, config.LogLevel))
+		zapCore := zapcore.NewTee(zapcore.NewCore(fileEncoder, w, level))
 		logger = zap.New(zapCore, zap.AddCaller(), zap.AddStacktrace(zapcore.FatalLevel))
 		logger = logger.WithOptions(zap.WithClock(clock))
 	} else {
@@ -128,8 +129,8 @@ func SetupLogging(config *Config, w *RSyncWrite, clock TickerClocker) (*zap.Logg
 		fileEncoder := zapcore.NewJSONEncoder(zapConfig)
 		consoleEncoder := zapcore.NewConsoleEncoder(zapConfig)
 		zapCore := zapcore.NewTee(
-			zapcore.NewCore(fileEncoder, w, config.LogLevel),
-			zapcore.NewCore(consoleEncoder, zapcore.Lock(&SyncWrite{os.Stdout}), config.LogLevel))
+			zapcore.NewCore(fileEncoder, w, level),
+			zapcore.NewCore(consoleEncoder, zapcore.Lock(&SyncWrite{os.Stdout}), level))
 		logger = zap.New(zapCore, zap.AddCaller(), zap.AddStacktrace(zapcore.FatalLevel))
 		logger = logger.WithOptions(zap.WithClock(clock))
 	}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification we generate.
+const OpenAPIVersion = "3.0.3"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// BuildOpenAPISpec derives an OpenAPI 3 document from the registered routes.
+// Request and response schemas are built by reflection on the sample values
+// attached to each route. Named structs are emitted once as components.
+func BuildOpenAPISpec(title, version string, routes []RouteDoc) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, route := range routes {
+		path, params := OpenAPIPath(route.Path)
+		for _, q := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name":     q,
+				"in":       "query",
+				"required": false,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+
+		operation := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", ":", "", "*", "").Replace(route.Path),
+			"responses":   openAPIResponses(route, schemas),
+		}
+		if route.Tag != "" {
+			operation["tags"] = []string{route.Tag}
+		}
+		if len(params) != 0 {
+			operation["parameters"] = params
+		}
+		if route.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": SchemaOf(reflect.TypeOf(route.Body), schemas),
+					},
+				},
+			}
+		}
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+// openAPIResponses builds the responses object of a route. APIResponse envelopes get
+// their `data` field specialized with the route data schema. Every route documents the
+// APIError model as its default error response.
+func openAPIResponses(route RouteDoc, schemas map[string]interface{}) map[string]interface{} {
+	var schema interface{}
+	switch {
+	case route.Response != nil:
+		schema = SchemaOf(reflect.TypeOf(route.Response), schemas)
+	case route.Data != nil:
+		schema = map[string]interface{}{
+			"allOf": []interface{}{
+				SchemaOf(reflect.TypeOf(APIResponse{}), schemas),
+				map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"data": SchemaOf(reflect.TypeOf(route.Data), schemas),
+					},
+				},
+			},
+		}
+	default:
+		schema = map[string]interface{}{}
+	}
+
+	status := "200"
+	if route.Method == http.MethodPost {
+		status = "201"
+	}
+	return map[string]interface{}{
+		status: map[string]interface{}{
+			"description": "successful operation",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			},
+		},
+		"default": map[string]interface{}{
+			"description": "failed operation",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": SchemaOf(reflect.TypeOf(APIError{}), schemas),
+				},
+			},
+		},
+	}
+}
+
+// OpenAPIPath converts an httprouter path into an OpenAPI path template
+// and returns the list of path parameters found. For example the path
+// `/v1/books/:id` becomes `/v1/books/{id}` with the `id` parameter.
+func OpenAPIPath(path string) (string, []interface{}) {
+	var params []interface{}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+		name := segment[1:]
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// SchemaOf returns the JSON schema of a given type. Named structs are added into
+// schemas (components) and referenced. Struct fields names are taken from their
+// json tags and fields tagged with `-` are skipped.
+func SchemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": SchemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": SchemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, found := schemas[t.Name()]; !found {
+			// reserve the name first to support recursive types.
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema builds the object schema of a struct type from its exported fields.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		properties[name] = SchemaOf(field.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidOverrides = errors.New("invalid feature overrides")
+	ErrExpiredOverrides = errors.New("expired feature overrides")
+)
+
+// FeatureOverridesHeader carries the feature overrides of a single request as
+// `<overrides>.<signature>`. The overrides are comma separated `name=true|false` pairs
+// along with the mandatory `exp=<unix seconds>` and the signature is their base64url
+// HMAC SHA-256 with the configured secret.
+const FeatureOverridesHeader = "X-Feature-Overrides"
+
+// FeatureOverridesContextKey holds the feature overrides applied to the request.
+const FeatureOverridesContextKey ContextKey = "feature.overrides"
+
+// Features which can be overridden per request.
+const (
+	FeatureBodies = "bodies" // debug log the request and response bodies.
+	FeatureTiming = "timing" // measure the request phases whatever the on-demand mode.
+	FeatureCache  = "cache"  // serve the books from the in-process cache.
+)
+
+// OverridableFeatures lists the features accepted into the overrides header.
+var OverridableFeatures = []string{FeatureBodies, FeatureTiming, FeatureCache}
+
+// FeatureOverrides maps the overridden features to their state for a request.
+type FeatureOverrides map[string]bool
+
+// SignFeatureOverrides provides the overrides header value signed with the secret which
+// expires at the given time. It is meant to get headers for canary testing.
+func SignFeatureOverrides(secret string, overrides FeatureOverrides, expires time.Time) string {
+	pairs := make([]string, 0, len(overrides))
+	for name, enabled := range overrides {
+		pairs = append(pairs, name+"="+strconv.FormatBool(enabled))
+	}
+	slices.Sort(pairs)
+	unsigned := strings.Join(append([]string{"exp=" + strconv.FormatInt(expires.Unix(), 10)}, pairs...), ",")
+	return unsigned + "." + signToken(secret, unsigned)
+}
+
+// ParseFeatureOverrides verifies the signature of the overrides header value with the
+// secret then returns the overrides. Unknown features and malformed values are invalid
+// and expired overrides are rejected.
+func ParseFeatureOverrides(secret, value string, now time.Time) (FeatureOverrides, error) {
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 || !hmac.Equal([]byte(value[dot+1:]), []byte(signToken(secret, value[:dot]))) {
+		return nil, ErrInvalidOverrides
+	}
+	overrides := FeatureOverrides{}
+	var expires int64
+	for _, pair := range strings.Split(value[:dot], ",") {
+		name, state, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, ErrInvalidOverrides
+		}
+		if name == "exp" {
+			var err error
+			if expires, err = strconv.ParseInt(state, 10, 64); err != nil {
+				return nil, ErrInvalidOverrides
+			}
+			continue
+		}
+		enabled, err := strconv.ParseBool(state)
+		if err != nil || !slices.Contains(OverridableFeatures, name) {
+			return nil, ErrInvalidOverrides
+		}
+		overrides[name] = enabled
+	}
+	if expires == 0 {
+		return nil, ErrInvalidOverrides
+	}
+	if now.Unix() >= expires {
+		return nil, ErrExpiredOverrides
+	}
+	return overrides, nil
+}
+
+// FeatureEnabled reports the state of the feature for the request: its override if
+// any, otherwise the given state of the feature.
+func FeatureEnabled(ctx context.Context, name string, enabled bool) bool {
+	if overrides, ok := ctx.Value(FeatureOverridesContextKey).(FeatureOverrides); ok {
+		if overridden, found := overrides[name]; found {
+			return overridden
+		}
+	}
+	return enabled
+}
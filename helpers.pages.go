@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultErrorPage is the minimal HTML page sent to browsers instead of a JSON error.
+// A custom page is an html/template which is executed with an ErrorPage value.
+const DefaultErrorPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Path}}<p><code>{{.Path}}</code></p>{{end}}
+<p><small>request id: {{.RequestID}}</small></p>
+</body>
+</html>
+`
+
+// ErrorPage holds the details of an error rendered as an HTML page.
+type ErrorPage struct {
+	Status    int
+	Title     string
+	Message   string
+	RequestID string
+	Path      string
+}
+
+// NewErrorPages parses the HTML error page template from the file. It
+// falls back to the DefaultErrorPage when no file is provided.
+func NewErrorPages(file string) (*template.Template, error) {
+	if file == "" {
+		return template.New("error").Parse(DefaultErrorPage)
+	}
+	return template.ParseFiles(file)
+}
+
+// AcceptsHTML reports whether the client prefers an HTML response over JSON based on the
+// `Accept` header. HTML must be explicitly accepted with a higher quality than JSON, so
+// API clients sending `*/*` or no header at all keep receiving JSON.
+func AcceptsHTML(r *http.Request) bool {
+	var html, json float64
+	for _, value := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediatype {
+		case "text/html", "application/xhtml+xml":
+			html = max(html, q)
+		case "application/json", "application/*", "*/*":
+			json = max(json, q)
+		}
+	}
+	return html > json
+}
+
+// WriteHTMLError is the WriteErrorResponse of browsers. It renders the error with the
+// HTML page template. The status codes of cancelled or timed out requests are set the
+// same way since the timeout middleware already responded.
+func WriteHTMLError(ctx context.Context, w http.ResponseWriter, pages *template.Template, errResp *APIError, path string) error {
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		} else {
+			w.WriteHeader(499)
+		}
+		return ctx.Err()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(errResp.Status)
+	return pages.Execute(w, ErrorPage{
+		Status:    errResp.Status,
+		Title:     http.StatusText(errResp.Status),
+		Message:   errResp.Message,
+		RequestID: errResp.RequestID,
+		Path:      path,
+	})
+}
@@ -1,80 +1,146 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
 // CustomResponseWriter is a wrapper for http.ResponseWriter. It is
 // used to record response details like status code and body size.
 // The underlying network connection is tracked for dynamic read/write
-// deadline setup.
+// deadline setup. Without connection, the deadlines are left to the
+// underlying writer if it supports them, else skipped. It is shared
+// by the timeout middleware and the handler goroutine so its state
+// and writes are guarded by a mutex. The handler sets its headers on
+// a copy which is only sent along with its response.
 type CustomResponseWriter struct {
 	http.ResponseWriter
-	conn  net.Conn
-	code  int
-	bytes int
-	wrote bool
+	mu       sync.Mutex
+	header   http.Header
+	conn     net.Conn
+	code     int
+	bytes    int
+	wrote    bool
+	aborted  bool // the timeout middleware took over the response.
+	deadline bool // the handler changed the connection write deadline.
 }
 
 // NewCustomResponseWriter provides CustomResponseWriter with 200 as status code.
 func NewCustomResponseWriter(rw http.ResponseWriter, c net.Conn) *CustomResponseWriter {
 	return &CustomResponseWriter{
 		ResponseWriter: rw,
+		header:         rw.Header().Clone(),
 		conn:           c,
 		code:           200,
 	}
 }
 
-// Header implements http.Header interface.
+// Header implements http.Header interface. It returns the handler copy of the
+// headers which must only be used from the handler goroutine.
 func (cw *CustomResponseWriter) Header() http.Header {
-	return cw.ResponseWriter.Header()
+	return cw.header
 }
 
-// WriteHeader implements http.WriteHeader interface.
+// WriteHeader implements http.WriteHeader interface. Once the response was
+// aborted, the status code is only recorded for the stats.
 func (cw *CustomResponseWriter) WriteHeader(code int) {
-	if cw.Header().Get("X-DRAP-ABORTED") != "" {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.aborted {
 		cw.code = code
 		cw.wrote = true
 		return
 	}
+	cw.writeHeader(code)
+}
 
-	if !cw.wrote {
-		cw.code = code
-		cw.wrote = true
-		cw.ResponseWriter.WriteHeader(code)
+// writeHeader sends the handler headers along with the status code once.
+// It must be called with the mutex held.
+func (cw *CustomResponseWriter) writeHeader(code int) {
+	if cw.wrote {
+		return
+	}
+	cw.code = code
+	cw.wrote = true
+	header := cw.ResponseWriter.Header()
+	for key, values := range cw.header {
+		header[key] = values
 	}
+	cw.ResponseWriter.WriteHeader(code)
 }
 
-// Write implements http.Write interface. If the header X-DRAP-ABORTED was set
-// that means the timeout middleware was already triggered so the final handler
+// Write implements http.Write interface. If the response was aborted that
+// means the timeout middleware was already triggered so the final handler
 // should not send any response to client.
 func (cw *CustomResponseWriter) Write(bytes []byte) (int, error) {
-	if cw.Header().Get("X-DRAP-ABORTED") != "" {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.aborted {
 		return 0, fmt.Errorf("handler: request timed out or cancelled")
 	}
-
-	if !cw.wrote {
-		cw.WriteHeader(cw.code)
-	}
-
+	cw.writeHeader(cw.code)
 	n, err := cw.ResponseWriter.Write(bytes)
 	cw.bytes += n
 	return n, err
 }
 
+// FlushError sends the buffered data to the client. It is called by the
+// http.ResponseController Flush method.
+func (cw *CustomResponseWriter) FlushError() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.aborted {
+		return fmt.Errorf("handler: request timed out or cancelled")
+	}
+	cw.writeHeader(cw.code)
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Finish sends the handler headers along with the status code if the handler returned
+// without writing, like a handler which only set headers. Nothing is sent once the
+// response was aborted.
+func (cw *CustomResponseWriter) Finish() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.aborted {
+		return
+	}
+	cw.writeHeader(cw.code)
+}
+
+// Abort prevents any further write from the handler. If the handler did not
+// start its response yet, respond is called to answer the client on the
+// underlying writer instead and it reports true. Any write in progress is
+// completed before.
+func (cw *CustomResponseWriter) Abort(respond func(w http.ResponseWriter)) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.aborted = true
+	if cw.wrote {
+		return false
+	}
+	respond(cw.ResponseWriter)
+	return true
+}
+
 // Status returns the written status code.
 func (cw *CustomResponseWriter) Status() int {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 	return cw.code
 }
 
 // Bytes returns bytes written as response body.
 func (cw *CustomResponseWriter) Bytes() int {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 	return cw.bytes
 }
 
@@ -87,15 +153,39 @@ func (cw *CustomResponseWriter) Unwrap() http.ResponseWriter {
 // SetWriteDeadline rewrites the underlying connection write deadline.
 // This is called by http.ResponseController SetWriteDeadline method.
 func (cw *CustomResponseWriter) SetWriteDeadline(t time.Time) error {
+	if cw.conn == nil {
+		return skipUnsupported(http.NewResponseController(cw.ResponseWriter).SetWriteDeadline(t))
+	}
+	cw.mu.Lock()
+	cw.deadline = true
+	cw.mu.Unlock()
 	return cw.conn.SetWriteDeadline(t)
 }
 
+// WriteDeadlineChanged reports whether the connection write deadline was rewritten.
+func (cw *CustomResponseWriter) WriteDeadlineChanged() bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.deadline
+}
+
 // SetReadDeadline rewrites the underlying connection read deadline.
 // This is called by http.ResponseController SetReadDeadline method.
 func (cw *CustomResponseWriter) SetReadDeadline(t time.Time) error {
+	if cw.conn == nil {
+		return skipUnsupported(http.NewResponseController(cw.ResponseWriter).SetReadDeadline(t))
+	}
 	return cw.conn.SetReadDeadline(t)
 }
 
+// skipUnsupported ignores the error of a deadline the underlying writer cannot set.
+func skipUnsupported(err error) error {
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
 // APIError is the data model sent when an error occurred during request processing.
 type APIError struct {
 	RequestID string      `json:"requestid"`
@@ -108,11 +198,33 @@ type APIError struct {
 // We use the omitempty flag on the `total` field. This helps
 // set the value for `GetAllBook` calls only.
 type APIResponse struct {
-	RequestID string      `json:"requestid"`
-	Status    int         `json:"status"`
-	Message   string      `json:"message"`
-	Total     *int        `json:"total,omitempty"`
-	Data      interface{} `json:"data"`
+	RequestID  string      `json:"requestid"`
+	Status     int         `json:"status"`
+	Message    string      `json:"message"`
+	Total      *int        `json:"total,omitempty"`
+	NextCursor string      `json:"nextCursor,omitempty"` // empty on the last page.
+	Data       interface{} `json:"data"`
+}
+
+// BulkItemResult reports the outcome of a single book of a bulk request.
+type BulkItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ImportResult reports the outcome of a books import. The failed books are
+// reported by their line number into the request, starting from 1.
+type ImportResult struct {
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Failed  []ImportFailure `json:"failed"`
+}
+
+// ImportFailure reports a book of an import which could not be upserted.
+type ImportFailure struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
 }
 
 func NewAPIError(requestid string, status int, message string, data interface{}) *APIError {
@@ -175,3 +287,45 @@ type StatusResponse struct {
 	Status    string `json:"status"`
 	Message   string `json:"message"`
 }
+
+// statusResponseWriter records the status code sent by the next handlers.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code  int
+	wrote bool
+}
+
+func (cw *statusResponseWriter) WriteHeader(code int) {
+	if !cw.wrote {
+		cw.code, cw.wrote = code, true
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *statusResponseWriter) Write(b []byte) (int, error) {
+	cw.wrote = true
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped response writer for the http.ResponseController.
+func (cw *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// bodyResponseWriter records the status code and the first max bytes of the body sent by
+// the next handlers.
+type bodyResponseWriter struct {
+	statusResponseWriter
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (bw *bodyResponseWriter) Write(b []byte) (int, error) {
+	room := max(bw.max-bw.body.Len(), 0)
+	if len(b) > room {
+		bw.truncated = true
+	}
+	bw.body.Write(b[:min(len(b), room)])
+	return bw.statusResponseWriter.Write(b)
+}
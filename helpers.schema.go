@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// ResponseSchemaViolations checks a JSON response body against the schema declared by
+// the route, the same one documented into the OpenAPI document. A field without the
+// `omitempty` option must be present and a string one must not be empty. It returns
+// the violations found, like `data.title: is empty`, or an error if the body is not JSON.
+func ResponseSchemaViolations(body []byte, route RouteDoc) ([]string, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	switch {
+	case route.Response != nil:
+		return schemaViolations("", value, reflect.TypeOf(route.Response)), nil
+	case route.Data != nil:
+		violations := schemaViolations("", value, reflect.TypeOf(APIResponse{}))
+		if object, ok := value.(map[string]interface{}); ok {
+			violations = append(violations, schemaViolations("data", object["data"], reflect.TypeOf(route.Data))...)
+		}
+		return violations, nil
+	default:
+		return nil, nil
+	}
+}
+
+// schemaViolations checks a decoded JSON value at path against the given type. Null
+// values are accepted for pointers, slices and maps which are encoded as such when nil.
+// The values of types with their own JSON encoding are not inspected.
+func schemaViolations(path string, value interface{}, t reflect.Type) []string {
+	mismatch := func(expected string) []string {
+		return []string{fmt.Sprintf("%s: expected %s but got %s", schemaPath(path), expected, jsonKind(value))}
+	}
+	if t.Implements(jsonMarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		if value == nil {
+			return nil
+		}
+		return schemaViolations(path, value, t.Elem())
+	case reflect.Interface:
+		return nil
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch("boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return mismatch("number")
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return mismatch("string")
+		}
+	case reflect.Slice, reflect.Array:
+		if value == nil && t.Kind() == reflect.Slice {
+			return nil
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch("array")
+		}
+		var violations []string
+		for i, item := range items {
+			violations = append(violations, schemaViolations(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+		return violations
+	case reflect.Map:
+		if value == nil {
+			return nil
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		var violations []string
+		for key, item := range object {
+			violations = append(violations, schemaViolations(joinSchemaPath(path, key), item, t.Elem())...)
+		}
+		return violations
+	case reflect.Struct:
+		if t == timeType {
+			if _, ok := value.(string); !ok {
+				return mismatch("string")
+			}
+			return nil
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		return structViolations(path, object, t)
+	}
+	return nil
+}
+
+// structViolations checks the fields of a decoded JSON object against the exported fields
+// of a struct type. The fields of the embedded structs are checked on the same object.
+func structViolations(path string, object map[string]interface{}, t reflect.Type) []string {
+	var violations []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, tagged := field.Name, "", false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			var tagName string
+			tagName, options, _ = strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name, tagged = tagName, true
+			}
+		}
+		if field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct {
+			violations = append(violations, structViolations(path, object, field.Type)...)
+			continue
+		}
+		omitempty := strings.Contains(options, "omitempty")
+		value, found := object[name]
+		if !found {
+			if !omitempty {
+				violations = append(violations, joinSchemaPath(path, name)+": is missing")
+			}
+			continue
+		}
+		if s, ok := value.(string); ok && s == "" && !omitempty && field.Type.Kind() == reflect.String {
+			violations = append(violations, joinSchemaPath(path, name)+": is empty")
+			continue
+		}
+		violations = append(violations, schemaViolations(joinSchemaPath(path, name), value, field.Type)...)
+	}
+	return violations
+}
+
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "body"
+	}
+	return path
+}
+
+// jsonKind returns the JSON type name of a decoded value.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
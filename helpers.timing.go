@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Phases of a request reported into the `Server-Timing` header.
+const (
+	TimingValidation = "validation"
+	TimingStorage    = "storage"
+	TimingQueue      = "queue"
+)
+
+// ServerTimingContextKey holds the ServerTiming of an instrumented request.
+const ServerTimingContextKey ContextKey = "server.timing"
+
+// ServerTiming collects the durations of the phases of a request. The durations of
+// a phase measured many times are summed. It is safe for concurrent use since the
+// handler may still be running while the timeout response is sent.
+type ServerTiming struct {
+	mu        sync.Mutex
+	phases    []string
+	durations map[string]time.Duration
+}
+
+func NewServerTiming() *ServerTiming {
+	return &ServerTiming{durations: make(map[string]time.Duration)}
+}
+
+// Add records the duration d spent into the phase.
+func (st *ServerTiming) Add(phase string, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, found := st.durations[phase]; !found {
+		st.phases = append(st.phases, phase)
+	}
+	st.durations[phase] += d
+}
+
+// Header formats the phases durations in milliseconds as the `Server-Timing`
+// header value (e.g. `validation;dur=0.021, storage;dur=1.304`).
+func (st *ServerTiming) Header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	metrics := make([]string, len(st.phases))
+	for i, phase := range st.phases {
+		metrics[i] = fmt.Sprintf("%s;dur=%.3f", phase, float64(st.durations[phase])/float64(time.Millisecond))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// Fields provides the phases durations as logging fields.
+func (st *ServerTiming) Fields() []zap.Field {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fields := make([]zap.Field, len(st.phases))
+	for i, phase := range st.phases {
+		fields[i] = zap.Duration("timing."+phase, st.durations[phase])
+	}
+	return fields
+}
+
+// TrackTiming starts measuring the phase and returns the function which stops it.
+// It does nothing when the request of the context is not instrumented.
+func TrackTiming(ctx context.Context, clock Clocker, phase string) func() {
+	st, ok := ctx.Value(ServerTimingContextKey).(*ServerTiming)
+	if !ok {
+		return func() {}
+	}
+	start := clock.Now()
+	return func() {
+		st.Add(phase, clock.Now().Sub(start))
+	}
+}
+
+// timingResponseWriter sets the `Server-Timing` header right before the response
+// header is sent, so the phases measured until the handler responded are reported.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing *ServerTiming
+	once   sync.Once
+}
+
+func (tw *timingResponseWriter) setHeader() {
+	tw.once.Do(func() {
+		if value := tw.timing.Header(); value != "" {
+			tw.ResponseWriter.Header().Set("Server-Timing", value)
+		}
+	})
+}
+
+func (tw *timingResponseWriter) WriteHeader(code int) {
+	tw.setHeader()
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingResponseWriter) Write(b []byte) (int, error) {
+	tw.setHeader()
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped response writer for the http.ResponseController.
+func (tw *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
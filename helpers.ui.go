@@ -0,0 +1,17 @@
+//go:build !minimal
+
+package main
+
+import "embed"
+
+// adminUIFiles holds the static files of the ops admin UI. They are left out of the
+// builds with the `minimal` tag.
+//
+//go:embed ui/admin.html
+var adminUIFiles embed.FS
+
+// AdminUI returns the ops admin page or nil if the build excluded it.
+func AdminUI() []byte {
+	page, _ := adminUIFiles.ReadFile("ui/admin.html")
+	return page
+}
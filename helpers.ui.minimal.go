@@ -0,0 +1,8 @@
+//go:build minimal
+
+package main
+
+// AdminUI returns nil since the minimal builds exclude the ops admin page.
+func AdminUI() []byte {
+	return nil
+}
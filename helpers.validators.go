@@ -1 +1,133 @@
 package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum number of characters of the books text fields.
+const (
+	MaxTitleLength       = 256
+	MaxDescriptionLength = 4096
+	MaxAuthorLength      = 128
+)
+
+// Rules checked on the books fields.
+const (
+	RuleRequired  = "required"
+	RuleMaxLength = "max_length"
+	RulePrice     = "price"
+	RuleMin       = "min"
+	RuleCurrency  = "currency"
+)
+
+// FieldViolation describes a rule broken by a field of a request body.
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects all the rules broken by a request body so
+// the client can fix them at once.
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (ve *ValidationError) Error() string {
+	messages := make([]string, 0, len(ve.Violations))
+	for _, v := range ve.Violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// required records a violation if the field value is empty.
+func (ve *ValidationError) required(field, value string) bool {
+	if value != "" {
+		return true
+	}
+	ve.Violations = append(ve.Violations, FieldViolation{Field: field, Rule: RuleRequired, Message: field + " is required"})
+	return false
+}
+
+// maxLength records a violation if the field value has more than max characters.
+func (ve *ValidationError) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		ve.Violations = append(ve.Violations, FieldViolation{Field: field, Rule: RuleMaxLength, Message: fmt.Sprintf("%s must be at most %d characters", field, max)})
+	}
+}
+
+// err returns the ValidationError if any rule was broken, otherwise nil.
+func (ve *ValidationError) err() error {
+	if len(ve.Violations) == 0 {
+		return nil
+	}
+	return ve
+}
+
+// ValidationErrorData provides the `data` of the error response of an invalid request
+// body: the list of broken rules of a *ValidationError, otherwise the error message.
+func ValidationErrorData(err error) interface{} {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve.Violations
+	}
+	return err.Error()
+}
+
+// validateBook checks the fields provided by the clients on books creation and update.
+func validateBook(ve *ValidationError, book *Book) {
+	if ve.required("title", book.Title) {
+		ve.maxLength("title", book.Title, MaxTitleLength)
+	}
+
+	if ve.required("description", book.Description) {
+		ve.maxLength("description", book.Description, MaxDescriptionLength)
+	}
+
+	if ve.required("author", book.Author) {
+		ve.maxLength("author", book.Author, MaxAuthorLength)
+	}
+
+	validatePrice(ve, book.Price)
+}
+
+// validatePrice checks the price is provided with a non-negative amount and a known currency.
+func validatePrice(ve *ValidationError, price Price) {
+	switch {
+	case price.IsZero():
+		ve.Violations = append(ve.Violations, FieldViolation{Field: "price", Rule: RuleRequired, Message: "price is required"})
+	case price.IsLegacy():
+		ve.Violations = append(ve.Violations, FieldViolation{Field: "price", Rule: RulePrice, Message: "price must be an amount with a currency like {\"amount\":1050,\"currency\":\"USD\"} or 10.50$"})
+	default:
+		if price.Amount < 0 {
+			ve.Violations = append(ve.Violations, FieldViolation{Field: "price.amount", Rule: RuleMin, Message: "price.amount must not be negative"})
+		}
+		if !knownCurrencies[price.Currency] {
+			ve.Violations = append(ve.Violations, FieldViolation{Field: "price.currency", Rule: RuleCurrency, Message: fmt.Sprintf("price.currency %q is not a known ISO-4217 code", price.Currency)})
+		}
+	}
+}
+
+// ValidateCreateBookRequestBody is a helper function to check if the content of a book creation request is valid.
+// The title, description, author and price are required while the ID and times are set by the service.
+// It returns a *ValidationError listing all the broken rules.
+func ValidateCreateBookRequestBody(book *Book) error {
+	ve := &ValidationError{}
+	validateBook(ve, book)
+	return ve.err()
+}
+
+// ValidateUpdateBookRequestBody is a helper function to check if the content of a book update request is valid.
+// It requires the fields of the creation along with the ID and the creation time, and returns a
+// *ValidationError listing all the broken rules.
+func ValidateUpdateBookRequestBody(book *Book) error {
+	ve := &ValidationError{}
+	validateBook(ve, book)
+	ve.required("id", book.ID)
+	ve.required("created_at", book.CreatedAt)
+	return ve.err()
+}
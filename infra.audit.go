@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a record of an ops request.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestid"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Source    string    `json:"source"`
+	Status    int       `json:"status"`
+}
+
+// AuditLog is an append-only JSON lines file of ops requests.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewAuditLog opens (or creates) the audit log file for appending.
+func NewAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Append writes the entry as a single JSON line.
+func (al *AuditLog) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	_, err = al.file.Write(append(line, '\n'))
+	return err
+}
+
+// Export streams into w the lines of entries recorded within [from, to]. The file is
+// read line by line so the whole log is never loaded in memory. It returns the number
+// of exported entries.
+func (al *AuditLog) Export(ctx context.Context, from, to time.Time, w io.Writer) (int, error) {
+	file, err := os.Open(al.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		var entry struct {
+			Time time.Time `json:"time"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry.Time.Before(from) || entry.Time.After(to) {
+			continue
+		}
+		if _, err = w.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// Close closes the audit log file.
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errorCircuit holds the client errors counted within the current window and, once
+// tripped, the time until which the client requests are short-circuited.
+type errorCircuit struct {
+	start     time.Time
+	errors    int
+	openUntil time.Time
+}
+
+// ErrorBreaker is a circuit breaker per client tripped by repeated client errors. Once a
+// client got threshold 4xx responses within a window, its requests are short-circuited
+// for the cooldown then its circuit is closed again with a fresh window. The circuits
+// which are equivalent to new ones are periodically removed to bound the memory.
+type ErrorBreaker struct {
+	mu        sync.Mutex
+	clock     Clocker
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	circuits  map[string]*errorCircuit
+	lastSweep time.Time
+}
+
+func NewErrorBreaker(clock Clocker, threshold int, window, cooldown time.Duration) *ErrorBreaker {
+	return &ErrorBreaker{
+		clock:     clock,
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*errorCircuit),
+		lastSweep: clock.Now(),
+	}
+}
+
+// Allow reports whether the client circuit is closed. Otherwise it returns false with
+// the remaining cooldown. A circuit whose cooldown elapsed is closed with a new window.
+func (eb *ErrorBreaker) Allow(client string) (bool, time.Duration) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	now := eb.clock.Now()
+	if now.Sub(eb.lastSweep) >= eb.window {
+		eb.sweep(now)
+	}
+	circuit, found := eb.circuits[client]
+	if !found || circuit.openUntil.IsZero() {
+		return true, 0
+	}
+	if now.Before(circuit.openUntil) {
+		return false, circuit.openUntil.Sub(now)
+	}
+	eb.circuits[client] = &errorCircuit{start: now}
+	return true, 0
+}
+
+// Record counts a client error response and trips the client circuit once the threshold
+// is reached within the window. It reports whether the circuit was tripped by this error.
+func (eb *ErrorBreaker) Record(client string) bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	now := eb.clock.Now()
+	circuit, found := eb.circuits[client]
+	if found && !circuit.openUntil.IsZero() {
+		return false
+	}
+	if !found || now.Sub(circuit.start) >= eb.window {
+		circuit = &errorCircuit{start: now}
+		eb.circuits[client] = circuit
+	}
+	circuit.errors++
+	if circuit.errors < eb.threshold {
+		return false
+	}
+	circuit.openUntil = now.Add(eb.cooldown)
+	return true
+}
+
+// sweep removes the circuits whose window ended without tripping or whose cooldown elapsed.
+func (eb *ErrorBreaker) sweep(now time.Time) {
+	for client, circuit := range eb.circuits {
+		if circuit.openUntil.IsZero() && now.Sub(circuit.start) >= eb.window || !circuit.openUntil.IsZero() && !now.Before(circuit.openUntil) {
+			delete(eb.circuits, client)
+		}
+	}
+	eb.lastSweep = now
+}
+
+// Len returns the number of tracked clients.
+func (eb *ErrorBreaker) Len() int {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return len(eb.circuits)
+}
+
+// Circuit states of the StorageBreaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned instead of calling a storage whose circuit is open.
+var ErrCircuitOpen = errors.New("storage circuit open")
+
+// StorageBreaker is a circuit breaker guarding a storage. Once threshold calls failed in a
+// row, the circuit is opened and the calls fail fast for the cooldown. Then it is half-opened
+// and a single probe call is let through: its success closes the circuit and its failure opens
+// it again for another cooldown. The transitions are logged.
+type StorageBreaker struct {
+	mu        sync.Mutex
+	logger    *zap.Logger
+	clock     Clocker
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewStorageBreaker(logger *zap.Logger, clock Clocker, name string, threshold int, cooldown time.Duration) *StorageBreaker {
+	return &StorageBreaker{
+		logger:    logger,
+		clock:     clock,
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// Allow reports whether a call can reach the storage. An open circuit whose cooldown elapsed
+// is half-opened and lets through a single probe call until its outcome is recorded.
+func (sb *StorageBreaker) Allow() bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	switch sb.state {
+	case CircuitOpen:
+		if sb.clock.Now().Sub(sb.openedAt) < sb.cooldown {
+			return false
+		}
+		sb.transition(CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if sb.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	sb.probing = true
+	return true
+}
+
+// Record records the outcome of an allowed call. The not found and the invalid cursor errors
+// tell the storage is healthy so they count as successes. The cancellations by the clients
+// tell nothing so they only release the probe. The late outcomes of calls allowed before the
+// circuit was opened are ignored.
+func (sb *StorageBreaker) Record(err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.state == CircuitOpen {
+		return
+	}
+	if sb.state == CircuitHalfOpen {
+		sb.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil || errors.Is(err, ErrBookNotFound) || errors.Is(err, ErrInvalidCursor) {
+		sb.failures = 0
+		if sb.state != CircuitClosed {
+			sb.transition(CircuitClosed)
+		}
+		return
+	}
+	sb.failures++
+	if sb.state == CircuitHalfOpen || sb.failures >= sb.threshold {
+		sb.openedAt = sb.clock.Now()
+		sb.transition(CircuitOpen)
+	}
+}
+
+// transition moves the circuit to the state and logs it.
+func (sb *StorageBreaker) transition(state string) {
+	fields := []zap.Field{zap.String("storage", sb.name), zap.String("from", sb.state), zap.String("to", state)}
+	sb.state = state
+	if state == CircuitOpen {
+		sb.logger.Warn("breaker: storage circuit opened", append(fields, zap.Int("failures", sb.failures), zap.Duration("cooldown", sb.cooldown))...)
+		return
+	}
+	sb.logger.Info("breaker: storage circuit changed", fields...)
+}
+
+// State returns the circuit state, the number of failures in a row and when it was last opened.
+func (sb *StorageBreaker) State() (string, int, time.Time) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.state, sb.failures, sb.openedAt
+}
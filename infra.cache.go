@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BookCache is a size-bounded in-process LRU cache of books. Each entry expires
+// after the configured TTL. It is safe for concurrent use. Since it lives in the
+// process, writes done by other instances are only observed once entries expire.
+type BookCache struct {
+	mu      sync.Mutex
+	clock   Clocker
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is the most recently used.
+	entries map[string]*list.Element
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// bookCacheEntry is the value of each element of the LRU list.
+type bookCacheEntry struct {
+	id        string
+	book      Book
+	expiresAt time.Time
+}
+
+// NewBookCache provides an instance of BookCache holding at most `size` books.
+func NewBookCache(clock Clocker, size int, ttl time.Duration) *BookCache {
+	return &BookCache{
+		clock:   clock,
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// Get returns the cached book and true if it exists and did not expire.
+func (c *BookCache) Get(id string) (Book, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[id]
+	if !found {
+		c.misses.Add(1)
+		return Book{}, false
+	}
+	entry := elem.Value.(*bookCacheEntry)
+	if !c.clock.Now().Before(entry.expiresAt) {
+		c.removeElement(elem)
+		c.misses.Add(1)
+		return Book{}, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits.Add(1)
+	return entry.book, true
+}
+
+// Put caches the book and evicts the least recently used one when full.
+func (c *BookCache) Put(id string, book Book) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiresAt := c.clock.Now().Add(c.ttl)
+	if elem, found := c.entries[id]; found {
+		entry := elem.Value.(*bookCacheEntry)
+		entry.book, entry.expiresAt = book, expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&bookCacheEntry{id: id, book: book, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Remove invalidates the cached book if any.
+func (c *BookCache) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[id]; found {
+		c.removeElement(elem)
+	}
+}
+
+// Purge invalidates all cached books.
+func (c *BookCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element, c.size)
+}
+
+// Len returns the number of cached books, including expired ones not yet evicted.
+func (c *BookCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns the number of lookups which found a cached book and of the ones which did not.
+func (c *BookCache) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+func (c *BookCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*bookCacheEntry).id)
+}
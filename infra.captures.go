@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedactedValue replaces sensitive values into captured requests.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedHeaders are the headers always redacted from captured requests.
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// Ensure *memoryCaptureStore implements CaptureStore.
+var _ CaptureStore = (*memoryCaptureStore)(nil)
+
+// CapturedRequest holds a recorded request with the status it was answered with.
+type CapturedRequest struct {
+	ID         string      `json:"id"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+	Truncated  bool        `json:"truncated"`
+	Status     int         `json:"status"`
+	CapturedAt time.Time   `json:"capturedAt"`
+}
+
+// CaptureStore defines operations on captured requests.
+type CaptureStore interface {
+	Save(capture CapturedRequest) error
+	Get(id string) (CapturedRequest, bool)
+	List() []CapturedRequest
+}
+
+// memoryCaptureStore keeps the most recent captured requests in memory.
+type memoryCaptureStore struct {
+	mu       sync.RWMutex
+	max      int
+	captures []CapturedRequest // oldest first.
+}
+
+// NewMemoryCaptureStore provides an in-memory store bounded to `max` captures.
+func NewMemoryCaptureStore(max int) CaptureStore {
+	if max <= 0 {
+		max = 100
+	}
+	return &memoryCaptureStore{max: max}
+}
+
+// Save records the capture and drops the oldest one when full.
+func (cs *memoryCaptureStore) Save(capture CapturedRequest) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.captures) == cs.max {
+		cs.captures = append(cs.captures[:0], cs.captures[1:]...)
+	}
+	cs.captures = append(cs.captures, capture)
+	return nil
+}
+
+// Get returns the capture with the given id.
+func (cs *memoryCaptureStore) Get(id string) (CapturedRequest, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, capture := range cs.captures {
+		if capture.ID == id {
+			return capture, true
+		}
+	}
+	return CapturedRequest{}, false
+}
+
+// List returns all captures from the oldest to the most recent.
+func (cs *memoryCaptureStore) List() []CapturedRequest {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	captures := make([]CapturedRequest, len(cs.captures))
+	copy(captures, cs.captures)
+	return captures
+}
+
+// RedactHeader returns a copy of the header with sensitive values redacted.
+func RedactHeader(header http.Header, names []string) http.Header {
+	redacted := header.Clone()
+	for _, name := range names {
+		if _, found := redacted[http.CanonicalHeaderKey(name)]; found {
+			redacted.Set(name, RedactedValue)
+		}
+	}
+	return redacted
+}
+
+// RedactJSONBody redacts the values of the given fields at any depth of a JSON body.
+// A body which is not valid JSON is returned unchanged.
+func RedactJSONBody(body []byte, fields []string) []byte {
+	if len(fields) == 0 {
+		return body
+	}
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return body
+	}
+	redactJSONValue(data, fields)
+	redacted, err := json.Marshal(data)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+func redactJSONValue(value interface{}, fields []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if containsFold(fields, key) {
+				v[key] = RedactedValue
+				continue
+			}
+			redactJSONValue(item, fields)
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactJSONValue(item, fields)
+		}
+	}
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,55 +2,383 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
+// Write policies of the backup consumer. With `all` a book is committed only when
+// every sink applied it. With `quorum` it is enough for a quorum of sinks.
+const (
+	BackupPolicyAll    = "all"
+	BackupPolicyQuorum = "quorum"
+)
+
+// Bounds of the delay waited by the backup consumer after a fatal error.
+const (
+	DefaultFatalDelay = time.Second
+	MaxFatalDelay     = time.Minute
+)
+
+// FatalErrors lists the errors which cannot go away by themselves so retrying at once
+// is pointless, like the storages closed for good.
+var FatalErrors = []error{redis.ErrClosed, bolt.ErrDatabaseNotOpen}
+
+// IsFatalError reports whether err is or wraps one of the FatalErrors.
+func IsFatalError(err error) bool {
+	return slices.ContainsFunc(FatalErrors, func(fatal error) bool { return errors.Is(err, fatal) })
+}
+
 type Consumer interface {
 	Consume(ctx context.Context, qids ...string) error
 }
 
-type boltDBConsumer struct {
-	logger *zap.Logger
-	queue  Queuer
-	repo   BookStorage
+// DeadLetterQueue returns the id of the queue holding the books popped from the queue
+// qid which could not be committed according to the write policy after the retries.
+func DeadLetterQueue(qid string) string {
+	return "failed:" + qid
+}
+
+// QuarantineQueue returns the id of the queue holding the books popped from the queue
+// qid which is not one of the queues consumed, like a stray key colliding with them.
+// They are kept aside for inspection instead of being applied or dropped.
+func QuarantineQueue(qid string) string {
+	return "quarantine:" + qid
+}
+
+// RepairQueue returns the id of the queue holding the books popped from the queue qid
+// which were committed on a quorum of sinks but failed on the sink named sink. They are
+// kept aside so that sink can be repaired instead of silently diverging from the others.
+func RepairQueue(sink, qid string) string {
+	return "repair:" + sink + ":" + qid
+}
+
+// Heartbeat records the last time a consumer was alive, that is waiting for a book or
+// processing one. A nil Heartbeat records nothing.
+type Heartbeat struct {
+	clock Clocker
+	last  atomic.Int64
+}
+
+// NewHeartbeat provides a Heartbeat which considers the consumer alive from now.
+func NewHeartbeat(clock Clocker) *Heartbeat {
+	hb := &Heartbeat{clock: clock}
+	hb.Beat()
+	return hb
+}
+
+// Beat records the consumer is alive.
+func (hb *Heartbeat) Beat() {
+	if hb != nil {
+		hb.last.Store(hb.clock.Now().UnixNano())
+	}
+}
+
+// Age returns the time elapsed since the last beat.
+func (hb *Heartbeat) Age() time.Duration {
+	return hb.clock.Now().Sub(time.Unix(0, hb.last.Load()))
+}
+
+// BackupSink is a named backup storage fed by the consumer.
+type BackupSink struct {
+	Name string
+	Repo BookStorage
 }
 
+// backupConsumer applies each popped book to all its backup sinks.
+type backupConsumer struct {
+	logger   *zap.Logger
+	queue    Queuer
+	sinks    []BackupSink
+	policy   string
+	quorum   int
+	retry    RetryConfig
+	fatal    FatalConfig
+	sampling uint64
+	applied  atomic.Uint64
+	beats    *Heartbeat
+}
+
+// NewBoltDBConsumer provides a consumer which feeds a single bolt-based backup storage.
 func NewBoltDBConsumer(logger *zap.Logger, q Queuer, repo BookStorage) Consumer {
-	return &boltDBConsumer{logger, q, repo}
+	return NewBackupConsumer(logger, q, BackupConfig{Policy: BackupPolicyAll}, nil, BackupSink{Name: "boltdb", Repo: repo})
+}
+
+// NewBackupConsumer provides a consumer which feeds multiple backup storages. The quorum
+// is only used with the `quorum` policy and defaults to the majority of sinks when not
+// set or greater than the number of sinks. Each sink write is retried per the retry config
+// and one out of the log sampling books applied is logged. The fatal errors are handled per
+// the fatal config. The sinks of the config are
+// ignored in favor of the given ones. The consumer beats the heartbeat, if any, on each loop.
+func NewBackupConsumer(logger *zap.Logger, q Queuer, config BackupConfig, beats *Heartbeat, sinks ...BackupSink) Consumer {
+	return &backupConsumer{
+		logger:   logger,
+		queue:    q,
+		sinks:    sinks,
+		policy:   config.Policy,
+		quorum:   config.Quorum,
+		retry:    config.Retry,
+		fatal:    FatalConfig{Attempts: config.Fatal.Attempts, Delay: orDefault(config.Fatal.Delay, DefaultFatalDelay)},
+		sampling: uint64(max(config.LogSampling, 0)),
+		beats:    beats,
+	}
 }
 
-func (bc *boltDBConsumer) Consume(ctx context.Context, qids ...string) error {
+// required returns the number of sinks which must apply a book for it to be committed.
+func (bc *backupConsumer) required() int {
+	if bc.policy != BackupPolicyQuorum {
+		return len(bc.sinks)
+	}
+	if bc.quorum > 0 && bc.quorum <= len(bc.sinks) {
+		return bc.quorum
+	}
+	return len(bc.sinks)/2 + 1
+}
+
+// Consume processes the books popped from the queues until the context is cancelled. The
+// storage writes are detached from the context cancellation so on shutdown the book being
+// processed is fully persisted before returning, and no new book is popped once cancelled.
+// With a queue which is an Acker, the books left unacknowledged by a previous run are first
+// recovered and each book is acknowledged once settled, so a crash does not lose it.
+// A fatal error of the queue or of the sinks makes it back off, and it returns the error
+// once they happened the configured number of times in a row. The book whose processing
+// failed with a fatal error is processed again before popping the next one, so it is kept
+// into the processing list until settled instead of being overwritten by the next pop.
+func (bc *backupConsumer) Consume(ctx context.Context, qids ...string) error {
 	var book Book
 	var err error
 	var qid string
+	var retry bool
+	fatals := 0
+	acker, reliable := bc.queue.(Acker)
+	reader, enveloped := bc.queue.(MessageReader)
+	if reliable {
+		moved, err := acker.Recover(ctx, qids...)
+		if err != nil {
+			bc.logger.Error("consumer: failed to recover processing books", zap.Int("count", moved), zap.Error(err))
+		} else if moved > 0 {
+			bc.logger.Info("consumer: recovered processing books", zap.Int("count", moved))
+		}
+	}
 	for {
-		qid, book, err = bc.queue.Pop(ctx, qids...)
+		bc.beats.Beat()
+		if ctx.Err() != nil {
+			bc.logger.Info("consumer: exited", zap.String("reason", ctx.Err().Error()))
+			return nil
+		}
+
+		if retry {
+			retry = false
+		} else {
+			qid, book, err = bc.queue.Pop(ctx, qids...)
+		}
 		if err != nil && ctx.Err() != nil {
 			bc.logger.Info("consumer: exited", zap.String("reason", ctx.Err().Error()))
 			return nil
 		}
 
+		if err == ErrQueueEmpty {
+			continue
+		}
+
+		if err != nil && IsFatalError(err) {
+			fatals++
+			if err = bc.backoff(ctx, fatals, err); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if err != nil {
 			bc.logger.Error("consumer: error on queue pop call", zap.Error(err))
 			continue
 		}
 
-		switch qid {
-		case CreateQueue:
-			if err = bc.repo.Add(ctx, book.ID, book); err != nil {
-				bc.logger.Error("consumer: failed to create", zap.Any("book", book), zap.Error(err))
+		pctx := ctx
+		if enveloped {
+			if msg, found := reader.Message(qid); found && msg.RequestID != "" {
+				pctx = context.WithValue(ctx, RequestIDContextKey, msg.RequestID)
 			}
-		case UpdateQueue:
-			if _, err = bc.repo.Update(ctx, book.ID, book); err != nil {
-				bc.logger.Error("consumer: failed to update", zap.Any("book", book), zap.Error(err))
+		}
+		var settled bool
+		if slices.Contains(qids, qid) {
+			settled, err = bc.process(pctx, qid, book)
+		} else {
+			settled = bc.quarantine(pctx, qid, book)
+		}
+		if err != nil {
+			fatals++
+			if err = bc.backoff(ctx, fatals, err); err != nil {
+				return err
 			}
-		case DeleteQueue:
-			if err = bc.repo.Delete(ctx, book.ID); err != nil {
-				bc.logger.Error("consumer: failed to delete", zap.String("id", book.ID), zap.Error(err))
+			retry = true
+			continue
+		}
+		fatals = 0
+		if !settled || !reliable {
+			continue
+		}
+		if err = acker.Ack(context.WithoutCancel(ctx), qid); err != nil {
+			bc.logger.Error("consumer: failed to acknowledge book", zap.String("qid", qid), zap.String("id", book.ID), zap.Error(err))
+		}
+	}
+}
+
+// process applies the operation associated to the queue into each sink. Each sink failure
+// is logged. When a quorum of sinks applied the book, it is pushed into the repair queue of
+// each failed sink. When not enough sinks applied it, it is routed to the dead letter queue
+// unless a sink failed with a fatal error which is returned. The book is then not settled.
+// The writes are detached from the context whose cancellation only stops the retries. It
+// reports whether the book is settled, that is applied, routed or quarantined when the queue
+// is not a backup one. The logs carry the operation, the queue, the book and the originating request ids.
+func (bc *backupConsumer) process(ctx context.Context, qid string, book Book) (bool, error) {
+	done := ctx.Done()
+	ctx = context.WithoutCancel(ctx)
+	logger := bc.logger.With(
+		zap.String("op", QueueOperation(qid)),
+		zap.String("qid", qid),
+		zap.String("id", book.ID),
+		zap.String("request.id", GetValueFromContext(ctx, RequestIDContextKey)),
+	)
+	if !slices.Contains(BackupQueues, qid) {
+		return bc.quarantine(ctx, qid, book), nil
+	}
+
+	var failed []string
+	var fatal error
+	attempts := 0
+	for _, sink := range bc.sinks {
+		n, err := bc.applyWithRetry(ctx, done, logger, sink, qid, book)
+		attempts = max(attempts, n)
+		if err != nil {
+			logger.Error("consumer: failed to apply", zap.String("sink", sink.Name), zap.Any("book", book), zap.Int("attempt", n), zap.Error(err))
+			failed = append(failed, sink.Name)
+		}
+		if IsFatalError(err) {
+			fatal = fmt.Errorf("sink %s: %w", sink.Name, err)
+		}
+	}
+
+	if len(failed) == 0 {
+		if bc.sampling > 0 && bc.applied.Add(1)%bc.sampling == 0 {
+			logger.Info("consumer: applied", zap.Int("sinks", len(bc.sinks)), zap.Int("attempt", attempts))
+		}
+		return true, nil
+	}
+	if len(bc.sinks)-len(failed) >= bc.required() {
+		logger.Warn("consumer: applied on a quorum of sinks", zap.Strings("failed", failed))
+		for _, sink := range failed {
+			if err := bc.queue.Push(ctx, RepairQueue(sink, qid), book); err != nil {
+				logger.Error("consumer: failed to push to repair queue", zap.String("sink", sink), zap.Any("book", book), zap.Error(err))
 			}
-		default:
-			bc.logger.Warn("consumer: received book on unknow queue id", zap.String("qid", qid), zap.Any("book", book))
 		}
+		return true, nil
+	}
+	if fatal != nil {
+		return false, fatal
+	}
+	if err := bc.queue.Push(ctx, DeadLetterQueue(qid), book); err != nil {
+		logger.Error("consumer: failed to push to dead letter queue", zap.Any("book", book), zap.Error(err))
+		return false, nil
+	}
+	return true, nil
+}
+
+// backoff waits after the fatal error err, the configured delay then twice longer after
+// each consecutive one up to MaxFatalDelay. It returns the error instead once the fatals
+// in a row reach the configured attempts, and returns at once when ctx is cancelled.
+func (bc *backupConsumer) backoff(ctx context.Context, fatals int, err error) error {
+	if bc.fatal.Attempts > 0 && fatals >= bc.fatal.Attempts {
+		bc.logger.Error("consumer: stopped on fatal errors", zap.Int("count", fatals), zap.Error(err))
+		return fmt.Errorf("consumer: %d fatal errors in a row: %w", fatals, err)
+	}
+	delay := bc.fatal.Delay
+	for i := 1; i < fatals && delay < MaxFatalDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, MaxFatalDelay)
+	bc.logger.Error("consumer: backing off on fatal error", zap.Int("count", fatals), zap.Duration("delay", delay), zap.Error(err))
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+	return nil
+}
+
+// quarantine moves the book popped from the unexpected queue qid into its quarantine queue
+// so it is neither applied under a wrong operation nor lost. It reports whether the book is
+// settled. The quarantine failure leaves it unacknowledged to be recovered on next start.
+func (bc *backupConsumer) quarantine(ctx context.Context, qid string, book Book) bool {
+	ctx = context.WithoutCancel(ctx)
+	logger := bc.logger.With(
+		zap.String("qid", qid),
+		zap.String("id", book.ID),
+		zap.String("request.id", GetValueFromContext(ctx, RequestIDContextKey)),
+	)
+	if err := bc.queue.Push(ctx, QuarantineQueue(qid), book); err != nil {
+		logger.Error("consumer: failed to quarantine book of unexpected queue id", zap.Any("book", book), zap.Error(err))
+		return false
+	}
+	logger.Error("consumer: quarantined book of unexpected queue id", zap.String("quarantine", QuarantineQueue(qid)))
+	return true
+}
+
+// applyWithRetry runs apply up to the configured number of attempts with an exponential
+// backoff starting at the configured delay. The failures which cannot be fixed by a retry
+// like a missing book or a fatal one are not retried, nor are the attempts left once `done` is closed.
+// It returns the number of attempts made.
+func (bc *backupConsumer) applyWithRetry(ctx context.Context, done <-chan struct{}, logger *zap.Logger, sink BackupSink, qid string, book Book) (int, error) {
+	delay := bc.retry.Delay
+	for attempt := 1; ; attempt++ {
+		err := bc.apply(ctx, sink.Repo, qid, book)
+		if err == nil || err == ErrBookNotFound || err == ErrTrashNotSupported || IsFatalError(err) || attempt >= bc.retry.Attempts {
+			return attempt, err
+		}
+		logger.Warn("consumer: retrying to apply", zap.String("sink", sink.Name), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// apply runs on the repository the operation associated to the queue.
+func (bc *backupConsumer) apply(ctx context.Context, repo BookStorage, qid string, book Book) error {
+	switch qid {
+	case CreateQueue:
+		return repo.Add(ctx, book.ID, book)
+	case UpdateQueue:
+		_, err := repo.Update(ctx, book.ID, book)
+		return err
+	case DeleteQueue:
+		return repo.Delete(ctx, book.ID)
+	case TrashQueue, RestoreQueue:
+		trasher, ok := repo.(BookTrasher)
+		if !ok {
+			return ErrTrashNotSupported
+		}
+		if qid == RestoreQueue {
+			_, err := trasher.Restore(ctx, book.ID)
+			return err
+		}
+		deletedAt, err := time.Parse(time.RFC3339, book.DeletedAt)
+		if err != nil {
+			return err
+		}
+		_, err = trasher.Trash(ctx, book.ID, deletedAt)
+		return err
 	}
+	return errors.New("unknown queue id")
 }
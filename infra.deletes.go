@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeleteBatchSize is the maximum number of due deletes claimed at once.
+const DeleteBatchSize = 100
+
+// DeleteScheduler carries out the books deletes once their grace period elapsed. Each
+// due delete is pushed to the deletion queue so the backup storage removes the book. The
+// primary storage is set when its copy was kept during the grace period as well.
+type DeleteScheduler struct {
+	logger   *zap.Logger
+	clock    Clocker
+	store    BookDeleteScheduler
+	primary  BookStorage // nil if the books were removed from primary storage at once.
+	queue    Queuer
+	interval time.Duration
+}
+
+// NewDeleteScheduler provides a scheduler which checks the due deletes every interval.
+func NewDeleteScheduler(logger *zap.Logger, clock Clocker, store BookDeleteScheduler, primary BookStorage, queue Queuer, interval time.Duration) *DeleteScheduler {
+	return &DeleteScheduler{
+		logger:   logger,
+		clock:    clock,
+		store:    store,
+		primary:  primary,
+		queue:    queue,
+		interval: interval,
+	}
+}
+
+// Run carries out the due deletes every interval until the context is cancelled.
+func (ds *DeleteScheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(ds.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ds.logger.Info("deletes: scheduler exited", zap.String("reason", ctx.Err().Error()))
+			return nil
+		case <-ticker.C:
+			if n, err := ds.Drain(ctx); err != nil && ctx.Err() == nil {
+				ds.logger.Error("deletes: failed to carry out deletes", zap.Int("deleted", n), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Drain claims the due deletes by batches and carries them out until none is due and
+// returns their number. On failure, the claimed deletes not carried out are scheduled
+// again to be retried on the next run.
+func (ds *DeleteScheduler) Drain(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		ids, err := ds.store.ClaimDueDeletes(ctx, ds.clock.Now(), DeleteBatchSize)
+		if err != nil || len(ids) == 0 {
+			return deleted, err
+		}
+		for i, id := range ids {
+			if err = ds.delete(ctx, id); err != nil {
+				ds.reschedule(ctx, ids[i:])
+				return deleted, err
+			}
+			deleted++
+		}
+		ds.logger.Info("deletes: carried out deletes", zap.Int("count", len(ids)))
+	}
+}
+
+// delete removes the book from primary storage if it was kept then pushes it to the deletion queue.
+func (ds *DeleteScheduler) delete(ctx context.Context, id string) error {
+	if ds.primary != nil {
+		if err := ds.primary.Delete(ctx, id); err != nil && err != ErrBookNotFound {
+			return err
+		}
+	}
+	return ds.queue.Push(ctx, DeleteQueue, Book{ID: id})
+}
+
+// reschedule records again the claimed deletes so they are due at once.
+func (ds *DeleteScheduler) reschedule(ctx context.Context, ids []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, id := range ids {
+		if err := ds.store.ScheduleDelete(ctx, id, ds.clock.Now(), false); err != nil {
+			ds.logger.Error("deletes: failed to reschedule delete", zap.String("id", id), zap.Error(err))
+		}
+	}
+}
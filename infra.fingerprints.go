@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Fingerprint identifies the requests of a same kind from a same client. It hashes
+// the method, the route template, the user-agent and the source IP of the request.
+func Fingerprint(method, template, userAgent, ip string) string {
+	sum := sha256.Sum256([]byte(method + "\n" + template + "\n" + userAgent + "\n" + ip))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RouteTemplate rebuilds the registered route of a path by replacing the values
+// of its parameters with their names. ie: `/v1/books/b:1` gives `/v1/books/:id`.
+func RouteTemplate(path string, ps httprouter.Params) string {
+	if len(ps) == 0 {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		for _, p := range ps {
+			if segment != "" && segment == p.Value {
+				segments[i] = ":" + p.Key
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// FingerprintTracker counts the requests per fingerprint over fixed windows and spots
+// the spikes. A fingerprint spikes once it reaches the threshold within the current
+// window while exceeding `factor` times its count of the previous window. Only the
+// current and previous windows counters are kept so the memory use stays bounded.
+type FingerprintTracker struct {
+	mu        sync.Mutex
+	clock     Clocker
+	window    time.Duration
+	threshold int64
+	factor    float64
+	start     time.Time
+	current   map[string]int64
+	previous  map[string]int64
+	reported  map[string]bool
+}
+
+func NewFingerprintTracker(clock Clocker, window time.Duration, threshold int64, factor float64) *FingerprintTracker {
+	return &FingerprintTracker{
+		clock:     clock,
+		window:    window,
+		threshold: threshold,
+		factor:    factor,
+		current:   make(map[string]int64),
+		previous:  make(map[string]int64),
+		reported:  make(map[string]bool),
+	}
+}
+
+// Observe counts one request of the fingerprint and returns its count into the current
+// window. The spike flag is only reported once per fingerprint and window.
+func (ft *FingerprintTracker) Observe(fingerprint string) (int64, bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	start := ft.clock.Now().Truncate(ft.window)
+	if !start.Equal(ft.start) {
+		if start.Sub(ft.start) == ft.window {
+			ft.previous = ft.current
+		} else {
+			ft.previous = make(map[string]int64)
+		}
+		ft.current = make(map[string]int64)
+		ft.reported = make(map[string]bool)
+		ft.start = start
+	}
+	ft.current[fingerprint]++
+	count := ft.current[fingerprint]
+	if ft.reported[fingerprint] || count < ft.threshold || float64(count) <= ft.factor*float64(ft.previous[fingerprint]) {
+		return count, false
+	}
+	ft.reported[fingerprint] = true
+	return count, true
+}
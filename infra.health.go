@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/redis/go-redis/v9"
+)
+
+// Health statuses of the app and of its subsystems.
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// HealthCheck is a named check of a subsystem. A failed critical check makes the app
+// unhealthy while any other failed check only makes it degraded. On success, Run
+// provides a short detail about the subsystem state, on failure its error is the detail.
+type HealthCheck struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) (string, error)
+}
+
+// ComponentHealth is the result of a subsystem check.
+type ComponentHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// HealthReport summarizes the checks of all subsystems.
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+	CheckedAt  time.Time                  `json:"checkedAt"`
+}
+
+// HealthChecker runs the checks of all subsystems.
+type HealthChecker struct {
+	clock   Clocker
+	timeout time.Duration
+	checks  []HealthCheck
+}
+
+// NewHealthChecker provides a HealthChecker which bounds each check to timeout.
+func NewHealthChecker(clock Clocker, timeout time.Duration, checks ...HealthCheck) *HealthChecker {
+	return &HealthChecker{clock: clock, timeout: timeout, checks: checks}
+}
+
+// Add registers more checks.
+func (hc *HealthChecker) Add(checks ...HealthCheck) {
+	hc.checks = append(hc.checks, checks...)
+}
+
+// Check runs every check and computes the app status from their results.
+func (hc *HealthChecker) Check(ctx context.Context) HealthReport {
+	report := HealthReport{Status: HealthStatusHealthy, Components: make(map[string]ComponentHealth, len(hc.checks)), CheckedAt: hc.clock.Now()}
+	for _, check := range hc.checks {
+		cctx, cancel := context.WithTimeout(ctx, hc.timeout)
+		detail, err := check.Run(cctx)
+		cancel()
+		if err == nil {
+			report.Components[check.Name] = ComponentHealth{Status: HealthStatusHealthy, Detail: detail}
+			continue
+		}
+		status := HealthStatusDegraded
+		if check.Critical {
+			status = HealthStatusUnhealthy
+		}
+		report.Components[check.Name] = ComponentHealth{Status: status, Detail: err.Error()}
+		if report.Status != HealthStatusUnhealthy {
+			report.Status = status
+		}
+	}
+	return report
+}
+
+// RedisCheck pings the redis server.
+func RedisCheck(client *redis.Client) HealthCheck {
+	return HealthCheck{Name: "redis", Critical: true, Run: func(ctx context.Context) (string, error) {
+		return client.Ping(ctx).Result()
+	}}
+}
+
+// BoltDBCheck ensures the books bucket of the boltdb database can be read.
+func BoltDBCheck(db *bolt.DB, bucket string) HealthCheck {
+	return HealthCheck{Name: "boltdb", Run: func(ctx context.Context) (string, error) {
+		var count int
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return fmt.Errorf("bucket %s does not exist", bucket)
+			}
+			count = b.Stats().KeyN
+			return nil
+		})
+		return fmt.Sprintf("%d books", count), err
+	}}
+}
+
+// QueuesCheck ensures the number of books waiting into the queues stays below threshold.
+func QueuesCheck(q Queuer, threshold int64, qids ...string) HealthCheck {
+	return HealthCheck{Name: "queues", Run: func(ctx context.Context) (string, error) {
+		var depth int64
+		for _, qid := range qids {
+			n, err := q.Len(ctx, qid)
+			if err != nil {
+				return "", err
+			}
+			depth += n
+		}
+		detail := fmt.Sprintf("%d books queued", depth)
+		if threshold > 0 && depth >= threshold {
+			return detail, errors.New(detail + ", above the threshold")
+		}
+		return detail, nil
+	}}
+}
+
+// HeartbeatCheck ensures the consumer was alive within the timeout.
+func HeartbeatCheck(hb *Heartbeat, timeout time.Duration) HealthCheck {
+	return HealthCheck{Name: "consumer", Run: func(ctx context.Context) (string, error) {
+		age := hb.Age()
+		detail := fmt.Sprintf("last seen %s ago", age.Round(time.Millisecond))
+		if age > timeout {
+			return detail, errors.New(detail + ", not alive")
+		}
+		return detail, nil
+	}}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Versions of the queue messages format. The legacy messages are the bare book JSON
+// whose operation is implied by the queue they were pushed onto.
+const (
+	LegacyQueueMessageVersion  = 0
+	CurrentQueueMessageVersion = 1
+)
+
+// ErrUnsupportedQueueMessage is returned when decoding a message of a version newer than
+// the ones this instance knows, i.e. pushed by a newer instance during a rolling deploy.
+var ErrUnsupportedQueueMessage = errors.New("unsupported queue message version")
+
+// QueueMessage is the envelope of the books pushed onto the queues. Op names the change
+// applied to the book, that is the id of the backup queue it was pushed onto. RequestID
+// is the id of the request which made the change, to correlate its processing logs.
+type QueueMessage struct {
+	Version   int    `json:"version"`
+	Op        string `json:"op"`
+	RequestID string `json:"request_id,omitempty"`
+	Book      Book   `json:"book"`
+}
+
+// QueueOperation returns the operation implied by the queue qid. The books of a dead
+// letter or of a repair queue keep the operation of the queue they failed from.
+func QueueOperation(qid string) string {
+	if rest, found := strings.CutPrefix(qid, "repair:"); found {
+		if _, op, found := strings.Cut(rest, ":"); found {
+			return op
+		}
+	}
+	return strings.TrimPrefix(qid, DeadLetterQueue(""))
+}
+
+// EncodeQueueMessage marshals the book pushed onto the queue qid by the request rid in
+// the given format version. The legacy version produces the bare book JSON understood by
+// the instances predating the envelope, so it does not carry the request id.
+func EncodeQueueMessage(version int, qid, rid string, book Book) ([]byte, error) {
+	if version == LegacyQueueMessageVersion {
+		return json.Marshal(book)
+	}
+	return json.Marshal(QueueMessage{Version: version, Op: QueueOperation(qid), RequestID: rid, Book: book})
+}
+
+// DecodeQueueMessage unmarshals a message popped from the queue qid whatever its format.
+// A payload without version is a legacy bare book whose operation is inferred from qid.
+func DecodeQueueMessage(qid string, data []byte) (QueueMessage, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return QueueMessage{}, err
+	}
+
+	switch {
+	case probe.Version == LegacyQueueMessageVersion:
+		var book Book
+		if err := json.Unmarshal(data, &book); err != nil {
+			return QueueMessage{}, err
+		}
+		return QueueMessage{Version: LegacyQueueMessageVersion, Op: QueueOperation(qid), Book: book}, nil
+	case probe.Version < LegacyQueueMessageVersion || probe.Version > CurrentQueueMessageVersion:
+		return QueueMessage{}, fmt.Errorf("%w: %d", ErrUnsupportedQueueMessage, probe.Version)
+	}
+
+	var msg QueueMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return QueueMessage{}, err
+	}
+	if msg.Op == "" {
+		msg.Op = QueueOperation(qid)
+	}
+	return msg, nil
+}
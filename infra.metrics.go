@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsNamespace prefixes the names of all exported metrics.
+const MetricsNamespace = "drap"
+
+// Metrics exports the app statistics in Prometheus exposition format. It has its
+// own registry so each APIHandler instance exports its metrics independently.
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration prometheus.Histogram
+}
+
+// NewMetrics registers the collectors of the requests, the goroutines and the
+// maintenance mode, evaluated at the time of the clock. The requests counters are read from the statistics.
+func NewMetrics(stats *Statistics, mode *Maintenance, clock Clocker) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "http_responses_total",
+			Help:      "Number of responses sent by status code.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of requests processing.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "http_requests_called_total",
+			Help:      "Number of public requests received.",
+		}, func() float64 { return float64(atomic.LoadUint64(&stats.called)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "maintenance_enabled",
+			Help:      "Whether the maintenance mode is enabled or its window active (1) or not (0).",
+		}, func() float64 {
+			if mode.Active(clock.Now()) {
+				return 1
+			}
+			return 0
+		}),
+		collectors.NewGoCollector(),
+	)
+	return m
+}
+
+// Observe records a response status code and the request processing duration.
+func (m *Metrics) Observe(code int, duration time.Duration) {
+	m.requests.WithLabelValues(strconv.Itoa(code)).Inc()
+	m.duration.Observe(duration.Seconds())
+}
+
+// Handler serves the registered metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// OpenMetricsContentType is the content type of the OpenMetrics text exposition.
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// MetricFamily is a metric exported in OpenMetrics text format. Its type is either
+// `counter` or `gauge`. The samples of a counter are exposed with the `_total` suffix.
+type MetricFamily struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples []MetricSample
+}
+
+// MetricSample is a value of a metric family along with its labels.
+type MetricSample struct {
+	Labels [][2]string
+	Value  float64
+}
+
+// WriteOpenMetrics renders the metric families in OpenMetrics text format. Their names
+// are prefixed with MetricsNamespace and the exposition ends with the `# EOF` marker.
+func WriteOpenMetrics(w io.Writer, families []MetricFamily) error {
+	bw := bufio.NewWriter(w)
+	for _, family := range families {
+		name := MetricsNamespace + "_" + family.Name
+		bw.WriteString("# TYPE " + name + " " + family.Type + "\n")
+		bw.WriteString("# HELP " + name + " " + escapeOpenMetrics(family.Help, false) + "\n")
+		if family.Type == "counter" {
+			name += "_total"
+		}
+		for _, sample := range family.Samples {
+			bw.WriteString(name)
+			for i, label := range sample.Labels {
+				sep := ","
+				if i == 0 {
+					sep = "{"
+				}
+				bw.WriteString(sep + label[0] + "=\"" + escapeOpenMetrics(label[1], true) + "\"")
+			}
+			if len(sample.Labels) > 0 {
+				bw.WriteString("}")
+			}
+			bw.WriteString(" " + strconv.FormatFloat(sample.Value, 'g', -1, 64) + "\n")
+		}
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// escapeOpenMetrics escapes the backslashes and the line feeds of a help text or a label
+// value, along with the double quotes of the latter.
+func escapeOpenMetrics(s string, quoted bool) string {
+	pairs := []string{"\\", "\\\\", "\n", "\\n"}
+	if quoted {
+		pairs = append(pairs, "\"", "\\\"")
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
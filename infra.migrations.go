@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrationPageSize is the number of books read at once by the migrations.
+const migrationPageSize = 500
+
+// MigrateBookTimes rewrites the books whose creation or update time is stored with the
+// legacy time.Time.String() format with RFC3339 times. It goes through all the books of
+// the storage page by page and returns the number of books rewritten. It is idempotent
+// so it can run again after a failure or on an already migrated storage.
+func MigrateBookTimes(ctx context.Context, storage BookStorage) (int, error) {
+	migrated, cursor := 0, ""
+	for {
+		books, next, err := storage.GetAll(ctx, migrationPageSize, cursor)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to list books: %v", err)
+		}
+		for _, book := range books {
+			book, converted := book.WithRFC3339Times()
+			if !converted {
+				continue
+			}
+			if _, err = storage.Update(ctx, book.ID, book); err != nil {
+				return migrated, fmt.Errorf("failed to rewrite book %s: %v", book.ID, err)
+			}
+			migrated++
+		}
+		if next == "" {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
+
+// MigrateRedisLayout moves all the books of the storage `from` into the storage `to`,
+// like from the hash redis layout to the keys one, and returns the number of books
+// moved. The books are copied page by page then removed from `from` once all copied,
+// so a failed migration loses nothing and can run again. Their views counters, shared
+// by the layouts, are kept and their expiry, if any, is renewed.
+func MigrateRedisLayout(ctx context.Context, from, to BookStorage) (int, error) {
+	moved, cursor := 0, ""
+	for {
+		books, next, err := from.GetAll(ctx, migrationPageSize, cursor)
+		if err != nil {
+			return moved, fmt.Errorf("failed to list books: %v", err)
+		}
+		for _, book := range books {
+			if err = to.Add(ctx, book.ID, book); err != nil {
+				return moved, fmt.Errorf("failed to copy book %s: %v", book.ID, err)
+			}
+			moved++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if err := from.DeleteAll(ctx); err != nil {
+		return moved, fmt.Errorf("failed to remove the moved books: %v", err)
+	}
+	return moved, nil
+}
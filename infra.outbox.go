@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// OutboxQueue is the redis list holding the books writes not yet relayed to their queue.
+const OutboxQueue = "outbox"
+
+// OutboxEntry is a book write recorded into the outbox for the queue QID.
+type OutboxEntry struct {
+	QID       string `json:"qid"`
+	RequestID string `json:"request_id,omitempty"`
+	Book      Book   `json:"book"`
+}
+
+// OutboxRelay moves the outbox entries to their queue. An entry is removed from the
+// outbox only once pushed, so it is delivered at least once: a crash in between may
+// push it twice, which the backup consumer tolerates since its writes are idempotent.
+type OutboxRelay struct {
+	logger   *zap.Logger
+	client   *redis.Client
+	queue    Queuer
+	interval time.Duration
+}
+
+// NewOutboxRelay provides a relay which drains the outbox every interval.
+func NewOutboxRelay(logger *zap.Logger, client *redis.Client, queue Queuer, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		logger:   logger,
+		client:   client,
+		queue:    queue,
+		interval: interval,
+	}
+}
+
+// Run drains the outbox every interval until the context is cancelled.
+func (or *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(or.interval)
+	defer ticker.Stop()
+	for {
+		if n, err := or.Relay(ctx); err != nil && ctx.Err() == nil {
+			or.logger.Error("outbox: failed to relay entries", zap.Int("relayed", n), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			or.logger.Info("outbox: relay exited", zap.String("reason", ctx.Err().Error()))
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Relay pushes the outbox entries to their queue in order until the outbox is
+// empty and returns the number of relayed entries. Malformed entries are dropped.
+func (or *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	relayed := 0
+	for {
+		raw, err := or.client.LIndex(ctx, OutboxQueue, 0).Result()
+		if err == redis.Nil {
+			return relayed, nil
+		}
+		if err != nil {
+			return relayed, err
+		}
+
+		var entry OutboxEntry
+		malformed := json.Unmarshal([]byte(raw), &entry)
+		if malformed != nil {
+			or.logger.Error("outbox: dropped malformed entry", zap.String("entry", raw), zap.Error(malformed))
+		} else if err = or.queue.Push(context.WithValue(ctx, RequestIDContextKey, entry.RequestID), entry.QID, entry.Book); err != nil {
+			return relayed, err
+		}
+
+		if err = or.client.LRem(ctx, OutboxQueue, 1, raw).Err(); err != nil {
+			return relayed, err
+		}
+		if malformed == nil {
+			relayed++
+		}
+	}
+}
@@ -2,58 +2,425 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
 )
 
 // Predefinied Queue IDs.
 const (
-	CreateQueue = "creation"
-	UpdateQueue = "updating"
-	DeleteQueue = "deletion"
+	CreateQueue  = "creation"
+	UpdateQueue  = "updating"
+	DeleteQueue  = "deletion"
+	TrashQueue   = "trashing"
+	RestoreQueue = "restoring"
 )
 
+// BackupQueues lists the queues consumed to feed the backup storages.
+var BackupQueues = []string{CreateQueue, UpdateQueue, DeleteQueue, TrashQueue, RestoreQueue}
+
 // Ensure *Queue implements Queuer.
-var _ Queuer = (*redisQueue)(nil)
+var (
+	_ Queuer        = (*redisQueue)(nil)
+	_ Queuer        = (*BatchQueue)(nil)
+	_ Acker         = (*redisQueue)(nil)
+	_ MessageReader = (*redisQueue)(nil)
+)
 
 // Queuer describes a queue.
 type Queuer interface {
 	Push(ctx context.Context, qid string, book Book) error
 	Pop(ctx context.Context, qids ...string) (string, Book, error)
+	Peek(ctx context.Context, qid string, n int) ([]Book, error)
+	Len(ctx context.Context, qid string) (int64, error)
 }
 
 // redisQueue represents a queue which implements the Queuer interface.
 type redisQueue struct {
-	client *redis.Client
+	client   *redis.Client
+	consumer string // name of the processing lists of the popped books.
+	version  int    // format version of the pushed messages.
+	mu       sync.Mutex
+	popped   map[string]string       // last popped item per queue, removed from processing on Ack.
+	messages map[string]QueueMessage // envelope of the last popped item per queue.
 }
 
 func NewRedisQueue(client *redis.Client) Queuer {
-	return &redisQueue{client: client}
+	return NewVersionedRedisQueue(client, LegacyQueueMessageVersion, DefaultConsumerName)
+}
+
+// NewVersionedRedisQueue provides a redis queue which pushes the messages in the format
+// version. It pops the messages of any known version whatever its own one. The books it
+// pops are kept into the processing lists of the consumer, which must be distinct per
+// instance.
+func NewVersionedRedisQueue(client *redis.Client, version int, consumer string) Queuer {
+	return &redisQueue{client: client, consumer: consumer, version: version, popped: make(map[string]string), messages: make(map[string]QueueMessage)}
 }
 
 // Push enqueues a book onto the queue identified by qid.
 func (q *redisQueue) Push(ctx context.Context, qid string, book Book) error {
-	bookBytes, err := json.Marshal(book)
+	bookBytes, err := EncodeQueueMessage(q.version, qid, GetValueFromContext(ctx, RequestIDContextKey), book)
 	if err != nil {
 		return err
 	}
 	return q.client.RPush(ctx, qid, bookBytes).Err()
 }
 
-// Pop returns the first dequeued book from the list of queue ids.
+// PopWait is how long Pop blocks on the first queue when all the queues are empty.
+const PopWait = 200 * time.Millisecond
+
+// ErrQueueEmpty is returned by Pop when no book was available within PopWait.
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// DefaultConsumerName names the processing lists of the backup consumer whose name is
+// not configured nor derived from the hostname.
+const DefaultConsumerName = "backup"
+
+// ProcessingQueue returns the id of the list holding the books popped from the queue qid
+// by the consumer until their processing is acknowledged.
+func ProcessingQueue(consumer, qid string) string {
+	return "processing:" + consumer + ":" + qid
+}
+
+// Acker is implemented by the queues which keep each popped book into a processing
+// list until it is acknowledged, so a book popped by a consumer which crashed before
+// acknowledging it is not lost but moved back into its queue by Recover.
+type Acker interface {
+	Ack(ctx context.Context, qid string) error
+	Recover(ctx context.Context, qids ...string) (int, error)
+}
+
+// Pop atomically moves the first book of the list of queue ids into the processing list
+// of its queue and returns it. The queues are checked in order without blocking then,
+// when all are empty, it blocks up to PopWait on the first one before it fails with
+// ErrQueueEmpty. The book must be acknowledged with Ack once processed.
 func (q *redisQueue) Pop(ctx context.Context, qids ...string) (string, Book, error) {
-	var book Book
-	var qid string
-	infos, err := q.client.BLPop(ctx, 0*time.Second, qids...).Result()
+	for _, qid := range qids {
+		item, err := q.client.LMove(ctx, qid, ProcessingQueue(q.consumer, qid), "LEFT", "RIGHT").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", Book{}, err
+		}
+		return q.decode(ctx, qid, item)
+	}
+
+	item, err := q.client.BLMove(ctx, qids[0], ProcessingQueue(q.consumer, qids[0]), "LEFT", "RIGHT", PopWait).Result()
+	if err == redis.Nil {
+		return "", Book{}, ErrQueueEmpty
+	}
+	if err != nil {
+		return "", Book{}, err
+	}
+	return q.decode(ctx, qids[0], item)
+}
+
+// decode unmarshals a message moved into the processing list of the queue qid. A malformed
+// one or one of an unknown version cannot be processed so it is moved into the dead letter
+// queue of qid.
+func (q *redisQueue) decode(ctx context.Context, qid, item string) (string, Book, error) {
+	msg, err := DecodeQueueMessage(qid, []byte(item))
+	if err != nil {
+		if merr := q.client.LMove(ctx, ProcessingQueue(q.consumer, qid), DeadLetterQueue(qid), "RIGHT", "RIGHT").Err(); merr != nil {
+			return qid, msg.Book, fmt.Errorf("%v: failed to move to dead letter queue: %v", err, merr)
+		}
+		return qid, msg.Book, err
+	}
+	q.mu.Lock()
+	q.popped[qid] = item
+	q.messages[qid] = msg
+	q.mu.Unlock()
+	return qid, msg.Book, nil
+}
+
+// MessageReader is implemented by the queues which keep the envelope of the last book
+// popped from each queue, so the consumers get the details pushed along with the book.
+type MessageReader interface {
+	Message(qid string) (QueueMessage, bool)
+}
+
+// Message returns the envelope of the last book popped from the queue qid.
+func (q *redisQueue) Message(qid string) (QueueMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	msg, found := q.messages[qid]
+	return msg, found
+}
+
+// Ack removes from the processing list of the queue qid the last book popped from it.
+// A book never acknowledged stays there until recovered by the next run.
+func (q *redisQueue) Ack(ctx context.Context, qid string) error {
+	q.mu.Lock()
+	item, found := q.popped[qid]
+	delete(q.popped, qid)
+	q.mu.Unlock()
+	if !found {
+		return nil
+	}
+	return q.client.LRem(ctx, ProcessingQueue(q.consumer, qid), 1, item).Err()
+}
+
+// Recover moves back to the head of their queues, in their original order, the books
+// left into the processing lists by a previous run. It returns the number of books moved.
+func (q *redisQueue) Recover(ctx context.Context, qids ...string) (int, error) {
+	moved := 0
+	for _, qid := range qids {
+		for {
+			err := q.client.LMove(ctx, ProcessingQueue(q.consumer, qid), qid, "RIGHT", "LEFT").Err()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// Peek returns the first n books of the queue qid without removing them. It
+// does not block so it does not interfere with the consumers blocking pops.
+func (q *redisQueue) Peek(ctx context.Context, qid string, n int) ([]Book, error) {
+	items, err := q.client.LRange(ctx, qid, 0, int64(n)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	books := make([]Book, 0, len(items))
+	for _, item := range items {
+		msg, err := DecodeQueueMessage(qid, []byte(item))
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, msg.Book)
+	}
+	return books, nil
+}
+
+// Len returns the number of books into the queue qid.
+func (q *redisQueue) Len(ctx context.Context, qid string) (int64, error) {
+	return q.client.LLen(ctx, qid).Result()
+}
+
+// QueuePurger is implemented by the queues whose pending books can be dropped at once.
+type QueuePurger interface {
+	Purge(ctx context.Context, qids ...string) error
+}
+
+// Purge drops the books of the queues along with their dead letter lists and the processing
+// lists of all the consumers, since those of the other instances hold books of the queues.
+func (q *redisQueue) Purge(ctx context.Context, qids ...string) error {
+	keys := make([]string, 0, 3*len(qids))
+	for _, qid := range qids {
+		keys = append(keys, qid, DeadLetterQueue(qid))
+		iter := q.client.Scan(ctx, 0, ProcessingQueue("*", qid), 0).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("redis scan: %v", err)
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, qid := range qids {
+		delete(q.popped, qid)
+		delete(q.messages, qid)
+	}
+	return q.client.Del(ctx, keys...).Err()
+}
+
+// pendingPush is a book buffered by the BatchQueue until the next flush.
+type pendingPush struct {
+	qid  string
+	data []byte
+}
+
+// BatchQueue is a Queuer which buffers the pushed books and enqueues them together into
+// a single redis pipeline every interval or once size books are buffered. It trades a
+// small delay before the books reach the queues for fewer redis round-trips. The other
+// operations are served by the wrapped queue. At most maxPending books are buffered so
+// failing flushes cannot grow the buffer without bound. The books beyond are dropped
+// and counted.
+type BatchQueue struct {
+	Queuer
+	logger     *zap.Logger
+	client     *redis.Client
+	interval   time.Duration
+	size       int
+	maxPending int
+	version    int
+	mu         sync.Mutex
+	pending    []pendingPush
+	full       chan struct{}
+	dropped    atomic.Uint64
+}
+
+// NewBatchQueue provides a BatchQueue which flushes into the queues of the redis client
+// in the format version and delegates the pops and the inspections to q. Its Run method
+// must be started.
+func NewBatchQueue(logger *zap.Logger, client *redis.Client, q Queuer, interval time.Duration, size, maxPending, version int) *BatchQueue {
+	return &BatchQueue{Queuer: q, logger: logger, client: client, interval: interval, size: size, maxPending: maxPending, version: version, full: make(chan struct{}, 1)}
+}
+
+// Push buffers the book to be enqueued onto the queue qid by the next flush. The book is
+// dropped with ErrBatchQueueFull if the buffer already holds maxPending books.
+func (bq *BatchQueue) Push(ctx context.Context, qid string, book Book) error {
+	bookBytes, err := EncodeQueueMessage(bq.version, qid, GetValueFromContext(ctx, RequestIDContextKey), book)
 	if err != nil {
-		return qid, book, err
+		return err
+	}
+	bq.mu.Lock()
+	if len(bq.pending) >= bq.maxPending {
+		bq.mu.Unlock()
+		bq.dropped.Add(1)
+		return ErrBatchQueueFull
 	}
+	bq.pending = append(bq.pending, pendingPush{qid: qid, data: bookBytes})
+	full := len(bq.pending) >= bq.size
+	bq.mu.Unlock()
+	if full {
+		select {
+		case bq.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run flushes the buffered books every interval or once the buffer is full until the
+// context is cancelled. It then flushes the books buffered so far before returning.
+func (bq *BatchQueue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(bq.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := bq.Flush(context.WithoutCancel(ctx)); err != nil {
+				bq.logger.Error("batch queue: failed to flush on exit", zap.Error(err))
+			}
+			bq.logger.Info("batch queue: exited", zap.String("reason", ctx.Err().Error()), zap.Uint64("dropped", bq.Dropped()))
+			return nil
+		case <-ticker.C:
+		case <-bq.full:
+		}
+		if err := bq.Flush(ctx); err != nil {
+			bq.logger.Error("batch queue: failed to flush", zap.Error(err))
+		}
+	}
+}
+
+// Flush enqueues the buffered books into a single pipeline. The consecutive books of a
+// queue are sent with one RPUSH so they keep their order. On failure, the books are put
+// back at the head of the buffer to be retried by the next flush and the most recent
+// ones beyond maxPending are dropped.
+func (bq *BatchQueue) Flush(ctx context.Context) error {
+	bq.mu.Lock()
+	batch := bq.pending
+	bq.pending = nil
+	bq.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	_, err := bq.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for start := 0; start < len(batch); {
+			end := start
+			values := []interface{}{}
+			for ; end < len(batch) && batch[end].qid == batch[start].qid; end++ {
+				values = append(values, batch[end].data)
+			}
+			pipe.RPush(ctx, batch[start].qid, values...)
+			start = end
+		}
+		return nil
+	})
+	if err != nil {
+		bq.mu.Lock()
+		bq.pending = append(batch, bq.pending...)
+		if overflow := len(bq.pending) - bq.maxPending; overflow > 0 {
+			bq.pending = bq.pending[:bq.maxPending]
+			bq.dropped.Add(uint64(overflow))
+			bq.logger.Error("batch queue: dropped buffered books", zap.Int("count", overflow))
+		}
+		bq.mu.Unlock()
+	}
+	return err
+}
+
+// Dropped returns the number of books dropped because the buffer was full.
+func (bq *BatchQueue) Dropped() uint64 {
+	return bq.dropped.Load()
+}
+
+// Purge drops the buffered books of the queues then purges the underlying queues if
+// they support it.
+func (bq *BatchQueue) Purge(ctx context.Context, qids ...string) error {
+	bq.mu.Lock()
+	kept := bq.pending[:0]
+	for _, p := range bq.pending {
+		if !slices.Contains(qids, p.qid) {
+			kept = append(kept, p)
+		}
+	}
+	bq.pending = kept
+	bq.mu.Unlock()
+	if purger, ok := bq.Queuer.(QueuePurger); ok {
+		return purger.Purge(ctx, qids...)
+	}
+	return nil
+}
+
+// IsKnownQueue reports whether qid is one of the backup queues or their dead letter queues.
+func IsKnownQueue(qid string) bool {
+	for _, known := range BackupQueues {
+		if qid == known || qid == DeadLetterQueue(known) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeadLetters moves back the books of the dead letter queues into their queues so they
+// go again through the consumers. Each book is atomically moved from the head of its dead
+// letter queue to the tail of its queue so none is lost nor duplicated.
+type DeadLetters struct {
+	client *redis.Client
+	qids   []string
+}
+
+// NewDeadLetters provides a DeadLetters of the dead letter queues of the queues qids.
+func NewDeadLetters(client *redis.Client, qids ...string) *DeadLetters {
+	return &DeadLetters{client: client, qids: qids}
+}
 
-	if err = json.Unmarshal([]byte(infos[1]), &book); err != nil {
-		return qid, book, err
+// Requeue drains the dead letter queues and returns the number of books moved per queue.
+// Each queue is drained up to its length at the start, so the books failing back into
+// a dead letter queue while it is drained are left there for the next run.
+func (dl *DeadLetters) Requeue(ctx context.Context) (map[string]int, error) {
+	moved := make(map[string]int, len(dl.qids))
+	for _, qid := range dl.qids {
+		moved[qid] = 0
+		n, err := dl.client.LLen(ctx, DeadLetterQueue(qid)).Result()
+		if err != nil {
+			return moved, err
+		}
+		for ; n > 0; n-- {
+			err := dl.client.LMove(ctx, DeadLetterQueue(qid), qid, "LEFT", "RIGHT").Err()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				return moved, err
+			}
+			moved[qid]++
+		}
 	}
-	qid = infos[0]
-	return qid, book, nil
+	return moved, nil
 }
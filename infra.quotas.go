@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultQuotaTier is the tier applied to clients without explicit assignment.
+const DefaultQuotaTier = "default"
+
+// Ensure *redisQuotaStore implements QuotaStore.
+var _ QuotaStore = (*redisQuotaStore)(nil)
+
+// QuotaStore describes a storage of requests counters which expire.
+type QuotaStore interface {
+	Increment(ctx context.Context, key string, expireAt time.Time) (int64, error)
+}
+
+// redisQuotaStore implements QuotaStore with redis counters.
+type redisQuotaStore struct {
+	client *redis.Client
+}
+
+func NewRedisQuotaStore(client *redis.Client) QuotaStore {
+	return &redisQuotaStore{client: client}
+}
+
+// Increment adds one to the counter identified by key and sets its expiry in the same
+// round-trip. The key is scoped to a window so setting the same expiry is idempotent.
+func (qs *redisQuotaStore) Increment(ctx context.Context, key string, expireAt time.Time) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := qs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireAt(ctx, key, expireAt)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// QuotaResult holds the outcome of a quota check for a client. When multiple
+// windows apply, it reports the most restrictive one.
+type QuotaResult struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+// QuotaLimiter enforces requests budgets per client over fixed time windows.
+type QuotaLimiter struct {
+	config *QuotaConfig
+	clock  Clocker
+	store  QuotaStore
+	tiers  map[string][]QuotaWindow // windows of each tier sorted by period.
+}
+
+// NewQuotaLimiter returns a limiter of the tiers windows sorted once by period. The
+// windows are copied so the shared configuration is never mutated by the sorting.
+func NewQuotaLimiter(config *QuotaConfig, clock Clocker, store QuotaStore) *QuotaLimiter {
+	tiers := make(map[string][]QuotaWindow, len(config.Tiers))
+	for tier, windows := range config.Tiers {
+		windows = append([]QuotaWindow(nil), windows...)
+		sort.Slice(windows, func(i, j int) bool { return windows[i].Period < windows[j].Period })
+		tiers[tier] = windows
+	}
+	return &QuotaLimiter{config: config, clock: clock, store: store, tiers: tiers}
+}
+
+// Tier returns the name of the tier assigned to the client.
+func (ql *QuotaLimiter) Tier(client string) string {
+	if tier, found := ql.config.Clients[client]; found {
+		return tier
+	}
+	return DefaultQuotaTier
+}
+
+// Check consumes one request from each window budget of the client tier. Windows are
+// aligned on the period so all clients budgets are restored at the same time.
+func (ql *QuotaLimiter) Check(ctx context.Context, client string) (QuotaResult, error) {
+	result := QuotaResult{Allowed: true, Remaining: -1}
+	tier := ql.Tier(client)
+	now := ql.clock.Now()
+	for _, window := range ql.tiers[tier] {
+		if window.Period <= 0 || window.Limit <= 0 {
+			continue
+		}
+		start := now.Truncate(window.Period)
+		reset := start.Add(window.Period)
+		key := fmt.Sprintf("quota:%s:%s:%s:%d", tier, window.Period, client, start.Unix())
+		count, err := ql.store.Increment(ctx, key, reset)
+		if err != nil {
+			return result, err
+		}
+
+		remaining := window.Limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		exceeded := count > window.Limit
+		switch {
+		case exceeded && result.Allowed, exceeded && reset.After(result.Reset):
+			// report the exhausted window which restores the latest.
+			result = QuotaResult{Allowed: false, Limit: window.Limit, Remaining: 0, Reset: reset}
+		case result.Allowed && (result.Remaining < 0 || remaining < result.Remaining):
+			result = QuotaResult{Allowed: true, Limit: window.Limit, Remaining: remaining, Reset: reset}
+		}
+	}
+	return result, nil
+}
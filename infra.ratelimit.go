@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens available to a client at a given time.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter implements a token bucket per client. Each bucket is refilled at rate
+// tokens per second up to burst tokens and each request consumes one token. Buckets
+// left idle long enough to be full again are equivalent to new ones, so they are
+// periodically removed to keep the memory bounded by the number of active clients.
+type RateLimiter struct {
+	mu        sync.Mutex
+	clock     Clocker
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(clock Clocker, rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		clock:     clock,
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: clock.Now(),
+	}
+}
+
+// SetLimits changes the rate and burst of all clients. The tokens already in the
+// buckets are kept, bounded by the new burst on their next refill.
+func (rl *RateLimiter) SetLimits(rate float64, burst int) {
+	rl.mu.Lock()
+	rl.rate = rate
+	rl.burst = float64(burst)
+	rl.mu.Unlock()
+}
+
+// idle returns the duration after which an unused bucket is full again.
+func (rl *RateLimiter) idle() time.Duration {
+	return time.Duration(rl.burst / rl.rate * float64(time.Second))
+}
+
+// Allow consumes one token of the client bucket. When the bucket is empty, it
+// returns false with the time to wait before a token is available.
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.clock.Now()
+	if now.Sub(rl.lastSweep) >= rl.idle() {
+		rl.sweep(now)
+	}
+
+	bucket, found := rl.buckets[client]
+	if !found {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+}
+
+// sweep removes the buckets which have been idle long enough to be full.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for client, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= rl.idle() {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// Len returns the number of tracked clients.
+func (rl *RateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.buckets)
+}
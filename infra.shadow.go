@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultShadowConcurrency is the maximum number of concurrent shadow reads.
+const DefaultShadowConcurrency = 4
+
+// ShadowReader verifies in background that the backup storage serves the same books as
+// the primary storage. A sample of the books read from primary storage is read again from
+// backup storage and compared. The mismatches are logged and counted without affecting
+// the responses. The number of concurrent reads is bounded and extra ones are skipped.
+// The books updated within the lag are skipped as well since the backup storage may
+// not have been written yet.
+type ShadowReader struct {
+	logger     *zap.Logger
+	clock      Clocker
+	backup     BookStorage
+	rate       float64
+	timeout    time.Duration
+	lag        time.Duration
+	reads      chan struct{}
+	compared   atomic.Uint64
+	mismatches atomic.Uint64
+	failures   atomic.Uint64
+}
+
+func NewShadowReader(logger *zap.Logger, clock Clocker, backup BookStorage, rate float64, timeout, lag time.Duration) *ShadowReader {
+	return &ShadowReader{
+		logger:  logger,
+		clock:   clock,
+		backup:  backup,
+		rate:    rate,
+		timeout: timeout,
+		lag:     lag,
+		reads:   make(chan struct{}, DefaultShadowConcurrency),
+	}
+}
+
+// Verify compares in background the book read from primary storage with the backup
+// storage one if the read is sampled. A book missing into backup storage is a mismatch.
+// A book updated within the lag is not verified.
+func (sr *ShadowReader) Verify(ctx context.Context, id string, primary Book) {
+	if rand.Float64() >= sr.rate {
+		return
+	}
+	if updated, err := primary.UpdatedTime(); err == nil && sr.clock.Now().Sub(updated) < sr.lag {
+		sr.logger.Debug("shadow: skipped recently updated book", zap.String("id", id))
+		return
+	}
+	select {
+	case sr.reads <- struct{}{}:
+	default:
+		sr.logger.Debug("shadow: skipped book verification", zap.String("id", id))
+		return
+	}
+	go func() {
+		defer func() { <-sr.reads }()
+		sCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sr.timeout)
+		defer cancel()
+		backup, err := sr.backup.GetOne(sCtx, id)
+		switch {
+		case err == ErrBookNotFound:
+			sr.logger.Warn("shadow: book missing into bstorage", zap.String("id", id))
+			sr.mismatches.Add(1)
+		case err != nil:
+			sr.logger.Error("shadow: failed to read book from bstorage", zap.String("id", id), zap.Error(err))
+			sr.failures.Add(1)
+			return
+		default:
+			if backup, _ = backup.WithRFC3339Times(); backup != primary {
+				sr.logger.Warn("shadow: book mismatch", zap.String("id", id), zap.Any("primary", primary), zap.Any("backup", backup))
+				sr.mismatches.Add(1)
+			}
+		}
+		sr.compared.Add(1)
+	}()
+}
+
+// Stats returns the number of compared books, of mismatches among them and of failed
+// backup storage reads.
+func (sr *ShadowReader) Stats() (compared, mismatches, failures uint64) {
+	return sr.compared.Load(), sr.mismatches.Load(), sr.failures.Load()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of the spans started by the app.
+const TracerName = "github.com/jeamon/demo-redis"
+
+// tracePropagator reads and writes the W3C `traceparent` and `tracestate` headers.
+var tracePropagator = propagation.TraceContext{}
+
+// NewTracerProvider sets up as global tracer provider one which exports the sampled
+// spans by batches to the configured OTLP/HTTP collector. The spans of the requests
+// whose caller sampled them are always recorded. Its Shutdown method flushes the
+// remaining spans and must be called on exit.
+func NewTracerProvider(ctx context.Context, config *TracingConfig, version string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create traces exporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(config.ServiceName),
+			semconv.ServiceVersion(version),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
+
+// StartSpan starts a child span of the span recorded into the context. Without such
+// span, like for the queues consumers, it starts nothing so the background work does
+// not produce traces on its own. The returned span must be ended.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error, if any, onto the span then ends it. The absence of
+// value in redis is not an error.
+func EndSpan(span trace.Span, err error) {
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext sets the `traceparent` header of the span of the context into
+// the headers of an outbound request or of a response.
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// RedisTracingHook is a redis hook which records each command and pipeline run
+// within a traced request as a child span of that request.
+type RedisTracingHook struct{}
+
+// DialHook does not trace the connections to redis.
+func (RedisTracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook records a span named by the command.
+func (RedisTracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := StartSpan(ctx, "redis."+cmd.Name(),
+			semconv.DBSystemRedis,
+			semconv.DBOperation(cmd.Name()),
+		)
+		err := next(ctx, cmd)
+		EndSpan(span, err)
+		return err
+	}
+}
+
+// ProcessPipelineHook records a single span for all the commands of the pipeline.
+func (RedisTracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := StartSpan(ctx, "redis.pipeline",
+			semconv.DBSystemRedis,
+			attribute.Int("db.redis.commands", len(cmds)),
+		)
+		err := next(ctx, cmds)
+		EndSpan(span, err)
+		return err
+	}
+}
+
+// tracingResponseWriter records the status code of the response of a traced request.
+type tracingResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (tw *tracingResponseWriter) WriteHeader(code int) {
+	tw.code = code
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the wrapped response writer for the http.ResponseController.
+func (tw *tracingResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TrashPurger permanently removes from the storages the books which
+// were trashed for longer than the retention.
+type TrashPurger struct {
+	logger    *zap.Logger
+	clock     Clocker
+	retention time.Duration
+	interval  time.Duration
+	stores    []BookTrasher
+}
+
+// NewTrashPurger provides a purger which runs every interval on the stores.
+func NewTrashPurger(logger *zap.Logger, clock Clocker, retention, interval time.Duration, stores ...BookTrasher) *TrashPurger {
+	return &TrashPurger{
+		logger:    logger,
+		clock:     clock,
+		retention: retention,
+		interval:  interval,
+		stores:    stores,
+	}
+}
+
+// Run purges the stores every interval until the context is cancelled.
+func (tp *TrashPurger) Run(ctx context.Context) error {
+	ticker := time.NewTicker(tp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			tp.logger.Info("trash: purger exited", zap.String("reason", ctx.Err().Error()))
+			return nil
+		case <-ticker.C:
+			tp.Purge(ctx)
+		}
+	}
+}
+
+// Purge removes the expired trashed books from each store and returns their
+// total number. A store failure is logged and does not prevent the others.
+func (tp *TrashPurger) Purge(ctx context.Context) int {
+	before := tp.clock.Now().Add(-tp.retention)
+	total := 0
+	for i, store := range tp.stores {
+		n, err := store.PurgeTrash(ctx, before)
+		if err != nil {
+			tp.logger.Error("trash: failed to purge store", zap.Int("store", i), zap.Error(err))
+		}
+		total += n
+	}
+	if total > 0 {
+		tp.logger.Info("trash: purged books", zap.Int("count", total), zap.Time("before", before))
+	}
+	return total
+}
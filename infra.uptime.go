@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ServiceStartedKey is the redis key holding the time (unix nanoseconds) at which the
+// service was started for the first time. It is shared by all instances and restarts.
+const ServiceStartedKey = "service:started"
+
+// PersistServiceStart records now as the service start time unless one was recorded
+// by a previous startup, and returns the recorded one.
+func PersistServiceStart(ctx context.Context, client *redis.Client, now time.Time) (time.Time, error) {
+	if err := client.SetNX(ctx, ServiceStartedKey, now.UnixNano(), 0).Err(); err != nil {
+		return time.Time{}, err
+	}
+	started, err := client.Get(ctx, ServiceStartedKey).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, started).In(now.Location()), nil
+}
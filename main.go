@@ -2,9 +2,16 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := TokenCommand(os.Stdout, os.Args[2:]); err != nil {
+			log.Fatalf("token failed: %v", err)
+		}
+		return
+	}
 	app, err := NewApp()
 	if err != nil {
 		log.Fatalf("app failed: %v", err)
@@ -4,11 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
+// TrashBucket is the bucket holding the trashed books.
+const TrashBucket = "trash"
+
+// Ensure *boltBookStorage implements BookTrasher.
+var _ BookTrasher = (*boltBookStorage)(nil)
+
 type boltBookStorage struct {
 	logger *zap.Logger
 	client *bolt.DB
@@ -17,13 +25,21 @@ type boltBookStorage struct {
 
 // GetBoltClient setup the database and the bucket then provides a ready to use client.
 func GetBoltDBClient(config *Config) (*bolt.DB, error) {
-	db, err := bolt.Open(config.BoltDB.FilePath, 0o644, &bolt.Options{Timeout: config.BoltDB.Timeout})
+	return OpenBoltDB(&config.BoltDB)
+}
+
+// OpenBoltDB setup the database file and the bucket described by the boltdb settings
+// along with the trash bucket.
+func OpenBoltDB(config *BoltDBConfig) (*bolt.DB, error) {
+	db, err := bolt.Open(config.FilePath, 0o644, &bolt.Options{Timeout: config.Timeout})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open the database, %v", err)
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		if _, errB := tx.CreateBucketIfNotExists([]byte(config.BoltDB.BucketName)); errB != nil {
-			return fmt.Errorf("failed to create %s bucket: %v", config.BoltDB.BucketName, errB)
+		for _, name := range []string{config.BucketName, TrashBucket} {
+			if _, errB := tx.CreateBucketIfNotExists([]byte(name)); errB != nil {
+				return fmt.Errorf("failed to create %s bucket: %v", name, errB)
+			}
 		}
 		return nil
 	})
@@ -48,7 +64,9 @@ func (bs *boltBookStorage) Close() error {
 }
 
 // Add inserts a new book record into boltdb store.
-func (bs *boltBookStorage) Add(_ context.Context, id string, book Book) error {
+func (bs *boltBookStorage) Add(ctx context.Context, id string, book Book) error {
+	_, span := StartSpan(ctx, "boltdb.Add", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
 	bookBytes, err := json.Marshal(book)
 	if err != nil {
 		return err
@@ -60,7 +78,9 @@ func (bs *boltBookStorage) Add(_ context.Context, id string, book Book) error {
 }
 
 // GetOne retrieves a book record based on its ID from boltdb store.
-func (bs *boltBookStorage) GetOne(_ context.Context, id string) (Book, error) {
+func (bs *boltBookStorage) GetOne(ctx context.Context, id string) (Book, error) {
+	_, span := StartSpan(ctx, "boltdb.GetOne", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
 	var book Book
 	// initialize a readable transaction.
 	tx, err := bs.client.Begin(false)
@@ -80,14 +100,18 @@ func (bs *boltBookStorage) GetOne(_ context.Context, id string) (Book, error) {
 }
 
 // Delete removes a book record based on its ID from boltdb store.
-func (bs *boltBookStorage) Delete(_ context.Context, id string) error {
+func (bs *boltBookStorage) Delete(ctx context.Context, id string) error {
+	_, span := StartSpan(ctx, "boltdb.Delete", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
 	return bs.client.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket([]byte(bs.config.BucketName)).Delete([]byte(id))
 	})
 }
 
 // Update replaces existing book record data or inserts a new book if does not exist.
-func (bs *boltBookStorage) Update(_ context.Context, id string, book Book) (Book, error) {
+func (bs *boltBookStorage) Update(ctx context.Context, id string, book Book) (Book, error) {
+	_, span := StartSpan(ctx, "boltdb.Update", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
 	bookBytes, err := json.Marshal(book)
 	if err != nil {
 		return book, err
@@ -98,11 +122,24 @@ func (bs *boltBookStorage) Update(_ context.Context, id string, book Book) (Book
 	return book, err
 }
 
-// GetAll retrieves a list of all books stored in the bolt database.
-func (bs *boltBookStorage) GetAll(_ context.Context) ([]Book, error) {
+// GetAll retrieves a page of books stored in the bolt database. The cursor wraps
+// the key of the first book of the page, which is reached with a seek. The next
+// cursor is empty once the last book has been listed.
+func (bs *boltBookStorage) GetAll(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+	_, span := StartSpan(ctx, "boltdb.GetAll", attribute.String("db.bucket", bs.config.BucketName))
+	defer span.End()
+	var start []byte
+	if cursor != "" {
+		key, err := DecodeCursor("bolt", cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start = []byte(key)
+	}
+
 	tx, err := bs.client.Begin(false)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer func() {
 		_ = tx.Rollback()
@@ -111,19 +148,183 @@ func (bs *boltBookStorage) GetAll(_ context.Context) ([]Book, error) {
 	// Create a cursor on the books' bucket.
 	c := tx.Bucket([]byte(bs.config.BucketName)).Cursor()
 
+	k, v := c.First()
+	if start != nil {
+		k, v = c.Seek(start)
+	}
 	books := []Book{}
-	for k, v := c.First(); k != nil; k, v = c.Next() {
+	for ; k != nil && int64(len(books)) < limit; k, v = c.Next() {
 		var book Book
 		if err = json.Unmarshal(v, &book); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		books = append(books, book)
 	}
+	if k == nil {
+		return books, "", nil
+	}
+	return books, EncodeCursor("bolt", string(k)), nil
+}
+
+// Search scans the bucket to find at most MaxSearchResults books whose fields contain
+// the query. The query is expected to be already trimmed and lowercased.
+func (bs *boltBookStorage) Search(ctx context.Context, query string, fields []string) ([]Book, error) {
+	_, span := StartSpan(ctx, "boltdb.Search", attribute.String("db.bucket", bs.config.BucketName))
+	defer span.End()
+	books := []Book{}
+	err := bs.client.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bs.config.BucketName)).Cursor()
+		for k, v := c.First(); k != nil && len(books) < MaxSearchResults; k, v = c.Next() {
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+			if len(book.Match(query, fields)) != 0 {
+				books = append(books, book)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// Count returns the number of books from the bucket statistics without reading them.
+func (bs *boltBookStorage) Count(ctx context.Context) (int, error) {
+	_, span := StartSpan(ctx, "boltdb.Count", attribute.String("db.bucket", bs.config.BucketName))
+	var n int
+	err := bs.client.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(bs.config.BucketName)).Stats().KeyN
+		return nil
+	})
+	EndSpan(span, err)
+	return n, err
+}
+
+// DeleteAll removes all stored books. The bucket is dropped and recreated into
+// a single transaction so readers never observe a missing bucket. The trash
+// bucket is left untouched.
+func (bs *boltBookStorage) DeleteAll(ctx context.Context) error {
+	_, span := StartSpan(ctx, "boltdb.DeleteAll", attribute.String("db.bucket", bs.config.BucketName))
+	err := bs.client.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(bs.config.BucketName)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(bs.config.BucketName))
+		return err
+	})
+	EndSpan(span, err)
+	return err
+}
+
+// move transfers the book from a bucket to another one after applying the change.
+func (bs *boltBookStorage) move(id, from, to string, change func(Book) Book) (Book, error) {
+	var book Book
+	err := bs.client.Update(func(tx *bolt.Tx) error {
+		result := tx.Bucket([]byte(from)).Get([]byte(id))
+		if result == nil {
+			return ErrBookNotFound
+		}
+		if err := json.Unmarshal(result, &book); err != nil {
+			return err
+		}
+		book = change(book)
+		bookBytes, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket([]byte(to)).Put([]byte(id), bookBytes); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(from)).Delete([]byte(id))
+	})
+	return book, err
+}
+
+// Trash moves the book to the trash bucket along with its deletion time.
+func (bs *boltBookStorage) Trash(ctx context.Context, id string, deletedAt time.Time) (Book, error) {
+	_, span := StartSpan(ctx, "boltdb.Trash", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
+	return bs.move(id, bs.config.BucketName, TrashBucket, func(book Book) Book {
+		return book.Trashed(deletedAt)
+	})
+}
+
+// Restore moves back the book from the trash bucket without its deletion time.
+func (bs *boltBookStorage) Restore(ctx context.Context, id string) (Book, error) {
+	_, span := StartSpan(ctx, "boltdb.Restore", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
+	return bs.move(id, TrashBucket, bs.config.BucketName, func(book Book) Book {
+		book.DeletedAt = ""
+		return book
+	})
+}
+
+// InTrash reports whether the book is into the trash bucket.
+func (bs *boltBookStorage) InTrash(ctx context.Context, id string) (bool, error) {
+	_, span := StartSpan(ctx, "boltdb.InTrash", attribute.String("db.bucket", bs.config.BucketName), attribute.String("book.id", id))
+	defer span.End()
+	found := false
+	err := bs.client.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(TrashBucket)).Get([]byte(id)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// GetTrash retrieves all the trashed books.
+func (bs *boltBookStorage) GetTrash(ctx context.Context) ([]Book, error) {
+	_, span := StartSpan(ctx, "boltdb.GetTrash", attribute.String("db.bucket", bs.config.BucketName))
+	defer span.End()
+	books := []Book{}
+	err := bs.client.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(TrashBucket)).ForEach(func(_, v []byte) error {
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+			books = append(books, book)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 	return books, nil
 }
 
-// DeleteAll removes all stored books.
-func (bs *boltBookStorage) DeleteAll(_ context.Context) error {
-	// TODO
-	return nil
+// PurgeTrash permanently removes the books trashed before the given time
+// and returns their number.
+func (bs *boltBookStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	_, span := StartSpan(ctx, "boltdb.PurgeTrash", attribute.String("db.bucket", bs.config.BucketName))
+	defer span.End()
+	purged := 0
+	err := bs.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(TrashBucket))
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+			if book.DeletedBefore(before) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// keys cannot be deleted while iterating over the bucket.
+		for _, k := range keys {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(keys)
+		return nil
+	})
+	return purged, err
 }
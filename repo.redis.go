@@ -4,24 +4,122 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-const HBooks string = "books"
+const (
+	HBooks       string = "books"
+	HViews       string = "views"
+	ZBooksViews  string = "books:views"
+	ZBooksExpiry string = "books:expiry"
+	HBooksTrash  string = "books:trash"
+	// sorted set of the books scheduled deletes scored by their execution time.
+	ZBooksDeletes string = "books:deletes"
+	// prefix of the keys of absent books tombstones.
+	TombstonePrefix string = "tombstone:"
+	// prefix of the keys of the lists of books prior versions.
+	HistoryPrefix string = "book:history:"
+)
+
+// Ensure *redisBookStorage implements BookViewsCounter and BookBulkAdder.
+var (
+	_ BookViewsCounter    = (*redisBookStorage)(nil)
+	_ BookBulkAdder       = (*redisBookStorage)(nil)
+	_ BookTombstoner      = (*redisBookStorage)(nil)
+	_ BookOutboxWriter    = (*redisBookStorage)(nil)
+	_ BookTrasher         = (*redisBookStorage)(nil)
+	_ BookRenamer         = (*redisBookStorage)(nil)
+	_ BookDeleteScheduler = (*redisBookStorage)(nil)
+	_ BookHistorian       = (*redisBookStorage)(nil)
+)
 
+// redisBookStorage stores books as fields of a single hash. Since hash fields cannot
+// expire, when a cache TTL is configured the expiry time (unix milliseconds) of each
+// book is kept into a companion sorted set which is consulted on reads. The expired
+// books are skipped and evicted from the hash when they are met by the reads. Their
+// views counters are kept since the books still exist into the backup storage.
 type redisBookStorage struct {
+	redisBookBase
+}
+
+// redisBookBase holds what the redis books layouts share: the settings and the books
+// data stored apart from the books themselves, like their views counters, tombstones
+// and history, which do not depend on the layout.
+type redisBookBase struct {
 	logger *zap.Logger
+	config *RedisConfig
+	clock  Clocker
 	client *redis.Client
 }
 
-// NewRedisBookStorage provides an instance of redis-based book storage.
-func NewRedisBookStorage(logger *zap.Logger, client *redis.Client) BookStorage {
-	return &redisBookStorage{
+// NewRedisBookStorage provides an instance of redis-based book storage with the
+// configured layout: a single hash by default or a key per book with `keys`.
+func NewRedisBookStorage(logger *zap.Logger, config *RedisConfig, clock Clocker, client *redis.Client) BookStorage {
+	base := redisBookBase{
 		logger: logger,
+		config: config,
+		clock:  clock,
 		client: client,
 	}
+	if config != nil && config.Layout == RedisLayoutKeys {
+		return &redisKeysBookStorage{redisBookBase: base}
+	}
+	return &redisBookStorage{redisBookBase: base}
+}
+
+// DefaultScanCount is the default number of books read per HSCAN or SSCAN batch.
+const DefaultScanCount int64 = 1000
+
+// scanCount returns the configured number of books read per HSCAN or SSCAN batch.
+func (rb *redisBookBase) scanCount() int64 {
+	if rb.config == nil || rb.config.ScanCount <= 0 {
+		return DefaultScanCount
+	}
+	return rb.config.ScanCount
+}
+
+// ttl returns the configured books cache TTL. Zero means no expiry.
+func (rb *redisBookBase) ttl() time.Duration {
+	if rb.config == nil {
+		return 0
+	}
+	return rb.config.CacheTTL
+}
+
+// expiry returns the expiry score of a book written or refreshed now.
+func (rs *redisBookStorage) expiry() float64 {
+	return float64(rs.clock.Now().Add(rs.ttl()).UnixMilli())
+}
+
+// set stores the book along with its expiry time when a TTL is configured.
+// The tombstone of the book, if any, is removed in the same transaction and
+// the outbox entry, if provided, is recorded into the outbox as well.
+func (rs *redisBookStorage) set(ctx context.Context, id string, bookBytes, entry []byte) error {
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rs.write(ctx, pipe, id, bookBytes)
+		if entry != nil {
+			pipe.RPush(ctx, OutboxQueue, entry)
+		}
+		return nil
+	})
+	return err
+}
+
+// write queues into the pipeline the commands storing the book along with its
+// expiry time and removing its tombstone. It returns the book write command.
+func (rs *redisBookStorage) write(ctx context.Context, pipe redis.Pipeliner, id string, bookBytes []byte) *redis.IntCmd {
+	cmd := pipe.HSet(ctx, HBooks, id, bookBytes)
+	pipe.Del(ctx, TombstonePrefix+id)
+	if rs.ttl() > 0 {
+		pipe.ZAdd(ctx, ZBooksExpiry, redis.Z{Score: rs.expiry(), Member: id})
+	} else {
+		pipe.ZRem(ctx, ZBooksExpiry, id)
+	}
+	return cmd
 }
 
 // NewRedisClient provides a ready to use redis client.
@@ -42,6 +140,9 @@ func NewRedisClient(config *Config) (*redis.Client, error) {
 	if pong, err := client.Ping(context.Background()).Result(); pong != "PONG" || err != nil {
 		return nil, fmt.Errorf("redis: ping failed: %v", err)
 	}
+	if config.Tracing.Enable {
+		client.AddHook(RedisTracingHook{})
+	}
 	return client, nil
 }
 
@@ -51,67 +152,316 @@ func (rs *redisBookStorage) Add(ctx context.Context, id string, book Book) error
 	if err != nil {
 		return err
 	}
-	return rs.client.HSet(ctx, HBooks, id, bookBytes).Err()
+	return rs.set(ctx, id, bookBytes, nil)
 }
 
-// GetOne retrieves a book record based on its ID.
+// AddMany inserts the books in a single round-trip. Each book is written
+// like by Add and the errors are aligned with the books.
+func (rs *redisBookStorage) AddMany(ctx context.Context, books []Book) []error {
+	errs := make([]error, len(books))
+	cmds := make([]*redis.IntCmd, len(books))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, book := range books {
+			bookBytes, merr := json.Marshal(book)
+			if merr != nil {
+				errs[i] = merr
+				continue
+			}
+			cmds[i] = rs.write(ctx, pipe, book.ID, bookBytes)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if cmd != nil {
+			errs[i] = cmd.Err()
+		} else if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// GetOne retrieves a book record based on its ID. An expired book is reported as not
+// found. When the sliding TTL is enabled, each read pushes back the book expiry so hot
+// books stay cached while cold ones expire.
 func (rs *redisBookStorage) GetOne(ctx context.Context, id string) (Book, error) {
 	var book Book
-	bookJSONString, err := rs.client.HGet(ctx, HBooks, id).Result()
+	var hget *redis.StringCmd
+	var zscore *redis.FloatCmd
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		hget = pipe.HGet(ctx, HBooks, id)
+		zscore = pipe.ZScore(ctx, ZBooksExpiry, id)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return book, err
+	}
+	bookJSONString, err := hget.Result()
 	if err == redis.Nil {
 		return book, ErrBookNotFound
 	}
 	if err != nil {
 		return book, err
 	}
-	err = json.Unmarshal([]byte(bookJSONString), &book)
-	return book, err
+	if expiry, zerr := zscore.Result(); zerr == nil && rs.isExpired(expiry) {
+		rs.evict(ctx, id)
+		return book, ErrBookNotFound
+	}
+	if err = json.Unmarshal([]byte(bookJSONString), &book); err != nil {
+		return book, err
+	}
+	if rs.ttl() > 0 && rs.config.SlidingTTL {
+		if err = rs.client.ZAddXX(ctx, ZBooksExpiry, redis.Z{Score: rs.expiry(), Member: id}).Err(); err != nil {
+			rs.logger.Error("redis: failed to refresh book ttl", zap.String("id", id), zap.Error(err))
+		}
+	}
+	return book, nil
+}
+
+// evictScript removes the book ARGV[1] if its expiry is still before ARGV[2] so a
+// book rewritten since it was read as expired is kept.
+var evictScript = redis.NewScript(`
+local expiry = redis.call("ZSCORE", KEYS[2], ARGV[1])
+if not expiry or tonumber(expiry) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+return 1
+`)
+
+// isExpired reports whether the expiry score is reached. Zero means no expiry.
+func (rs *redisBookStorage) isExpired(expiry float64) bool {
+	return expiry > 0 && int64(expiry) <= rs.clock.Now().UnixMilli()
 }
 
-// Delete removes a book record based on its ID.
+// evict removes the expired book. It is best-effort since an expired book is not served.
+func (rs *redisBookStorage) evict(ctx context.Context, ids ...string) {
+	now := rs.clock.Now().UnixMilli()
+	for _, id := range ids {
+		if err := evictScript.Run(ctx, rs.client, []string{HBooks, ZBooksExpiry}, id, now).Err(); err != nil {
+			rs.logger.Error("redis: failed to evict expired book", zap.String("id", id), zap.Error(err))
+		}
+	}
+}
+
+// unexpired returns the books which are not expired and evicts the others. The
+// ids are the hash fields of the books.
+func (rs *redisBookStorage) unexpired(ctx context.Context, ids []string, books []Book) ([]Book, error) {
+	if len(books) == 0 {
+		return books, nil
+	}
+	expiries, err := rs.client.ZMScore(ctx, ZBooksExpiry, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	live := books[:0]
+	var expired []string
+	for i, book := range books {
+		if rs.isExpired(expiries[i]) {
+			expired = append(expired, ids[i])
+			continue
+		}
+		live = append(live, book)
+	}
+	rs.evict(ctx, expired...)
+	return live, nil
+}
+
+// Delete removes a book record based on its ID along with its views counters and history.
 func (rs *redisBookStorage) Delete(ctx context.Context, id string) error {
 	numDeleted, err := rs.client.HDel(ctx, HBooks, id).Result()
 	if numDeleted == 0 || err == redis.Nil {
 		return ErrBookNotFound
 	}
+	if err != nil {
+		return err
+	}
+	_, err = rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, HViews, id)
+		pipe.ZRem(ctx, ZBooksViews, id)
+		pipe.ZRem(ctx, ZBooksExpiry, id)
+		pipe.Del(ctx, historyKey(id))
+		return nil
+	})
 	return err
 }
 
+// deleteWithOutboxScript removes a book along with its views counters, expiry and history
+// and records the outbox entry. Nothing is recorded if the book does not exist.
+var deleteWithOutboxScript = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZREM", KEYS[4], ARGV[1])
+redis.call("DEL", KEYS[6])
+redis.call("RPUSH", KEYS[5], ARGV[2])
+return 1
+`)
+
+// SetWithOutbox inserts or replaces a book record and records its outbox entry
+// for the queue qid in a single transaction.
+func (rs *redisBookStorage) SetWithOutbox(ctx context.Context, qid, id string, book Book) error {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(OutboxEntry{QID: qid, RequestID: GetValueFromContext(ctx, RequestIDContextKey), Book: book})
+	if err != nil {
+		return err
+	}
+	return rs.set(ctx, id, bookBytes, entry)
+}
+
+// DeleteWithOutbox removes a book record like Delete and records its outbox
+// entry for the deletion queue atomically.
+func (rs *redisBookStorage) DeleteWithOutbox(ctx context.Context, id string) error {
+	entry, err := json.Marshal(OutboxEntry{QID: DeleteQueue, RequestID: GetValueFromContext(ctx, RequestIDContextKey), Book: Book{ID: id}})
+	if err != nil {
+		return err
+	}
+	keys := []string{HBooks, HViews, ZBooksViews, ZBooksExpiry, OutboxQueue, historyKey(id)}
+	deleted, err := deleteWithOutboxScript.Run(ctx, rs.client, keys, id, entry).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrBookNotFound
+	}
+	return nil
+}
+
 // Update replaces existing book record data or inserts a new book if does not exist.
 func (rs *redisBookStorage) Update(ctx context.Context, id string, book Book) (Book, error) {
 	bookBytes, err := json.Marshal(book)
 	if err != nil {
 		return book, err
 	}
-	err = rs.client.HSet(ctx, HBooks, id, bookBytes).Err()
+	err = rs.set(ctx, id, bookBytes, nil)
 	return book, err
 }
 
-// GetAll retrieves a list of all books stored in the redis database.
-func (rs *redisBookStorage) GetAll(ctx context.Context) ([]Book, error) {
-	mapBooks, err := rs.client.HVals(ctx, HBooks).Result()
+// GetAll retrieves a page of books stored in the redis database. The cursor wraps
+// the native HSCAN cursor and the next one is empty once the scan completed. Since
+// the scan count is only a hint to redis, a page may hold slightly more than limit.
+func (rs *redisBookStorage) GetAll(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+	var position uint64
+	if cursor != "" {
+		value, err := DecodeCursor("redis", cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if position, err = strconv.ParseUint(value, 10, 64); err != nil || position == 0 {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	books := []Book{}
+	for {
+		results, next, err := rs.client.HScan(ctx, HBooks, position, "*", limit-int64(len(books))).Result()
+		if err != nil {
+			return nil, "", fmt.Errorf("redis hscan: %v", err)
+		}
+		ids, page := make([]string, 0, len(results)/2), make([]Book, 0, len(results)/2)
+		for i := 1; i < len(results); i += 2 {
+			var book Book
+			if err = json.Unmarshal([]byte(results[i]), &book); err != nil {
+				return nil, "", err
+			}
+			ids, page = append(ids, results[i-1]), append(page, book)
+		}
+		if page, err = rs.unexpired(ctx, ids, page); err != nil {
+			return nil, "", err
+		}
+		books = append(books, page...)
+		position = next
+		if position == 0 || int64(len(books)) >= limit {
+			break
+		}
+	}
+	if position == 0 {
+		return books, "", nil
+	}
+	return books, EncodeCursor("redis", strconv.FormatUint(position, 10)), nil
+}
+
+// Search scans the books to find at most MaxSearchResults books whose fields contain
+// the query. The query is expected to be already trimmed and lowercased.
+func (rs *redisBookStorage) Search(ctx context.Context, query string, fields []string) ([]Book, error) {
+	books := []Book{}
+	err := rs.scanBooks(ctx, HBooks, func(ids []string, batch []Book) (bool, error) {
+		var matchIDs []string
+		var matches []Book
+		for i, book := range batch {
+			if len(book.Match(query, fields)) != 0 {
+				matchIDs, matches = append(matchIDs, ids[i]), append(matches, book)
+			}
+		}
+		matches, err := rs.unexpired(ctx, matchIDs, matches)
+		if err != nil {
+			return false, err
+		}
+		for _, book := range matches {
+			books = append(books, book)
+			if len(books) == MaxSearchResults {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	lg := len(mapBooks)
-	books := make([]Book, 0, lg)
-	for _, bookJSONString := range mapBooks {
-		var book Book
-		if err = json.Unmarshal([]byte(bookJSONString), &book); err != nil {
-			return nil, err
+	return books, nil
+}
+
+// scanBooks iterates over the books of the hash by HSCAN batches of scanCount, so they
+// are never all loaded into memory at once. Each batch is passed to fn along with the
+// books IDs until fn returns false or an error, or the scan completed.
+func (rs *redisBookStorage) scanBooks(ctx context.Context, key string, fn func(ids []string, books []Book) (bool, error)) error {
+	cursor := uint64(0)
+	for {
+		results, next, err := rs.client.HScan(ctx, key, cursor, "*", rs.scanCount()).Result()
+		if err != nil {
+			return fmt.Errorf("redis hscan: %v", err)
+		}
+		ids, books := make([]string, 0, len(results)/2), make([]Book, 0, len(results)/2)
+		for i := 1; i < len(results); i += 2 {
+			var book Book
+			if err = json.Unmarshal([]byte(results[i]), &book); err != nil {
+				return err
+			}
+			ids, books = append(ids, results[i-1]), append(books, book)
+		}
+		if more, err := fn(ids, books); err != nil || !more {
+			return err
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
 		}
-		books = append(books, book)
 	}
-	return books, nil
 }
 
-// DeleteAll removes all stored books.
+// Count returns the number of books of the hash in constant time with HLEN. With a cache
+// TTL, the expired books which are not yet evicted are counted as well.
+func (rs *redisBookStorage) Count(ctx context.Context) (int, error) {
+	n, err := rs.client.HLen(ctx, HBooks).Result()
+	return int(n), err
+}
+
+// DeleteAll removes all stored books along with the histories of all the books. The books
+// hash is scanned again until empty, up to deleteAllScans times.
 func (rs *redisBookStorage) DeleteAll(ctx context.Context) error {
+	if err := rs.deleteHistories(ctx); err != nil {
+		return err
+	}
 	cursor := uint64(0)
-	for {
+	for scans := 1; ; {
 		var results []string
 		var err error
-		results, cursor, err = rs.client.HScan(ctx, HBooks, cursor, "*", 1000).Result()
+		results, cursor, err = rs.client.HScan(ctx, HBooks, cursor, "*", rs.scanCount()).Result()
 
 		if err != nil {
 			return fmt.Errorf("redis hscan: %v", err)
@@ -121,9 +471,403 @@ func (rs *redisBookStorage) DeleteAll(ctx context.Context) error {
 			rs.client.HDel(ctx, HBooks, results[i])
 		}
 
-		if cursor == 0 {
-			break
+		if cursor != 0 {
+			continue
+		}
+		// fields removed while scanning may be skipped so scan again until empty.
+		left, err := rs.client.HLen(ctx, HBooks).Result()
+		if err != nil || left == 0 {
+			return err
+		}
+		if scans == deleteAllScans {
+			return fmt.Errorf("redis: %d books left after %d scans", left, scans)
+		}
+		scans++
+	}
+}
+
+// deleteAllScans bounds the scans of DeleteAll, which scans again the books left by the
+// previous scan, so the books added concurrently without end do not keep it running.
+const deleteAllScans = 5
+
+// watchRetries bounds the attempts of a watched transaction aborted by concurrent writes.
+const watchRetries = 10
+
+// watch runs the transaction fn watching the keys. Since a write of any book of a
+// watched hash aborts the transaction, it runs it again up to watchRetries times.
+func (rs *redisBookStorage) watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		err := rs.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr || attempt == watchRetries {
+			return err
+		}
+	}
+}
+
+// Trash moves the book to the trash hash along with its deletion time. Its views
+// counters and expiry are dropped. The books hash is watched so a concurrent write
+// retries the move instead of being lost.
+func (rs *redisBookStorage) Trash(ctx context.Context, id string, deletedAt time.Time) (Book, error) {
+	var book Book
+	err := rs.watch(ctx, func(tx *redis.Tx) error {
+		result, err := tx.HGet(ctx, HBooks, id).Result()
+		if err == redis.Nil {
+			return ErrBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal([]byte(result), &book); err != nil {
+			return err
+		}
+		book = book.Trashed(deletedAt)
+		bookBytes, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, HBooksTrash, id, bookBytes)
+			pipe.HDel(ctx, HBooks, id)
+			pipe.HDel(ctx, HViews, id)
+			pipe.ZRem(ctx, ZBooksViews, id)
+			pipe.ZRem(ctx, ZBooksExpiry, id)
+			return nil
+		})
+		return err
+	}, HBooks)
+	return book, err
+}
+
+// Restore moves back the book from the trash without its deletion time. The trash
+// hash is watched so a concurrent trashing retries the move instead of being lost.
+func (rs *redisBookStorage) Restore(ctx context.Context, id string) (Book, error) {
+	var book Book
+	err := rs.watch(ctx, func(tx *redis.Tx) error {
+		result, err := tx.HGet(ctx, HBooksTrash, id).Result()
+		if err == redis.Nil {
+			return ErrBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal([]byte(result), &book); err != nil {
+			return err
 		}
+		book.DeletedAt = ""
+		bookBytes, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			rs.write(ctx, pipe, id, bookBytes)
+			pipe.HDel(ctx, HBooksTrash, id)
+			return nil
+		})
+		return err
+	}, HBooksTrash)
+	return book, err
+}
+
+// renameScript replaces the book ARGV[1] by the book ARGV[2] stored as ARGV[3] and
+// moves its views counters and its history. The expiry of the new book is set to ARGV[4]
+// if not empty.
+// Nothing is changed if the new book already exists or is into the trash.
+var renameScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[2]) == 1 or redis.call("HEXISTS", KEYS[5], ARGV[2]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[2], ARGV[3])
+redis.call("HDEL", KEYS[1], ARGV[1])
+local views = redis.call("HGET", KEYS[2], ARGV[1])
+if views then
+	redis.call("HSET", KEYS[2], ARGV[2], views)
+	redis.call("HDEL", KEYS[2], ARGV[1])
+end
+local rank = redis.call("ZSCORE", KEYS[3], ARGV[1])
+if rank then
+	redis.call("ZADD", KEYS[3], rank, ARGV[2])
+	redis.call("ZREM", KEYS[3], ARGV[1])
+end
+redis.call("ZREM", KEYS[4], ARGV[1])
+if ARGV[4] ~= "" then
+	redis.call("ZADD", KEYS[4], ARGV[4], ARGV[2])
+end
+redis.call("DEL", KEYS[6])
+if redis.call("EXISTS", KEYS[7]) == 1 then
+	redis.call("RENAME", KEYS[7], KEYS[8])
+else
+	redis.call("DEL", KEYS[8])
+end
+return 1
+`)
+
+// Rename atomically replaces the book `id` by the book which carries its new ID. The
+// views counters and the history follow the book and the tombstone of the new ID, if
+// any, is removed.
+func (rs *redisBookStorage) Rename(ctx context.Context, id string, book Book) error {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	var expiry string
+	if rs.ttl() > 0 {
+		expiry = strconv.FormatFloat(rs.expiry(), 'f', -1, 64)
+	}
+	keys := []string{HBooks, HViews, ZBooksViews, ZBooksExpiry, HBooksTrash, TombstonePrefix + book.ID, historyKey(id), historyKey(book.ID)}
+	renamed, err := renameScript.Run(ctx, rs.client, keys, id, book.ID, bookBytes, expiry).Int()
+	if err != nil {
+		return err
+	}
+	if renamed == 0 {
+		return ErrBookExists
 	}
 	return nil
 }
+
+// InTrash reports whether the book is into the trash.
+func (rs *redisBookStorage) InTrash(ctx context.Context, id string) (bool, error) {
+	return rs.client.HExists(ctx, HBooksTrash, id).Result()
+}
+
+// GetTrash retrieves all the trashed books. They are scanned by batches instead of
+// with HVALS which would load the whole trash within a single reply.
+func (rs *redisBookStorage) GetTrash(ctx context.Context) ([]Book, error) {
+	books := []Book{}
+	err := rs.scanBooks(ctx, HBooksTrash, func(_ []string, batch []Book) (bool, error) {
+		books = append(books, batch...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// PurgeTrash permanently removes the books trashed before the given time along
+// with their history and returns their number.
+func (rs *redisBookStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	books, err := rs.GetTrash(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for _, book := range books {
+		if book.DeletedBefore(before) {
+			ids = append(ids, book.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	var deleted *redis.IntCmd
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.HDel(ctx, HBooksTrash, ids...)
+		pipe.Del(ctx, historyKeys(ids)...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted.Val()), nil
+}
+
+// SetTombstone records the book as absent for the ttl duration.
+func (rb *redisBookBase) SetTombstone(ctx context.Context, id string, ttl time.Duration) error {
+	return rb.client.Set(ctx, TombstonePrefix+id, 1, ttl).Err()
+}
+
+// HasTombstone reports whether the book is recorded as absent.
+func (rb *redisBookBase) HasTombstone(ctx context.Context, id string) (bool, error) {
+	n, err := rb.client.Exists(ctx, TombstonePrefix+id).Result()
+	return n == 1, err
+}
+
+// IncrViews adds one view to the book. The views hash and the ranking
+// sorted set are updated in a single round-trip.
+func (rb *redisBookBase) IncrViews(ctx context.Context, id string) error {
+	_, err := rb.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, HViews, id, 1)
+		pipe.ZIncrBy(ctx, ZBooksViews, 1, id)
+		return nil
+	})
+	return err
+}
+
+// GetViews retrieves the number of views of a book. It is zero if never viewed.
+func (rb *redisBookBase) GetViews(ctx context.Context, id string) (int64, error) {
+	views, err := rb.client.HGet(ctx, HViews, id).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return views, err
+}
+
+// TopViewed retrieves at most `limit` books ordered by their number of views.
+// Ranked books which no longer exist are skipped.
+func (rs *redisBookStorage) TopViewed(ctx context.Context, limit int64) ([]BookViews, error) {
+	ranks, err := rs.client.ZRevRangeWithScores(ctx, ZBooksViews, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return []BookViews{}, nil
+	}
+	ids := make([]string, 0, len(ranks))
+	for _, rank := range ranks {
+		ids = append(ids, rank.Member.(string))
+	}
+	values, err := rs.client.HMGet(ctx, HBooks, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	books := make([]BookViews, 0, len(ranks))
+	for i, value := range values {
+		bookJSONString, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var book Book
+		if err = json.Unmarshal([]byte(bookJSONString), &book); err != nil {
+			return nil, err
+		}
+		books = append(books, BookViews{Book: book, Views: int64(ranks[i].Score)})
+	}
+	return books, nil
+}
+
+// ScheduleDelete records the delete of the book at the given time unless one is already
+// scheduled. With purge, the book is removed at once along with its views counters.
+func (rs *redisBookStorage) ScheduleDelete(ctx context.Context, id string, at time.Time, purge bool) error {
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddNX(ctx, ZBooksDeletes, redis.Z{Score: float64(at.UnixMilli()), Member: id})
+		if purge {
+			pipe.HDel(ctx, HBooks, id)
+			pipe.HDel(ctx, HViews, id)
+			pipe.ZRem(ctx, ZBooksViews, id)
+			pipe.ZRem(ctx, ZBooksExpiry, id)
+		}
+		return nil
+	})
+	return err
+}
+
+// CancelDelete removes the scheduled delete of the book. It reports
+// false if there was none or if it was already claimed.
+func (rs *redisBookStorage) CancelDelete(ctx context.Context, id string) (bool, error) {
+	n, err := rs.client.ZRem(ctx, ZBooksDeletes, id).Result()
+	return n > 0, err
+}
+
+// DeletePending reports whether the book has a scheduled delete.
+func (rs *redisBookStorage) DeletePending(ctx context.Context, id string) (bool, error) {
+	err := rs.client.ZScore(ctx, ZBooksDeletes, id).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PendingDeletes retrieves among the ids the ones of the books with a scheduled delete.
+// Only the given ids are looked up so the cost follows the page size rather than the
+// number of scheduled deletes. A missing member is scored 0 which no schedule is.
+func (rs *redisBookStorage) PendingDeletes(ctx context.Context, ids ...string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	scores, err := rs.client.ZMScore(ctx, ZBooksDeletes, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for i, score := range scores {
+		if score != 0 {
+			pending = append(pending, ids[i])
+		}
+	}
+	return pending, nil
+}
+
+// claimDeletesScript removes and returns up to ARGV[2] deletes scheduled before ARGV[1].
+var claimDeletesScript = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #ids > 0 then
+	redis.call("ZREM", KEYS[1], unpack(ids))
+end
+return ids
+`)
+
+// ClaimDueDeletes atomically removes and returns up to limit deletes due at the given
+// time. So a claimed delete cannot be cancelled anymore nor claimed by another instance.
+func (rs *redisBookStorage) ClaimDueDeletes(ctx context.Context, now time.Time, limit int64) ([]string, error) {
+	return claimDeletesScript.Run(ctx, rs.client, []string{ZBooksDeletes}, now.UnixMilli(), limit).StringSlice()
+}
+
+// historyKey returns the key of the list of the book prior versions.
+func historyKey(id string) string {
+	return HistoryPrefix + id
+}
+
+// historyKeys returns the keys of the lists of the books prior versions.
+func historyKeys(ids []string) []string {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, historyKey(id))
+	}
+	return keys
+}
+
+// deleteHistories removes the histories of all the books, including those of the books
+// evicted from the cache or trashed. Their keys are scanned by batches of scanCount.
+func (rb *redisBookBase) deleteHistories(ctx context.Context) error {
+	iter := rb.client.Scan(ctx, 0, HistoryPrefix+"*", rb.scanCount()).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if int64(len(keys)) < rb.scanCount() {
+			continue
+		}
+		if err := rb.client.Del(ctx, keys...).Err(); err != nil {
+			return err
+		}
+		keys = keys[:0]
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("redis scan: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return rb.client.Del(ctx, keys...).Err()
+}
+
+// AppendHistory appends the book version to its history list which is trimmed
+// to its last max versions.
+func (rb *redisBookBase) AppendHistory(ctx context.Context, id string, book Book, max int64) error {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	_, err = rb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, historyKey(id), bookBytes)
+		pipe.LTrim(ctx, historyKey(id), -max, -1)
+		return nil
+	})
+	return err
+}
+
+// GetHistory retrieves the prior versions of the book from the oldest.
+func (rb *redisBookBase) GetHistory(ctx context.Context, id string) ([]Book, error) {
+	values, err := rb.client.LRange(ctx, historyKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	books := make([]Book, 0, len(values))
+	for _, value := range values {
+		var book Book
+		if err = json.Unmarshal([]byte(value), &book); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
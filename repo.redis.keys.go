@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// prefix of the keys of the books with the keys layout.
+	BookKeyPrefix string = "books:item:"
+	// set of the IDs of the books stored with the keys layout.
+	SBooksIndex string = "books:index"
+)
+
+// Ensure *redisKeysBookStorage implements the optional operations supported by the keys layout.
+var (
+	_ BookViewsCounter = (*redisKeysBookStorage)(nil)
+	_ BookBulkAdder    = (*redisKeysBookStorage)(nil)
+	_ BookTombstoner   = (*redisKeysBookStorage)(nil)
+	_ BookOutboxWriter = (*redisKeysBookStorage)(nil)
+	_ BookHistorian    = (*redisKeysBookStorage)(nil)
+)
+
+// redisKeysBookStorage stores each book under its own key so a book is read with a
+// single GET and many with MGET, which spread over a cluster unlike the fields of
+// a single hash. The books IDs are indexed into a set which is scanned to list them.
+// When a cache TTL is configured, the books keys expire natively and their IDs left
+// into the index are removed when they are met by the listings.
+type redisKeysBookStorage struct {
+	redisBookBase
+}
+
+// bookKey returns the key of the book.
+func bookKey(id string) string {
+	return BookKeyPrefix + id
+}
+
+// bookKeys returns the keys of the books.
+func bookKeys(ids []string) []string {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, bookKey(id))
+	}
+	return keys
+}
+
+// set stores the book and records the outbox entry, if provided, in a single transaction.
+func (rk *redisKeysBookStorage) set(ctx context.Context, id string, bookBytes, entry []byte) error {
+	_, err := rk.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rk.write(ctx, pipe, id, bookBytes)
+		if entry != nil {
+			pipe.RPush(ctx, OutboxQueue, entry)
+		}
+		return nil
+	})
+	return err
+}
+
+// write queues into the pipeline the commands storing the book with its expiry, indexing
+// it and removing its tombstone. It returns the book write command.
+func (rk *redisKeysBookStorage) write(ctx context.Context, pipe redis.Pipeliner, id string, bookBytes []byte) *redis.StatusCmd {
+	cmd := pipe.Set(ctx, bookKey(id), bookBytes, rk.ttl())
+	pipe.SAdd(ctx, SBooksIndex, id)
+	pipe.Del(ctx, TombstonePrefix+id)
+	return cmd
+}
+
+// Add inserts a new book record.
+func (rk *redisKeysBookStorage) Add(ctx context.Context, id string, book Book) error {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	return rk.set(ctx, id, bookBytes, nil)
+}
+
+// AddMany inserts the books in a single round-trip. Each book is written
+// like by Add and the errors are aligned with the books.
+func (rk *redisKeysBookStorage) AddMany(ctx context.Context, books []Book) []error {
+	errs := make([]error, len(books))
+	cmds := make([]*redis.StatusCmd, len(books))
+	_, err := rk.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, book := range books {
+			bookBytes, merr := json.Marshal(book)
+			if merr != nil {
+				errs[i] = merr
+				continue
+			}
+			cmds[i] = rk.write(ctx, pipe, book.ID, bookBytes)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if cmd != nil {
+			errs[i] = cmd.Err()
+		} else if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// GetOne retrieves a book record with a single GET. When the sliding TTL is enabled,
+// the book is read with GETEX which pushes back its expiry in the same command.
+func (rk *redisKeysBookStorage) GetOne(ctx context.Context, id string) (Book, error) {
+	var book Book
+	var cmd *redis.StringCmd
+	if rk.ttl() > 0 && rk.config.SlidingTTL {
+		cmd = rk.client.GetEx(ctx, bookKey(id), rk.ttl())
+	} else {
+		cmd = rk.client.Get(ctx, bookKey(id))
+	}
+	bookJSONString, err := cmd.Result()
+	if err == redis.Nil {
+		return book, ErrBookNotFound
+	}
+	if err != nil {
+		return book, err
+	}
+	err = json.Unmarshal([]byte(bookJSONString), &book)
+	return book, err
+}
+
+// getMany reads the books with MGET. The IDs of the missing books, like the expired
+// ones, are returned apart so they can be removed from the index.
+func (rk *redisKeysBookStorage) getMany(ctx context.Context, ids []string) ([]Book, []string, error) {
+	if len(ids) == 0 {
+		return []Book{}, nil, nil
+	}
+	values, err := rk.client.MGet(ctx, bookKeys(ids)...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	books := make([]Book, 0, len(values))
+	var missing []string
+	for i, value := range values {
+		bookJSONString, ok := value.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var book Book
+		if err = json.Unmarshal([]byte(bookJSONString), &book); err != nil {
+			return nil, nil, err
+		}
+		books = append(books, book)
+	}
+	return books, missing, nil
+}
+
+// unindex removes from the index the IDs of the books which no longer exist. It is
+// best-effort since the missing books are not served anyway.
+func (rk *redisKeysBookStorage) unindex(ctx context.Context, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := rk.client.SRem(ctx, SBooksIndex, ids).Err(); err != nil {
+		rk.logger.Error("redis: failed to unindex missing books", zap.Strings("ids", ids), zap.Error(err))
+	}
+}
+
+// Delete removes a book record based on its ID along with its views counters and history.
+func (rk *redisKeysBookStorage) Delete(ctx context.Context, id string) error {
+	numDeleted, err := rk.client.Del(ctx, bookKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	_, perr := rk.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, SBooksIndex, id)
+		if numDeleted > 0 {
+			pipe.HDel(ctx, HViews, id)
+			pipe.ZRem(ctx, ZBooksViews, id)
+			pipe.Del(ctx, historyKey(id))
+		}
+		return nil
+	})
+	if numDeleted == 0 {
+		return ErrBookNotFound
+	}
+	return perr
+}
+
+// deleteKeyWithOutboxScript removes the book key along with its index entry, views counters
+// and history and records the outbox entry. Nothing is recorded if the book does not exist.
+var deleteKeyWithOutboxScript = redis.NewScript(`
+redis.call("SREM", KEYS[2], ARGV[1])
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("ZREM", KEYS[4], ARGV[1])
+redis.call("DEL", KEYS[6])
+redis.call("RPUSH", KEYS[5], ARGV[2])
+return 1
+`)
+
+// SetWithOutbox inserts or replaces a book record and records its outbox entry
+// for the queue qid in a single transaction.
+func (rk *redisKeysBookStorage) SetWithOutbox(ctx context.Context, qid, id string, book Book) error {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(OutboxEntry{QID: qid, RequestID: GetValueFromContext(ctx, RequestIDContextKey), Book: book})
+	if err != nil {
+		return err
+	}
+	return rk.set(ctx, id, bookBytes, entry)
+}
+
+// DeleteWithOutbox removes a book record like Delete and records its outbox
+// entry for the deletion queue atomically.
+func (rk *redisKeysBookStorage) DeleteWithOutbox(ctx context.Context, id string) error {
+	entry, err := json.Marshal(OutboxEntry{QID: DeleteQueue, RequestID: GetValueFromContext(ctx, RequestIDContextKey), Book: Book{ID: id}})
+	if err != nil {
+		return err
+	}
+	keys := []string{bookKey(id), SBooksIndex, HViews, ZBooksViews, OutboxQueue, historyKey(id)}
+	deleted, err := deleteKeyWithOutboxScript.Run(ctx, rk.client, keys, id, entry).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrBookNotFound
+	}
+	return nil
+}
+
+// Update replaces existing book record data or inserts a new book if does not exist.
+func (rk *redisKeysBookStorage) Update(ctx context.Context, id string, book Book) (Book, error) {
+	bookBytes, err := json.Marshal(book)
+	if err != nil {
+		return book, err
+	}
+	err = rk.set(ctx, id, bookBytes, nil)
+	return book, err
+}
+
+// GetAll retrieves a page of books. The index is scanned with SSCAN, whose cursor is
+// wrapped by the page cursor, and the books of each batch are read with MGET. Like for
+// the hash layout, a page may hold slightly more than limit.
+func (rk *redisKeysBookStorage) GetAll(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+	var position uint64
+	if cursor != "" {
+		value, err := DecodeCursor("redis", cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if position, err = strconv.ParseUint(value, 10, 64); err != nil || position == 0 {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	books := []Book{}
+	for {
+		ids, next, err := rk.client.SScan(ctx, SBooksIndex, position, "*", limit-int64(len(books))).Result()
+		if err != nil {
+			return nil, "", fmt.Errorf("redis sscan: %v", err)
+		}
+		page, missing, err := rk.getMany(ctx, ids)
+		if err != nil {
+			return nil, "", err
+		}
+		rk.unindex(ctx, missing)
+		books = append(books, page...)
+		position = next
+		if position == 0 || int64(len(books)) >= limit {
+			break
+		}
+	}
+	if position == 0 {
+		return books, "", nil
+	}
+	return books, EncodeCursor("redis", strconv.FormatUint(position, 10)), nil
+}
+
+// scanBooks iterates over the books by SSCAN batches of scanCount of the index, so they
+// are never all loaded into memory at once. Each batch is passed to fn until fn returns
+// false or an error, or the scan completed.
+func (rk *redisKeysBookStorage) scanBooks(ctx context.Context, fn func(books []Book) (bool, error)) error {
+	cursor := uint64(0)
+	for {
+		ids, next, err := rk.client.SScan(ctx, SBooksIndex, cursor, "*", rk.scanCount()).Result()
+		if err != nil {
+			return fmt.Errorf("redis sscan: %v", err)
+		}
+		books, missing, err := rk.getMany(ctx, ids)
+		if err != nil {
+			return err
+		}
+		rk.unindex(ctx, missing)
+		if more, err := fn(books); err != nil || !more {
+			return err
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Search scans the books to find at most MaxSearchResults books whose fields contain
+// the query. The query is expected to be already trimmed and lowercased.
+func (rk *redisKeysBookStorage) Search(ctx context.Context, query string, fields []string) ([]Book, error) {
+	books := []Book{}
+	err := rk.scanBooks(ctx, func(batch []Book) (bool, error) {
+		for _, book := range batch {
+			if len(book.Match(query, fields)) == 0 {
+				continue
+			}
+			books = append(books, book)
+			if len(books) == MaxSearchResults {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// Count returns the number of indexed books in constant time with SCARD. With a cache
+// TTL, the expired books which are not yet unindexed are counted as well.
+func (rk *redisKeysBookStorage) Count(ctx context.Context) (int, error) {
+	n, err := rk.client.SCard(ctx, SBooksIndex).Result()
+	return int(n), err
+}
+
+// DeleteAll removes all stored books by batches of the index along with the histories of
+// all the books. The index is scanned again until empty, up to deleteAllScans times, since
+// removing members while scanning may skip some of them.
+func (rk *redisKeysBookStorage) DeleteAll(ctx context.Context) error {
+	if err := rk.deleteHistories(ctx); err != nil {
+		return err
+	}
+	cursor := uint64(0)
+	for scans := 1; ; {
+		ids, next, err := rk.client.SScan(ctx, SBooksIndex, cursor, "*", rk.scanCount()).Result()
+		if err != nil {
+			return fmt.Errorf("redis sscan: %v", err)
+		}
+		if len(ids) > 0 {
+			_, err = rk.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, bookKeys(ids)...)
+				pipe.SRem(ctx, SBooksIndex, ids)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if cursor != 0 {
+			continue
+		}
+		left, err := rk.client.SCard(ctx, SBooksIndex).Result()
+		if err != nil || left == 0 {
+			return err
+		}
+		if scans == deleteAllScans {
+			return fmt.Errorf("redis: %d books left after %d scans", left, scans)
+		}
+		scans++
+	}
+}
+
+// TopViewed retrieves at most `limit` books ordered by their number of views. The
+// books are read with a single MGET and the ranked ones which no longer exist are skipped.
+func (rk *redisKeysBookStorage) TopViewed(ctx context.Context, limit int64) ([]BookViews, error) {
+	ranks, err := rk.client.ZRevRangeWithScores(ctx, ZBooksViews, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return []BookViews{}, nil
+	}
+	ids := make([]string, 0, len(ranks))
+	for _, rank := range ranks {
+		ids = append(ids, rank.Member.(string))
+	}
+	values, err := rk.client.MGet(ctx, bookKeys(ids)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	books := make([]BookViews, 0, len(ranks))
+	for i, value := range values {
+		bookJSONString, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var book Book
+		if err = json.Unmarshal([]byte(bookJSONString), &book); err != nil {
+			return nil, err
+		}
+		books = append(books, BookViews{Book: book, Views: int64(ranks[i].Score)})
+	}
+	return books, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestAppStop_DrainingLogs ensures the number of requests in flight is logged while
+// draining and the number of forcibly terminated ones once the shutdown timed out.
+func TestAppStop_DrainingLogs(t *testing.T) {
+	observedZapCore, observedLogs := observer.New(zap.InfoLevel)
+	stats := &Statistics{}
+	release := make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&stats.inflight, 1)
+		defer atomic.AddInt64(&stats.inflight, -1)
+		<-release
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	go http.Get("http://" + listener.Addr().String())
+	require.Eventually(t, func() bool { return stats.InFlight() == 1 }, time.Second, 5*time.Millisecond)
+
+	app := &App{
+		logger:      zap.New(observedZapCore),
+		config:      &Config{Server: ServerConfig{ShutdownTimeout: 1500 * time.Millisecond}},
+		server:      server,
+		stats:       stats,
+		redisClient: newMiniRedisClient(t),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, app.Stop(ctx, ctx)())
+
+	draining := observedLogs.FilterMessage("api server draining requests").All()
+	require.NotEmpty(t, draining)
+	assert.Equal(t, int64(1), draining[0].ContextMap()["requests.inflight"])
+	timedout := observedLogs.FilterMessage("api server graceful shutdown timed out").All()
+	require.Len(t, timedout, 1)
+	assert.Equal(t, int64(1), timedout[0].ContextMap()["requests.terminated"])
+}
+
+// bufferedMetricSink buffers the recorded metrics until they are flushed.
+type bufferedMetricSink struct {
+	mu      sync.Mutex
+	pending map[string]int
+	flushed map[string]int
+}
+
+func (bs *bufferedMetricSink) Record(name string, value int) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.pending[name] += value
+}
+
+func (bs *bufferedMetricSink) Flush(ctx context.Context) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for name, value := range bs.pending {
+		bs.flushed[name] += value
+	}
+	bs.pending = map[string]int{}
+	return ctx.Err()
+}
+
+// TestAppStop_Flushers ensures the buffered subsystems are flushed in order on shutdown
+// and a stuck one is abandoned after the flush timeout without preventing the next ones.
+func TestAppStop_Flushers(t *testing.T) {
+	observedZapCore, observedLogs := observer.New(zap.InfoLevel)
+	sink := &bufferedMetricSink{pending: map[string]int{}, flushed: map[string]int{}}
+	sink.Record("books_created", 3)
+	sink.Record("books_deleted", 1)
+	release := make(chan struct{})
+	defer close(release)
+	var mu sync.Mutex
+	var order []string
+	called := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+	app := &App{
+		logger:      zap.New(observedZapCore),
+		config:      &Config{Server: ServerConfig{ShutdownTimeout: time.Second, FlushTimeout: 50 * time.Millisecond}},
+		server:      &http.Server{},
+		stats:       &Statistics{},
+		redisClient: newMiniRedisClient(t),
+		flushers: []Flusher{
+			{Name: "stuck", Flush: func(ctx context.Context) error {
+				called("stuck")
+				<-release
+				return nil
+			}},
+			{Name: "metrics", Flush: func(ctx context.Context) error {
+				called("metrics")
+				return sink.Flush(ctx)
+			}},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	require.NoError(t, app.Stop(ctx, ctx)())
+
+	assert.Less(t, time.Since(start), time.Second)
+	mu.Lock()
+	assert.Equal(t, []string{"stuck", "metrics"}, order)
+	mu.Unlock()
+	assert.Empty(t, sink.pending)
+	assert.Equal(t, map[string]int{"books_created": 3, "books_deleted": 1}, sink.flushed)
+	timedout := observedLogs.FilterMessage("flushing buffered writes timed out").All()
+	require.Len(t, timedout, 1)
+	assert.Equal(t, "stuck", timedout[0].ContextMap()["flusher"])
+	assert.Zero(t, observedLogs.FilterMessage("error flushing buffered writes").Len())
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key into dir.
+func writeTestCertificate(t *testing.T, dir string) (certsFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "drap"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certsFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	require.NoError(t, os.WriteFile(certsFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certsFile, keyFile
+}
+
+// TestNewServerTLSConfig ensures a valid certificate and key pair is loaded while missing
+// files or a mismatched pair are rejected.
+func TestNewServerTLSConfig(t *testing.T) {
+	certsFile, keyFile := writeTestCertificate(t, t.TempDir())
+	config, err := NewServerTLSConfig(certsFile, keyFile)
+	require.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+
+	_, err = NewServerTLSConfig(filepath.Join(t.TempDir(), "missing.crt"), keyFile)
+	assert.ErrorContains(t, err, "failed to load the server tls certificate and key")
+
+	_, otherKey := writeTestCertificate(t, t.TempDir())
+	_, err = NewServerTLSConfig(certsFile, otherKey)
+	assert.Error(t, err)
+
+	assert.False(t, ServerConfig{CertsFile: certsFile}.TLSEnabled())
+	assert.True(t, ServerConfig{CertsFile: certsFile, KeyFile: keyFile}.TLSEnabled())
+}
+
+// TestServeTLS_HTTP2 ensures the api is served over HTTP/2 with the TLS config and the
+// handlers extending their write deadline do it per stream instead of on the connection.
+func TestServeTLS_HTTP2(t *testing.T) {
+	certsFile, keyFile := writeTestCertificate(t, t.TempDir())
+	tlsConfig, err := NewServerTLSConfig(certsFile, keyFile)
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.ErrorLevel)
+	config := &Config{Server: ServerConfig{WriteTimeout: 5 * time.Second, LongRequestWriteTimeout: time.Minute, RequestTimeout: time.Second}}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return []Book{}, "", nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	chained := (&Middlewares{api.TimeoutMiddleware, api.StatsMiddleware}).Chain(api.GetAllBooks)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chained(w, r, nil)
+		}),
+		ConnContext: SaveConnInContext,
+		TLSConfig:   tlsConfig,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/v1/books")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Zero(t, logs.Len(), "the write deadline must be set without error")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadConfig_Durations ensures the durations settings from the file or the environment
+// require their units so a unitless number, like any malformed value, is rejected with an
+// error naming the setting and the expected format.
+func TestLoadConfig_Durations(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+		err      string
+	}{
+		{"30s", 30 * time.Second, ""},
+		{"1h30m", 90 * time.Minute, ""},
+		{"0", 0, ""},
+		{"30", 0, `invalid duration "30": use numbers with units like 30s, 5m or 1h30m`},
+		{"abc", 0, `invalid duration "abc": use numbers with units like 30s, 5m or 1h30m`},
+	}
+
+	t.Run("file", func(t *testing.T) {
+		for _, tc := range testCases {
+			file := filepath.Join(t.TempDir(), "config.yml")
+			require.NoError(t, os.WriteFile(file, []byte("server:\n  host: localhost\n  read_timeout: "+tc.value+"\n"), 0o600))
+			config, err := LoadConfigFile(file)
+			if tc.err != "" {
+				require.Error(t, err, tc.value)
+				assert.Equal(t, "config file setting server.read_timeout: "+tc.err, err.Error())
+				continue
+			}
+			require.NoError(t, err, tc.value)
+			assert.Equal(t, tc.expected, config.Server.ReadTimeout, tc.value)
+			assert.Equal(t, "localhost", config.Server.Host)
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		for _, tc := range testCases {
+			t.Setenv("DRAP_SERVER_READ_TIMEOUT", tc.value)
+			config := &Config{}
+			err := LoadConfigEnvs("DRAP", config)
+			if tc.err != "" {
+				require.Error(t, err, tc.value)
+				assert.Equal(t, "environment variable DRAP_SERVER_READ_TIMEOUT: "+tc.err, err.Error())
+				continue
+			}
+			require.NoError(t, err, tc.value)
+			assert.Equal(t, tc.expected, config.Server.ReadTimeout, tc.value)
+		}
+	})
+
+	t.Run("default file", func(t *testing.T) {
+		config, err := LoadConfigFile("./config.yml")
+		require.NoError(t, err)
+		assert.Equal(t, 5*time.Second, config.Server.ReadTimeout)
+	})
+}
+
+// TestServerConfig_Accessors ensures each server setting accessor provides
+// its default when the setting is unset and the setting value otherwise.
+func TestServerConfig_Accessors(t *testing.T) {
+	var unset ServerConfig
+	set := ServerConfig{
+		ReadTimeout:                  time.Second,
+		WriteTimeout:                 2 * time.Second,
+		RequestTimeout:               3 * time.Second,
+		LongRequestProcessingTimeout: 4 * time.Second,
+		LongRequestWriteTimeout:      5 * time.Second,
+		ShutdownTimeout:              6 * time.Second,
+		FlushTimeout:                 7 * time.Second,
+		MaxRequestBodyBytes:          1024,
+	}
+	testCases := []struct {
+		name     string
+		get      func(ServerConfig) time.Duration
+		defaults time.Duration
+		value    time.Duration
+	}{
+		{"read timeout", ServerConfig.GetReadTimeout, DefaultServerReadTimeout, time.Second},
+		{"write timeout", ServerConfig.GetWriteTimeout, DefaultServerWriteTimeout, 2 * time.Second},
+		{"request timeout", ServerConfig.GetRequestTimeout, DefaultServerRequestTimeout, 3 * time.Second},
+		{"long request processing timeout", ServerConfig.GetLongRequestProcessingTimeout, DefaultServerLongRequestProcessingTimeout, 4 * time.Second},
+		{"long request write timeout", ServerConfig.GetLongRequestWriteTimeout, DefaultServerLongRequestWriteTimeout, 5 * time.Second},
+		{"shutdown timeout", ServerConfig.GetShutdownTimeout, DefaultServerShutdownTimeout, 6 * time.Second},
+		{"flush timeout", ServerConfig.GetFlushTimeout, DefaultServerFlushTimeout, 7 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.defaults, tc.get(unset))
+			assert.Equal(t, tc.value, tc.get(set))
+		})
+	}
+
+	t.Run("max request body bytes", func(t *testing.T) {
+		assert.Equal(t, DefaultMaxRequestBodyBytes, unset.GetMaxRequestBodyBytes())
+		assert.Equal(t, int64(1024), set.GetMaxRequestBodyBytes())
+	})
+}
+
+// TestServerConfig_TimeoutWarnings ensures the unset long requests timeouts and a write
+// timeout which would cut the responses before the end of the processing are reported.
+func TestServerConfig_TimeoutWarnings(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   ServerConfig
+		warnings []string
+	}{
+		{"valid", ServerConfig{LongRequestProcessingTimeout: 55 * time.Second, LongRequestWriteTimeout: time.Minute}, nil},
+		{"unset write timeout", ServerConfig{LongRequestProcessingTimeout: 55 * time.Second}, []string{
+			"server long request write timeout unset, using 1m0s",
+		}},
+		{"unset", ServerConfig{}, []string{
+			"server long request processing timeout unset, using 55s",
+			"server long request write timeout unset, using 1m0s",
+		}},
+		{"write before processing end", ServerConfig{LongRequestProcessingTimeout: time.Minute, LongRequestWriteTimeout: 30 * time.Second}, []string{
+			"server long request write timeout 30s should exceed the processing timeout 1m0s",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.warnings, tc.config.TimeoutWarnings())
+		})
+	}
+}
+
+// TestHealthConfig_Defaults ensures a configuration without the health section is
+// accepted and its unset timeouts default while a negative queue threshold is refused.
+func TestHealthConfig_Defaults(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Host: "localhost", Port: "8080"},
+		Redis:  RedisConfig{Host: "localhost", Port: "6379"},
+	}
+	require.NoError(t, InitConfig(config, "", "", ""))
+	assert.Equal(t, DefaultHealthTimeout, config.Ops.Health.GetTimeout())
+	assert.Equal(t, DefaultHealthHeartbeatTimeout, config.Ops.Health.GetHeartbeatTimeout())
+
+	set := HealthConfig{Timeout: time.Second, HeartbeatTimeout: time.Minute}
+	assert.Equal(t, time.Second, set.GetTimeout())
+	assert.Equal(t, time.Minute, set.GetHeartbeatTimeout())
+
+	config.Ops.Health.QueueThreshold = -1
+	err := InitConfig(config, "", "", "")
+	require.Error(t, err)
+	assert.Equal(t, "make sure to set non-negative ops health queue threshold", err.Error())
+}
+
+// TestLoadEnvFile ensures loading again the env file overrides the variables it set
+// before, so a reload picks up the edited values, while the variables set by the process
+// environment keep precedence over the file.
+func TestLoadEnvFile(t *testing.T) {
+	t.Setenv("DRAP_TEST_ENV_PROCESS", "process")
+	t.Cleanup(func() {
+		os.Unsetenv("DRAP_TEST_ENV_FILE")
+		envFileKeys.Lock()
+		delete(envFileKeys.set, "DRAP_TEST_ENV_FILE")
+		envFileKeys.Unlock()
+	})
+	file := filepath.Join(t.TempDir(), "config.env")
+
+	require.NoError(t, os.WriteFile(file, []byte("DRAP_TEST_ENV_FILE=v1\nDRAP_TEST_ENV_PROCESS=file\n"), 0o600))
+	require.NoError(t, LoadEnvFile(file))
+	assert.Equal(t, "v1", os.Getenv("DRAP_TEST_ENV_FILE"))
+	assert.Equal(t, "process", os.Getenv("DRAP_TEST_ENV_PROCESS"))
+
+	require.NoError(t, os.WriteFile(file, []byte("DRAP_TEST_ENV_FILE=v2\nDRAP_TEST_ENV_PROCESS=file\n"), 0o600))
+	require.NoError(t, LoadEnvFile(file))
+	assert.Equal(t, "v2", os.Getenv("DRAP_TEST_ENV_FILE"))
+	assert.Equal(t, "process", os.Getenv("DRAP_TEST_ENV_PROCESS"))
+}
+
+// TestCORSConfig_WildcardCredentials ensures the `*` origin is refused along with the
+// credentials so any site cannot make credentialed reads.
+func TestCORSConfig_WildcardCredentials(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Host: "localhost", Port: "8080"},
+		Redis:  RedisConfig{Host: "localhost", Port: "6379"},
+		CORS:   CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true},
+	}
+	err := InitConfig(config, "", "", "")
+	require.Error(t, err)
+	assert.Equal(t, "make sure to set explicit cors allowed origins instead of * when allowing credentials", err.Error())
+
+	config.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	require.NoError(t, InitConfig(config, "", "", ""))
+}
+
+// TestBackupConfig_ConsumerName ensures the configured consumer name is used and the
+// hostname otherwise, so the instances do not share their processing lists.
+func TestBackupConfig_ConsumerName(t *testing.T) {
+	assert.Equal(t, "instance-1", BackupConfig{ConsumerName: "instance-1"}.GetConsumerName())
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, hostname, BackupConfig{}.GetConsumerName())
+}
+
+// TestRedisConfig_KeysLayoutRename ensures the books renaming, which the keys layout
+// does not support, is rejected along with it.
+func TestRedisConfig_KeysLayoutRename(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Host: "localhost", Port: "8080"},
+		Redis:  RedisConfig{Host: "localhost", Port: "6379", Layout: RedisLayoutKeys},
+		Ops:    OpsConfig{Rename: RenameConfig{Enable: true, Token: "token"}},
+	}
+	err := InitConfig(config, "", "", "")
+	require.Error(t, err)
+	assert.Equal(t, "make sure to use the redis hash layout with the trash or the delayed deletes or the books renaming", err.Error())
+
+	config.Redis.Layout = RedisLayoutHash
+	require.NoError(t, InitConfig(config, "", "", ""))
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestBoltDBConsumer_Shutdown ensures a book being processed when the consumer is asked
+// to stop is fully persisted before Consume returns and no other book is popped.
+func TestBoltDBConsumer_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pops := 0
+	queue := &MockQueuer{
+		PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+			pops++
+			return CreateQueue, Book{ID: "b:1"}, nil
+		},
+	}
+	persisted := map[string]Book{}
+	repo := &MockBookStorage{
+		AddFunc: func(wctx context.Context, id string, book Book) error {
+			// shutdown requested in the middle of the write.
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+			if wctx.Err() != nil {
+				return wctx.Err()
+			}
+			persisted[id] = book
+			return nil
+		},
+	}
+
+	err := NewBoltDBConsumer(zap.NewNop(), queue, repo).Consume(ctx, CreateQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pops)
+	assert.Equal(t, Book{ID: "b:1"}, persisted["b:1"])
+}
+
+// TestBackupConsumer_Policies ensures a book is applied to every backup sink and a
+// single sink failure is routed to the dead letter queue only when the policy failed,
+// or to the repair queue of the failed sink when a quorum applied it.
+func TestBackupConsumer_Policies(t *testing.T) {
+	newSink := func(name string, fail bool, added map[string]Book) BackupSink {
+		return BackupSink{Name: name, Repo: &MockBookStorage{
+			AddFunc: func(ctx context.Context, id string, book Book) error {
+				if fail {
+					return errors.New("sink: write failure")
+				}
+				added[id] = book
+				return nil
+			},
+		}}
+	}
+
+	testCases := []struct {
+		name       string
+		policy     string
+		quorum     int
+		failSecond bool
+		pushed     []string
+	}{
+		{"all sinks applied", BackupPolicyAll, 0, false, nil},
+		{"all policy with a failed sink", BackupPolicyAll, 0, true, []string{DeadLetterQueue(CreateQueue)}},
+		{"quorum reached with a failed sink", BackupPolicyQuorum, 1, true, []string{RepairQueue("second", CreateQueue)}},
+		{"majority missed with a failed sink", BackupPolicyQuorum, 0, true, []string{DeadLetterQueue(CreateQueue)}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var pushed []string
+			queue := &MockQueuer{
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					pushed = append(pushed, qid)
+					return nil
+				},
+			}
+			first, second := map[string]Book{}, map[string]Book{}
+			consumer := NewBackupConsumer(zap.NewNop(), queue, BackupConfig{Policy: tc.policy, Quorum: tc.quorum}, nil,
+				newSink("first", false, first), newSink("second", tc.failSecond, second)).(*backupConsumer)
+
+			book := Book{ID: "b:1"}
+			consumer.process(context.Background(), CreateQueue, book)
+
+			assert.Equal(t, book, first["b:1"])
+			if !tc.failSecond {
+				assert.Equal(t, book, second["b:1"])
+			}
+			assert.Equal(t, tc.pushed, pushed)
+		})
+	}
+}
+
+// TestBackupConsumer_Retry ensures a failed write is retried with a backoff before the
+// book is routed to the dead letter queue, except for the failures a retry cannot fix
+// and once the consumer is asked to stop.
+func TestBackupConsumer_Retry(t *testing.T) {
+	testCases := []struct {
+		name       string
+		failures   int
+		err        error
+		cancel     bool
+		attempts   int
+		deadLetter bool
+	}{
+		{"applied after retries", 2, errors.New("sink: write failure"), false, 3, false},
+		{"attempts exhausted", 5, errors.New("sink: write failure"), false, 3, true},
+		{"missing book not retried", 5, ErrBookNotFound, false, 1, true},
+		{"stopped consumer not retried", 5, errors.New("sink: write failure"), true, 1, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var deadLetters []string
+			queue := &MockQueuer{
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					deadLetters = append(deadLetters, qid)
+					return nil
+				},
+			}
+			attempts := 0
+			repo := &MockBookStorage{
+				DeleteFunc: func(ctx context.Context, id string) error {
+					attempts++
+					if attempts <= tc.failures {
+						return tc.err
+					}
+					return nil
+				},
+			}
+			consumer := NewBackupConsumer(zap.NewNop(), queue, BackupConfig{Policy: BackupPolicyAll, Retry: RetryConfig{Attempts: 3, Delay: time.Millisecond}}, nil,
+				BackupSink{Name: "boltdb", Repo: repo}).(*backupConsumer)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.cancel {
+				cancel()
+			}
+			defer cancel()
+			consumer.process(ctx, DeleteQueue, Book{ID: "b:1"})
+
+			assert.Equal(t, tc.attempts, attempts)
+			if tc.deadLetter {
+				assert.Equal(t, []string{DeadLetterQueue(DeleteQueue)}, deadLetters)
+			} else {
+				assert.Empty(t, deadLetters)
+			}
+		})
+	}
+}
+
+// TestBackupConsumer_Acknowledge ensures a book popped by a consumer which stopped before
+// persisting it is recovered by the next run, and each persisted book is acknowledged.
+func TestBackupConsumer_Acknowledge(t *testing.T) {
+	client := newMiniRedisClient(t)
+	ctx := context.Background()
+	processing := ProcessingQueue(DefaultConsumerName, CreateQueue)
+	crashed := NewRedisQueue(client)
+	require.NoError(t, crashed.Push(ctx, CreateQueue, Book{ID: "b:1"}))
+	require.NoError(t, crashed.Push(ctx, CreateQueue, Book{ID: "b:2"}))
+
+	_, book, err := crashed.Pop(ctx, CreateQueue)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", book.ID)
+	assert.Equal(t, int64(1), client.LLen(ctx, processing).Val())
+	assert.Equal(t, int64(1), client.LLen(ctx, CreateQueue).Val())
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var applied []string
+	repo := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			if applied = append(applied, id); len(applied) == 2 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	require.NoError(t, NewBoltDBConsumer(zap.NewNop(), NewRedisQueue(client), repo).Consume(cctx, CreateQueue))
+	assert.Equal(t, []string{"b:1", "b:2"}, applied)
+	assert.Zero(t, client.LLen(ctx, processing).Val())
+	assert.Zero(t, client.LLen(ctx, CreateQueue).Val())
+}
+
+// TestRedisQueue_ConsumerNames ensures each instance keeps the books it popped into its own
+// processing lists so it recovers only those, while a purge drops the lists of all of them.
+func TestRedisQueue_ConsumerNames(t *testing.T) {
+	client := newMiniRedisClient(t)
+	ctx := context.Background()
+	first := NewVersionedRedisQueue(client, CurrentQueueMessageVersion, "first")
+	second := NewVersionedRedisQueue(client, CurrentQueueMessageVersion, "second")
+	for _, id := range []string{"b:1", "b:2", "b:3"} {
+		require.NoError(t, first.Push(ctx, CreateQueue, Book{ID: id}))
+	}
+	_, book, err := first.Pop(ctx, CreateQueue)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", book.ID)
+	_, book, err = second.Pop(ctx, CreateQueue)
+	require.NoError(t, err)
+	assert.Equal(t, "b:2", book.ID)
+	assert.Equal(t, int64(1), client.LLen(ctx, ProcessingQueue("first", CreateQueue)).Val())
+	assert.Equal(t, int64(1), client.LLen(ctx, ProcessingQueue("second", CreateQueue)).Val())
+
+	moved, err := second.(Acker).Recover(ctx, CreateQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved, "only its own book is recovered")
+	assert.Equal(t, int64(1), client.LLen(ctx, ProcessingQueue("first", CreateQueue)).Val())
+	assert.Equal(t, []string{"b:2", "b:3"}, peekIDs(t, second, CreateQueue))
+
+	_, _, err = second.Pop(ctx, CreateQueue)
+	require.NoError(t, err)
+	require.NoError(t, first.(QueuePurger).Purge(ctx, CreateQueue))
+	for _, key := range []string{CreateQueue, ProcessingQueue("first", CreateQueue), ProcessingQueue("second", CreateQueue)} {
+		assert.Zero(t, client.Exists(ctx, key).Val(), key)
+	}
+}
+
+// peekIDs returns the ids of the books waiting into the queue qid.
+func peekIDs(t *testing.T, q Queuer, qid string) []string {
+	t.Helper()
+	books, err := q.Peek(context.Background(), qid, 10)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+	return ids
+}
+
+// TestDecodeQueueMessage ensures the legacy bare books and the versioned envelopes both
+// decode into their book and operation, including those of the dead letter and repair
+// queues, and that unknown versions are rejected.
+func TestDecodeQueueMessage(t *testing.T) {
+	t.Run("legacy bare book", func(t *testing.T) {
+		msg, err := DecodeQueueMessage(UpdateQueue, []byte(`{"id":"b:1","title":"golang"}`))
+		require.NoError(t, err)
+		assert.Equal(t, LegacyQueueMessageVersion, msg.Version)
+		assert.Equal(t, UpdateQueue, msg.Op)
+		assert.Equal(t, Book{ID: "b:1", Title: "golang"}, msg.Book)
+	})
+
+	t.Run("versioned envelope", func(t *testing.T) {
+		msg, err := DecodeQueueMessage(CreateQueue, []byte(`{"version":1,"op":"deletion","book":{"id":"b:2","title":"redis"}}`))
+		require.NoError(t, err)
+		assert.Equal(t, CurrentQueueMessageVersion, msg.Version)
+		assert.Equal(t, DeleteQueue, msg.Op)
+		assert.Equal(t, Book{ID: "b:2", Title: "redis"}, msg.Book)
+	})
+
+	t.Run("dead letter keeps the operation", func(t *testing.T) {
+		msg, err := DecodeQueueMessage(DeadLetterQueue(TrashQueue), []byte(`{"id":"b:3"}`))
+		require.NoError(t, err)
+		assert.Equal(t, TrashQueue, msg.Op)
+	})
+
+	t.Run("repair keeps the operation", func(t *testing.T) {
+		msg, err := DecodeQueueMessage(RepairQueue("boltdb", UpdateQueue), []byte(`{"id":"b:3"}`))
+		require.NoError(t, err)
+		assert.Equal(t, UpdateQueue, msg.Op)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := DecodeQueueMessage(CreateQueue, []byte(`{"version":2,"op":"creation","book":{"id":"b:4"}}`))
+		assert.ErrorIs(t, err, ErrUnsupportedQueueMessage)
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, version := range []int{LegacyQueueMessageVersion, CurrentQueueMessageVersion} {
+			data, err := EncodeQueueMessage(version, RestoreQueue, "", Book{ID: "b:5"})
+			require.NoError(t, err)
+			msg, err := DecodeQueueMessage(RestoreQueue, data)
+			require.NoError(t, err)
+			assert.Equal(t, QueueMessage{Version: version, Op: RestoreQueue, Book: Book{ID: "b:5"}}, msg)
+		}
+	})
+}
+
+// TestRedisQueue_MixedMessageVersions ensures a queue filled by instances pushing both
+// formats, as during a rolling deploy, is consumed in order.
+func TestRedisQueue_MixedMessageVersions(t *testing.T) {
+	client := newMiniRedisClient(t)
+	ctx := context.Background()
+	require.NoError(t, NewRedisQueue(client).Push(ctx, CreateQueue, Book{ID: "b:1"}))
+	require.NoError(t, NewVersionedRedisQueue(client, CurrentQueueMessageVersion, DefaultConsumerName).Push(ctx, CreateQueue, Book{ID: "b:2"}))
+
+	queue := NewRedisQueue(client)
+	books, err := queue.Peek(ctx, CreateQueue, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []Book{{ID: "b:1"}, {ID: "b:2"}}, books)
+	for _, id := range []string{"b:1", "b:2"} {
+		_, book, err := queue.Pop(ctx, CreateQueue)
+		require.NoError(t, err)
+		assert.Equal(t, id, book.ID)
+	}
+}
+
+// TestBackupConsumer_CorrelatedLogs ensures the processing of a book logs its operation,
+// queue, attempt and the id of the request which pushed it along with the envelope.
+func TestBackupConsumer_CorrelatedLogs(t *testing.T) {
+	client := newMiniRedisClient(t)
+	rctx := context.WithValue(context.Background(), RequestIDContextKey, "rid-1")
+	require.NoError(t, NewVersionedRedisQueue(client, CurrentQueueMessageVersion, DefaultConsumerName).Push(rctx, DeleteQueue, Book{ID: "b:1"}))
+
+	core, logs := observer.New(zap.InfoLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo := &MockBookStorage{
+		DeleteFunc: func(ctx context.Context, id string) error {
+			cancel()
+			return nil
+		},
+	}
+	consumer := NewBackupConsumer(zap.New(core), NewRedisQueue(client), BackupConfig{Policy: BackupPolicyAll, LogSampling: 1}, nil, BackupSink{Name: "boltdb", Repo: repo})
+	require.NoError(t, consumer.Consume(ctx, DeleteQueue))
+
+	applied := logs.FilterMessage("consumer: applied").All()
+	require.Len(t, applied, 1)
+	fields := applied[0].ContextMap()
+	assert.Equal(t, DeleteQueue, fields["op"])
+	assert.Equal(t, DeleteQueue, fields["qid"])
+	assert.Equal(t, "b:1", fields["id"])
+	assert.Equal(t, "rid-1", fields["request.id"])
+	assert.Equal(t, int64(1), fields["attempt"])
+}
+
+// TestBackupConsumer_UnexpectedQueue ensures a book popped with a queue id other than the
+// consumed ones, like a stray key, is quarantined without being applied.
+func TestBackupConsumer_UnexpectedQueue(t *testing.T) {
+	for _, qid := range []string{"creation:stray", DeleteQueue} {
+		t.Run(qid, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pushed := map[string]Book{}
+			queue := &MockQueuer{
+				PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+					cancel()
+					return qid, Book{ID: "b:1"}, nil
+				},
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					pushed[qid] = book
+					return nil
+				},
+			}
+			var applied bool
+			repo := &MockBookStorage{
+				AddFunc: func(ctx context.Context, id string, book Book) error {
+					applied = true
+					return nil
+				},
+				DeleteFunc: func(ctx context.Context, id string) error {
+					applied = true
+					return nil
+				},
+			}
+			consumer := NewBackupConsumer(zap.New(core), queue, BackupConfig{Policy: BackupPolicyAll}, nil, BackupSink{Name: "boltdb", Repo: repo})
+			require.NoError(t, consumer.Consume(ctx, CreateQueue))
+
+			assert.False(t, applied)
+			assert.Equal(t, map[string]Book{QuarantineQueue(qid): {ID: "b:1"}}, pushed)
+			quarantined := logs.FilterMessage("consumer: quarantined book of unexpected queue id").All()
+			require.Len(t, quarantined, 1)
+			assert.Equal(t, qid, quarantined[0].ContextMap()["qid"])
+		})
+	}
+}
+
+// TestBackupConsumer_FatalErrors ensures the fatal errors of the queue or of the sinks are
+// not retried at once: the consumer backs off between them and returns the error once they
+// happened the configured number of times in a row, unless it is stopped meanwhile. The
+// book which failed on a fatal error is processed again before popping the next one.
+func TestBackupConsumer_FatalErrors(t *testing.T) {
+	config := BackupConfig{
+		Policy: BackupPolicyAll,
+		Retry:  RetryConfig{Attempts: 5, Delay: time.Millisecond},
+		Fatal:  FatalConfig{Attempts: 3, Delay: 5 * time.Millisecond},
+	}
+
+	t.Run("sink", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		pops, writes := 0, 0
+		queue := &MockQueuer{
+			PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+				pops++
+				return CreateQueue, Book{ID: "b:1"}, nil
+			},
+			PushFunc: func(ctx context.Context, qid string, book Book) error {
+				t.Errorf("unexpected push of %s into %s", book.ID, qid)
+				return nil
+			},
+		}
+		repo := &MockBookStorage{
+			AddFunc: func(ctx context.Context, id string, book Book) error {
+				writes++
+				return bolt.ErrDatabaseNotOpen
+			},
+		}
+
+		start := time.Now()
+		err := NewBackupConsumer(zap.New(core), queue, config, nil, BackupSink{Name: "boltdb", Repo: repo}).Consume(context.Background(), CreateQueue)
+		require.ErrorIs(t, err, bolt.ErrDatabaseNotOpen)
+		assert.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+		assert.Equal(t, 1, pops, "the failed book must be processed again before the next pop")
+		assert.Equal(t, 3, writes, "fatal errors must not be retried")
+		var delays []interface{}
+		for _, entry := range logs.FilterMessage("consumer: backing off on fatal error").All() {
+			delays = append(delays, entry.ContextMap()["delay"])
+		}
+		assert.Equal(t, []interface{}{5 * time.Millisecond, 10 * time.Millisecond}, delays)
+		assert.Equal(t, 1, logs.FilterMessage("consumer: stopped on fatal errors").Len())
+	})
+
+	t.Run("failed book kept", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		client := newMiniRedisClient(t)
+		queue := NewRedisQueue(client)
+		require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:1"}))
+		require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:2"}))
+		var written []string
+		repo := &MockBookStorage{
+			AddFunc: func(ctx context.Context, id string, book Book) error {
+				written = append(written, id)
+				if len(written) == 1 {
+					return bolt.ErrDatabaseNotOpen
+				}
+				if id == "b:2" {
+					cancel()
+				}
+				return nil
+			},
+		}
+		require.NoError(t, NewBackupConsumer(zap.NewNop(), queue, config, nil, BackupSink{Name: "boltdb", Repo: repo}).Consume(ctx, CreateQueue))
+		assert.Equal(t, []string{"b:1", "b:1", "b:2"}, written)
+		processing, err := client.LLen(context.Background(), ProcessingQueue(DefaultConsumerName, CreateQueue)).Result()
+		require.NoError(t, err)
+		assert.Zero(t, processing, "each book must be acknowledged once applied")
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		pops := 0
+		queue := &MockQueuer{
+			PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+				pops++
+				return "", Book{}, redis.ErrClosed
+			},
+		}
+		err := NewBackupConsumer(zap.NewNop(), queue, config, nil).Consume(context.Background(), CreateQueue)
+		require.ErrorIs(t, err, redis.ErrClosed)
+		assert.Equal(t, 3, pops)
+	})
+
+	t.Run("stopped while backing off", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		queue := &MockQueuer{
+			PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+				return CreateQueue, Book{ID: "b:1"}, nil
+			},
+		}
+		repo := &MockBookStorage{
+			AddFunc: func(ctx context.Context, id string, book Book) error {
+				cancel()
+				return bolt.ErrDatabaseNotOpen
+			},
+		}
+		config := BackupConfig{Policy: BackupPolicyAll, Fatal: FatalConfig{Delay: time.Hour}}
+		done := make(chan error)
+		go func() {
+			done <- NewBackupConsumer(zap.NewNop(), queue, config, nil, BackupSink{Name: "boltdb", Repo: repo}).Consume(ctx, CreateQueue)
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("consumer did not stop while backing off")
+		}
+	})
+}
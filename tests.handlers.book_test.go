@@ -5,9 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -67,7 +71,7 @@ func TestCreateBookHandler(t *testing.T) {
 			Title:       "Test book title",
 			Description: "Test book description",
 			Author:      "Jerome Amon",
-			Price:       "10$",
+			Price:       Price{Amount: 1000, Currency: "USD"},
 		}
 		payload, err := json.Marshal(book)
 		assert.NoError(t, err)
@@ -105,9 +109,26 @@ func TestCreateBookHandler(t *testing.T) {
 		assert.Equal(t, "Test book title", bookMap["title"])
 		assert.Equal(t, "Test book description", bookMap["description"])
 		assert.Equal(t, "Jerome Amon", bookMap["author"])
-		assert.Equal(t, "10$", bookMap["price"])
-		assert.Equal(t, "2023-07-02 00:00:00 +0000 UTC", bookMap["createdAt"])
-		assert.Equal(t, "2023-07-02 00:00:00 +0000 UTC", bookMap["updatedAt"])
+		assert.Equal(t, map[string]interface{}{"amount": float64(1000), "currency": "USD"}, bookMap["price"])
+		assert.Equal(t, "2023-07-02T00:00:00Z", bookMap["createdAt"])
+		assert.Equal(t, "2023-07-02T00:00:00Z", bookMap["updatedAt"])
+	})
+
+	t.Run("should pass: payload without id nor creation time", func(t *testing.T) {
+		payload := `{"title":"Test book title", "description":"Test book description", "author":"Jerome Amon", "price":"10$"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/books", bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		api.CreateBook(w, req, httprouter.Params{})
+		res := w.Result()
+		defer res.Body.Close()
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+
+		var body struct {
+			Data Book `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		assert.Equal(t, "b:abc", body.Data.ID)
+		assert.Equal(t, "2023-07-02T00:00:00Z", body.Data.CreatedAt)
 	})
 
 	t.Run("should fail: storage insertion failure", func(t *testing.T) {
@@ -151,9 +172,9 @@ func TestCreateBookHandler(t *testing.T) {
 		assert.Equal(t, "Test book title", bookMap["title"])
 		assert.Equal(t, "Test book description", bookMap["description"])
 		assert.Equal(t, "Jerome Amon", bookMap["author"])
-		assert.Equal(t, "10$", bookMap["price"])
-		assert.Equal(t, "2023-07-02 00:00:00 +0000 UTC", bookMap["createdAt"])
-		assert.Equal(t, "2023-07-02 00:00:00 +0000 UTC", bookMap["updatedAt"])
+		assert.Equal(t, map[string]interface{}{"amount": float64(1000), "currency": "USD"}, bookMap["price"])
+		assert.Equal(t, "2023-07-02T00:00:00Z", bookMap["createdAt"])
+		assert.Equal(t, "2023-07-02T00:00:00Z", bookMap["updatedAt"])
 	})
 
 	t.Run("should fail: invalid payload", func(t *testing.T) {
@@ -168,7 +189,7 @@ func TestCreateBookHandler(t *testing.T) {
 		data, err := io.ReadAll(res.Body)
 		require.NoError(t, err)
 		expected := `{"requestid":"", "status":400, "message":"failed to create the book",
-		"data":{"id":"", "title":"", "description":"Test book description", "author":"Jerome Amon", "price":"10$", "createdAt":"", "updatedAt":""}}`
+		"data":{"id":"", "title":"", "description":"Test book description", "author":"Jerome Amon", "price":{"amount":1000, "currency":"USD"}, "createdAt":"", "updatedAt":""}}`
 		assert.JSONEq(t, expected, string(data))
 	})
 
@@ -183,13 +204,13 @@ func TestCreateBookHandler(t *testing.T) {
 				name:     "empty",
 				payload:  []byte(`{"title":"", "description":"Test book description", "author":"Jerome Amon", "price":"10$"}`),
 				status:   http.StatusBadRequest,
-				expected: `{"requestid":"", "status":400, "message":"failed to create the book", "data":"title is required"}`,
+				expected: `{"requestid":"", "status":400, "message":"failed to create the book", "data":[{"field":"title", "rule":"required", "message":"title is required"}]}`,
 			},
 			{
 				name:     "missing",
 				payload:  []byte(`{"description":"Test book description", "author":"Jerome Amon", "price":"10$"}`),
 				status:   http.StatusBadRequest,
-				expected: `{"requestid":"", "status":400, "message":"failed to create the book", "data":"title is required"}`,
+				expected: `{"requestid":"", "status":400, "message":"failed to create the book", "data":[{"field":"title", "rule":"required", "message":"title is required"}]}`,
 			},
 		}
 
@@ -207,7 +228,7 @@ func TestCreateBookHandler(t *testing.T) {
 				assert.Equal(t, "failed to create book", log.Message)
 				assert.ElementsMatch(t, []zap.Field{
 					zap.String("request.id", ""),
-					zap.Error(missingFieldError("title")),
+					zap.Error(&ValidationError{Violations: []FieldViolation{{Field: "title", Rule: RuleRequired, Message: "title is required"}}}),
 				}, log.Context)
 
 				res := w.Result()
@@ -266,8 +287,1392 @@ func TestDeleteOneBook_MissingBook(t *testing.T) {
 			data, err := io.ReadAll(res.Body)
 			require.NoError(t, err)
 			expected := `{"requestid":"", "status":404, "message":"book does not exist",
-				"data":{"id":"", "title":"", "description":"", "author":"", "price":"", "createdAt":"", "updatedAt":""}}`
+				"data":{"id":"", "title":"", "description":"", "author":"", "price":null, "createdAt":"", "updatedAt":""}}`
 			assert.JSONEq(t, expected, string(data))
 		})
 	}
 }
+
+// TestBookHandlers_BookIDValidation ensures all handlers working on a single book respond
+// with 400 for malformed ids and with 404 only for well-formed ids which do not exist.
+func TestBookHandlers_BookIDValidation(t *testing.T) {
+	mockRepo := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return Book{}, ErrBookNotFound },
+		DeleteFunc: func(ctx context.Context, id string) error { return ErrBookNotFound },
+	}
+	mockQueue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			return nil
+		},
+	}
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	payload := `{"title":"Test book title", "description":"Test book description", "author":"Jerome Amon", "price":"10$", "createdAt":"2023-07-02T00:00:00Z"}`
+
+	handlers := []struct {
+		name    string
+		method  string
+		payload string
+		handle  func(api *APIHandler) httprouter.Handle
+	}{
+		{"get one book", http.MethodGet, "", func(api *APIHandler) httprouter.Handle { return api.GetOneBook }},
+		{"delete one book", http.MethodDelete, "", func(api *APIHandler) httprouter.Handle { return api.DeleteOneBook }},
+		{"update book", http.MethodPut, payload, func(api *APIHandler) httprouter.Handle { return api.UpdateBook }},
+	}
+
+	testCases := []struct {
+		name    string
+		valid   bool
+		status  int
+		message string
+	}{
+		{"malformed id", false, http.StatusBadRequest, "book id provided is not valid"},
+		{"absent id", true, http.StatusNotFound, "book does not exist"},
+	}
+
+	for _, h := range handlers {
+		for _, tc := range testCases {
+			t.Run(h.name+":"+tc.name, func(t *testing.T) {
+				bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), mockRepo, mockRepo, mockQueue)
+				api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", tc.valid), bs)
+				req := httptest.NewRequest(h.method, "/v1/books/"+bookID, bytes.NewBufferString(h.payload))
+				w := httptest.NewRecorder()
+				h.handle(api)(w, req, httprouter.Params{httprouter.Param{Key: "id", Value: bookID}})
+				res := w.Result()
+				defer res.Body.Close()
+				assert.Equal(t, tc.status, res.StatusCode)
+				data, err := io.ReadAll(res.Body)
+				require.NoError(t, err)
+				resultMap := make(map[string]interface{})
+				require.NoError(t, json.Unmarshal(data, &resultMap))
+				assert.Equal(t, tc.message, resultMap["message"])
+			})
+		}
+	}
+}
+
+// TestBookHandlers_Views ensures fetching a book counts its views and
+// popular books are ordered by their number of views.
+func TestBookHandlers_Views(t *testing.T) {
+	repo := NewMockBookViewsStorage(Book{ID: "b:1", Title: "one"}, Book{ID: "b:2", Title: "two"}, Book{ID: "b:3", Title: "three"})
+	config := &Config{Views: ViewsConfig{Enable: true, IncludeInResponse: true}}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+	router := httprouter.New()
+	require.NoError(t, api.SetupBookRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	get := func(t *testing.T, path string, data interface{}) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		resp := APIResponse{Data: data}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code
+	}
+
+	views := map[string]int{"b:1": 1, "b:2": 3, "b:3": 2}
+	for id, n := range views {
+		for i := 0; i < n; i++ {
+			require.Equal(t, http.StatusOK, get(t, "/v1/books/"+id, nil))
+		}
+	}
+	assert.Eventually(t, func() bool {
+		for id, n := range views {
+			if v, _ := repo.GetViews(context.Background(), id); v != int64(n) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 5*time.Millisecond)
+
+	t.Run("popular ordering", func(t *testing.T) {
+		var popular []BookViews
+		require.Equal(t, http.StatusOK, get(t, "/v1/books/popular?limit=2", &popular))
+		require.Len(t, popular, 2)
+		assert.Equal(t, "b:2", popular[0].ID)
+		assert.Equal(t, int64(3), popular[0].Views)
+		assert.Equal(t, "b:3", popular[1].ID)
+		assert.Equal(t, int64(2), popular[1].Views)
+	})
+
+	t.Run("invalid limit", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, get(t, "/v1/books/popular?limit=0", nil))
+	})
+
+	t.Run("views in response", func(t *testing.T) {
+		var book BookViews
+		require.Equal(t, http.StatusOK, get(t, "/v1/books/b:2", &book))
+		assert.Equal(t, "b:2", book.ID)
+		assert.GreaterOrEqual(t, book.Views, int64(3))
+	})
+
+	t.Run("views in etag", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/b:3", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var book BookViews
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &book}))
+		etag := w.Header().Get("ETag")
+		assert.Equal(t, book.ETag(), etag)
+		assert.True(t, strings.HasPrefix(etag, "W/"))
+		assert.NotEqual(t, book.Book.ETag(), strings.TrimPrefix(etag, "W/"))
+		assert.Equal(t, book.Book.ETag(), w.Header().Get(BookETagHeader))
+	})
+}
+
+// TestGetAllBooks_PriceFilter ensures books are filtered by the numeric
+// value of their price and unparseable bounds are rejected.
+func TestGetAllBooks_PriceFilter(t *testing.T) {
+	books := []Book{
+		{ID: "b:1", Price: Price{Amount: 500, Currency: "USD"}},
+		{ID: "b:2", Price: Price{Amount: 1050, Currency: "USD"}},
+		{ID: "b:3", Price: Price{Amount: 120000, Currency: "EUR"}},
+		{ID: "b:4", Price: Price{legacy: "free"}},
+	}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) { return books, "", nil },
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	testCases := []struct {
+		name   string
+		query  string
+		status int
+		ids    []string
+	}{
+		{"no bounds", "", http.StatusOK, []string{"b:1", "b:2", "b:3", "b:4"}},
+		{"min only", "?priceMin=10", http.StatusOK, []string{"b:2", "b:3"}},
+		{"max only", "?priceMax=10.5", http.StatusOK, []string{"b:1", "b:2"}},
+		{"both bounds", "?priceMin=6&priceMax=1200", http.StatusOK, []string{"b:2", "b:3"}},
+		{"unparseable bound", "?priceMin=ten", http.StatusBadRequest, []string{}},
+		{"inverted bounds", "?priceMin=20&priceMax=10", http.StatusBadRequest, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.GetAllBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books"+tc.query, nil), httprouter.Params{})
+			assert.Equal(t, tc.status, w.Code)
+			var result []Book
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &result}))
+			ids := []string{}
+			for _, book := range result {
+				ids = append(ids, book.ID)
+			}
+			assert.Equal(t, tc.ids, ids)
+		})
+	}
+}
+
+// TestGetAllBooks_PriceFilterFillsPage ensures a filtered page is filled with limit matching
+// books from the next storage pages and its cursor resumes right after the last one.
+func TestGetAllBooks_PriceFilterFillsPage(t *testing.T) {
+	books := []Book{
+		{ID: "b:1", Price: Price{Amount: 100, Currency: "USD"}},
+		{ID: "b:2", Price: Price{Amount: 2000, Currency: "USD"}},
+		{ID: "b:3", Price: Price{Amount: 300, Currency: "USD"}},
+		{ID: "b:4", Price: Price{Amount: 400, Currency: "USD"}},
+		{ID: "b:5", Price: Price{Amount: 5000, Currency: "USD"}},
+		{ID: "b:6", Price: Price{Amount: 6000, Currency: "USD"}},
+		{ID: "b:7", Price: Price{Amount: 700, Currency: "USD"}},
+	}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			start, _ := strconv.Atoi(cursor)
+			end := min(start+int(limit), len(books))
+			next := ""
+			if end < len(books) {
+				next = strconv.Itoa(end)
+			}
+			return append([]Book{}, books[start:end]...), next, nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	var ids []string
+	cursor := ""
+	for _, expected := range [][]string{{"b:2", "b:5"}, {"b:6"}} {
+		w := httptest.NewRecorder()
+		api.GetAllBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books?priceMin=10&limit=2&cursor="+cursor, nil), httprouter.Params{})
+		require.Equal(t, http.StatusOK, w.Code)
+		var result []Book
+		resp := APIResponse{Data: &result}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		ids = ids[:0]
+		for _, book := range result {
+			ids = append(ids, book.ID)
+		}
+		assert.Equal(t, expected, ids)
+		cursor = resp.NextCursor
+	}
+	assert.Empty(t, cursor)
+}
+
+// TestGetAllBooks_Sort ensures books are ordered by the requested field and order,
+// newest first by default, with ties kept in ID order and invalid sorts rejected.
+func TestGetAllBooks_Sort(t *testing.T) {
+	books := []Book{
+		{ID: "b:1", Title: "beta", Author: "Zoe", Price: Price{Amount: 1500, Currency: "USD"}, CreatedAt: "2023-07-02 09:00:00 +0000 UTC"},
+		{ID: "b:2", Title: "Alpha", Author: "adam", Price: Price{Amount: 500, Currency: "USD"}, CreatedAt: "2023-07-10 08:00:00 +0000 UTC m=+0.000123"},
+		{ID: "b:3", Title: "alpha", Author: "Zoe", Price: Price{Amount: 500, Currency: "EUR"}, CreatedAt: "2023-07-02 10:00:00 +0200 CEST"},
+		{ID: "b:4", Title: "gamma", Author: "mia", Price: Price{legacy: "free"}, CreatedAt: "unknown"},
+	}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return append([]Book{}, books...), "", nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	testCases := []struct {
+		name   string
+		query  string
+		status int
+		ids    []string
+	}{
+		{"default newest first", "", http.StatusOK, []string{"b:2", "b:1", "b:3", "b:4"}},
+		{"created ascending", "?sort=createdAt", http.StatusOK, []string{"b:3", "b:1", "b:2", "b:4"}},
+		{"order only", "?order=asc", http.StatusOK, []string{"b:3", "b:1", "b:2", "b:4"}},
+		{"title ties", "?sort=title&order=asc", http.StatusOK, []string{"b:2", "b:3", "b:1", "b:4"}},
+		{"title descending", "?sort=title&order=desc", http.StatusOK, []string{"b:4", "b:1", "b:2", "b:3"}},
+		{"author ties", "?sort=author", http.StatusOK, []string{"b:2", "b:4", "b:1", "b:3"}},
+		{"price ties", "?sort=price", http.StatusOK, []string{"b:2", "b:3", "b:1", "b:4"}},
+		{"price descending", "?sort=price&order=desc", http.StatusOK, []string{"b:1", "b:2", "b:3", "b:4"}},
+		{"unknown field", "?sort=id", http.StatusBadRequest, []string{}},
+		{"unknown order", "?sort=title&order=up", http.StatusBadRequest, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.GetAllBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books"+tc.query, nil), httprouter.Params{})
+			assert.Equal(t, tc.status, w.Code)
+			var result []Book
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &result}))
+			ids := []string{}
+			for _, book := range result {
+				ids = append(ids, book.ID)
+			}
+			assert.Equal(t, tc.ids, ids)
+		})
+	}
+}
+
+// TestGetAllBooks_SortAcrossPages ensures a sorted listing orders the books of all the
+// pages as a whole, keeps the first limit ones without next cursor and refuses a cursor.
+func TestGetAllBooks_SortAcrossPages(t *testing.T) {
+	pages := map[string][]Book{
+		"":   {{ID: "b:1", Title: "delta"}, {ID: "b:2", Title: "alpha"}},
+		"p2": {{ID: "b:3", Title: "charlie"}, {ID: "b:4", Title: "bravo"}},
+	}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			if cursor == "" {
+				return append([]Book{}, pages[""]...), "p2", nil
+			}
+			return append([]Book{}, pages[cursor]...), "", nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	testCases := []struct {
+		name   string
+		query  string
+		status int
+		ids    []string
+	}{
+		{"whole catalog", "?sort=title", http.StatusOK, []string{"b:2", "b:4", "b:3", "b:1"}},
+		{"first books", "?sort=title&order=desc&limit=2", http.StatusOK, []string{"b:1", "b:3"}},
+		{"with cursor", "?sort=title&cursor=p2", http.StatusBadRequest, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.GetAllBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books"+tc.query, nil), httprouter.Params{})
+			assert.Equal(t, tc.status, w.Code)
+			var result []Book
+			resp := APIResponse{Data: &result}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ids := []string{}
+			for _, book := range result {
+				ids = append(ids, book.ID)
+			}
+			assert.Equal(t, tc.ids, ids)
+			assert.Empty(t, resp.NextCursor)
+		})
+	}
+}
+
+// TestGetAllBooks_UnsetLongRequestWriteTimeout ensures a list served over a real
+// connection is fully sent when the long requests write timeout is unset, instead
+// of being cut by a write deadline set to now.
+func TestGetAllBooks_UnsetLongRequestWriteTimeout(t *testing.T) {
+	books := make([]Book, 500)
+	for i := range books {
+		books[i] = Book{ID: "b:" + strconv.Itoa(i), Title: strings.Repeat("t", 200), Price: Price{Amount: 1000, Currency: "USD"}}
+	}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return append([]Book{}, books...), "", nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.GetAllBooks(w, r, httprouter.Params{})
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/books?limit=1000")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result []Book
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&APIResponse{Data: &result}))
+	assert.Len(t, result, len(books))
+}
+
+// TestGetAllBooks_Pagination ensures the page limit is defaulted and capped,
+// the next cursor is provided and invalid limits or cursors are rejected.
+func TestGetAllBooks_Pagination(t *testing.T) {
+	var gotLimit int64
+	var gotCursor string
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			if gotLimit == 0 {
+				// the first storage page is the one requested, the next ones fill the page.
+				gotLimit, gotCursor = limit, cursor
+			}
+			if cursor == "bad" {
+				return nil, "", ErrInvalidCursor
+			}
+			return []Book{{ID: "b:1"}}, "next", nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	testCases := []struct {
+		name   string
+		query  string
+		status int
+		limit  int64
+		cursor string
+	}{
+		{"default limit", "", http.StatusOK, DefaultBooksPageLimit, ""},
+		{"custom limit", "?limit=10&cursor=abc", http.StatusOK, 10, "abc"},
+		{"capped limit", "?limit=1000", http.StatusOK, MaxBooksPageLimit, ""},
+		{"invalid limit", "?limit=-1", http.StatusBadRequest, 0, ""},
+		{"invalid cursor", "?cursor=bad", http.StatusBadRequest, DefaultBooksPageLimit, "bad"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotLimit, gotCursor = 0, ""
+			w := httptest.NewRecorder()
+			api.GetAllBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books"+tc.query, nil), httprouter.Params{})
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.limit, gotLimit)
+			assert.Equal(t, tc.cursor, gotCursor)
+			if tc.status == http.StatusOK {
+				var resp APIResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "next", resp.NextCursor)
+			}
+		})
+	}
+}
+
+// TestPatchBook ensures only the provided fields are merged into the existing book,
+// the merged book is pushed to the queue and invalid payloads are rejected.
+func TestPatchBook(t *testing.T) {
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	existing := Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: "2023-07-01T00:00:00Z"}
+
+	testCases := []struct {
+		name     string
+		payload  string
+		status   int
+		expected Book
+	}{
+		{"single field", `{"price":"12$"}`, http.StatusOK, Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1200, Currency: "USD"}, CreatedAt: existing.CreatedAt, UpdatedAt: "2023-07-02T00:00:00Z"}},
+		{"several fields", `{"title":"new title","author":"new author"}`, http.StatusOK, Book{ID: bookID, Title: "new title", Description: "description", Author: "new author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: existing.CreatedAt, UpdatedAt: "2023-07-02T00:00:00Z"}},
+		{"unknown field", `{"price":"12$","isbn":"0"}`, http.StatusBadRequest, Book{}},
+		{"read-only field", `{"id":"b:other"}`, http.StatusBadRequest, Book{}},
+		{"empty patch", `{}`, http.StatusBadRequest, Book{}},
+		{"required field set to empty", `{"title":""}`, http.StatusBadRequest, Book{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stored, pushed Book
+			repo := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) { return existing, nil },
+				UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) {
+					stored = book
+					return book, nil
+				},
+			}
+			queue := &MockQueuer{
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					assert.Equal(t, UpdateQueue, qid)
+					pushed = book
+					return nil
+				},
+			}
+			bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, queue)
+			api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+			req := httptest.NewRequest(http.MethodPatch, "/v1/books/"+bookID, bytes.NewBufferString(tc.payload))
+			w := httptest.NewRecorder()
+			api.PatchBook(w, req, httprouter.Params{httprouter.Param{Key: "id", Value: bookID}})
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.expected, stored)
+			assert.Equal(t, tc.expected, pushed)
+		})
+	}
+
+	t.Run("absent book", func(t *testing.T) {
+		repo := &MockBookStorage{
+			GetOneFunc: func(ctx context.Context, id string) (Book, error) { return Book{}, ErrBookNotFound },
+		}
+		bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, nil)
+		api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+		req := httptest.NewRequest(http.MethodPatch, "/v1/books/"+bookID, bytes.NewBufferString(`{"price":"12$"}`))
+		w := httptest.NewRecorder()
+		api.PatchBook(w, req, httprouter.Params{httprouter.Param{Key: "id", Value: bookID}})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// TestPatchBook_Concurrent ensures the concurrent patches of a same book are serialized
+// with the locks: the patches of distinct fields are all kept and only one of the patches
+// conditioned on a same ETag is applied while the others fail with 412.
+func TestPatchBook_Concurrent(t *testing.T) {
+	const patches = 20
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	existing := Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: "2023-07-01T00:00:00Z"}
+	setup := func(t *testing.T) (*APIHandler, BookServiceProvider) {
+		repo := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), newMiniRedisClient(t))
+		require.NoError(t, repo.Add(context.Background(), bookID, existing))
+		queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+		config := &Config{}
+		bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, queue)
+		return NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs), bs
+	}
+	patch := func(api *APIHandler, payload, ifMatch string) int {
+		req := httptest.NewRequest(http.MethodPatch, "/v1/books/"+bookID, bytes.NewBufferString(payload))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		api.PatchBook(w, req, httprouter.Params{httprouter.Param{Key: "id", Value: bookID}})
+		return w.Code
+	}
+
+	t.Run("distinct fields", func(t *testing.T) {
+		api, bs := setup(t)
+		var wg sync.WaitGroup
+		for i := 0; i < patches; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				payload := `{"title":"title ` + strconv.Itoa(i) + `"}`
+				if i%2 == 1 {
+					payload = `{"author":"author ` + strconv.Itoa(i) + `"}`
+				}
+				assert.Equal(t, http.StatusOK, patch(api, payload, ""))
+			}(i)
+		}
+		wg.Wait()
+
+		book, err := bs.GetOne(context.Background(), bookID)
+		require.NoError(t, err)
+		assert.NotEqual(t, existing.Title, book.Title, "a title patch was lost")
+		assert.NotEqual(t, existing.Author, book.Author, "an author patch was lost")
+	})
+
+	t.Run("same if-match", func(t *testing.T) {
+		api, _ := setup(t)
+		etag := existing.ETag()
+		var mu sync.Mutex
+		codes := map[int]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < patches; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				code := patch(api, `{"title":"title `+strconv.Itoa(i)+`"}`, etag)
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusPreconditionFailed: patches - 1}, codes)
+	})
+
+	t.Run("delete against patches", func(t *testing.T) {
+		api, _ := setup(t)
+		etag := existing.ETag()
+		var mu sync.Mutex
+		codes := map[int]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < patches; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var code int
+				if i%2 == 0 {
+					code = patch(api, `{"title":"title `+strconv.Itoa(i)+`"}`, etag)
+				} else {
+					req := httptest.NewRequest(http.MethodDelete, "/v1/books/"+bookID, nil)
+					req.Header.Set("If-Match", etag)
+					w := httptest.NewRecorder()
+					api.DeleteOneBook(w, req, httprouter.Params{httprouter.Param{Key: "id", Value: bookID}})
+					code = w.Code
+				}
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 1, codes[http.StatusOK], "only one conditional write must succeed")
+		assert.Equal(t, patches-1, codes[http.StatusPreconditionFailed]+codes[http.StatusNotFound])
+	})
+}
+
+// TestCreateBooks ensures each book of a bulk request is reported by its index
+// and invalid books are reported as failures without aborting the others.
+func TestCreateBooks(t *testing.T) {
+	stored, pushed := map[string]Book{}, []Book{}
+	repo := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			if book.Title == "failing" {
+				return errors.New("redis: failure")
+			}
+			stored[id] = book
+			return nil
+		},
+	}
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			pushed = append(pushed, book)
+			return nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+
+	t.Run("mixed results", func(t *testing.T) {
+		payload := `[
+			{"title":"one", "description":"d", "author":"a", "price":"1$"},
+			{"title":"two", "description":"d", "author":"a"},
+			{"title":"failing", "description":"d", "author":"a", "price":"1$"}
+		]`
+		w := httptest.NewRecorder()
+		api.CreateBooks(w, httptest.NewRequest(http.MethodPost, "/v1/books/bulk", bytes.NewBufferString(payload)), httprouter.Params{})
+		assert.Equal(t, http.StatusMultiStatus, w.Code)
+		var results []BulkItemResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &results}))
+		assert.Equal(t, []BulkItemResult{
+			{Index: 0, ID: "b:abc"},
+			{Index: 1, Error: "price is required"},
+			{Index: 2, Error: "redis: failure"},
+		}, results)
+		assert.Equal(t, "one", stored["b:abc"].Title)
+		require.Len(t, pushed, 1)
+		assert.Equal(t, "one", pushed[0].Title)
+	})
+
+	t.Run("invalid payloads", func(t *testing.T) {
+		for _, payload := range []string{`{}`, `[]`} {
+			w := httptest.NewRecorder()
+			api.CreateBooks(w, httptest.NewRequest(http.MethodPost, "/v1/books/bulk", bytes.NewBufferString(payload)), httprouter.Params{})
+			assert.Equal(t, http.StatusBadRequest, w.Code, payload)
+		}
+	})
+}
+
+// TestCountBooks ensures the books count is served from the backup storage and from the
+// primary storage when the backup one fails.
+func TestCountBooks(t *testing.T) {
+	primary := &MockBookStorage{CountFunc: func(ctx context.Context) (int, error) { return 3, nil }}
+	var backupErr error
+	backup := &MockBookStorage{CountFunc: func(ctx context.Context) (int, error) { return 2, backupErr }}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), primary, backup, nil)
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+	router := httprouter.New()
+	require.NoError(t, api.SetupBookRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/count", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"requestid":"","count":2}`, w.Body.String())
+
+	backupErr = errors.New("bolt: failure")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/count", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"requestid":"","count":3}`, w.Body.String())
+
+	primary.CountFunc = func(ctx context.Context) (int, error) { return 0, errors.New("redis: failure") }
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/count", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+// TestSearchBooks ensures the search is served next to the single book route,
+// reports the matched fields of each book and rejects invalid parameters.
+func TestSearchBooks(t *testing.T) {
+	books := []Book{
+		{ID: "b:1", Title: "Golang programming", Author: "Jerome Amon"},
+		{ID: "b:2", Title: "Redis in action", Author: "Josiah Carlson"},
+		{ID: "b:3", Title: "The Go way", Author: "Gopher"},
+	}
+	repo := &MockBookStorage{
+		SearchFunc: func(ctx context.Context, query string, fields []string) ([]Book, error) {
+			found := []Book{}
+			for _, book := range books {
+				if len(book.Match(query, fields)) != 0 {
+					found = append(found, book)
+				}
+			}
+			return found, nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+	router := httprouter.New()
+	require.NoError(t, api.SetupBookRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	testCases := []struct {
+		name     string
+		query    string
+		status   int
+		expected map[string][]string
+	}{
+		{"all fields", "?q=%20GO%20", http.StatusOK, map[string][]string{"b:1": {"title"}, "b:3": {"title", "author"}}},
+		{"author only", "?q=go&field=author", http.StatusOK, map[string][]string{"b:3": {"author"}}},
+		{"no match", "?q=python", http.StatusOK, map[string][]string{}},
+		{"empty query", "?q=%20", http.StatusBadRequest, map[string][]string{}},
+		{"unknown field", "?q=go&field=price", http.StatusBadRequest, map[string][]string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/search"+tc.query, nil))
+			assert.Equal(t, tc.status, w.Code)
+			var result []BookMatch
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &result}))
+			got := map[string][]string{}
+			for _, book := range result {
+				got[book.ID] = book.Matches
+			}
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+// TestBookHandlers_ETag ensures a book is served with its ETag, a matching
+// `If-None-Match` is answered with 304 without body, and writes carrying a
+// stale or weak `If-Match` are refused with 412 while a matching one is applied.
+func TestBookHandlers_ETag(t *testing.T) {
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	existing := Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: "2023-07-01T00:00:00Z"}
+	etag := existing.ETag()
+	writes := 0
+	repo := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return existing, nil },
+		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) {
+			writes++
+			return book, nil
+		},
+		DeleteFunc: func(ctx context.Context, id string) error {
+			writes++
+			return nil
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+	ps := httprouter.Params{httprouter.Param{Key: "id", Value: bookID}}
+
+	t.Run("get", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		api.GetOneBook(w, httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil), ps)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+
+		for header, status := range map[string]int{etag: http.StatusNotModified, `"other", ` + etag: http.StatusNotModified, `"other"`: http.StatusOK} {
+			req := httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil)
+			req.Header.Set("If-None-Match", header)
+			w := httptest.NewRecorder()
+			api.GetOneBook(w, req, ps)
+			assert.Equal(t, status, w.Code, header)
+			if status == http.StatusNotModified {
+				assert.Empty(t, w.Body.Bytes())
+			}
+		}
+	})
+
+	update := `{"title":"new", "description":"description", "author":"author", "price":"10$", "createdAt":"2023-07-01T00:00:00Z"}`
+	testCases := []struct {
+		name    string
+		handler httprouter.Handle
+		method  string
+		payload string
+		ifMatch string
+		status  int
+		writes  int
+	}{
+		{"update with stale etag", api.UpdateBook, http.MethodPut, update, `"stale"`, http.StatusPreconditionFailed, 0},
+		{"update with current etag", api.UpdateBook, http.MethodPut, update, etag, http.StatusOK, 1},
+		{"patch with stale etag", api.PatchBook, http.MethodPatch, `{"title":"new"}`, `"stale"`, http.StatusPreconditionFailed, 0},
+		{"patch with current etag", api.PatchBook, http.MethodPatch, `{"title":"new"}`, etag, http.StatusOK, 1},
+		{"patch with weak current etag", api.PatchBook, http.MethodPatch, `{"title":"new"}`, "W/" + etag, http.StatusPreconditionFailed, 0},
+		{"patch with any etag", api.PatchBook, http.MethodPatch, `{"title":"new"}`, "*", http.StatusOK, 1},
+		{"delete with stale etag", api.DeleteOneBook, http.MethodDelete, "", `"stale"`, http.StatusPreconditionFailed, 0},
+		{"delete with current etag", api.DeleteOneBook, http.MethodDelete, "", etag, http.StatusOK, 1},
+		{"delete without etag", api.DeleteOneBook, http.MethodDelete, "", "", http.StatusOK, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writes = 0
+			req := httptest.NewRequest(tc.method, "/v1/books/"+bookID, bytes.NewBufferString(tc.payload))
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			tc.handler(w, req, ps)
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.writes, writes)
+			if tc.status == http.StatusPreconditionFailed {
+				assert.Equal(t, etag, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+// TestDeleteAllBooks ensures the catalog clearing requires the confirmation then
+// answers at once while the storages and the pending queues are cleared in background.
+func TestDeleteAllBooks(t *testing.T) {
+	client := newMiniRedisClient(t)
+	queue := NewRedisQueue(client)
+	ctx := context.Background()
+	require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:1"}))
+	require.NoError(t, client.RPush(ctx, DeadLetterQueue(UpdateQueue), "{}").Err())
+	require.NoError(t, client.RPush(ctx, OutboxQueue, "{}").Err())
+
+	cleared := make(chan string, 2)
+	pstorage := &MockBookStorage{DeleteAllFunc: func(ctx context.Context) error { cleared <- "primary"; return nil }}
+	bstorage := &MockBookStorage{DeleteAllFunc: func(ctx context.Context) error { cleared <- "backup"; return nil }}
+	bs := NewBookService(zap.NewNop(), &Config{}, NewMockClocker(), pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	for _, query := range []string{"", "?confirm=yes"} {
+		w := httptest.NewRecorder()
+		api.DeleteAllBooks(w, httptest.NewRequest(http.MethodDelete, "/v1/books"+query, nil), httprouter.Params{})
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	assert.Empty(t, cleared)
+
+	w := httptest.NewRecorder()
+	api.DeleteAllBooks(w, httptest.NewRequest(http.MethodDelete, "/v1/books?confirm=true", nil), httprouter.Params{})
+	require.Equal(t, http.StatusAccepted, w.Code)
+	for _, expected := range []string{"backup", "primary"} {
+		select {
+		case store := <-cleared:
+			assert.Equal(t, expected, store)
+		case <-time.After(time.Second):
+			t.Fatalf("%s storage was not cleared", expected)
+		}
+	}
+	for _, key := range []string{CreateQueue, DeadLetterQueue(UpdateQueue), OutboxQueue} {
+		n, err := client.Exists(ctx, key).Result()
+		require.NoError(t, err)
+		assert.Zero(t, n, key)
+	}
+}
+
+// TestBookHandlers_SoftDelete ensures a deleted book is moved to the trash, is not
+// served anymore even if the backup storage still holds it, and can be restored.
+func TestBookHandlers_SoftDelete(t *testing.T) {
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	backup := Book{ID: bookID, Title: "title"}
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return backup, nil },
+	}
+	var pushed []string
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			pushed = append(pushed, qid)
+			return nil
+		},
+	}
+	config := &Config{Trash: TrashConfig{Enable: true, Retention: time.Hour, PurgeInterval: time.Minute}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("", true), bs)
+	ps := httprouter.Params{httprouter.Param{Key: "id", Value: bookID}}
+	require.NoError(t, pstorage.Add(context.Background(), bookID, backup))
+
+	w := httptest.NewRecorder()
+	api.DeleteOneBook(w, httptest.NewRequest(http.MethodDelete, "/v1/books/"+bookID, nil), ps)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{TrashQueue}, pushed)
+
+	w = httptest.NewRecorder()
+	api.GetOneBook(w, httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil), ps)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	api.GetTrashBooks(w, httptest.NewRequest(http.MethodGet, "/v1/books/trash", nil), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var trashed []Book
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &trashed}))
+	require.Len(t, trashed, 1)
+	assert.Equal(t, clock.Now().UTC().Format(time.RFC3339), trashed[0].DeletedAt)
+
+	w = httptest.NewRecorder()
+	api.RestoreBook(w, httptest.NewRequest(http.MethodPost, "/v1/books/"+bookID+"/restore", nil), ps)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{TrashQueue, RestoreQueue}, pushed)
+
+	w = httptest.NewRecorder()
+	api.RestoreBook(w, httptest.NewRequest(http.MethodPost, "/v1/books/"+bookID+"/restore", nil), ps)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	api.GetOneBook(w, httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil), ps)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("purge", func(t *testing.T) {
+		trasher := pstorage.(BookTrasher)
+		_, err := trasher.Trash(context.Background(), bookID, clock.Now().Add(-2*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, NewTrashPurger(zap.NewNop(), clock, time.Hour, time.Minute, trasher).Purge(context.Background()))
+		books, err := trasher.GetTrash(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, books)
+	})
+}
+
+// TestBookHandlers_RequestBodyLimit ensures the create, bulk create, update and patch
+// requests with a body over the configured size are rejected with 413 while a body
+// exactly at the limit is processed.
+func TestBookHandlers_RequestBodyLimit(t *testing.T) {
+	const limit = 256
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	repo := &MockBookStorage{
+		AddFunc:    func(ctx context.Context, id string, book Book) error { return nil },
+		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) { return book, nil },
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return Book{ID: id, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 100, Currency: "USD"}, CreatedAt: "2023-07-02T00:00:00Z"}, nil
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	config := &Config{Server: ServerConfig{MaxRequestBodyBytes: limit}}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	ps := httprouter.Params{httprouter.Param{Key: "id", Value: bookID}}
+
+	// sized returns the payload built by format with its description padded so the
+	// whole payload is exactly size bytes long.
+	sized := func(format string, size int) string {
+		payload := fmt.Sprintf(format, "")
+		return fmt.Sprintf(format, strings.Repeat("d", size-len(payload)))
+	}
+
+	testCases := []struct {
+		name    string
+		format  string
+		status  int
+		handler httprouter.Handle
+	}{
+		{"create", `{"title":"t","description":"%s","author":"a","price":"1$"}`, http.StatusCreated, api.CreateBook},
+		{"bulk", `[{"title":"t","description":"%s","author":"a","price":"1$"}]`, http.StatusCreated, api.CreateBooks},
+		{"update", `{"title":"t","description":"%s","author":"a","price":"1$","createdAt":"2023-07-02T00:00:00Z"}`, http.StatusOK, api.UpdateBook},
+		{"patch", `{"description":"%s"}`, http.StatusOK, api.PatchBook},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(sized(tc.format, limit))), ps)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+
+			w = httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(sized(tc.format, limit+1))), ps)
+			require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+			var result map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Equal(t, "request body too large", result["message"])
+			assert.Equal(t, map[string]interface{}{"maxbytes": float64(limit)}, result["data"])
+		})
+	}
+}
+
+// TestBookHandlers_StrictBody ensures the create and update requests are rejected
+// when their body has an unknown or a repeated field or data after the book object.
+func TestBookHandlers_StrictBody(t *testing.T) {
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	repo := &MockBookStorage{
+		AddFunc:    func(ctx context.Context, id string, book Book) error { return nil },
+		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) { return book, nil },
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return Book{ID: id, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 100, Currency: "USD"}, CreatedAt: "2023-07-02T00:00:00Z"}, nil
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	ps := httprouter.Params{httprouter.Param{Key: "id", Value: bookID}}
+	fields := `"title":"t","description":"d","author":"a","price":"1$","createdAt":"2023-07-02T00:00:00Z"`
+
+	testCases := []struct {
+		name    string
+		payload string
+		data    interface{}
+	}{
+		{"unknown field", `{` + fields + `,"titel":"t"}`, map[string]interface{}{"field": "titel", "reason": "unknown"}},
+		{"duplicate field", `{` + fields + `,"title":"other"}`, map[string]interface{}{"field": "title", "reason": "duplicate"}},
+		{"duplicate field case", `{` + fields + `,"Author":"other"}`, map[string]interface{}{"field": "Author", "reason": "duplicate"}},
+		{"trailing garbage", `{` + fields + `} garbage`, nil},
+		{"trailing object", `{` + fields + `}{}`, nil},
+	}
+
+	handlers := map[string]httprouter.Handle{"create": api.CreateBook, "update": api.UpdateBook}
+	for name, handler := range handlers {
+		for _, tc := range testCases {
+			handler, tc := handler, tc
+			t.Run(name+" "+tc.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(tc.payload)), ps)
+				require.Equal(t, http.StatusBadRequest, w.Code)
+				if tc.data == nil {
+					return
+				}
+				var result map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+				assert.Equal(t, tc.data, result["data"])
+			})
+		}
+
+		t.Run(name+" valid", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(`{`+fields+"}\n")), ps)
+			assert.Less(t, w.Code, http.StatusBadRequest, w.Body.String())
+		})
+	}
+}
+
+// TestValidateBookRequestBody ensures every violated rule of a book request body is reported
+// as a field violation and that updates additionally require the id and the creation date.
+func TestValidateBookRequestBody(t *testing.T) {
+	t.Run("all violations", func(t *testing.T) {
+		book := &Book{Title: strings.Repeat("t", MaxTitleLength+1), Author: "author", Price: Price{legacy: "ten dollars"}}
+		err := ValidateCreateBookRequestBody(book)
+		var ve *ValidationError
+		require.ErrorAs(t, err, &ve)
+		assert.Equal(t, []FieldViolation{
+			{Field: "title", Rule: RuleMaxLength, Message: "title must be at most 256 characters"},
+			{Field: "description", Rule: RuleRequired, Message: "description is required"},
+			{Field: "price", Rule: RulePrice, Message: `price must be an amount with a currency like {"amount":1050,"currency":"USD"} or 10.50$`},
+		}, ve.Violations)
+		assert.Equal(t, ve.Violations, ValidationErrorData(err))
+	})
+
+	t.Run("invalid structured price", func(t *testing.T) {
+		book := &Book{Title: "title", Description: "description", Author: "author", Price: Price{Amount: -100, Currency: "ABC"}}
+		err := ValidateCreateBookRequestBody(book)
+		var ve *ValidationError
+		require.ErrorAs(t, err, &ve)
+		assert.Equal(t, []FieldViolation{
+			{Field: "price.amount", Rule: RuleMin, Message: "price.amount must not be negative"},
+			{Field: "price.currency", Rule: RuleCurrency, Message: `price.currency "ABC" is not a known ISO-4217 code`},
+		}, ve.Violations)
+	})
+
+	t.Run("update requires id and created_at", func(t *testing.T) {
+		book := &Book{Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}}
+		require.NoError(t, ValidateCreateBookRequestBody(book))
+		err := ValidateUpdateBookRequestBody(book)
+		assert.EqualError(t, err, "id is required; created_at is required")
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		assert.Equal(t, "invalid json", ValidationErrorData(errors.New("invalid json")))
+	})
+}
+
+// TestPrice ensures the legacy price strings are parsed into amounts with a currency and
+// that prices survive a json round-trip in both the legacy and the structured formats.
+func TestPrice(t *testing.T) {
+	t.Run("parse legacy prices", func(t *testing.T) {
+		tests := []struct {
+			input string
+			price Price
+		}{
+			{"10$", Price{Amount: 1000, Currency: "USD"}},
+			{"$ 10.50", Price{Amount: 1050, Currency: "USD"}},
+			{"1,200 EUR", Price{Amount: 120000, Currency: "EUR"}},
+			{"12.5", Price{Amount: 1250, Currency: DefaultCurrency}},
+			{"£0.05", Price{Amount: 5, Currency: "GBP"}},
+			{"-3€", Price{Amount: -300, Currency: "EUR"}},
+		}
+		for _, tc := range tests {
+			price, err := ParsePrice(tc.input)
+			require.NoError(t, err, tc.input)
+			assert.Equal(t, tc.price, price, tc.input)
+		}
+		for _, input := range []string{"free", "10.505$", "1,20$", "$10€", "$ 10 USD", ""} {
+			_, err := ParsePrice(input)
+			assert.ErrorIs(t, err, ErrInvalidPrice, input)
+		}
+	})
+
+	t.Run("json round-trip", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			input   string
+			price   Price
+			encoded string
+		}{
+			{"structured", `{"amount":1050,"currency":"EUR"}`, Price{Amount: 1050, Currency: "EUR"}, `{"amount":1050,"currency":"EUR"}`},
+			{"legacy string", `"10.50$"`, Price{Amount: 1050, Currency: "USD"}, `{"amount":1050,"currency":"USD"}`},
+			{"unparseable legacy string", `"free"`, Price{legacy: "free"}, `"free"`},
+			{"empty string", `""`, Price{}, `null`},
+			{"null", `null`, Price{}, `null`},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				var price Price
+				require.NoError(t, json.Unmarshal([]byte(tc.input), &price))
+				assert.Equal(t, tc.price, price)
+				encoded, err := json.Marshal(price)
+				require.NoError(t, err)
+				assert.Equal(t, tc.encoded, string(encoded))
+			})
+		}
+	})
+}
+
+// TestBook_MarshalLogObject ensures the logged books carry only their summary by default and
+// all their fields in verbose mode.
+func TestBook_MarshalLogObject(t *testing.T) {
+	book := Book{
+		ID:          "b:1",
+		Title:       "Golang programming",
+		Description: strings.Repeat("long description ", 1000),
+		Author:      "Jerome Amon",
+		Price:       Price{Amount: 1050, Currency: "EUR"},
+		CreatedAt:   "2023-07-02T00:00:00Z",
+		UpdatedAt:   "2023-07-02T00:00:00Z",
+	}
+	logged := func() interface{} {
+		core, logs := observer.New(zap.InfoLevel)
+		zap.New(core).Info("book", zap.Any("book", book))
+		return logs.All()[0].ContextMap()["book"]
+	}
+
+	assert.Equal(t, map[string]interface{}{"id": "b:1", "title": "Golang programming", "author": "Jerome Amon"}, logged())
+
+	SetVerboseBookLogs(true)
+	t.Cleanup(func() { SetVerboseBookLogs(false) })
+	assert.Equal(t, map[string]interface{}{
+		"id":          "b:1",
+		"title":       "Golang programming",
+		"description": book.Description,
+		"author":      "Jerome Amon",
+		"price":       book.Price.String(),
+		"createdAt":   "2023-07-02T00:00:00Z",
+		"updatedAt":   "2023-07-02T00:00:00Z",
+	}, logged())
+}
+
+// TestCreateBook_BackupWriteFailed ensures a creation whose synchronous backup write
+// failed is reported with 503 and a message telling the book was not created, or with
+// 500 and a message telling the storages are inconsistent when the rollback failed.
+func TestCreateBook_BackupWriteFailed(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rollback error
+		status   int
+		message  string
+	}{
+		{"rolled back", nil, http.StatusServiceUnavailable, "failed to create the book into backup storage, it was not created"},
+		{"rollback failed", errors.New("redis: connection refused"), http.StatusInternalServerError, "failed to create the book into backup storage and to roll it back, the storages are inconsistent"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := &MockBookStorage{
+				AddFunc:    func(ctx context.Context, id string, book Book) error { return nil },
+				DeleteFunc: func(ctx context.Context, id string) error { return tc.rollback },
+			}
+			backup := &MockBookStorage{
+				AddFunc: func(ctx context.Context, id string, book Book) error { return errors.New("boltdb: timeout") },
+			}
+			queue := &MockQueuer{
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					t.Fatal("book must not be pushed to the queue")
+					return nil
+				},
+			}
+			config := &Config{Backup: BackupConfig{WriteMode: WriteModeSync}}
+			bs := NewBookService(zap.NewNop(), config, NewMockClocker(), primary, backup, queue)
+			api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+			payload, err := json.Marshal(Book{Title: "Title", Description: "Description", Author: "Author", Price: Price{Amount: 1000, Currency: "USD"}})
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			api.CreateBook(w, httptest.NewRequest(http.MethodPost, "/v1/books", bytes.NewBuffer(payload)), httprouter.Params{})
+			assert.Equal(t, tc.status, w.Code)
+			var resp APIError
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tc.message, resp.Message)
+		})
+	}
+}
+
+// TestGetBookHistory ensures the history of an existing book lists its prior versions
+// from the oldest, trimmed to the configured size, while an unknown book gets 404 and
+// a disabled history 501.
+func TestGetBookHistory(t *testing.T) {
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return Book{}, ErrBookNotFound },
+	}
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error { return nil },
+	}
+	config := &Config{History: HistoryConfig{Enable: true, Size: 2}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), bs)
+	ctx := context.Background()
+
+	getHistory := func(t *testing.T, id string) (*httptest.ResponseRecorder, []Book) {
+		w := httptest.NewRecorder()
+		api.GetBookHistory(w, httptest.NewRequest(http.MethodGet, "/v1/books/"+id+"/history", nil), httprouter.Params{{Key: "id", Value: id}})
+		var resp struct {
+			Data []Book `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w, resp.Data
+	}
+
+	t.Run("never existed", func(t *testing.T) {
+		w, _ := getHistory(t, "b:0")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("without prior version", func(t *testing.T) {
+		err := bs.Add(ctx, "b:1", Book{ID: "b:1", Title: "v1"})
+		require.NoError(t, err)
+		w, books := getHistory(t, "b:1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, books)
+	})
+
+	t.Run("trimmed to the last versions", func(t *testing.T) {
+		for _, title := range []string{"v2", "v3", "v4"} {
+			clock.MockNow = clock.MockNow.Add(time.Minute)
+			_, err := bs.Update(ctx, "b:1", Book{ID: "b:1", Title: title})
+			require.NoError(t, err)
+		}
+		w, books := getHistory(t, "b:1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, books, 2)
+		assert.Equal(t, "v2", books[0].Title)
+		assert.Equal(t, "v3", books[1].Title)
+		assert.True(t, books[0].UpdatedAt < books[1].UpdatedAt)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		config := &Config{}
+		bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), bs)
+		w := httptest.NewRecorder()
+		api.GetBookHistory(w, httptest.NewRequest(http.MethodGet, "/v1/books/b:1/history", nil), httprouter.Params{{Key: "id", Value: "b:1"}})
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+// TestCreateOrUpdateBook_EmptyBody ensures a missing, empty or blank request body is
+// rejected with 400 before any book is stored.
+func TestCreateOrUpdateBook_EmptyBody(t *testing.T) {
+	mockRepo := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			t.Fatal("book must not be stored")
+			return nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), mockRepo, mockRepo, &MockQueuer{})
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	handlers := map[string]func(w http.ResponseWriter, r *http.Request){
+		http.MethodPost: func(w http.ResponseWriter, r *http.Request) { api.CreateBook(w, r, httprouter.Params{}) },
+		http.MethodPut: func(w http.ResponseWriter, r *http.Request) {
+			api.UpdateBook(w, r, httprouter.Params{{Key: "id", Value: "b:1"}})
+		},
+	}
+	bodies := map[string]*string{
+		"nil body":        nil,
+		"empty body":      new(string),
+		"whitespace body": func(s string) *string { return &s }(" \n\t "),
+	}
+	for method, handle := range handlers {
+		for name, body := range bodies {
+			t.Run(method+" "+name, func(t *testing.T) {
+				req := httptest.NewRequest(method, "/v1/books", nil)
+				if body == nil {
+					req.Body = nil
+				} else {
+					req = httptest.NewRequest(method, "/v1/books", strings.NewReader(*body))
+				}
+				w := httptest.NewRecorder()
+				handle(w, req)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var resp APIError
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "request body is empty", resp.Message)
+			})
+		}
+	}
+}
+
+// TestImportBooks ensures the NDJSON books are created or updated line by line with
+// their failures reported by line number, that the ops replace import clears them first
+// and that the public import refuses the replace mode.
+func TestImportBooks(t *testing.T) {
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	bstorage := &MockBookStorage{
+		GetOneFunc:    func(ctx context.Context, id string) (Book, error) { return Book{}, ErrBookNotFound },
+		DeleteAllFunc: func(ctx context.Context) error { return nil },
+	}
+	var pushed []string
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			pushed = append(pushed, qid+":"+book.ID)
+			return nil
+		},
+	}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("new", true), bs)
+	ctx := context.Background()
+	existing := Book{ID: "b:1", Title: "Old", Description: "Description", Author: "Author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: "2023-01-01T00:00:00Z"}
+	require.NoError(t, pstorage.Add(ctx, "b:1", existing))
+
+	importBooks := func(t *testing.T, handle httprouter.Handle, lines ...string) (int, ImportResult) {
+		body := strings.NewReader(strings.Join(lines, "\n"))
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(http.MethodPost, "/v1/books/import", body), httprouter.Params{})
+		var resp struct {
+			Data ImportResult `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp.Data
+	}
+
+	t.Run("upserted with failures", func(t *testing.T) {
+		pushed = nil
+		code, result := importBooks(t, api.ImportBooks,
+			`{"title":"New","description":"Description","author":"Author","price":{"amount":500,"currency":"USD"}}`,
+			`{"id":"b:1","title":"Updated","description":"Description","author":"Author","price":{"amount":1000,"currency":"USD"}}`,
+			`{"title":`,
+			``,
+			`{"description":"Description","author":"Author","price":{"amount":500,"currency":"USD"}}`,
+		)
+		assert.Equal(t, http.StatusMultiStatus, code)
+		assert.Equal(t, 1, result.Created)
+		assert.Equal(t, 1, result.Updated)
+		require.Len(t, result.Failed, 2)
+		assert.Equal(t, 3, result.Failed[0].Line)
+		assert.Equal(t, 5, result.Failed[1].Line)
+		assert.Equal(t, []string{CreateQueue + ":b:new", UpdateQueue + ":b:1"}, pushed)
+
+		book, err := pstorage.GetOne(ctx, "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "Updated", book.Title)
+		assert.Equal(t, existing.CreatedAt, book.CreatedAt)
+	})
+
+	t.Run("public replace mode", func(t *testing.T) {
+		pushed = nil
+		w := httptest.NewRecorder()
+		api.ImportBooks(w, httptest.NewRequest(http.MethodPost, "/v1/books/import?mode=replace", strings.NewReader(`{"id":"b:2"}`)), httprouter.Params{})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, pushed)
+		_, err := pstorage.GetOne(ctx, "b:1")
+		assert.NoError(t, err, "the books must not be cleared")
+	})
+
+	t.Run("ops replace", func(t *testing.T) {
+		pushed = nil
+		code, result := importBooks(t, api.ReplaceBooks,
+			`{"id":"b:2","title":"Only","description":"Description","author":"Author","price":{"amount":500,"currency":"USD"}}`,
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, ImportResult{Created: 1, Failed: []ImportFailure{}}, result)
+		assert.Equal(t, []string{CreateQueue + ":b:2"}, pushed)
+		_, err := pstorage.GetOne(ctx, "b:1")
+		assert.Equal(t, ErrBookNotFound, err)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		api.ImportBooks(w, httptest.NewRequest(http.MethodPost, "/v1/books/import?mode=merge", nil), httprouter.Params{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestImportBooks_ReplaceClearsBackup ensures the replace mode removes the old books
+// from both the redis and bolt storages so the listing only returns the imported ones.
+func TestImportBooks_ReplaceClearsBackup(t *testing.T) {
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	bstorage, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		assert.NoError(t, bstorage.closeTestBoltStore())
+	}()
+	// the queued books are consumed into the bolt storage right away.
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error {
+		return bstorage.Add(ctx, book.ID, book)
+	}}
+	config := &Config{}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("new", true), bs)
+	ctx := context.Background()
+	for _, id := range []string{"b:1", "b:2"} {
+		old := Book{ID: id, Title: "Old", Description: "Description", Author: "Author", Price: Price{Amount: 1000, Currency: "USD"}}
+		require.NoError(t, pstorage.Add(ctx, id, old))
+		require.NoError(t, bstorage.Add(ctx, id, old))
+	}
+
+	body := strings.NewReader(`{"id":"b:3","title":"Only","description":"Description","author":"Author","price":{"amount":500,"currency":"USD"}}`)
+	w := httptest.NewRecorder()
+	api.ReplaceBooks(w, httptest.NewRequest(http.MethodPost, "/ops/books/import", body), httprouter.Params{})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, id := range []string{"b:1", "b:2"} {
+		_, err = pstorage.GetOne(ctx, id)
+		assert.Equal(t, ErrBookNotFound, err)
+		_, err = bstorage.GetOne(ctx, id)
+		assert.Equal(t, ErrBookNotFound, err)
+		_, err = bs.GetOne(ctx, id)
+		assert.Equal(t, ErrBookNotFound, err)
+	}
+	books, _, err := bs.GetAll(ctx, 10, "", BookSort{})
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "b:3", books[0].ID)
+}
@@ -0,0 +1,941 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestMaintenance_ConcurrentToggles ensures toggling the maintenance mode while
+// statistics are read is free of data races. It is meaningful with `-race`.
+func TestMaintenance_ConcurrentToggles(t *testing.T) {
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	ctx := context.WithValue(context.Background(), RequestIDContextKey, "abc")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/ops/maintenance?status=enable&msg=upgrade", nil).WithContext(ctx)
+			api.Maintenance(httptest.NewRecorder(), req, httprouter.Params{})
+		}()
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/ops/maintenance?status=disable", nil).WithContext(ctx)
+			api.Maintenance(httptest.NewRecorder(), req, httprouter.Params{})
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			api.GetStatistics(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil).WithContext(ctx), httprouter.Params{})
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+	}
+	wg.Wait()
+
+	req := httptest.NewRequest(http.MethodGet, "/ops/maintenance?status=enable&msg=upgrade", nil).WithContext(ctx)
+	api.Maintenance(httptest.NewRecorder(), req, httprouter.Params{})
+	w := httptest.NewRecorder()
+	api.GetStatistics(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil).WithContext(ctx), httprouter.Params{})
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	maintenance, ok := stats["maintenance"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, true, maintenance["enabled"])
+	assert.Equal(t, "upgrade", maintenance["reason"])
+}
+
+// TestCaptureReplay ensures a captured create request is recorded with its sensitive
+// headers redacted and that replaying it reproduces the same outcome.
+func TestCaptureReplay(t *testing.T) {
+	var added int
+	repo := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			added++
+			return nil
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	config := &Config{
+		OpsEndpointsEnable: true,
+		Server:             ServerConfig{RequestTimeout: time.Second},
+		Debug:              DebugConfig{Capture: CaptureConfig{Enable: true, MaxBodyBytes: 1024}},
+	}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	api.SetCaptureStore(NewMemoryCaptureStore(10))
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+
+	body := `{"title":"title","description":"description","author":"author","price":"10$"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("X-Capture", "true")
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	captures := api.captures.List()
+	require.Len(t, captures, 1)
+	capture := captures[0]
+	assert.Equal(t, http.StatusCreated, capture.Status)
+	assert.Equal(t, "/v1/books", capture.URI)
+	assert.JSONEq(t, body, capture.Body)
+	assert.Equal(t, RedactedValue, capture.Header.Get("Authorization"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ops/captures/"+capture.ID+"/replay", nil).WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data struct {
+			Original   int  `json:"original"`
+			Status     int  `json:"status"`
+			Reproduced bool `json:"reproduced"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, http.StatusCreated, resp.Data.Original)
+	assert.Equal(t, http.StatusCreated, resp.Data.Status)
+	assert.True(t, resp.Data.Reproduced)
+	assert.Equal(t, 2, added)
+	assert.Len(t, api.captures.List(), 1, "replayed request must not be captured")
+}
+
+// TestRedactJSONBody ensures sensitive fields are redacted at any depth.
+func TestRedactJSONBody(t *testing.T) {
+	body := []byte(`{"title":"t","password":"p","nested":[{"Token":"x","keep":1}]}`)
+	redacted := RedactJSONBody(body, []string{"password", "token"})
+	assert.JSONEq(t, `{"title":"t","password":"[REDACTED]","nested":[{"Token":"[REDACTED]","keep":1}]}`, string(redacted))
+	assert.Equal(t, []byte("not json"), RedactJSONBody([]byte("not json"), []string{"password"}))
+}
+
+// TestGetStatistics_CalledCounters ensures the reported number of public requests, their
+// status codes and their Prometheus observations are not affected by concurrent ops requests.
+func TestGetStatistics_CalledCounters(t *testing.T) {
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil).WithContext(ctx))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil).WithContext(ctx))
+			var stats map[string]interface{}
+			if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats)) {
+				assert.Equal(t, float64(3), stats["called"])
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(20), atomic.LoadUint64(&api.stats.opsCalled))
+	// the ops responses are counted apart from the public ones.
+	assert.Equal(t, map[int]uint64{http.StatusOK: 3}, api.stats.status)
+	assert.Equal(t, map[int]uint64{http.StatusOK: 20}, api.stats.opsStatus)
+	assert.Equal(t, float64(3), testutil.ToFloat64(api.metrics.requests.WithLabelValues("200")))
+}
+
+// TestNotFound_Counted ensures a request to an unknown route is numbered, counted as
+// a public request and reported under the 404 status like the existing routes.
+func TestNotFound_Counted(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+
+	for _, path := range []string{"/v1/unknown", "/v1/books/unknown/route"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx))
+		require.Equal(t, http.StatusNotFound, w.Code)
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "r:abc", body["requestid"])
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil).WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, float64(2), stats["called"])
+	assert.Equal(t, map[string]interface{}{"404": float64(2)}, stats["status"])
+
+	unknowns := logs.FilterMessage("unknown route").All()
+	require.Len(t, unknowns, 2)
+	assert.Equal(t, uint64(2), unknowns[1].ContextMap()["request.number"])
+}
+
+// TestExportAudit ensures the audit export requires the token, validates the time
+// range and streams as NDJSON only the entries recorded within the range.
+func TestExportAudit(t *testing.T) {
+	auditLog, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	defer auditLog.Close()
+	start := NewMockClocker().Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, auditLog.Append(AuditEntry{Time: start.Add(time.Duration(i) * time.Hour), RequestID: "r:" + strconv.Itoa(i), Method: http.MethodGet, Path: "/ops/stats", Status: http.StatusOK}))
+	}
+
+	config := &Config{Ops: OpsConfig{Audit: AuditConfig{Enable: true, ExportToken: "token"}}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: start}, NewMockClocker(), nil, nil)
+	api.SetAuditLog(auditLog)
+	export := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ops/audit/export?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ExportAudit(w, req, httprouter.Params{})
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, export("", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, export("", "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, export("from=yesterday", "token").Code)
+	assert.Equal(t, http.StatusBadRequest, export("from=2023-07-02T02:00:00Z&to=2023-07-02T01:00:00Z", "token").Code)
+
+	w := export("from=2023-07-02T00:30:00Z&to=2023-07-02T01:30:00Z", "token")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	require.Len(t, lines, 1)
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "r:1", entry.RequestID)
+	assert.True(t, entry.Time.Equal(start.Add(time.Hour)))
+}
+
+// TestMaintenance_DisableWithStatsReset ensures disabling the maintenance with
+// `reset=true` zeroes the requests counters and clears the status counters.
+func TestMaintenance_DisableWithStatsReset(t *testing.T) {
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	atomic.StoreUint64(&api.stats.called, 7)
+	atomic.StoreUint64(&api.stats.opsCalled, 3)
+	api.stats.status[http.StatusOK] = 5
+	api.stats.status[http.StatusServiceUnavailable] = 2
+
+	for _, query := range []string{"status=enable&msg=incident", "status=disable"} {
+		api.Maintenance(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ops/maintenance?"+query, nil), httprouter.Params{})
+	}
+	assert.Equal(t, uint64(7), atomic.LoadUint64(&api.stats.called), "reset must be opt-in")
+	assert.Len(t, api.stats.status, 2)
+
+	for _, query := range []string{"status=enable&msg=incident", "status=disable&reset=true"} {
+		api.Maintenance(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ops/maintenance?"+query, nil), httprouter.Params{})
+	}
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&api.stats.called))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&api.stats.opsCalled))
+	assert.Empty(t, api.stats.status)
+	enabled, _, _ := api.mode.State()
+	assert.False(t, enabled)
+}
+
+// TestMaintenance_ScheduledWindow ensures the public requests are answered with 503 only
+// while the clock falls into the scheduled window, which the stats report beforehand.
+func TestMaintenance_ScheduledWindow(t *testing.T) {
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}
+	clock := NewMockClocker()
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+		return w
+	}
+	window := func() interface{} {
+		var stats map[string]interface{}
+		require.NoError(t, json.Unmarshal(serve("/ops/stats").Body.Bytes(), &stats))
+		return stats["maintenance"].(map[string]interface{})["window"]
+	}
+
+	for _, query := range []string{
+		"start=2023-07-02T01:00:00Z",
+		"start=yesterday&end=2023-07-02T02:00:00Z",
+		"start=2023-07-02T02:00:00Z&end=2023-07-02T01:00:00Z",
+		"start=2023-07-01T01:00:00Z&end=2023-07-01T02:00:00Z",
+	} {
+		w := serve("/ops/maintenance?status=enable&" + query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	assert.Nil(t, window())
+
+	w := serve("/ops/maintenance?status=enable&msg=upgrade&start=2023-07-02T01:00:00Z&end=2023-07-02T02:00:00Z")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, serve("/status").Code)
+	assert.Equal(t, map[string]interface{}{
+		"status": "upcoming",
+		"start":  "2023-07-02T01:00:00Z",
+		"end":    "2023-07-02T02:00:00Z",
+		"reason": "upgrade",
+	}, window())
+
+	clock.MockNow = clock.MockNow.Add(90 * time.Minute)
+	w = serve("/status")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"upgrade"`)
+	assert.Contains(t, w.Body.String(), `"since":"Sun, 02 Jul 2023 01:00:00 UTC"`)
+	assert.Contains(t, w.Body.String(), `"maintenance_until":"2023-07-02T02:00:00Z"`)
+	assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+	assert.Equal(t, "active", window().(map[string]interface{})["status"])
+	enabled, _, _ := api.mode.State()
+	assert.False(t, enabled, "the window must not turn on the manual mode")
+
+	clock.MockNow = clock.MockNow.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, serve("/status").Code)
+	assert.Nil(t, window())
+
+	serve("/ops/maintenance?status=enable&start=2023-07-02T02:00:00Z&end=2023-07-02T03:00:00Z")
+	require.Equal(t, http.StatusServiceUnavailable, serve("/status").Code)
+	serve("/ops/maintenance?status=disable")
+	assert.Equal(t, http.StatusOK, serve("/status").Code, "disabling must cancel the window")
+	assert.True(t, api.mode.Window().IsZero())
+}
+
+// TestReloadConfig ensures the reload swaps in the settings which can change at runtime and
+// rejects, without applying anything, the changes of the settings which require a restart.
+func TestReloadConfig(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{
+			OpsEndpointsEnable: true,
+			LogLevel:           zap.InfoLevel,
+			Server: ServerConfig{
+				Host:           "127.0.0.1",
+				Port:           "8080",
+				RequestTimeout: time.Second,
+				RateLimit:      RateLimitConfig{Enable: true, Rate: 1, Burst: 1},
+			},
+			Redis: RedisConfig{Host: "127.0.0.1", Port: "6379"},
+		}
+	}
+	clock := NewMockClocker()
+	api := NewAPIHandler(zap.NewNop(), newConfig(), &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	api.SetLogLevel(level)
+	api.SetRateLimiter(NewRateLimiter(clock, 1, 1))
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+	reload := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ops/config/reload", nil).WithContext(ctx))
+		return w
+	}
+	status := func(ip string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/status", nil).WithContext(ctx)
+		req.RemoteAddr = ip + ":1234"
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("restart required", func(t *testing.T) {
+		api.loadConfig = func() (*Config, error) {
+			config := newConfig()
+			config.LogLevel = zap.DebugLevel
+			config.Server.Port = "9090"
+			config.Redis.Host = "10.0.0.1"
+			return config, nil
+		}
+		w := reload()
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "configuration changes require a restart: server.port, redis.host")
+		assert.Equal(t, "8080", api.Config().Server.Port)
+		assert.Equal(t, zap.InfoLevel, level.Level(), "nothing must be applied")
+	})
+
+	t.Run("load failure", func(t *testing.T) {
+		api.loadConfig = func() (*Config, error) {
+			return nil, errors.New("failed to initialize configurations")
+		}
+		assert.Equal(t, http.StatusInternalServerError, reload().Code)
+		assert.Equal(t, time.Second, api.Config().Server.RequestTimeout)
+	})
+
+	t.Run("runtime changes", func(t *testing.T) {
+		api.mode.Enable("upgrade", clock.Now())
+		defer api.mode.Disable(time.Time{})
+		require.Equal(t, http.StatusServiceUnavailable, status("10.1.2.3"))
+
+		api.loadConfig = func() (*Config, error) {
+			config := newConfig()
+			config.LogLevel = zap.DebugLevel
+			config.Server.RequestTimeout = 5 * time.Second
+			config.Server.RateLimit.Burst = 5
+			config.Maintenance.AllowedIPs = []string{"10.1.2.0/24"}
+			return config, nil
+		}
+		w := reload()
+		require.Equal(t, http.StatusOK, w.Code)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, []interface{}{"log_level", "server.request_timeout", "server.rate_limit.burst", "maintenance.allowed_ips"}, body["changes"])
+		assert.Equal(t, zap.DebugLevel, level.Level())
+		assert.Equal(t, 5*time.Second, api.GetTimeout(httptest.NewRequest(http.MethodGet, "/status", nil)))
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusOK, status("10.1.2.3"), "allowlisted source within the new burst")
+		}
+		assert.Equal(t, http.StatusTooManyRequests, status("10.1.2.3"))
+		assert.Equal(t, http.StatusServiceUnavailable, status("10.9.9.9"))
+	})
+}
+
+// TestLogLevel ensures the app log level is reported and changed at runtime to one of the
+// supported levels only.
+func TestLogLevel(t *testing.T) {
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	api.SetLogLevel(level)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+	serve := func(method, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/ops/loglevel", strings.NewReader(body)).WithContext(ctx))
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	code, response := serve(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", response["level"])
+
+	code, response = serve(http.MethodPut, `{"level":"debug"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", response["previous"])
+	assert.Equal(t, "debug", response["level"])
+	assert.True(t, level.Enabled(zap.DebugLevel))
+
+	for _, body := range []string{`{"level":"verbose"}`, `{"level":"fatal"}`, `{"level":""}`, `debug`} {
+		code, _ = serve(http.MethodPut, body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	_, response = serve(http.MethodGet, "")
+	assert.Equal(t, "debug", response["level"])
+}
+
+// TestMetrics ensures the metrics endpoint exports the requests counters, the
+// requests durations, the goroutines count and the maintenance mode status.
+func TestMetrics(t *testing.T) {
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil).WithContext(ctx))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	api.mode.Enable("upgrade", NewMockClocker().Now())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/metrics", nil).WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	for _, line := range []string{
+		`drap_http_responses_total{code="200"} 2`,
+		`drap_http_request_duration_seconds_count 2`,
+		`drap_http_requests_called_total 2`,
+		`drap_maintenance_enabled 1`,
+		`go_goroutines `,
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+// TestForceGC_Cooldown ensures the gc endpoints share a cooldown so a call within
+// it is rejected with the remaining time while a spaced call runs to completion.
+func TestForceGC_Cooldown(t *testing.T) {
+	clock := NewMockClocker()
+	config := &Config{Ops: OpsConfig{GC: GCConfig{Cooldown: 10 * time.Second, Timeout: 5 * time.Second}}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+
+	w := httptest.NewRecorder()
+	api.RunGC(w, httptest.NewRequest(http.MethodGet, "/ops/debug/gc", nil), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, true, result["completed"])
+	assert.Equal(t, "runtime.GC()", result["called"])
+
+	clock.MockNow = clock.MockNow.Add(4 * time.Second)
+	w = httptest.NewRecorder()
+	api.FreeOSMemory(w, httptest.NewRequest(http.MethodGet, "/ops/debug/fos", nil), nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "6", w.Header().Get("Retry-After"))
+	result = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "6s", result["remaining"])
+
+	clock.MockNow = clock.MockNow.Add(6 * time.Second)
+	w = httptest.NewRecorder()
+	api.FreeOSMemory(w, httptest.NewRequest(http.MethodGet, "/ops/debug/fos", nil), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	result = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, true, result["completed"])
+	assert.Equal(t, "debug.FreeOSMemory()", result["called"])
+}
+
+// TestRenameBook ensures a book is moved to a new valid ID along with its views and
+// the backup storage is notified, while a taken or an invalid new ID is rejected.
+func TestRenameBook(t *testing.T) {
+	oldID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	newID := "b:0c1e0d5a-3f4b-4f0e-9d5c-6f0a9b6c2e11"
+	takenID := "b:5e3b1c2a-7d8e-4f9a-8b0c-1d2e3f4a5b6c"
+	backupID := "b:9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c6d"
+	clock := NewMockClocker()
+	client := newMiniRedisClient(t)
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, client)
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			if id == backupID {
+				return Book{ID: id}, nil
+			}
+			return Book{}, ErrBookNotFound
+		},
+	}
+	var pushed []string
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			pushed = append(pushed, qid+" "+book.ID)
+			return nil
+		},
+	}
+	config := &Config{Ops: OpsConfig{Rename: RenameConfig{Enable: true, Token: "secret"}}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewIDsHandler(), bs)
+	router := httprouter.New()
+	require.NoError(t, api.SetupOpsRoutes(router, &MiddlewareMap{public: func(h httprouter.Handle) httprouter.Handle { return h }, ops: func(h httprouter.Handle) httprouter.Handle { return h }}))
+
+	ctx := context.Background()
+	require.NoError(t, pstorage.Add(ctx, oldID, Book{ID: oldID, Title: "title"}))
+	require.NoError(t, pstorage.Add(ctx, takenID, Book{ID: takenID, Title: "taken"}))
+	require.NoError(t, pstorage.(BookViewsCounter).IncrViews(ctx, oldID))
+
+	rename := func(id, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ops/books/"+id+"/rename", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, rename(oldID, `{"id":"`+newID+`"}`, "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, rename(oldID, `{"id":"x:invalid"}`, "secret").Code)
+	assert.Equal(t, http.StatusBadRequest, rename(oldID, `{"id":"`+oldID+`"}`, "secret").Code)
+	assert.Equal(t, http.StatusConflict, rename(oldID, `{"id":"`+takenID+`"}`, "secret").Code)
+	assert.Equal(t, http.StatusConflict, rename(oldID, `{"id":"`+backupID+`"}`, "secret").Code)
+	assert.Empty(t, pushed)
+
+	w := rename(oldID, `{"id":"`+newID+`"}`, "secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var book Book
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &book}))
+	assert.Equal(t, newID, book.ID)
+	assert.Equal(t, "title", book.Title)
+	assert.Equal(t, []string{CreateQueue + " " + newID, DeleteQueue + " " + oldID}, pushed)
+
+	_, err := pstorage.GetOne(ctx, oldID)
+	assert.Equal(t, ErrBookNotFound, err)
+	stored, err := pstorage.GetOne(ctx, newID)
+	require.NoError(t, err)
+	assert.Equal(t, book, stored)
+	views, err := pstorage.(BookViewsCounter).GetViews(ctx, newID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), views)
+
+	assert.Equal(t, http.StatusNotFound, rename(oldID, `{"id":"`+takenID+`"}`, "secret").Code)
+}
+
+// TestRetryFailedQueues ensures the dead letter queues are drained back into their queues.
+func TestRetryFailedQueues(t *testing.T) {
+	client := newMiniRedisClient(t)
+	queue := NewRedisQueue(client)
+	ctx := context.Background()
+	require.NoError(t, queue.Push(ctx, DeadLetterQueue(CreateQueue), Book{ID: "b:1"}))
+	require.NoError(t, queue.Push(ctx, DeadLetterQueue(CreateQueue), Book{ID: "b:2"}))
+	require.NoError(t, queue.Push(ctx, DeadLetterQueue(DeleteQueue), Book{ID: "b:3"}))
+	require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:0"}))
+
+	config := &Config{OpsEndpointsEnable: true}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	api.SetDeadLetters(NewDeadLetters(client, BackupQueues...))
+	router := httprouter.New()
+	require.NoError(t, api.SetupOpsRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ops/queues/retry-failed", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, float64(3), result["total"])
+	assert.Equal(t, float64(2), result["requeued"].(map[string]interface{})[CreateQueue])
+	assert.Equal(t, float64(1), result["requeued"].(map[string]interface{})[DeleteQueue])
+
+	for _, expected := range []string{"b:0", "b:1", "b:2"} {
+		qid, book, err := queue.Pop(ctx, CreateQueue)
+		require.NoError(t, err)
+		assert.Equal(t, CreateQueue, qid)
+		assert.Equal(t, expected, book.ID)
+	}
+	_, book, err := queue.Pop(ctx, DeleteQueue)
+	require.NoError(t, err)
+	assert.Equal(t, "b:3", book.ID)
+	n, err := client.Exists(ctx, DeadLetterQueue(CreateQueue), DeadLetterQueue(DeleteQueue)).Result()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// refailHook pushes back into the dead letter queue every book moved out of it,
+// the way a consumer failing them again right away would.
+type refailHook struct {
+	client *redis.Client
+}
+
+func (rh *refailHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (rh *refailHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := next(ctx, cmd); err != nil || cmd.Name() != "lmove" {
+			return err
+		}
+		return rh.client.RPush(ctx, cmd.Args()[1].(string), cmd.(*redis.StringCmd).Val()).Err()
+	}
+}
+
+func (rh *refailHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// TestDeadLetters_RequeueBounded ensures the requeue stops at the length of the dead
+// letter queue taken at the start even when the books keep failing back into it.
+func TestDeadLetters_RequeueBounded(t *testing.T) {
+	client := newMiniRedisClient(t)
+	queue := NewRedisQueue(client)
+	ctx := context.Background()
+	for _, id := range []string{"b:1", "b:2", "b:3"} {
+		require.NoError(t, queue.Push(ctx, DeadLetterQueue(CreateQueue), Book{ID: id}))
+	}
+	hooked := redis.NewClient(client.Options())
+	t.Cleanup(func() { _ = hooked.Close() })
+	hooked.AddHook(&refailHook{client: client})
+
+	moved, err := NewDeadLetters(hooked, CreateQueue).Requeue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{CreateQueue: 3}, moved)
+	n, err := client.LLen(ctx, CreateQueue).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = client.LLen(ctx, DeadLetterQueue(CreateQueue)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+// TestInspectQueue ensures the queue inspection peeks at the oldest books without removing
+// them and rejects unknown queues or invalid sizes.
+func TestInspectQueue(t *testing.T) {
+	client := newMiniRedisClient(t)
+	queue := NewRedisQueue(client)
+	ctx := context.Background()
+	for _, id := range []string{"b:1", "b:2", "b:3"} {
+		require.NoError(t, queue.Push(ctx, DeadLetterQueue(CreateQueue), Book{ID: id}))
+	}
+
+	config := &Config{OpsEndpointsEnable: true}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	api.SetQueue(queue)
+	router := httprouter.New()
+	require.NoError(t, api.SetupOpsRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	t.Run("peek", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/queues/"+DeadLetterQueue(CreateQueue)+"?n=2", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var result struct {
+			QID    string `json:"qid"`
+			Length int64  `json:"length"`
+			Books  []Book `json:"books"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, DeadLetterQueue(CreateQueue), result.QID)
+		assert.Equal(t, int64(3), result.Length)
+		require.Len(t, result.Books, 2)
+		assert.Equal(t, "b:1", result.Books[0].ID)
+		assert.Equal(t, "b:2", result.Books[1].ID)
+
+		n, err := queue.Len(ctx, DeadLetterQueue(CreateQueue))
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+	})
+
+	t.Run("unknown queue", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/queues/unknown", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("invalid size", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/queues/"+CreateQueue+"?n=-1", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestGetHealth ensures the health summary is degraded when a non critical subsystem
+// failed and that the failing component is identified.
+func TestGetHealth(t *testing.T) {
+	client := newMiniRedisClient(t)
+	clock := NewMockClocker()
+	queue := &MockQueuer{LenFunc: func(ctx context.Context, qid string) (int64, error) {
+		return 0, errors.New("queue: connection refused")
+	}}
+	config := &Config{OpsEndpointsEnable: true}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	api.SetHealthChecker(NewHealthChecker(clock, time.Second,
+		RedisCheck(client),
+		QueuesCheck(queue, 10, BackupQueues...),
+		HeartbeatCheck(NewHeartbeat(clock), time.Minute),
+	))
+	router := httprouter.New()
+	require.NoError(t, api.SetupOpsRoutes(router, &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/health", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var report HealthReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, HealthStatusDegraded, report.Status)
+	assert.Equal(t, ComponentHealth{Status: HealthStatusDegraded, Detail: "queue: connection refused"}, report.Components["queues"])
+	for _, name := range []string{"redis", "consumer", "maintenance", "uptime"} {
+		assert.Equal(t, HealthStatusHealthy, report.Components[name].Status, name)
+	}
+
+	api.mode.Enable("upgrade", clock.Now())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/health", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, HealthStatusDegraded, report.Components["maintenance"].Status)
+	assert.Contains(t, report.Components["maintenance"].Detail, "upgrade")
+}
+
+// TestGetStatistics_ServiceUptime ensures the persisted service start time survives a
+// restart so the service uptime keeps counting while the process uptime resets.
+func TestGetStatistics_ServiceUptime(t *testing.T) {
+	client := newMiniRedisClient(t)
+	clock := NewMockClocker()
+	ctx := context.Background()
+	first := clock.Now()
+	started, err := PersistServiceStart(ctx, client, first)
+	require.NoError(t, err)
+	assert.True(t, started.Equal(first))
+
+	// simulated restart two hours later.
+	restarted := first.Add(2 * time.Hour)
+	started, err = PersistServiceStart(ctx, client, restarted)
+	require.NoError(t, err)
+	assert.True(t, started.Equal(first))
+
+	clock.MockNow = restarted.Add(time.Hour)
+	stats := NewStatistics("", "abc", "go", "linux/amd64", false, restarted)
+	stats.SetServiceStarted(started)
+	api := NewAPIHandler(zap.NewNop(), &Config{}, stats, clock, NewMockUIDHandler("abc", true), nil)
+	w := httptest.NewRecorder()
+	api.GetStatistics(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil), nil)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "60 mins", body["uptime"])
+	assert.Equal(t, "180 mins", body["service.uptime"])
+	assert.Equal(t, first.Format(time.RFC1123), body["service.started"])
+
+	t.Run("not persisted", func(t *testing.T) {
+		api := NewAPIHandler(zap.NewNop(), &Config{}, NewStatistics("", "abc", "go", "linux/amd64", false, restarted), clock, NewMockUIDHandler("abc", true), nil)
+		w := httptest.NewRecorder()
+		api.GetStatistics(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil), nil)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "60 mins", body["uptime"])
+		assert.NotContains(t, body, "service.uptime")
+	})
+}
+
+// TestGetOpenMetrics ensures the statistics are exported as a valid OpenMetrics exposition
+// with the requests per route, the cache hits, the queues depth and the maintenance mode.
+func TestGetOpenMetrics(t *testing.T) {
+	config := &Config{
+		OpsEndpointsEnable: true,
+		Server:             ServerConfig{RequestTimeout: time.Second},
+		Cache:              CacheConfig{Enable: true, Size: 10, TTL: time.Minute},
+		Ops:                OpsConfig{Stats: StatsConfig{OpenMetrics: true}},
+	}
+	clock := NewMockClocker()
+	repo := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return Book{ID: id, Title: "Cached"}, nil },
+		CountFunc:  func(ctx context.Context) (int, error) { return 1, nil },
+	}
+	bs := NewBookService(zap.NewNop(), config, clock, repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), bs)
+	api.SetQueue(&MockQueuer{LenFunc: func(ctx context.Context, qid string) (int64, error) {
+		if qid == TrashQueue {
+			return 0, errors.New("unavailable")
+		}
+		return int64(len(qid)), nil
+	}})
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+		return w
+	}
+	for _, target := range []string{"/v1/books/b:1", "/v1/books/b:1", "/v1/books/b:1", "/v1/books/count", "/v1/unknown"} {
+		serve(target)
+	}
+	api.mode.Enable("upgrade", clock.Now())
+
+	w := serve("/ops/stats/openmetrics")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, OpenMetricsContentType, w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assertValidOpenMetrics(t, body)
+	for _, line := range []string{
+		"drap_requests_called_total 5",
+		"drap_responses_total{code=\"404\"} 1",
+		"drap_route_requests_total{method=\"GET\",route=\"/v1/books/:id\"} 3",
+		"drap_route_requests_total{method=\"GET\",route=\"/v1/books/count\"} 1",
+		"drap_cache_hits_total 2",
+		"drap_cache_misses_total 1",
+		"drap_cache_hit_ratio 0.6666666666666666",
+		"drap_cache_entries 1",
+		"drap_queue_depth{queue=\"creation\"} 8",
+		"drap_maintenance_enabled 1",
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.NotContains(t, body, "queue=\"trashing\"")
+}
+
+// TestWriteOpenMetrics_Escaping ensures the help texts and the label values are escaped.
+func TestWriteOpenMetrics_Escaping(t *testing.T) {
+	var buf strings.Builder
+	require.NoError(t, WriteOpenMetrics(&buf, []MetricFamily{{
+		Name:    "escaped",
+		Type:    "gauge",
+		Help:    "a \\ help\non two lines",
+		Samples: []MetricSample{{Labels: [][2]string{{"path", "/a\"b\\c\n"}}, Value: 1.5}},
+	}}))
+	assertValidOpenMetrics(t, buf.String())
+	assert.Equal(t, "# TYPE drap_escaped gauge\n# HELP drap_escaped a \\\\ help\\non two lines\ndrap_escaped{path=\"/a\\\"b\\\\c\\n\"} 1.5\n# EOF\n", buf.String())
+}
+
+var (
+	openMetricsDescriptor = regexp.MustCompile(`^# (TYPE|HELP|UNIT) ([a-zA-Z_:][a-zA-Z0-9_:]*)(?: (.*))?$`)
+	openMetricsSample     = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*")*\})? (\S+)$`)
+)
+
+// assertValidOpenMetrics checks the exposition against the OpenMetrics text format: the
+// families are declared once with a known type before their samples, the counters samples
+// have the `_total` suffix, the values are numbers and it ends with `# EOF`.
+func assertValidOpenMetrics(t *testing.T, exposition string) {
+	t.Helper()
+	require.True(t, strings.HasSuffix(exposition, "# EOF\n"), "exposition must end with # EOF")
+	lines := strings.Split(strings.TrimSuffix(exposition, "# EOF\n"), "\n")
+	lines = lines[:len(lines)-1]
+	types := make(map[string]string)
+	var family string
+	for _, line := range lines {
+		if m := openMetricsDescriptor.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				_, declared := types[m[2]]
+				require.False(t, declared, "family %s declared twice", m[2])
+				require.Contains(t, []string{"counter", "gauge"}, m[3], line)
+				types[m[2]], family = m[3], m[2]
+			} else {
+				require.Equal(t, family, m[2], line)
+			}
+			continue
+		}
+		m := openMetricsSample.FindStringSubmatch(line)
+		require.NotNil(t, m, "invalid sample line %q", line)
+		name := family
+		if types[family] == "counter" {
+			name += "_total"
+		}
+		require.Equal(t, name, m[1], line)
+		_, err := strconv.ParseFloat(m[3], 64)
+		require.NoError(t, err, line)
+	}
+}
@@ -2,14 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest/observer"
 )
@@ -19,7 +31,7 @@ import (
 func TestMiddlewaresStacks(t *testing.T) {
 	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
 	pub, ops := api.MiddlewaresStacks()
-	assert.Equal(t, 8, len(*pub))
+	assert.Equal(t, 9, len(*pub))
 	assert.Equal(t, 7, len(*ops))
 }
 
@@ -119,10 +131,7 @@ func TestMaintenanceModeMiddleware(t *testing.T) {
 			called = true
 		}
 		api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
-		api.mode.enabled.Store(true)
-		ts := NewMockClocker().Now()
-		api.mode.started = ts
-		api.mode.reason = "ongoing maintenance."
+		api.mode.Enable("ongoing maintenance.", NewMockClocker().Now())
 		req = req.WithContext(context.WithValue(req.Context(), RequestIDContextKey, "abc"))
 		wrapped := api.MaintenanceModeMiddleware(handler)
 		wrapped(w, req, nil)
@@ -133,8 +142,23 @@ func TestMaintenanceModeMiddleware(t *testing.T) {
 		defer res.Body.Close()
 		data, err := io.ReadAll(res.Body)
 		require.NoError(t, err)
-		expected := `{"requestid":"abc","message":"service currently unvailable.","reason":"ongoing maintenance.", "since":"Sun, 02 Jul 2023 00:00:00 UTC"}`
+		expected := `{"requestid":"abc","message":"service currently unvailable.","reason":"ongoing maintenance.", "since":"Sun, 02 Jul 2023 00:00:00 UTC", "maintenance_until":"2023-07-02T00:05:00Z"}`
 		assert.JSONEq(t, expected, string(data))
+		assert.Equal(t, "300", res.Header.Get("Retry-After"))
+	})
+
+	t.Run("maintenance with configured estimate", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {}
+		config := &Config{Maintenance: MaintenanceConfig{RetryAfter: 90 * time.Second}}
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+		api.mode.Enable("ongoing maintenance.", NewMockClocker().Now())
+		api.MaintenanceModeMiddleware(handler)(w, req, nil)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "90", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), `"maintenance_until":"2023-07-02T00:01:30Z"`)
 	})
 }
 
@@ -153,6 +177,49 @@ func TestRequestIDMiddleware(t *testing.T) {
 	wrapped(w, req, nil)
 	assert.Equal(t, true, called)
 	assert.Equal(t, RequestIDPrefix+":"+"abc", id)
+	assert.Equal(t, id, w.Header().Get(RequestIDHeader))
+}
+
+// TestRequestIDMiddleware_Passthrough ensures the well-formed inbound request id is reused
+// when the passthrough is enabled, a fresh one generated otherwise and both echoed back.
+func TestRequestIDMiddleware_Passthrough(t *testing.T) {
+	inbound := "r:0b7e4a3c-5f2d-4e8a-9c1b-2d3e4f5a6b7c"
+	testCases := []struct {
+		name        string
+		passthrough bool
+		header      string
+		reused      bool
+	}{
+		{"passthrough of well-formed id", true, inbound, true},
+		{"passthrough of bare uuid", true, "0b7e4a3c-5f2d-4e8a-9c1b-2d3e4f5a6b7c", true},
+		{"passthrough of malformed id", true, "r:<script>", false},
+		{"passthrough without id", true, "", false},
+		{"passthrough disabled", false, inbound, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &Config{Server: ServerConfig{RequestIDPassthrough: tc.passthrough}}
+			api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewIDsHandler(), nil)
+			req := httptest.NewRequest(http.MethodGet, "/v1/books", nil)
+			if tc.header != "" {
+				req.Header.Set(RequestIDHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			var id string
+			api.RequestIDMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				id = GetValueFromContext(r.Context(), RequestIDContextKey)
+			})(w, req, nil)
+
+			if tc.reused {
+				assert.Equal(t, tc.header, id)
+			} else {
+				assert.NotEqual(t, tc.header, id)
+				assert.True(t, strings.HasPrefix(id, RequestIDPrefix+":"))
+				assert.True(t, NewIDsHandler().IsValid(id, RequestIDPrefix))
+			}
+			assert.Equal(t, id, w.Header().Get(RequestIDHeader))
+		})
+	}
 }
 
 // TestAddLoggerMiddleware ensures custom logger with exact fields is injected into the request context.
@@ -189,3 +256,988 @@ func TestAddLoggerMiddleware(t *testing.T) {
 		zap.String("request.referer", ""),
 	}, log.Context)
 }
+
+// TestQuotaMiddleware ensures a client gets 429 once its budget is exhausted, even
+// behind a spoofed forwarding header, and that the budget is restored when the window
+// rolls over.
+func TestQuotaMiddleware(t *testing.T) {
+	clock := NewMockClocker()
+	config := &Config{Quota: QuotaConfig{
+		Enable: true,
+		Tiers:  map[string][]QuotaWindow{DefaultQuotaTier: {{Period: time.Hour, Limit: 2}}},
+	}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+	api.SetQuotaLimiter(NewQuotaLimiter(&config.Quota, clock, NewMockQuotaStore()))
+	handler := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	}
+	wrapped := api.QuotaMiddleware(handler)
+	call := func(forwarded ...string) *http.Response {
+		req := httptest.NewRequest("GET", "/v1/books", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, ip := range forwarded {
+			req.Header.Add("X-Forwarded-For", ip)
+		}
+		w := httptest.NewRecorder()
+		wrapped(w, req, nil)
+		return w.Result()
+	}
+
+	for i := 2; i > 0; i-- {
+		res := call()
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "2", res.Header.Get("X-Quota-Limit"))
+		assert.Equal(t, strconv.Itoa(i-1), res.Header.Get("X-Quota-Remaining"))
+	}
+
+	res := call()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "3600", res.Header.Get("Retry-After"))
+	assert.Equal(t, strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 10), res.Header.Get("X-Quota-Reset"))
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	expected := `{"requestid":"", "message":"requests quota exhausted", "limit":2, "reset":"Sun, 02 Jul 2023 01:00:00 UTC", "retryafter":3600}`
+	assert.JSONEq(t, expected, string(data))
+
+	// a forwarding header from an untrusted peer does not provide a fresh budget.
+	res = call("10.0.0.9")
+	res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	// move into the next window.
+	clock.MockNow = clock.MockNow.Add(time.Hour)
+	res = call()
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("X-Quota-Remaining"))
+}
+
+// TestQuotaLimiter_ConcurrentChecks ensures the concurrent checks apply the windows by
+// period while the configured windows are left in their original order.
+func TestQuotaLimiter_ConcurrentChecks(t *testing.T) {
+	clock := NewMockClocker()
+	windows := []QuotaWindow{{Period: time.Hour, Limit: 100}, {Period: time.Minute, Limit: 10}}
+	config := &QuotaConfig{Enable: true, Tiers: map[string][]QuotaWindow{DefaultQuotaTier: windows}}
+	ql := NewQuotaLimiter(config, clock, NewMockQuotaStore())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := ql.Check(context.Background(), "10.0.0.1")
+			assert.NoError(t, err)
+			assert.True(t, result.Allowed)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, []QuotaWindow{{Period: time.Hour, Limit: 100}, {Period: time.Minute, Limit: 10}}, config.Tiers[DefaultQuotaTier])
+	result, err := ql.Check(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, QuotaResult{Allowed: false, Limit: 10, Reset: clock.Now().Add(time.Minute)}, result)
+}
+
+// TestTimeoutMiddleware_StatsRecordedOnce ensures a timed out request is answered with 504
+// and that this status is recorded exactly once into the statistics.
+func TestTimeoutMiddleware_StatsRecordedOnce(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: 10 * time.Millisecond}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	release, done := make(chan struct{}), make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer close(done)
+		<-release
+		resp := GenericResponse("", http.StatusOK, "too late.", nil, nil)
+		assert.Error(t, WriteResponse(r.Context(), w, resp))
+	}
+	chained := (&Middlewares{api.TimeoutMiddleware, api.StatsMiddleware}).Chain(handler)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	req := httptest.NewRequest(http.MethodGet, "/v1/books/b:0", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ConnContextKey, conn))
+	w := httptest.NewRecorder()
+	chained(w, req, nil)
+	close(release)
+	<-done
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Eventually(t, func() bool {
+		api.stats.mu.RLock()
+		defer api.stats.mu.RUnlock()
+		return len(api.stats.status) == 1 && api.stats.status[http.StatusGatewayTimeout] == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+// TestTimeoutMiddleware_LateHandlerWrite ensures a handler writing right after the request
+// timed out never interleaves with the timeout response. Run it with -race to check the
+// shared response writer is safe for concurrent use.
+func TestTimeoutMiddleware_LateHandlerWrite(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: 5 * time.Millisecond}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	for i := 0; i < 50; i++ {
+		done := make(chan struct{})
+		handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			defer close(done)
+			<-r.Context().Done()
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Late", "true")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("late body"))
+		}
+		chained := (&Middlewares{api.TimeoutMiddleware, api.StatsMiddleware}).Chain(handler)
+
+		conn, peer := net.Pipe()
+		req := httptest.NewRequest(http.MethodGet, "/v1/books/b:0", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ConnContextKey, conn))
+		w := httptest.NewRecorder()
+		chained(w, req, nil)
+		<-done
+		conn.Close()
+		peer.Close()
+
+		if w.Code == http.StatusGatewayTimeout {
+			assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+			assert.Empty(t, w.Header().Get("X-Late"))
+			assert.Contains(t, w.Body.String(), "request handling timed out")
+			assert.NotContains(t, w.Body.String(), "late body")
+		} else {
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "late body", w.Body.String())
+		}
+	}
+}
+
+// TestTimeoutMiddleware_RequestIDHeader ensures the timeout response carries the request id
+// into its headers like the handler responses.
+func TestTimeoutMiddleware_RequestIDHeader(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: 5 * time.Millisecond}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	done := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer close(done)
+		<-r.Context().Done()
+	}
+	chained := (&Middlewares{api.RequestIDMiddleware, api.TimeoutMiddleware, api.StatsMiddleware}).Chain(handler)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	req := httptest.NewRequest(http.MethodGet, "/v1/books/b:0", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ConnContextKey, conn))
+	w := httptest.NewRecorder()
+	chained(w, req, nil)
+	<-done
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	id := w.Header().Get(RequestIDHeader)
+	assert.NotEmpty(t, id)
+	assert.Contains(t, w.Body.String(), id)
+}
+
+// TestCustomResponseWriter_Abort ensures an aborted writer drops the handler writes while
+// recording their status code, and a writer whose response started cannot be taken over.
+// TestMiddlewares_HeadersOnlyHandler ensures the headers of a handler which returned without
+// writing are sent, with or without the timeout middleware in the chain.
+func TestMiddlewares_HeadersOnlyHandler(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: time.Second}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("X-Test", "yes")
+	}
+	chains := map[string]*Middlewares{
+		"stats":   {api.StatsMiddleware},
+		"timeout": {api.TimeoutMiddleware, api.StatsMiddleware},
+	}
+	for name, middlewares := range chains {
+		t.Run(name, func(t *testing.T) {
+			chained := middlewares.Chain(handler)
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			req := httptest.NewRequest(http.MethodGet, "/v1/books/b:0", nil)
+			req = req.WithContext(context.WithValue(req.Context(), ConnContextKey, conn))
+			w := httptest.NewRecorder()
+			chained(w, req, nil)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "yes", w.Header().Get("X-Test"))
+		})
+	}
+}
+
+func TestCustomResponseWriter_Abort(t *testing.T) {
+	w := httptest.NewRecorder()
+	cw := NewCustomResponseWriter(w, nil)
+	cw.Header().Set("X-Handler", "true")
+	assert.True(t, cw.Abort(func(w http.ResponseWriter) { w.WriteHeader(499) }))
+	cw.WriteHeader(http.StatusGatewayTimeout)
+	_, err := cw.Write([]byte("dropped"))
+	assert.Error(t, err)
+	assert.Equal(t, 499, w.Code)
+	assert.Empty(t, w.Header().Get("X-Handler"))
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, http.StatusGatewayTimeout, cw.Status())
+	assert.Zero(t, cw.Bytes())
+
+	w = httptest.NewRecorder()
+	cw = NewCustomResponseWriter(w, nil)
+	cw.Header().Set("X-Handler", "true")
+	_, err = cw.Write([]byte("sent"))
+	require.NoError(t, err)
+	assert.False(t, cw.Abort(func(w http.ResponseWriter) { w.WriteHeader(http.StatusGatewayTimeout) }))
+	_, err = cw.Write([]byte(" dropped"))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Handler"))
+	assert.Equal(t, "sent", w.Body.String())
+}
+
+// TestMaintenanceModeMiddleware_AllowedIPs ensures allowlisted sources reach the
+// service while the maintenance mode is enabled and others receive a 503.
+func TestMaintenanceModeMiddleware_AllowedIPs(t *testing.T) {
+	config := &Config{
+		Server:      ServerConfig{TrustedProxies: []string{"172.16.0.1"}},
+		Maintenance: MaintenanceConfig{AllowedIPs: []string{"10.0.0.0/24"}},
+	}
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		allowed    bool
+	}{
+		{"allowlisted source", "10.0.0.5:4000", "", true},
+		{"non allowlisted source", "192.168.1.1:4000", "", false},
+		{"spoofed header from untrusted peer", "192.168.1.1:4000", "10.0.0.5", false},
+		{"allowlisted source behind trusted proxy", "172.16.0.1:4000", "10.0.0.7", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+			api.mode.Enable("upgrade", NewMockClocker().Now())
+			called := false
+			handler := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+				called = true
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1/books", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+			w := httptest.NewRecorder()
+			api.MaintenanceModeMiddleware(handler)(w, req, nil)
+			assert.Equal(t, tc.allowed, called)
+			if !tc.allowed {
+				assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			}
+		})
+	}
+}
+
+// TestFingerprintMiddleware ensures a burst of requests from one fingerprint logs a
+// single spike warning per window while other fingerprints and steady rates do not.
+func TestFingerprintMiddleware(t *testing.T) {
+	clock := NewMockClocker()
+	core, logs := observer.New(zap.WarnLevel)
+	config := &Config{Fingerprint: FingerprintConfig{Enable: true, Window: time.Minute, Threshold: 5, SpikeFactor: 2}}
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+	api.SetFingerprintTracker(NewFingerprintTracker(clock, config.Fingerprint.Window, config.Fingerprint.Threshold, config.Fingerprint.SpikeFactor))
+	wrapped := api.FingerprintMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(n int, ip, id string) {
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/v1/books/"+id, nil)
+			req.RemoteAddr = ip + ":1234"
+			w := httptest.NewRecorder()
+			wrapped(w, req, httprouter.Params{{Key: "id", Value: id}})
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+	}
+
+	send(4, "10.0.0.2", "b:1")
+	send(10, "10.0.0.1", "b:1")
+	entries := logs.FilterMessage("requests fingerprint spike").All()
+	require.Len(t, entries, 1, "one warning per spiking fingerprint and window")
+	assert.Equal(t, "/v1/books/:id", entries[0].ContextMap()["route"])
+	assert.Equal(t, "10.0.0.1", entries[0].ContextMap()["source.ip"])
+	assert.Equal(t, int64(5), entries[0].ContextMap()["count"])
+
+	// the same rate into the next window is not a spike.
+	clock.MockNow = clock.MockNow.Add(time.Minute)
+	send(20, "10.0.0.1", "b:2")
+	assert.Equal(t, 1, logs.FilterMessage("requests fingerprint spike").Len())
+
+	// more than twice the previous rate is.
+	send(1, "10.0.0.1", "b:3")
+	assert.Equal(t, 2, logs.FilterMessage("requests fingerprint spike").Len())
+}
+
+// TestRateLimitMiddleware ensures each client is limited by its own bucket, gets 429
+// with the time to wait once empty, that a spoofed forwarding header does not provide
+// a fresh bucket, and that idle buckets are garbage-collected.
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := NewMockClocker()
+	config := &Config{Server: ServerConfig{RateLimit: RateLimitConfig{Enable: true, Rate: 0.5, Burst: 2}}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+	api.SetRateLimiter(NewRateLimiter(clock, config.Server.RateLimit.Rate, config.Server.RateLimit.Burst))
+	wrapped := api.RateLimitMiddleware(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+	call := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/books", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		wrapped(w, req, nil)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, call("10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, call("10.0.0.1").Code)
+	w := call("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"requestid":"", "message":"too many requests", "retryafter":2}`, w.Body.String())
+	spoofed := httptest.NewRequest(http.MethodGet, "/v1/books", nil)
+	spoofed.RemoteAddr = "10.0.0.1:1234"
+	spoofed.Header.Set("X-Forwarded-For", "10.0.0.9")
+	w = httptest.NewRecorder()
+	wrapped(w, spoofed, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "untrusted forwarding headers are ignored")
+	assert.Equal(t, http.StatusOK, call("10.0.0.2").Code, "clients have distinct buckets")
+
+	clock.MockNow = clock.MockNow.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, call("10.0.0.1").Code, "one token refilled")
+	assert.Equal(t, 2, api.limiter.Len())
+
+	// both buckets are full again after 4s idle so they are removed.
+	clock.MockNow = clock.MockNow.Add(4 * time.Second)
+	assert.Equal(t, http.StatusOK, call("10.0.0.3").Code)
+	assert.Equal(t, 1, api.limiter.Len())
+}
+
+// TestStatsMiddleware_InFlight ensures requests are counted as in flight only while
+// being handled and the count is reported by the statistics endpoint.
+func TestStatsMiddleware_InFlight(t *testing.T) {
+	api := NewAPIHandler(zap.NewNop(), nil, &Statistics{started: NewMockClocker().Now(), status: map[int]uint64{}, mu: &sync.RWMutex{}}, NewMockClocker(), nil, nil)
+	release := make(chan struct{})
+	blocking := api.StatsMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		<-release
+	})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := context.WithValue(context.Background(), ConnContextKey, conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			blocking(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/books", nil).WithContext(ctx), nil)
+		}()
+	}
+	require.Eventually(t, func() bool { return api.stats.InFlight() == 2 }, time.Second, 5*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	api.GetStatistics(w, httptest.NewRequest(http.MethodGet, "/ops/stats", nil), nil)
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, float64(2), stats["inflight"])
+
+	close(release)
+	wg.Wait()
+	assert.Zero(t, api.stats.InFlight())
+}
+
+// TestServerTimingMiddleware ensures the validation, storage and queue phases of a
+// create request are reported into the `Server-Timing` header and, in on-demand
+// mode, only for requests asking for it.
+func TestServerTimingMiddleware(t *testing.T) {
+	repo := &MockBookStorage{AddFunc: func(ctx context.Context, id string, book Book) error { return nil }}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	config := &Config{Debug: DebugConfig{Timing: TimingConfig{Enable: true, OnDemand: true}}}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, queue)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+	handler := api.ServerTimingMiddleware(api.CreateBook)
+	payload := `{"title":"t", "description":"d", "author":"a", "price":"1$"}`
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(payload))
+	req.Header.Set("X-Server-Timing", "true")
+	handler(w, req, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "validation;dur=0.000, storage;dur=0.000, queue;dur=0.000", w.Header().Get("Server-Timing"))
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(payload)), nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get("Server-Timing"))
+}
+
+// TestDegradedMiddleware ensures a book read served from the backup storage because
+// the primary storage failed carries the degraded header, unlike a regular read or
+// a book missing from the primary storage.
+func TestDegradedMiddleware(t *testing.T) {
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	book := Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}}
+	testCases := []struct {
+		name       string
+		primaryErr error
+		degraded   string
+	}{
+		{"primary available", nil, ""},
+		{"primary missing the book", ErrBookNotFound, ""},
+		{"primary failing", errors.New("redis: connection refused"), DegradedSourceBackup},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// the book found into backup storage is filled back in background.
+			filled := make(chan struct{}, 1)
+			pstorage := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+					if tc.primaryErr != nil {
+						return Book{}, tc.primaryErr
+					}
+					return book, nil
+				},
+				AddFunc: func(ctx context.Context, id string, book Book) error {
+					filled <- struct{}{}
+					return tc.primaryErr
+				},
+			}
+			bstorage := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) { return book, nil },
+			}
+			config := &Config{Degraded: DegradedConfig{Enable: true, Header: "X-Degraded-Mode"}}
+			bs := NewBookService(zap.NewNop(), config, NewMockClocker(), pstorage, bstorage, nil)
+			api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+			w := httptest.NewRecorder()
+			api.DegradedMiddleware(api.GetOneBook)(w, httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil), httprouter.Params{{Key: "id", Value: bookID}})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.degraded, w.Header().Get("X-Degraded-Mode"))
+			var result Book
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &result}))
+			assert.Equal(t, book, result)
+
+			if tc.primaryErr != nil {
+				select {
+				case <-filled:
+				case <-time.After(time.Second):
+					t.Fatal("book not filled back into primary storage")
+				}
+			}
+		})
+	}
+}
+
+// TestTracingMiddleware ensures the request span continues the trace of the caller, is
+// named by the route, carries the request id and parents the service and storage spans.
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	bookID := "b:cb8f2136-fae4-4200-85d9-3533c7f8c70d"
+	book := Book{ID: bookID, Title: "title", Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}}
+	pstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			_, span := StartSpan(ctx, "storage.GetOne")
+			defer span.End()
+			return book, nil
+		},
+	}
+	config := &Config{Tracing: TracingConfig{Enable: true}}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), pstorage, nil, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/v1/books/"+bookID, nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req = req.WithContext(context.WithValue(req.Context(), RequestIDContextKey, "rid"))
+	w := httptest.NewRecorder()
+	api.TracingMiddleware(api.GetOneBook)(w, req, httprouter.Params{{Key: "id", Value: bookID}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("traceparent"), traceID)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	storage, service, server := spans[0], spans[1], spans[2]
+	assert.Equal(t, "GET /v1/books/:id", server.Name())
+	assert.Equal(t, traceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Contains(t, server.Attributes(), attribute.String("request.id", "rid"))
+	assert.Contains(t, server.Attributes(), semconv.HTTPResponseStatusCode(http.StatusOK))
+	assert.Equal(t, "bookService.GetOne", service.Name())
+	assert.Equal(t, server.SpanContext().SpanID(), service.Parent().SpanID())
+	assert.Equal(t, "storage.GetOne", storage.Name())
+	assert.Equal(t, service.SpanContext().SpanID(), storage.Parent().SpanID())
+
+	t.Run("no span outside of a traced request", func(t *testing.T) {
+		_, err := bs.GetOne(context.Background(), bookID)
+		require.NoError(t, err)
+		assert.Len(t, recorder.Ended(), 3)
+	})
+}
+
+// TestAuthMiddleware ensures only the requests with a valid and unexpired bearer JWT
+// reach the handler which gets the token subject from the request context.
+func TestAuthMiddleware(t *testing.T) {
+	const secret = "s3cr3t"
+	clock := NewMockClocker()
+	valid, err := GenerateToken(secret, "alice", clock.Now(), time.Hour)
+	require.NoError(t, err)
+	expired, err := GenerateToken(secret, "alice", clock.Now().Add(-2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	forged, err := GenerateToken("other", "alice", clock.Now(), time.Hour)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		authorization string
+		status        int
+		message       string
+	}{
+		{"valid token", "Bearer " + valid, http.StatusOK, ""},
+		{"missing token", "", http.StatusUnauthorized, "missing bearer token"},
+		{"malformed token", "Bearer not.a-jwt", http.StatusUnauthorized, ErrInvalidToken.Error()},
+		{"wrongly signed token", "Bearer " + forged, http.StatusUnauthorized, ErrInvalidToken.Error()},
+		{"expired token", "Bearer " + expired, http.StatusUnauthorized, ErrExpiredToken.Error()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &Config{Auth: AuthConfig{Enable: true, Secret: secret}}
+			api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+			var subject string
+			handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				subject = GetValueFromContext(r.Context(), SubjectContextKey)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/ops/stats", nil)
+			req = req.WithContext(context.WithValue(req.Context(), RequestIDContextKey, "abc"))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			api.AuthMiddleware(handler)(w, req, nil)
+			assert.Equal(t, tc.status, w.Code)
+			if tc.status == http.StatusOK {
+				assert.Equal(t, "alice", subject)
+				return
+			}
+			assert.Empty(t, subject)
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+			var errResp APIError
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+			assert.Equal(t, tc.message, errResp.Message)
+		})
+	}
+}
+
+// TestErrorBreakerMiddleware ensures a client sending repeated invalid requests is short
+// circuited with 429 once the threshold is reached and recovers after the cooldown.
+func TestErrorBreakerMiddleware(t *testing.T) {
+	clock := NewMockClocker()
+	config := &Config{Server: ServerConfig{ErrorBreaker: ErrorBreakerConfig{Enable: true, Threshold: 3, Window: time.Minute, Cooldown: 5 * time.Minute}}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+	api.SetErrorBreaker(NewErrorBreaker(clock, 3, time.Minute, 5*time.Minute))
+	calls := 0
+	handler := api.ErrorBreakerMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	send := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/books", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, req, nil)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, send("10.0.0.1").Code)
+	}
+	w := send("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "300", w.Header().Get("Retry-After"))
+	assert.Equal(t, 3, calls, "tripped client must not reach the handler")
+	assert.Equal(t, http.StatusBadRequest, send("10.0.0.2").Code, "other clients are not affected")
+
+	clock.MockNow = clock.MockNow.Add(4 * time.Minute)
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1").Code)
+	clock.MockNow = clock.MockNow.Add(time.Minute)
+	assert.Equal(t, http.StatusBadRequest, send("10.0.0.1").Code, "client must recover after the cooldown")
+	assert.Equal(t, 5, calls)
+}
+
+// deadlineConn records the last write deadline set on the connection.
+type deadlineConn struct {
+	net.Conn
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *deadlineConn) WriteDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+// TestStatsMiddleware_WriteDeadlineReset ensures the write deadline extended by GetAllBooks
+// is restored to the server write timeout before the next request of the same connection.
+func TestStatsMiddleware_WriteDeadlineReset(t *testing.T) {
+	config := &Config{Server: ServerConfig{WriteTimeout: 5 * time.Second, LongRequestWriteTimeout: time.Hour}}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return []Book{}, "", nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+
+	pipe, peer := net.Pipe()
+	defer pipe.Close()
+	defer peer.Close()
+	conn := &deadlineConn{Conn: pipe}
+	ctx := context.WithValue(context.Background(), ConnContextKey, net.Conn(conn))
+
+	var extended time.Time
+	getAll := api.StatsMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		api.GetAllBooks(w, r, ps)
+		extended = conn.WriteDeadline()
+	})
+	w := httptest.NewRecorder()
+	getAll(w, httptest.NewRequest(http.MethodGet, "/v1/books", nil).WithContext(ctx), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), extended, time.Minute, "GetAllBooks must extend the deadline")
+
+	var next time.Time
+	getOne := api.StatsMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		next = conn.WriteDeadline()
+	})
+	getOne(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/books/b:1", nil).WithContext(ctx), nil)
+	assert.WithinDuration(t, time.Now().Add(5*time.Second), next, time.Second, "next request must get the default write timeout")
+}
+
+// TestStatsMiddleware_WithoutConn ensures a request whose context has no connection, like
+// with a server without the ConnContext hook, is handled and recorded without panicking
+// while the deadlines changes are skipped.
+func TestStatsMiddleware_WithoutConn(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	config := &Config{Server: ServerConfig{WriteTimeout: 5 * time.Second, LongRequestWriteTimeout: time.Hour, RequestTimeout: time.Second}}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return []Book{}, "", nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), repo, repo, nil)
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), bs)
+
+	_, found := GetConnFromContext(context.Background())
+	assert.False(t, found)
+
+	chained := (&Middlewares{api.TimeoutMiddleware, api.StatsMiddleware}).Chain(api.GetAllBooks)
+	w := httptest.NewRecorder()
+	require.NotPanics(t, func() {
+		chained(w, httptest.NewRequest(http.MethodGet, "/v1/books", nil), nil)
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Zero(t, logs.Len(), "the skipped deadlines must not be reported as failures")
+	api.stats.mu.RLock()
+	defer api.stats.mu.RUnlock()
+	assert.Equal(t, uint64(1), api.stats.status[http.StatusOK])
+}
+
+// TestBodiesLoggingMiddleware ensures the requests and responses bodies are debug logged with
+// their fields masked only while toggled on, and the handlers still read the full body.
+func TestBodiesLoggingMiddleware(t *testing.T) {
+	config := &Config{Debug: DebugConfig{Bodies: BodiesConfig{MaxBytes: 40, RedactFields: []string{"author"}}}}
+	core, logs := observer.New(zap.DebugLevel)
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	handler := api.BodiesLoggingMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	})
+	serve := func(body string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(body)), nil)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		return w.Body.String()
+	}
+	small := `{"title":"go","author":"jerome"}`
+	large := `{"title":"` + strings.Repeat("go", 40) + `","author":"jerome"}`
+
+	assert.Equal(t, small, serve(small))
+	assert.Zero(t, logs.Len(), "bodies logging is off by default")
+
+	w := httptest.NewRecorder()
+	api.UpdateBodiesLogging(w, httptest.NewRequest(http.MethodPut, "/ops/debug/bodies", strings.NewReader(`{"enable":true}`)), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"requestid":"","enable":true,"logged":true}`, w.Body.String())
+	logs.TakeAll()
+
+	assert.Equal(t, small, serve(small))
+	assert.Equal(t, large, serve(large), "the handler must read the full body")
+	entries := logs.FilterMessage("http: bodies").All()
+	require.Len(t, entries, 2)
+	fields := entries[0].ContextMap()
+	assert.JSONEq(t, `{"title":"go","author":"[REDACTED]"}`, fields["request.body"].(string))
+	assert.JSONEq(t, `{"title":"go","author":"[REDACTED]"}`, fields["response.body"].(string))
+	assert.Equal(t, int64(http.StatusCreated), fields["response.status"])
+	fields = entries[1].ContextMap()
+	assert.Equal(t, RedactedValue, fields["request.body"])
+	assert.Equal(t, true, fields["request.body.truncated"])
+	assert.Equal(t, RedactedValue, fields["response.body"])
+	assert.Equal(t, true, fields["response.body.truncated"])
+
+	infoAPI := NewAPIHandler(zap.New(core, zap.IncreaseLevel(zap.InfoLevel)), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	infoAPI.bodies.Store(true)
+	logs.TakeAll()
+	w = httptest.NewRecorder()
+	infoAPI.BodiesLoggingMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {})(w, httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(small)), nil)
+	assert.Zero(t, logs.Len(), "bodies are only logged at debug level")
+}
+
+// TestFeatureOverridesMiddleware ensures a request with a valid signed overrides header
+// gets its features flipped for itself only while an unsigned, tampered or expired header
+// is ignored.
+func TestFeatureOverridesMiddleware(t *testing.T) {
+	clock := NewMockClocker()
+	config := &Config{Overrides: OverridesConfig{Enable: true, Secret: "s3cr3t"}}
+	core, logs := observer.New(zap.DebugLevel)
+	api := NewAPIHandler(zap.New(core), config, &Statistics{started: clock.Now()}, clock, nil, nil)
+	handler := api.FeatureOverridesMiddleware(api.BodiesLoggingMiddleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		_, _ = w.Write([]byte(`{"title":"go"}`))
+	}))
+	serve := func(header string) int {
+		logs.TakeAll()
+		r := httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(`{"title":"go"}`))
+		if header != "" {
+			r.Header.Set(FeatureOverridesHeader, header)
+		}
+		handler(httptest.NewRecorder(), r, nil)
+		return logs.FilterMessage("http: bodies").Len()
+	}
+	valid := SignFeatureOverrides("s3cr3t", FeatureOverrides{FeatureBodies: true}, clock.Now().Add(time.Minute))
+
+	assert.Equal(t, 1, serve(valid))
+	assert.Equal(t, 1, logs.FilterMessage("applied feature overrides").Len())
+	assert.Zero(t, serve(""), "overrides apply to their request only")
+
+	unsigned, _, _ := strings.Cut(valid, ".")
+	testCases := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"unsigned", unsigned, ErrInvalidOverrides},
+		{"tampered", strings.Replace(valid, "bodies=true", "cache=true", 1), ErrInvalidOverrides},
+		{"signed with another secret", SignFeatureOverrides("other", FeatureOverrides{FeatureBodies: true}, clock.Now().Add(time.Minute)), ErrInvalidOverrides},
+		{"expired", SignFeatureOverrides("s3cr3t", FeatureOverrides{FeatureBodies: true}, clock.Now()), ErrExpiredOverrides},
+		{"unknown feature", SignFeatureOverrides("s3cr3t", FeatureOverrides{"quota": false}, clock.Now().Add(time.Minute)), ErrInvalidOverrides},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Zero(t, serve(tc.header))
+			ignored := logs.FilterMessage("ignored feature overrides").All()
+			require.Len(t, ignored, 1)
+			assert.Equal(t, tc.err.Error(), ignored[0].ContextMap()["error"])
+		})
+	}
+
+	t.Run("enabled feature turned off", func(t *testing.T) {
+		api.bodies.Store(true)
+		defer api.bodies.Store(false)
+		assert.Equal(t, 1, serve(""))
+		assert.Zero(t, serve(SignFeatureOverrides("s3cr3t", FeatureOverrides{FeatureBodies: false}, clock.Now().Add(time.Minute))))
+	})
+}
+
+// TestCORSMiddleware ensures the cors headers are only set for the allowed origins and
+// the preflight requests are answered without reaching the handler.
+func TestCORSMiddleware(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      CORSConfig
+		method      string
+		origin      string
+		called      bool
+		code        int
+		allowOrigin string
+		credentials string
+		maxAge      string
+	}{
+		{"allowed origin", CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, http.MethodGet, "https://app.example.com", true, http.StatusOK, "https://app.example.com", "", ""},
+		{"allowed origin pattern", CORSConfig{AllowedOrigins: []string{"https://*.example.com"}}, http.MethodGet, "https://ui.example.com", true, http.StatusOK, "https://ui.example.com", "", ""},
+		{"disallowed origin", CORSConfig{AllowedOrigins: []string{"https://*.example.com"}}, http.MethodGet, "https://example.org", true, http.StatusOK, "", "", ""},
+		{"disallowed origin matching the pattern ends only", CORSConfig{AllowedOrigins: []string{"https://*.example.com"}}, http.MethodGet, "https://.example.com", true, http.StatusOK, "", "", ""},
+		{"no allowed origins", CORSConfig{}, http.MethodGet, "https://app.example.com", true, http.StatusOK, "", "", ""},
+		{"wildcard origin", CORSConfig{AllowedOrigins: []string{"*"}}, http.MethodGet, "https://app.example.com", true, http.StatusOK, "*", "", ""},
+		{"wildcard origin with credentials", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, http.MethodGet, "https://app.example.com", true, http.StatusOK, "*", "", ""},
+		{"allowed origin with credentials", CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, http.MethodGet, "https://app.example.com", true, http.StatusOK, "https://app.example.com", "true", ""},
+		{"allowed preflight", CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: 10 * time.Minute}, http.MethodOptions, "https://app.example.com", false, http.StatusNoContent, "https://app.example.com", "", "600"},
+		{"disallowed preflight", CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: 10 * time.Minute}, http.MethodOptions, "https://example.org", false, http.StatusNoContent, "", "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := NewAPIHandler(zap.NewNop(), &Config{CORS: tc.config}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+			var called bool
+			handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				called = true
+			}
+			r := httptest.NewRequest(tc.method, "/v1/books", nil)
+			r.Header.Set("Origin", tc.origin)
+			if tc.method == http.MethodOptions {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			api.CORSMiddleware(handler)(w, r, nil)
+
+			assert.Equal(t, tc.called, called)
+			assert.Equal(t, tc.code, w.Code)
+			assert.Equal(t, "Origin", w.Header().Get("Vary"))
+			assert.Equal(t, tc.allowOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tc.credentials, w.Header().Get("Access-Control-Allow-Credentials"))
+			assert.Equal(t, tc.maxAge, w.Header().Get("Access-Control-Max-Age"))
+			if tc.called && tc.allowOrigin != "" {
+				assert.Equal(t, RequestIDHeader, w.Header().Get("Access-Control-Expose-Headers"))
+			} else {
+				assert.Empty(t, w.Header().Get("Access-Control-Expose-Headers"))
+			}
+			if tc.maxAge != "" {
+				assert.Equal(t, strings.Join(DefaultCORSMethods, ", "), w.Header().Get("Access-Control-Allow-Methods"))
+				assert.Equal(t, strings.Join(DefaultCORSHeaders, ", "), w.Header().Get("Access-Control-Allow-Headers"))
+			} else {
+				assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+			}
+		})
+	}
+
+	t.Run("preflight through the router", func(t *testing.T) {
+		config := &Config{Server: ServerConfig{RequestTimeout: time.Second}, CORS: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedMethods: []string{"GET", "PUT"}}}
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+		public, ops := api.MiddlewaresStacks()
+		router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodOptions, "/v1/books/b:1", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+	})
+}
+
+// TestResponseSchemaMiddleware ensures the responses not matching their route schema are
+// logged in development only and sent untouched.
+func TestResponseSchemaMiddleware(t *testing.T) {
+	malformed := Book{ID: "b:1", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}, CreatedAt: "2023-07-02T00:00:00Z", UpdatedAt: "2023-07-02T00:00:00Z"}
+	valid := malformed
+	valid.Title, valid.Description = "title", "description"
+	testCases := []struct {
+		name       string
+		production bool
+		book       Book
+		violations []string
+	}{
+		{"malformed response in development", false, malformed, []string{"data.title: is empty", "data.description: is empty"}},
+		{"malformed response in production", true, malformed, nil},
+		{"valid response in development", false, valid, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			config := &Config{IsProduction: tc.production, Server: ServerConfig{RequestTimeout: time.Second}}
+			api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+			api.document(RouteDoc{Method: http.MethodGet, Path: "/v1/books/:id", Data: Book{}})
+			handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				require.NoError(t, WriteResponse(r.Context(), w, GenericResponse("abc", http.StatusOK, "Book found successfully.", nil, tc.book)))
+			}
+			public, _ := api.MiddlewaresStacks()
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			r := httptest.NewRequest(http.MethodGet, "/v1/books/b:1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn))
+			w := httptest.NewRecorder()
+			public.Chain(handler)(w, r, httprouter.Params{{Key: "id", Value: "b:1"}})
+
+			require.Equal(t, http.StatusOK, w.Code)
+			var book Book
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &APIResponse{Data: &book}))
+			assert.Equal(t, tc.book, book)
+			entries := logs.FilterMessage("schema: response does not match the route schema").All()
+			if tc.violations == nil {
+				assert.Empty(t, entries)
+				return
+			}
+			require.Len(t, entries, 1)
+			assert.Equal(t, zap.ErrorLevel, entries[0].Level)
+			assert.Equal(t, "GET /v1/books/:id", entries[0].ContextMap()["route"])
+			assert.ElementsMatch(t, tc.violations, entries[0].ContextMap()["violations"])
+		})
+	}
+
+	t.Run("status route served in development", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		config := &Config{Server: ServerConfig{RequestTimeout: time.Second}}
+		api := NewAPIHandler(zap.New(core), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+		public, ops := api.MiddlewaresStacks()
+		router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+		require.NoError(t, err)
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Zero(t, logs.FilterMessageSnippet("schema:").Len())
+	})
+}
+
+// TestResponseSchemaViolations ensures the JSON bodies are checked against the route schemas.
+func TestResponseSchemaViolations(t *testing.T) {
+	testCases := []struct {
+		name       string
+		body       string
+		route      RouteDoc
+		violations []string
+	}{
+		{"undeclared schema", `{"any":1}`, RouteDoc{}, nil},
+		{"valid response", `{"requestid":"abc","status":"ok","message":"running"}`, RouteDoc{Response: StatusResponse{}}, nil},
+		{"missing field", `{"requestid":"abc","status":"ok"}`, RouteDoc{Response: StatusResponse{}}, []string{"message: is missing"}},
+		{"wrong type", `{"requestid":"abc","status":200,"message":"running"}`, RouteDoc{Response: StatusResponse{}}, []string{"status: expected string but got number"}},
+		{"null list", `{"requestid":"abc","status":200,"message":"ok","data":null}`, RouteDoc{Data: []Book{}}, nil},
+		{"list item", `{"requestid":"abc","status":200,"message":"ok","data":[{"id":"b:1","title":"t","description":"d","author":"","price":null,"createdAt":"c","updatedAt":"u"}]}`, RouteDoc{Data: []Book{}}, []string{"data[0].author: is empty"}},
+		{"embedded book", `{"requestid":"abc","status":200,"message":"ok","data":[{"id":"b:1","title":"t","description":"d","author":"a","price":"10 USD","createdAt":"c","updatedAt":"u"}]}`, RouteDoc{Data: []BookViews{}}, []string{"data[0].views: is missing"}},
+		{"omitted optional fields", `{"requestid":"abc","status":200,"message":"ok","data":[{"index":0}]}`, RouteDoc{Data: []BulkItemResult{}}, nil},
+		{"not an object", `[]`, RouteDoc{Data: Book{}}, []string{"body: expected object but got array"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			violations, err := ResponseSchemaViolations([]byte(tc.body), tc.route)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tc.violations, violations)
+		})
+	}
+
+	_, err := ResponseSchemaViolations([]byte(`{"requestid"`), RouteDoc{Data: Book{}})
+	assert.Error(t, err)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -12,7 +14,9 @@ type MockBookStorage struct {
 	GetOneFunc    func(ctx context.Context, id string) (Book, error)
 	DeleteFunc    func(ctx context.Context, id string) error
 	UpdateFunc    func(ctx context.Context, id string, book Book) (Book, error)
-	GetAllFunc    func(ctx context.Context) ([]Book, error)
+	GetAllFunc    func(ctx context.Context, limit int64, cursor string) ([]Book, string, error)
+	CountFunc     func(ctx context.Context) (int, error)
+	SearchFunc    func(ctx context.Context, query string, fields []string) ([]Book, error)
 	DeleteAllFunc func(ctx context.Context) error
 }
 
@@ -36,9 +40,19 @@ func (m *MockBookStorage) Update(ctx context.Context, id string, book Book) (Boo
 	return m.UpdateFunc(ctx, id, book)
 }
 
-// GetAll mocks the behavior of retrieving all books by the repository.
-func (m *MockBookStorage) GetAll(ctx context.Context) ([]Book, error) {
-	return m.GetAllFunc(ctx)
+// GetAll mocks the behavior of retrieving a page of books by the repository.
+func (m *MockBookStorage) GetAll(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+	return m.GetAllFunc(ctx, limit, cursor)
+}
+
+// Count mocks the behavior of counting the books by the repository.
+func (m *MockBookStorage) Count(ctx context.Context) (int, error) {
+	return m.CountFunc(ctx)
+}
+
+// Search mocks the behavior of searching books by the repository.
+func (m *MockBookStorage) Search(ctx context.Context, query string, fields []string) ([]Book, error) {
+	return m.SearchFunc(ctx, query, fields)
 }
 
 // DeleteAll mocks the behavior of deleting all books by the repository.
@@ -93,6 +107,8 @@ func (muid *MockUIDHandler) IsValid(_, _ string) bool {
 type MockQueuer struct {
 	PushFunc func(ctx context.Context, qid string, book Book) error
 	PopFunc  func(ctx context.Context, qids ...string) (string, Book, error)
+	PeekFunc func(ctx context.Context, qid string, n int) ([]Book, error)
+	LenFunc  func(ctx context.Context, qid string) (int64, error)
 }
 
 // Push mocks the behavior of book enqueuing into the queue.
@@ -105,6 +121,16 @@ func (m *MockQueuer) Pop(ctx context.Context, qids ...string) (string, Book, err
 	return m.PopFunc(ctx, qids...)
 }
 
+// Peek mocks the behavior of reading the first books of the queue.
+func (m *MockQueuer) Peek(ctx context.Context, qid string, n int) ([]Book, error) {
+	return m.PeekFunc(ctx, qid, n)
+}
+
+// Len mocks the behavior of counting the books of the queue.
+func (m *MockQueuer) Len(ctx context.Context, qid string) (int64, error) {
+	return m.LenFunc(ctx, qid)
+}
+
 type MockConsumer struct {
 	ConsumeFunc func(ctx context.Context, qids ...string)
 }
@@ -112,3 +138,78 @@ type MockConsumer struct {
 func (m *MockConsumer) Consume(ctx context.Context, qids ...string) {
 	m.ConsumeFunc(ctx, qids...)
 }
+
+// MockQuotaStore implements an in-memory QuotaStore.
+type MockQuotaStore struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewMockQuotaStore() *MockQuotaStore {
+	return &MockQuotaStore{counts: make(map[string]int64)}
+}
+
+// Increment mocks the counter increment. Keys are scoped by window so expiry is ignored.
+func (m *MockQuotaStore) Increment(_ context.Context, key string, _ time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key]++
+	return m.counts[key], nil
+}
+
+// MockBookViewsStorage implements an in-memory BookStorage which counts books views.
+type MockBookViewsStorage struct {
+	MockBookStorage
+	mu    sync.Mutex
+	books map[string]Book
+	views map[string]int64
+}
+
+func NewMockBookViewsStorage(books ...Book) *MockBookViewsStorage {
+	m := &MockBookViewsStorage{books: make(map[string]Book), views: make(map[string]int64)}
+	for _, book := range books {
+		m.books[book.ID] = book
+	}
+	m.GetOneFunc = func(_ context.Context, id string) (Book, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		book, found := m.books[id]
+		if !found {
+			return Book{}, ErrBookNotFound
+		}
+		return book, nil
+	}
+	return m
+}
+
+// IncrViews mocks counting one view of a book.
+func (m *MockBookViewsStorage) IncrViews(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.views[id]++
+	return nil
+}
+
+// GetViews mocks retrieving the number of views of a book.
+func (m *MockBookViewsStorage) GetViews(_ context.Context, id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.views[id], nil
+}
+
+// TopViewed mocks ranking books by their number of views.
+func (m *MockBookViewsStorage) TopViewed(_ context.Context, limit int64) ([]BookViews, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	books := make([]BookViews, 0, len(m.views))
+	for id, views := range m.views {
+		if book, found := m.books[id]; found {
+			books = append(books, BookViews{Book: book, Views: views})
+		}
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Views > books[j].Views })
+	if int64(len(books)) > limit {
+		books = books[:limit]
+	}
+	return books, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -89,9 +90,9 @@ func TestBoltStore_GetOneBook_FoundBook(t *testing.T) {
 		Title:       "Bolt test book title",
 		Description: "Bolt test book desc",
 		Author:      "Jerome Amon",
-		Price:       "10$",
-		CreatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
-		UpdatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
+		Price:       Price{Amount: 1000, Currency: "USD"},
+		CreatedAt:   "2023-04-26T21:42:10.7604632Z",
+		UpdatedAt:   "2023-04-26T21:42:10.7604632Z",
 	}
 	err = bs.Add(context.TODO(), testBookID, b)
 	require.NoError(t, err)
@@ -141,9 +142,9 @@ func TestBoltStore_DeleteBook(t *testing.T) {
 		Title:       "Bolt test book title",
 		Description: "Bolt test book desc",
 		Author:      "Jerome Amon",
-		Price:       "10$",
-		CreatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
-		UpdatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
+		Price:       Price{Amount: 1000, Currency: "USD"},
+		CreatedAt:   "2023-04-26T21:42:10.7604632Z",
+		UpdatedAt:   "2023-04-26T21:42:10.7604632Z",
 	}
 	err = bs.Add(context.TODO(), testBookID, b)
 	require.NoError(t, err)
@@ -179,9 +180,101 @@ func TestBoltStore_GetAllBooks(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify books can be retrieved.
-	books, err := bs.GetAll(context.TODO())
+	books, next, err := bs.GetAll(context.TODO(), DefaultBooksPageLimit, "")
 	require.NoError(t, err)
 	assert.ElementsMatch(t, books, []Book{b0, b1})
+	assert.Empty(t, next)
+}
+
+// Ensure bolt store counts the books of its bucket only.
+func TestBoltStore_CountBooks(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+
+	for _, id := range []string{"b:0", "b:1", "b:2"} {
+		require.NoError(t, bs.Add(context.TODO(), id, Book{ID: id}))
+	}
+	_, err = bs.Trash(context.TODO(), "b:2", time.Now())
+	require.NoError(t, err)
+
+	n, err := bs.Count(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+// Ensure bolt store removes all the books of its bucket and keeps the trash.
+func TestBoltStore_DeleteAllBooks(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+
+	for _, id := range []string{"b:0", "b:1", "b:2"} {
+		require.NoError(t, bs.Add(context.TODO(), id, Book{ID: id}))
+	}
+	_, err = bs.Trash(context.TODO(), "b:2", time.Now())
+	require.NoError(t, err)
+
+	require.NoError(t, bs.DeleteAll(context.TODO()))
+
+	books, _, err := bs.GetAll(context.TODO(), 10, "")
+	require.NoError(t, err)
+	assert.Empty(t, books)
+	_, err = bs.GetOne(context.TODO(), "b:0")
+	assert.Equal(t, ErrBookNotFound, err)
+	trashed, err := bs.GetTrash(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, trashed, 1)
+
+	// the recreated bucket accepts new books.
+	require.NoError(t, bs.Add(context.TODO(), "b:3", Book{ID: "b:3"}))
+	n, err := bs.Count(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// Ensure bolt store lists books page by page and rejects unknown cursors.
+func TestBoltStore_GetAllBooks_Pagination(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("b:%d", i)
+		require.NoError(t, bs.Add(context.TODO(), id, Book{ID: id}))
+	}
+
+	ids := []string{}
+	cursor, pages := "", 0
+	for {
+		books, next, err := bs.GetAll(context.TODO(), 2, cursor)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(books), 2)
+		for _, book := range books {
+			ids = append(ids, book.ID)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []string{"b:0", "b:1", "b:2", "b:3", "b:4"}, ids)
+
+	for _, cursor := range []string{"%%%", EncodeCursor("redis", "12")} {
+		_, _, err = bs.GetAll(context.TODO(), 2, cursor)
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+	}
 }
 
 // Ensure bolt store can update an existing book details.
@@ -201,9 +294,9 @@ func TestBoltStore_UpdateBook_ExistingBook(t *testing.T) {
 		Title:       "Bolt test book title",
 		Description: "Bolt test book desc",
 		Author:      "Jerome Amon",
-		Price:       "10$",
-		CreatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
-		UpdatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
+		Price:       Price{Amount: 1000, Currency: "USD"},
+		CreatedAt:   "2023-04-26T21:42:10.7604632Z",
+		UpdatedAt:   "2023-04-26T21:42:10.7604632Z",
 	}
 	err = bs.Add(context.TODO(), testBookID, b)
 	require.NoError(t, err)
@@ -211,7 +304,7 @@ func TestBoltStore_UpdateBook_ExistingBook(t *testing.T) {
 	// Modify existing book details and update.
 	newBook := b
 	newBook.Title = "Bolt test book new title"
-	newBook.Price = "20$"
+	newBook.Price = Price{Amount: 2000, Currency: "USD"}
 	newBook.UpdatedAt = time.Now().UTC().String()
 	book, err := bs.Update(context.TODO(), testBookID, newBook)
 	require.NoError(t, err)
@@ -241,8 +334,8 @@ func TestBoltStore_UpdateBook_NotExistingBook(t *testing.T) {
 		Title:       "Bolt test book title",
 		Description: "Bolt test book desc",
 		Author:      "Jerome Amon",
-		Price:       "10$",
-		CreatedAt:   "2023-04-26 21:42:10.7604632 +0000 UTC",
+		Price:       Price{Amount: 1000, Currency: "USD"},
+		CreatedAt:   "2023-04-26T21:42:10.7604632Z",
 		UpdatedAt:   time.Now().UTC().String(),
 	}
 
@@ -256,3 +349,108 @@ func TestBoltStore_UpdateBook_NotExistingBook(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, b, book)
 }
+
+// Ensure bolt store searches books by title or author ignoring the case.
+func TestBoltStore_SearchBooks(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+
+	b0 := Book{ID: "b:0", Title: "Bolt internals", Author: "Ben"}
+	b1 := Book{ID: "b:1", Title: "Redis internals", Author: "Salvatore"}
+	require.NoError(t, bs.Add(context.TODO(), b0.ID, b0))
+	require.NoError(t, bs.Add(context.TODO(), b1.ID, b1))
+
+	books, err := bs.Search(context.TODO(), "internals", []string{BookFieldTitle})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Book{b0, b1}, books)
+
+	books, err = bs.Search(context.TODO(), "ben", []string{BookFieldAuthor})
+	require.NoError(t, err)
+	assert.Equal(t, []Book{b0}, books)
+
+	books, err = bs.Search(context.TODO(), "ben", []string{BookFieldTitle})
+	require.NoError(t, err)
+	assert.Empty(t, books)
+}
+
+// Ensure bolt store moves books to the trash bucket, restores
+// them and purges those trashed before the purge time.
+func TestBoltStore_Trash(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+	ctx := context.Background()
+	now := NewMockClocker().Now()
+	require.NoError(t, bs.Add(ctx, "b:1", Book{ID: "b:1"}))
+	require.NoError(t, bs.Add(ctx, "b:2", Book{ID: "b:2"}))
+
+	_, err = bs.Trash(ctx, "b:1", now)
+	require.NoError(t, err)
+	_, err = bs.GetOne(ctx, "b:1")
+	assert.Equal(t, ErrBookNotFound, err)
+	book, err := bs.Restore(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, Book{ID: "b:1"}, book)
+	_, err = bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+
+	_, err = bs.Trash(ctx, "b:1", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	_, err = bs.Trash(ctx, "b:2", now)
+	require.NoError(t, err)
+	purged, err := bs.PurgeTrash(ctx, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	books, err := bs.GetTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "b:2", books[0].ID)
+}
+
+// TestMigrateBookTimes ensures the books times stored with the legacy format are
+// rewritten as RFC3339 across pages, the others are left untouched and a new run
+// has nothing to migrate.
+func TestMigrateBookTimes(t *testing.T) {
+	bs, err := newTestBoltStore()
+	require.NoError(t, err, "failed in creating a test bolt store")
+	defer func() {
+		err = bs.closeTestBoltStore()
+		assert.NoError(t, err)
+	}()
+	ctx := context.Background()
+	for i := 0; i < migrationPageSize+2; i++ {
+		id := fmt.Sprintf("b:%04d", i)
+		book := Book{ID: id, Title: "title", CreatedAt: "2023-04-26 21:42:10.7604632 +0200 CEST", UpdatedAt: "2023-07-01 20:19:10 +0000 UTC m=+0.000123"}
+		if i%2 == 1 {
+			book.CreatedAt, book.UpdatedAt = "2023-04-26T19:42:10.7604632Z", "2023-07-01T20:19:10Z"
+		}
+		require.NoError(t, bs.Add(ctx, id, book))
+	}
+	require.NoError(t, bs.Add(ctx, "b:empty", Book{ID: "b:empty"}))
+
+	migrated, err := MigrateBookTimes(ctx, bs)
+	require.NoError(t, err)
+	assert.Equal(t, migrationPageSize/2+1, migrated)
+
+	book, err := bs.GetOne(ctx, "b:0000")
+	require.NoError(t, err)
+	assert.Equal(t, "2023-04-26T21:42:10.7604632+02:00", book.CreatedAt)
+	assert.Equal(t, "2023-07-01T20:19:10Z", book.UpdatedAt)
+	book, err = bs.GetOne(ctx, "b:0001")
+	require.NoError(t, err)
+	assert.Equal(t, "2023-04-26T19:42:10.7604632Z", book.CreatedAt)
+	book, err = bs.GetOne(ctx, "b:empty")
+	require.NoError(t, err)
+	assert.Empty(t, book.CreatedAt)
+
+	migrated, err = MigrateBookTimes(ctx, bs)
+	require.NoError(t, err)
+	assert.Zero(t, migrated)
+}
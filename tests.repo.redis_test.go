@@ -4,11 +4,16 @@ import (
 	"context"
 	"net"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/ory/dockertest/v3"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -64,20 +69,28 @@ func TestRedisBookStorageImplementsBookStorageInterface(t *testing.T) {
 	}
 }
 
+// Ensure concrete type redisKeysBookStorage satisfies BookStorage interface.
+func TestRedisKeysBookStorageImplementsBookStorageInterface(t *testing.T) {
+	var i interface{} = new(redisKeysBookStorage)
+	if _, ok := i.(BookStorage); !ok {
+		t.Fatalf("expected %T to implement BookStorage", i)
+	}
+}
+
 func TestRedisStore(t *testing.T) {
 	t.Skip("github actions failing to pull container. Failed to start redis: API error (500): Get https://registry-1.docker.io/v2/library/redis/manifests/sha256:0859ed47321d2d26a3f53bca47b76fb7970ea2512ca3a379926dc965880e442e: EOF")
 	addr, destroyFunc := startRedisDockerContainer(t)
 	defer destroyFunc()
-	rs := NewRedisBookStorage(zap.NewNop(), redis.NewClient(&redis.Options{Addr: addr}))
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), redis.NewClient(&redis.Options{Addr: addr}))
 	testBook0ID, testBook1ID := "b:0", "b:1"
 	testBook := Book{
 		ID:          testBook0ID,
 		Title:       "Redis test book title",
 		Description: "Redis test book desc",
 		Author:      "Jerome Amon",
-		Price:       "10$",
-		CreatedAt:   "2023-07-01 20:19:10.7604632 +0000 UTC",
-		UpdatedAt:   "2023-07-01 20:19:10.7604632 +0000 UTC",
+		Price:       Price{Amount: 1000, Currency: "USD"},
+		CreatedAt:   "2023-07-01T20:19:10.7604632Z",
+		UpdatedAt:   "2023-07-01T20:19:10.7604632Z",
 	}
 
 	t.Run("Add Book", func(t *testing.T) {
@@ -133,7 +146,7 @@ func TestRedisStore(t *testing.T) {
 
 	t.Run("Update Existent Book", func(t *testing.T) {
 		// ensures we can update an existent book record.
-		testBook.Price = "20$"
+		testBook.Price = Price{Amount: 2000, Currency: "USD"}
 		book, err := rs.Update(context.Background(), testBook0ID, testBook)
 		assert.NoError(t, err)
 		if !reflect.DeepEqual(testBook, book) {
@@ -148,8 +161,674 @@ func TestRedisStore(t *testing.T) {
 		// ensures we get exact number of stored books.
 		err := rs.Add(context.Background(), testBook1ID, testBook)
 		assert.NoError(t, err)
-		books, err := rs.GetAll(context.Background())
+		books, _, err := rs.GetAll(context.Background(), DefaultBooksPageLimit, "")
 		assert.NoError(t, err)
 		assert.Equal(t, 2, len(books))
 	})
 }
+
+// newMiniRedisClient provides a client connected to an in-memory redis server
+// which is closed at the end of the test.
+func newMiniRedisClient(t *testing.T) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// TestRedisStore_SlidingTTL ensures reading a cached book extends its expiry
+// while an unread book expires once its TTL elapsed.
+func TestRedisStore_SlidingTTL(t *testing.T) {
+	clock := NewMockClocker()
+	config := &RedisConfig{CacheTTL: time.Minute, SlidingTTL: true}
+	rs := NewRedisBookStorage(zap.NewNop(), config, clock, newMiniRedisClient(t))
+	ctx := context.Background()
+	require.NoError(t, rs.Add(ctx, "b:hot", Book{ID: "b:hot"}))
+	require.NoError(t, rs.Add(ctx, "b:cold", Book{ID: "b:cold"}))
+
+	for i := 0; i < 3; i++ {
+		clock.MockNow = clock.MockNow.Add(40 * time.Second)
+		_, err := rs.GetOne(ctx, "b:hot")
+		require.NoError(t, err, "read must extend the hot book expiry")
+	}
+
+	_, err := rs.GetOne(ctx, "b:cold")
+	assert.Equal(t, ErrBookNotFound, err)
+
+	t.Run("without sliding", func(t *testing.T) {
+		config.SlidingTTL = false
+		clock.MockNow = clock.MockNow.Add(40 * time.Second)
+		_, err := rs.GetOne(ctx, "b:hot")
+		require.NoError(t, err)
+		clock.MockNow = clock.MockNow.Add(40 * time.Second)
+		_, err = rs.GetOne(ctx, "b:hot")
+		assert.Equal(t, ErrBookNotFound, err)
+	})
+
+	t.Run("without ttl", func(t *testing.T) {
+		config.CacheTTL = 0
+		require.NoError(t, rs.Add(ctx, "b:forever", Book{ID: "b:forever"}))
+		clock.MockNow = clock.MockNow.Add(24 * time.Hour)
+		_, err := rs.GetOne(ctx, "b:forever")
+		assert.NoError(t, err)
+	})
+}
+
+// TestRedisStore_ExpiredEviction ensures the expired books are not listed nor found
+// and are removed from the books hash once met, while their views are kept.
+func TestRedisStore_ExpiredEviction(t *testing.T) {
+	clock := NewMockClocker()
+	client := newMiniRedisClient(t)
+	config := &RedisConfig{CacheTTL: time.Minute}
+	rs := NewRedisBookStorage(zap.NewNop(), config, clock, client)
+	ctx := context.Background()
+	require.NoError(t, rs.Add(ctx, "b:old", Book{ID: "b:old", Title: "go"}))
+	require.NoError(t, rs.(BookViewsCounter).IncrViews(ctx, "b:old"))
+	clock.MockNow = clock.MockNow.Add(30 * time.Second)
+	require.NoError(t, rs.Add(ctx, "b:new", Book{ID: "b:new", Title: "go"}))
+	clock.MockNow = clock.MockNow.Add(45 * time.Second)
+
+	books, err := rs.Search(ctx, "go", []string{BookFieldTitle})
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "b:new", books[0].ID)
+	n, err := client.HLen(ctx, HBooks).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n, "expired book must be evicted")
+
+	require.NoError(t, rs.Add(ctx, "b:old", Book{ID: "b:old", Title: "go"}))
+	clock.MockNow = clock.MockNow.Add(45 * time.Second)
+	books, _, err = rs.GetAll(ctx, 10, "")
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "b:old", books[0].ID)
+
+	clock.MockNow = clock.MockNow.Add(time.Minute)
+	_, err = rs.GetOne(ctx, "b:old")
+	assert.Equal(t, ErrBookNotFound, err)
+	n, err = client.HLen(ctx, HBooks).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = client.ZCard(ctx, ZBooksExpiry).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	views, err := rs.(BookViewsCounter).GetViews(ctx, "b:old")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), views)
+}
+
+// TestRedisStore_GetAllPagination ensures the last page has no next cursor
+// and cursors which do not wrap a redis scan cursor are rejected.
+func TestRedisStore_GetAllPagination(t *testing.T) {
+	rs := NewRedisBookStorage(zap.NewNop(), nil, NewMockClocker(), newMiniRedisClient(t))
+	ctx := context.Background()
+	for _, id := range []string{"b:0", "b:1", "b:2"} {
+		require.NoError(t, rs.Add(ctx, id, Book{ID: id}))
+	}
+
+	books, next, err := rs.GetAll(ctx, DefaultBooksPageLimit, "")
+	require.NoError(t, err)
+	assert.Len(t, books, 3)
+	assert.Empty(t, next)
+
+	for _, cursor := range []string{"not-a-cursor", EncodeCursor("bolt", "b:1"), EncodeCursor("redis", "abc")} {
+		_, _, err = rs.GetAll(ctx, DefaultBooksPageLimit, cursor)
+		assert.ErrorIs(t, err, ErrInvalidCursor, cursor)
+	}
+}
+
+// TestRedisStore_Count ensures the books are counted without the other hashes.
+func TestRedisStore_Count(t *testing.T) {
+	rs := NewRedisBookStorage(zap.NewNop(), nil, NewMockClocker(), newMiniRedisClient(t))
+	ctx := context.Background()
+	n, err := rs.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	for _, id := range []string{"b:0", "b:1", "b:2"} {
+		require.NoError(t, rs.Add(ctx, id, Book{ID: id}))
+	}
+	require.NoError(t, rs.(BookViewsCounter).IncrViews(ctx, "b:0"))
+	require.NoError(t, rs.Delete(ctx, "b:2"))
+	n, err = rs.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+// TestRedisStore_AddMany ensures books inserted in batch are retrievable.
+func TestRedisStore_AddMany(t *testing.T) {
+	rs := NewRedisBookStorage(zap.NewNop(), nil, NewMockClocker(), newMiniRedisClient(t)).(BookBulkAdder)
+	books := []Book{{ID: "b:0", Title: "zero"}, {ID: "b:1", Title: "one"}}
+	errs := rs.AddMany(context.Background(), books)
+	assert.Equal(t, []error{nil, nil}, errs)
+	for _, book := range books {
+		got, err := rs.(BookStorage).GetOne(context.Background(), book.ID)
+		require.NoError(t, err)
+		assert.Equal(t, book, got)
+	}
+}
+
+// TestRedisStore_Search ensures books are found by a case-insensitive substring.
+func TestRedisStore_Search(t *testing.T) {
+	rs := NewRedisBookStorage(zap.NewNop(), nil, NewMockClocker(), newMiniRedisClient(t))
+	ctx := context.Background()
+	b0 := Book{ID: "b:0", Title: "Mastering Redis", Author: "Jeremy"}
+	b1 := Book{ID: "b:1", Title: "Bolt basics", Author: "Ben"}
+	require.NoError(t, rs.Add(ctx, b0.ID, b0))
+	require.NoError(t, rs.Add(ctx, b1.ID, b1))
+
+	books, err := rs.Search(ctx, "redis", []string{BookFieldTitle, BookFieldAuthor})
+	require.NoError(t, err)
+	assert.Equal(t, []Book{b0}, books)
+}
+
+// TestRedisClient_SharedByStorageAndQueue ensures the storage and the queue are built on
+// the same client type, so a single client instance flows through the app wiring.
+func TestRedisClient_SharedByStorageAndQueue(t *testing.T) {
+	client := newMiniRedisClient(t)
+	storage, ok := NewRedisBookStorage(zap.NewNop(), nil, NewMockClocker(), client).(*redisBookStorage)
+	require.True(t, ok)
+	queue, ok := NewRedisQueue(client).(*redisQueue)
+	require.True(t, ok)
+	assert.Same(t, storage.client, queue.client)
+
+	require.NoError(t, queue.Push(context.Background(), CreateQueue, Book{ID: "b:1"}))
+	qid, book, err := queue.Pop(context.Background(), CreateQueue)
+	require.NoError(t, err)
+	assert.Equal(t, CreateQueue, qid)
+	assert.Equal(t, "b:1", book.ID)
+}
+
+// TestRedisStore_Trash ensures a trashed book is not served anymore until
+// restored and is permanently removed once trashed before the purge time.
+func TestRedisStore_Trash(t *testing.T) {
+	clock := NewMockClocker()
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t)).(*redisBookStorage)
+	ctx := context.Background()
+	require.NoError(t, rs.Add(ctx, "b:1", Book{ID: "b:1"}))
+	require.NoError(t, rs.Add(ctx, "b:2", Book{ID: "b:2"}))
+
+	book, err := rs.Trash(ctx, "b:1", clock.Now())
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().UTC().Format(time.RFC3339), book.DeletedAt)
+	_, err = rs.GetOne(ctx, "b:1")
+	assert.Equal(t, ErrBookNotFound, err)
+	_, err = rs.Trash(ctx, "b:1", clock.Now())
+	assert.Equal(t, ErrBookNotFound, err)
+	trashed, err := rs.InTrash(ctx, "b:1")
+	require.NoError(t, err)
+	assert.True(t, trashed)
+
+	book, err = rs.Restore(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, Book{ID: "b:1"}, book)
+	book, err = rs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, Book{ID: "b:1"}, book)
+	_, err = rs.Restore(ctx, "b:1")
+	assert.Equal(t, ErrBookNotFound, err)
+
+	_, err = rs.Trash(ctx, "b:1", clock.Now().Add(-2*time.Hour))
+	require.NoError(t, err)
+	_, err = rs.Trash(ctx, "b:2", clock.Now())
+	require.NoError(t, err)
+	purged, err := rs.PurgeTrash(ctx, clock.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	books, err := rs.GetTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "b:2", books[0].ID)
+}
+
+// TestRedisStore_TrashConcurrentWrites ensures the trashing and restoring of books
+// succeed while other books of the watched hashes are written concurrently.
+func TestRedisStore_TrashConcurrentWrites(t *testing.T) {
+	const books = 20
+	clock := NewMockClocker()
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t)).(*redisBookStorage)
+	ctx := context.Background()
+	for i := 0; i < books; i++ {
+		id := "b:" + strconv.Itoa(i)
+		require.NoError(t, rs.Add(ctx, id, Book{ID: id}))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < books; i++ {
+		wg.Add(2)
+		go func(id string) {
+			defer wg.Done()
+			_, err := rs.Trash(ctx, id, clock.Now())
+			if assert.NoError(t, err) {
+				_, err = rs.Restore(ctx, id)
+				assert.NoError(t, err)
+			}
+		}("b:" + strconv.Itoa(i))
+		go func(id string) {
+			defer wg.Done()
+			assert.NoError(t, rs.Add(ctx, id, Book{ID: id}))
+		}("b:other:" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	trashed, err := rs.GetTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+	n, err := rs.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2*books, n)
+}
+
+// TestRedisStore_History ensures the history holds the last versions of a book from
+// the oldest, follows the book when it is renamed and is removed along with the book
+// by the deletes, the catalog clearing and the trash purge, with both layouts.
+func TestRedisStore_History(t *testing.T) {
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), newMiniRedisClient(t)).(*redisBookStorage)
+	ctx := context.Background()
+	books, err := rs.GetHistory(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Empty(t, books)
+
+	for _, title := range []string{"v1", "v2", "v3"} {
+		require.NoError(t, rs.AppendHistory(ctx, "b:1", Book{ID: "b:1", Title: title}, 2))
+	}
+	books, err = rs.GetHistory(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, []Book{{ID: "b:1", Title: "v2"}, {ID: "b:1", Title: "v3"}}, books)
+
+	historyOf := func(t *testing.T, rh BookHistorian, id string) []Book {
+		t.Helper()
+		books, err := rh.GetHistory(ctx, id)
+		require.NoError(t, err)
+		return books
+	}
+	for _, layout := range []string{RedisLayoutHash, RedisLayoutKeys} {
+		t.Run(layout, func(t *testing.T) {
+			storage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: layout}, NewMockClocker(), newMiniRedisClient(t))
+			rh := storage.(BookHistorian)
+			for _, id := range []string{"b:1", "b:2", "b:3"} {
+				require.NoError(t, storage.Add(ctx, id, Book{ID: id}))
+				require.NoError(t, rh.AppendHistory(ctx, id, Book{ID: id, Title: "v1"}, 2))
+			}
+
+			require.NoError(t, storage.Delete(ctx, "b:1"))
+			assert.Empty(t, historyOf(t, rh, "b:1"), "deleted along with the book")
+			require.NoError(t, storage.(BookOutboxWriter).DeleteWithOutbox(ctx, "b:2"))
+			assert.Empty(t, historyOf(t, rh, "b:2"), "deleted along with the book and its outbox entry")
+			require.NoError(t, rh.AppendHistory(ctx, "b:4", Book{ID: "b:4", Title: "v1"}, 2))
+			require.NoError(t, storage.DeleteAll(ctx))
+			assert.Empty(t, historyOf(t, rh, "b:3"), "cleared along with the catalog")
+			assert.Empty(t, historyOf(t, rh, "b:4"), "cleared even without its book")
+		})
+	}
+
+	t.Run("rename and trash purge", func(t *testing.T) {
+		clock := NewMockClocker()
+		rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t)).(*redisBookStorage)
+		for _, id := range []string{"b:1", "b:2"} {
+			require.NoError(t, rs.Add(ctx, id, Book{ID: id}))
+			require.NoError(t, rs.AppendHistory(ctx, id, Book{ID: id, Title: "v1"}, 2))
+		}
+		require.NoError(t, rs.Rename(ctx, "b:1", Book{ID: "b:9"}))
+		assert.Empty(t, historyOf(t, rs, "b:1"))
+		assert.Equal(t, []Book{{ID: "b:1", Title: "v1"}}, historyOf(t, rs, "b:9"), "moved along with the book")
+
+		_, err := rs.Trash(ctx, "b:2", clock.Now())
+		require.NoError(t, err)
+		assert.NotEmpty(t, historyOf(t, rs, "b:2"), "kept while the book can be restored")
+		n, err := rs.PurgeTrash(ctx, clock.Now().Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Empty(t, historyOf(t, rs, "b:2"), "purged along with the book")
+	})
+}
+
+// TestRedisStore_PendingDeletes ensures only the given ids are looked up among the
+// scheduled deletes and the ones pending are returned.
+func TestRedisStore_PendingDeletes(t *testing.T) {
+	clock := NewMockClocker()
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t)).(*redisBookStorage)
+	ctx := context.Background()
+	for _, id := range []string{"b:1", "b:3"} {
+		require.NoError(t, rs.ScheduleDelete(ctx, id, clock.Now().Add(time.Minute), false))
+	}
+
+	pending, err := rs.PendingDeletes(ctx, "b:1", "b:2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b:1"}, pending)
+	pending, err = rs.PendingDeletes(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+// refillHook adds a book right before each count of the books left by DeleteAll, like
+// writes which keep coming while the catalog is cleared.
+type refillHook struct {
+	added int
+}
+
+func (rh *refillHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (rh *refillHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		switch cmd.Name() {
+		case "hlen", "scard":
+			rh.added++
+			id := "b:refill:" + strconv.Itoa(rh.added)
+			refill := redis.NewIntCmd(ctx, "hset", HBooks, id, "{}")
+			if cmd.Name() == "scard" {
+				refill = redis.NewIntCmd(ctx, "sadd", SBooksIndex, id)
+			}
+			if err := next(ctx, refill); err != nil {
+				return err
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (rh *refillHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// TestRedisStore_DeleteAllBoundedScans ensures the catalog clearing stops with an error
+// after a bounded number of scans when books keep being added, with both layouts.
+func TestRedisStore_DeleteAllBoundedScans(t *testing.T) {
+	for _, layout := range []string{RedisLayoutHash, RedisLayoutKeys} {
+		t.Run(layout, func(t *testing.T) {
+			client := newMiniRedisClient(t)
+			hook := &refillHook{}
+			client.AddHook(hook)
+			storage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: layout}, NewMockClocker(), client)
+			require.NoError(t, storage.Add(context.Background(), "b:1", Book{ID: "b:1"}))
+			err := storage.DeleteAll(context.Background())
+			require.Error(t, err)
+			assert.Equal(t, "redis: 1 books left after 5 scans", err.Error())
+			assert.Equal(t, deleteAllScans, hook.added)
+		})
+	}
+}
+
+// scanRecorder records the redis commands which read all the books of a hash.
+type scanRecorder struct {
+	commands []string
+	counts   []interface{}
+}
+
+func (sr *scanRecorder) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (sr *scanRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		switch args := cmd.Args(); cmd.Name() {
+		case "hscan":
+			sr.commands = append(sr.commands, "hscan")
+			sr.counts = append(sr.counts, args[len(args)-1])
+		case "hvals", "hgetall":
+			sr.commands = append(sr.commands, cmd.Name())
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (sr *scanRecorder) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// TestRedisStore_ScanBatches ensures all the books are returned when they are
+// read by batches of HSCAN with the configured count instead of a single HVALS.
+func TestRedisStore_ScanBatches(t *testing.T) {
+	clock := NewMockClocker()
+	client := newMiniRedisClient(t)
+	recorder := &scanRecorder{}
+	client.AddHook(recorder)
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{ScanCount: 10}, clock, client).(*redisBookStorage)
+	ctx := context.Background()
+	const total = 250
+	for i := 0; i < total; i++ {
+		id := "b:" + strconv.Itoa(i)
+		require.NoError(t, rs.Add(ctx, id, Book{ID: id, Title: "Scanned"}))
+	}
+
+	seen := make(map[string]struct{})
+	cursor := ""
+	for {
+		books, next, err := rs.GetAll(ctx, 20, cursor)
+		require.NoError(t, err)
+		for _, book := range books {
+			seen[book.ID] = struct{}{}
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	assert.Len(t, seen, total)
+
+	recorder.commands, recorder.counts = nil, nil
+	books, err := rs.Search(ctx, "scanned", []string{BookFieldTitle})
+	require.NoError(t, err)
+	assert.Len(t, books, min(total, MaxSearchResults))
+
+	for i := 0; i < total; i += 2 {
+		_, err = rs.Trash(ctx, "b:"+strconv.Itoa(i), clock.Now())
+		require.NoError(t, err)
+	}
+	books, err = rs.GetTrash(ctx)
+	require.NoError(t, err)
+	assert.Len(t, books, total/2)
+
+	assert.NotContains(t, recorder.commands, "hvals")
+	assert.NotContains(t, recorder.commands, "hgetall")
+	require.NotEmpty(t, recorder.counts)
+	for _, count := range recorder.counts {
+		assert.EqualValues(t, 10, count)
+	}
+}
+
+// TestRedisKeysStore ensures the books are stored under their own keys indexed by a set
+// with the keys layout and all the book storage operations work on them.
+func TestRedisKeysStore(t *testing.T) {
+	client := newMiniRedisClient(t)
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: RedisLayoutKeys, ScanCount: 2}, NewMockClocker(), client)
+	require.IsType(t, &redisKeysBookStorage{}, rs)
+	ctx := context.Background()
+	book := func(i int, title string) Book {
+		id := "b:" + strconv.Itoa(i)
+		return Book{ID: id, Title: title, Description: "description", Author: "author", Price: Price{Amount: 1000, Currency: "USD"}}
+	}
+
+	require.NoError(t, rs.Add(ctx, "b:1", book(1, "Redis in Action")))
+	stored, err := client.Get(ctx, BookKeyPrefix+"b:1").Result()
+	require.NoError(t, err)
+	assert.Contains(t, stored, "Redis in Action")
+	assert.Zero(t, client.Exists(ctx, HBooks).Val(), "books must not be stored into the hash")
+	assert.Equal(t, []string{"b:1"}, client.SMembers(ctx, SBooksIndex).Val())
+
+	got, err := rs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, book(1, "Redis in Action"), got)
+	_, err = rs.GetOne(ctx, "b:0")
+	assert.Equal(t, ErrBookNotFound, err)
+
+	updated, err := rs.Update(ctx, "b:1", book(1, "Redis in Practice"))
+	require.NoError(t, err)
+	got, err = rs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, updated, got)
+
+	for i := 2; i <= 7; i++ {
+		require.NoError(t, rs.Add(ctx, "b:"+strconv.Itoa(i), book(i, "Go "+strconv.Itoa(i))))
+	}
+	count, err := rs.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	found, err := rs.Search(ctx, "go", []string{"title"})
+	require.NoError(t, err)
+	assert.Len(t, found, 6)
+
+	assert.Equal(t, ErrBookNotFound, rs.Delete(ctx, "b:0"))
+	require.NoError(t, rs.Delete(ctx, "b:7"))
+	_, err = rs.GetOne(ctx, "b:7")
+	assert.Equal(t, ErrBookNotFound, err)
+	assert.False(t, client.SIsMember(ctx, SBooksIndex, "b:7").Val())
+
+	require.NoError(t, rs.DeleteAll(ctx))
+	count, err = rs.Count(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.Empty(t, client.Keys(ctx, BookKeyPrefix+"b:*").Val())
+}
+
+// TestRedisKeysStore_GetAll ensures the books are listed page by page through the index
+// set and read with MGET, and the expired books are skipped and unindexed.
+func TestRedisKeysStore_GetAll(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	recorder := &keysRecorder{}
+	client.AddHook(recorder)
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: RedisLayoutKeys, CacheTTL: time.Minute}, NewMockClocker(), client)
+	ctx := context.Background()
+	const total = 25
+	for i := 0; i < total; i++ {
+		id := "b:" + strconv.Itoa(i)
+		require.NoError(t, rs.Add(ctx, id, Book{ID: id, Title: "Listed"}))
+	}
+
+	seen := make(map[string]struct{})
+	cursor, pages := "", 0
+	for {
+		books, next, err := rs.GetAll(ctx, 10, cursor)
+		require.NoError(t, err)
+		pages++
+		for _, book := range books {
+			seen[book.ID] = struct{}{}
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	assert.Len(t, seen, total)
+	assert.Contains(t, recorder.commands, "sscan")
+	assert.Contains(t, recorder.commands, "mget")
+	assert.NotContains(t, recorder.commands, "hscan")
+
+	server.FastForward(30 * time.Second)
+	require.NoError(t, rs.Add(ctx, "b:fresh", Book{ID: "b:fresh", Title: "Fresh"}))
+	server.FastForward(45 * time.Second)
+	books, next, err := rs.GetAll(ctx, DefaultBooksPageLimit, "")
+	require.NoError(t, err)
+	assert.Empty(t, next)
+	assert.Equal(t, []Book{{ID: "b:fresh", Title: "Fresh"}}, books)
+	assert.Equal(t, []string{"b:fresh"}, client.SMembers(ctx, SBooksIndex).Val(), "expired books must be unindexed")
+
+	_, _, err = rs.GetAll(ctx, 10, "invalid")
+	assert.Error(t, err)
+}
+
+// TestRedisKeysStore_SlidingTTL ensures reading a book with the keys layout extends its
+// native expiry while an unread book expires once its TTL elapsed.
+func TestRedisKeysStore_SlidingTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: RedisLayoutKeys, CacheTTL: time.Minute, SlidingTTL: true}, NewMockClocker(), client)
+	ctx := context.Background()
+	require.NoError(t, rs.Add(ctx, "b:hot", Book{ID: "b:hot"}))
+	require.NoError(t, rs.Add(ctx, "b:cold", Book{ID: "b:cold"}))
+
+	for i := 0; i < 3; i++ {
+		server.FastForward(40 * time.Second)
+		_, err := rs.GetOne(ctx, "b:hot")
+		require.NoError(t, err)
+	}
+	_, err := rs.GetOne(ctx, "b:cold")
+	assert.Equal(t, ErrBookNotFound, err)
+}
+
+// TestRedisKeysStore_Extras ensures the views, the outbox writes and the bulk inserts
+// work with the keys layout.
+func TestRedisKeysStore_Extras(t *testing.T) {
+	client := newMiniRedisClient(t)
+	rs := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: RedisLayoutKeys}, NewMockClocker(), client).(*redisKeysBookStorage)
+	ctx := context.Background()
+
+	errs := rs.AddMany(ctx, []Book{{ID: "b:1", Title: "one"}, {ID: "b:2", Title: "two"}, {ID: "b:3", Title: "three"}})
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rs.IncrViews(ctx, "b:2"))
+	}
+	require.NoError(t, rs.IncrViews(ctx, "b:1"))
+	require.NoError(t, rs.IncrViews(ctx, "b:gone"))
+	top, err := rs.TopViewed(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []BookViews{{Book: Book{ID: "b:2", Title: "two"}, Views: 3}, {Book: Book{ID: "b:1", Title: "one"}, Views: 1}}, top)
+
+	require.NoError(t, rs.SetWithOutbox(ctx, CreateQueue, "b:4", Book{ID: "b:4", Title: "four"}))
+	require.NoError(t, rs.DeleteWithOutbox(ctx, "b:2"))
+	assert.Equal(t, ErrBookNotFound, rs.DeleteWithOutbox(ctx, "b:2"))
+	assert.Equal(t, int64(2), client.LLen(ctx, OutboxQueue).Val())
+	views, err := rs.GetViews(ctx, "b:2")
+	require.NoError(t, err)
+	assert.Zero(t, views)
+	assert.ElementsMatch(t, []string{"b:1", "b:3", "b:4"}, client.SMembers(ctx, SBooksIndex).Val())
+}
+
+// TestMigrateRedisLayout ensures the books are moved between the redis layouts both ways
+// along with their views counters.
+func TestMigrateRedisLayout(t *testing.T) {
+	client := newMiniRedisClient(t)
+	hash := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), client)
+	keys := NewRedisBookStorage(zap.NewNop(), &RedisConfig{Layout: RedisLayoutKeys}, NewMockClocker(), client)
+	ctx := context.Background()
+	const total = 1200
+	for i := 0; i < total; i++ {
+		id := "b:" + strconv.Itoa(i)
+		require.NoError(t, hash.Add(ctx, id, Book{ID: id, Title: "Moved"}))
+	}
+	require.NoError(t, hash.(BookViewsCounter).IncrViews(ctx, "b:7"))
+
+	moved, err := MigrateRedisLayout(ctx, hash, keys)
+	require.NoError(t, err)
+	assert.Equal(t, total, moved)
+	assert.Zero(t, client.HLen(ctx, HBooks).Val())
+	count, err := keys.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, total, count)
+	book, err := keys.GetOne(ctx, "b:7")
+	require.NoError(t, err)
+	assert.Equal(t, Book{ID: "b:7", Title: "Moved"}, book)
+	views, err := keys.(BookViewsCounter).GetViews(ctx, "b:7")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), views)
+
+	moved, err = MigrateRedisLayout(ctx, hash, keys)
+	require.NoError(t, err)
+	assert.Zero(t, moved, "the migration must be idempotent")
+
+	moved, err = MigrateRedisLayout(ctx, keys, hash)
+	require.NoError(t, err)
+	assert.Equal(t, total, moved)
+	assert.Zero(t, client.SCard(ctx, SBooksIndex).Val())
+	assert.Equal(t, int64(total), client.HLen(ctx, HBooks).Val())
+}
+
+// keysRecorder records the names of the redis commands run.
+type keysRecorder struct {
+	commands []string
+}
+
+func (kr *keysRecorder) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (kr *keysRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		kr.commands = append(kr.commands, cmd.Name())
+		return next(ctx, cmd)
+	}
+}
+
+func (kr *keysRecorder) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
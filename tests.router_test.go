@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,6 +39,16 @@ func TestSetupBookRoutes(t *testing.T) {
 			httptest.NewRequest(http.MethodPost, "/v1/books", nil),
 			true,
 		},
+		{
+			"bulk create books endpoint",
+			httptest.NewRequest(http.MethodPost, "/v1/books/bulk", nil),
+			true,
+		},
+		{
+			"import books endpoint",
+			httptest.NewRequest(http.MethodPost, "/v1/books/import", nil),
+			true,
+		},
 		{
 			"fetch all books endpoint",
 			httptest.NewRequest(http.MethodGet, "/v1/books", nil),
@@ -56,11 +69,36 @@ func TestSetupBookRoutes(t *testing.T) {
 			httptest.NewRequest(http.MethodPut, "/v1/books/b:cb8f2136-fae4-4200-85d9-3533c7f8c70d", nil),
 			true,
 		},
+		{
+			"patch book endpoint",
+			httptest.NewRequest(http.MethodPatch, "/v1/books/b:cb8f2136-fae4-4200-85d9-3533c7f8c70d", nil),
+			true,
+		},
 		{
 			"delete book endpoint",
 			httptest.NewRequest(http.MethodDelete, "/v1/books/b:cb8f2136-fae4-4200-85d9-3533c7f8c70d", nil),
 			true,
 		},
+		{
+			"delete all books endpoint",
+			httptest.NewRequest(http.MethodDelete, "/v1/books", nil),
+			true,
+		},
+		{
+			"trashed books endpoint",
+			httptest.NewRequest(http.MethodGet, "/v1/books/trash", nil),
+			true,
+		},
+		{
+			"restore book endpoint",
+			httptest.NewRequest(http.MethodPost, "/v1/books/b:cb8f2136-fae4-4200-85d9-3533c7f8c70d/restore", nil),
+			true,
+		},
+		{
+			"create book with id endpoint",
+			httptest.NewRequest(http.MethodPost, "/v1/books/b:cb8f2136-fae4-4200-85d9-3533c7f8c70d", nil),
+			false,
+		},
 		{
 			"invalid api endpoint",
 			httptest.NewRequest(http.MethodGet, "/v1", nil),
@@ -86,8 +124,8 @@ func TestSetupBookRoutes(t *testing.T) {
 		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) {
 			return Book{}, nil
 		},
-		GetAllFunc: func(ctx context.Context) ([]Book, error) {
-			return []Book{}, nil
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return []Book{}, "", nil
 		},
 	}
 	mockQueue := &MockQueuer{
@@ -98,10 +136,10 @@ func TestSetupBookRoutes(t *testing.T) {
 
 	bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), mockRepo, mockRepo, mockQueue)
 	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("", true), bs)
-	api.config.Server.LongRequestWriteTimeout = time.Second
+	api.Config().Server.LongRequestWriteTimeout = time.Second
 	router := httprouter.New()
 	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
-	api.SetupBookRoutes(router, m)
+	require.NoError(t, api.SetupBookRoutes(router, m))
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -165,7 +203,7 @@ func TestSetupOpsRoutes(t *testing.T) {
 	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, bs)
 	router := httprouter.New()
 	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
-	api.SetupOpsRoutes(router, m)
+	require.NoError(t, api.SetupOpsRoutes(router, m))
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -247,10 +285,12 @@ func TestSetupRoutes(t *testing.T) {
 			router := httprouter.New()
 			if tc.OpsEndpointsEnable {
 				config.OpsEndpointsEnable = true
-				api.SetupRoutes(router, m)
+				_, err := api.SetupRoutes(router, m)
+				require.NoError(t, err)
 			} else {
 				config.OpsEndpointsEnable = false
-				api.SetupRoutes(router, m)
+				_, err := api.SetupRoutes(router, m)
+				require.NoError(t, err)
 			}
 			w := httptest.NewRecorder()
 			router.ServeHTTP(w, tc.request)
@@ -263,12 +303,38 @@ func TestSetupRoutes(t *testing.T) {
 	}
 }
 
+// TestSetupRoutes_Duplicate ensures registering twice the same route reports a
+// descriptive error instead of panicking and does not document the route twice.
+func TestSetupRoutes_Duplicate(t *testing.T) {
+	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
+	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	router, err := api.SetupRoutes(httprouter.New(), m)
+	require.NoError(t, err)
+	registered := len(api.Routes())
+
+	var dupErr error
+	require.NotPanics(t, func() {
+		dupErr = api.register(router, RouteDoc{Method: http.MethodGet, Path: "/v1/books", Tag: "Books"}, api.GetAllBooks)
+	})
+	var routeErr *RouteError
+	require.ErrorAs(t, dupErr, &routeErr)
+	assert.Equal(t, http.MethodGet, routeErr.Method)
+	assert.Equal(t, "/v1/books", routeErr.Path)
+	assert.Contains(t, dupErr.Error(), "failed to register route GET /v1/books: a handle is already registered for path '/v1/books'")
+	assert.Len(t, api.Routes(), registered)
+
+	require.NotPanics(t, func() { dupErr = api.SetupBookRoutes(router, m) })
+	assert.ErrorContains(t, dupErr, "failed to register route POST /v1/books/:id")
+	assert.ErrorContains(t, dupErr, "failed to register route DELETE /v1/books/:id")
+}
+
 // TestSetupRoutes_NotFound ensures exact status code and json response body when a user requests an inexistant route.
 func TestSetupRoutes_NotFound(t *testing.T) {
 	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
 	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
 	router := httprouter.New()
-	api.SetupRoutes(router, m)
+	_, err := api.SetupRoutes(router, m)
+	require.NoError(t, err)
 	r := httptest.NewRequest(http.MethodGet, "/x/books/", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, r)
@@ -282,3 +348,368 @@ func TestSetupRoutes_NotFound(t *testing.T) {
 	expected := `{"requestid":"r:abc", "message":"route does not exist", "path":"GET /x/books/"}`
 	assert.JSONEq(t, expected, string(data))
 }
+
+// TestSetupRoutes_NotFoundNegotiation ensures browsers requesting an inexistant route get
+// an HTML page while the API clients keep the JSON body, as for the panic recovery.
+func TestSetupRoutes_NotFoundNegotiation(t *testing.T) {
+	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
+	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	pages, err := NewErrorPages("")
+	require.NoError(t, err)
+	api.SetErrorPages(pages)
+	router, err := api.SetupRoutes(httprouter.New(), m)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		accept string
+		html   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/html", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+		{"application/json, text/html;q=0.5", false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/x/books/", nil)
+		r.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code, tc.accept)
+		if tc.html {
+			assert.Equal(t, "text/html; charset=UTF-8", w.Header().Get("Content-Type"), tc.accept)
+			assert.Contains(t, w.Body.String(), "<h1>404 Not Found</h1>")
+			assert.Contains(t, w.Body.String(), "<code>GET /x/books/</code>")
+			assert.Contains(t, w.Body.String(), "request id: r:abc")
+			continue
+		}
+		assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"), tc.accept)
+		assert.JSONEq(t, `{"requestid":"r:abc", "message":"route does not exist", "path":"GET /x/books/"}`, w.Body.String())
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		handle := api.PanicRecoveryMiddleware(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			panic("boom")
+		})
+		r := httptest.NewRequest(http.MethodGet, "/v1/books", nil)
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		handle(w, r, nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "<h1>500 Internal Server Error</h1>")
+
+		r.Header.Del("Accept")
+		w = httptest.NewRecorder()
+		handle(w, r, nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	})
+}
+
+// TestSetupRoutes_OpenAPISpec ensures the served OpenAPI document reflects the registered book routes.
+func TestSetupRoutes_OpenAPISpec(t *testing.T) {
+	m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
+	config := &Config{OpenAPIEndpointEnable: true}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+	router, err := api.SetupRoutes(httprouter.New(), m)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs/openapi.json", nil))
+
+	res := w.Result()
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&spec))
+	assert.Equal(t, OpenAPIVersion, spec.OpenAPI)
+
+	expected := map[string][]string{
+		"/v1/books":      {"delete", "get", "post"},
+		"/v1/books/{id}": {"delete", "get", "patch", "put"},
+	}
+	for path, methods := range expected {
+		item, ok := spec.Paths[path]
+		require.True(t, ok, "missing path %s", path)
+		var got []string
+		for method := range item {
+			got = append(got, method)
+		}
+		assert.ElementsMatch(t, methods, got, "methods of path %s", path)
+	}
+	_, ok := spec.Paths["/ops/configs"]
+	assert.False(t, ok, "ops routes must not be documented when disabled")
+}
+
+// TestSetupRoutes_ProfilerIndex ensures the pprof index page is served through
+// the ops routes only when the profiler endpoints are enabled.
+func TestSetupRoutes_ProfilerIndex(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		config := &Config{OpsEndpointsEnable: true, ProfilerEndpointsEnable: enabled}
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+		m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
+		router, err := api.SetupRoutes(httprouter.New(), m)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ops/debug/pprof/", nil))
+		if enabled {
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), "heap")
+		} else {
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+// TestSetupRoutes_Swagger ensures the swagger spec documents the book endpoints and
+// is served along with its UI only when the ops endpoints are enabled.
+func TestSetupRoutes_Swagger(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		config := &Config{OpsEndpointsEnable: enabled}
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), NewMockUIDHandler("abc", true), nil)
+		m := &MiddlewareMap{public: (&Middlewares{}).Chain, ops: (&Middlewares{}).Chain}
+		router, err := api.SetupRoutes(httprouter.New(), m)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/swagger/index.html", nil))
+		if !enabled {
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			continue
+		}
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/swagger/doc.json", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var spec struct {
+			Paths map[string]map[string]interface{} `json:"paths"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+		expected := map[string][]string{
+			"/books":      {"get", "post"},
+			"/books/{id}": {"delete", "get", "put"},
+		}
+		for path, methods := range expected {
+			var got []string
+			for method := range spec.Paths[path] {
+				got = append(got, method)
+			}
+			assert.ElementsMatch(t, methods, got, "methods of path %s", path)
+		}
+	}
+}
+
+// TestRoute ensures the requests are mapped to the route serving them.
+func TestRoute(t *testing.T) {
+	api := NewAPIHandler(zap.NewNop(), &Config{}, &Statistics{started: NewMockClocker().Now()}, NewMockClocker(), nil, nil)
+	public, ops := api.MiddlewaresStacks()
+	_, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	testCases := []struct {
+		method string
+		path   string
+		route  string
+		found  bool
+	}{
+		{http.MethodGet, "/v1/books", "/v1/books", true},
+		{http.MethodGet, "/v1/books/count", "/v1/books/count", true},
+		{http.MethodGet, "/v1/books/b:1", "/v1/books/:id", true},
+		{http.MethodGet, "/v1/books/b:1/history", "/v1/books/:id/history", true},
+		{http.MethodPost, "/v1/books/import", "/v1/books/import", true},
+		{http.MethodGet, "/v1/books/", "", false},
+		{http.MethodGet, "/v1/unknown", "", false},
+		{http.MethodPatch, "/v1/books", "", false},
+	}
+	for _, tc := range testCases {
+		route, found := api.Route(tc.method, tc.path)
+		assert.Equal(t, tc.found, found, tc.path)
+		assert.Equal(t, tc.route, route.Path, tc.path)
+	}
+}
+
+// TestSetupRoutes_Preflight ensures the OPTIONS requests are answered with the cors headers
+// without reaching the book handlers or the maintenance mode, and are never redirected.
+func TestSetupRoutes_Preflight(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: time.Second}, CORS: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}}
+	clock := NewMockClocker()
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	api.mode.Enable("upgrade", clock.Now())
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	serve := func(method, target, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+			r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		return w
+	}
+
+	w := serve(http.MethodOptions, "/v1/books/b:1", "https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPut)
+	assert.Contains(t, w.Header().Get("Allow"), http.MethodPut)
+	assert.Empty(t, w.Body.String())
+
+	w = serve(http.MethodOptions, "/v1/books", "https://example.org")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = serve(http.MethodOptions, "/v1/books", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Contains(t, w.Header().Get("Allow"), http.MethodPost)
+
+	w = serve(http.MethodOptions, "/v1/books/", "https://app.example.com")
+	assert.Empty(t, w.Header().Get("Location"), "preflight requests must not be redirected")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/v1/books", "").Code)
+}
+
+// TestSetupRoutes_RequestIDHeader ensures the responses which are not built by the book
+// handlers, like the unknown routes, the disallowed methods or the profiles, carry the
+// request id into their headers.
+func TestSetupRoutes_RequestIDHeader(t *testing.T) {
+	config := &Config{Server: ServerConfig{RequestTimeout: time.Second}, OpsEndpointsEnable: true, ProfilerEndpointsEnable: true}
+	clock := NewMockClocker()
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		return w
+	}
+
+	w := serve(http.MethodGet, "/v1/unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+	assert.Contains(t, w.Body.String(), w.Header().Get(RequestIDHeader))
+
+	w = serve(http.MethodTrace, "/v1/books")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+	assert.Contains(t, w.Header().Get("Allow"), http.MethodGet)
+	assert.Contains(t, w.Body.String(), w.Header().Get(RequestIDHeader))
+
+	w = serve(http.MethodGet, "/ops/debug/pprof/cmdline")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+}
+
+// TestSetupRoutes_AdminUI ensures the ops admin page is served as HTML once enabled, even
+// without token when the ops authentication is enabled, and is not found while disabled.
+func TestSetupRoutes_AdminUI(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	serve := func(config *Config, token string, paths ...string) *httptest.ResponseRecorder {
+		clock := NewMockClocker()
+		api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+		public, ops := api.MiddlewaresStacks()
+		router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+		require.NoError(t, err)
+		path := "/ops/ui"
+		if len(paths) != 0 {
+			path = paths[0]
+		}
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		return w
+	}
+	enabled := func() *Config {
+		return &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}, Ops: OpsConfig{UI: UIConfig{Enable: true}}}
+	}
+
+	assert.Equal(t, http.StatusNotFound, serve(&Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}}, "").Code)
+	if AdminUI() == nil {
+		assert.Equal(t, http.StatusNotFound, serve(enabled(), "").Code, "minimal builds must not serve the admin page")
+		return
+	}
+
+	w := serve(enabled(), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<!DOCTYPE html>")
+	assert.Contains(t, w.Body.String(), "/ops/stats")
+
+	// the page loads without token while the endpoints it calls still require one.
+	guarded := enabled()
+	guarded.Auth = AuthConfig{Enable: true, Secret: "secret"}
+	w = serve(guarded, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, RequestIDPrefix+":abc", w.Header().Get(RequestIDHeader))
+	assert.Equal(t, http.StatusUnauthorized, serve(guarded, "", "/ops/stats").Code)
+}
+
+// TestSetupRoutes_DeleteAllBooksAuth ensures the catalog clearing is served behind the
+// ops authentication so it cannot be reached without a valid token.
+func TestSetupRoutes_DeleteAllBooksAuth(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	clock := NewMockClocker()
+	config := &Config{Server: ServerConfig{RequestTimeout: time.Second}, Auth: AuthConfig{Enable: true, Secret: "secret"}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	serve := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/books", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code)
+	token, err := GenerateToken("secret", "ops", clock.Now(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, serve(token).Code, "the confirmation is still required")
+}
+
+// TestSetupRoutes_ReplaceBooksAuth ensures the import replacing all the books is only
+// served behind the ops authentication and is refused on the public import.
+func TestSetupRoutes_ReplaceBooksAuth(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	clock := NewMockClocker()
+	config := &Config{OpsEndpointsEnable: true, Server: ServerConfig{RequestTimeout: time.Second}, Auth: AuthConfig{Enable: true, Secret: "secret"}}
+	api := NewAPIHandler(zap.NewNop(), config, &Statistics{started: clock.Now()}, clock, NewMockUIDHandler("abc", true), nil)
+	public, ops := api.MiddlewaresStacks()
+	router, err := api.SetupRoutes(httprouter.New(), &MiddlewareMap{public: public.Chain, ops: ops.Chain})
+	require.NoError(t, err)
+	serve := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"title":"Only"}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ConnContextKey, conn)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("/v1/books/import?mode=replace").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("/ops/books/import").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("/ops/books/other").Code)
+}
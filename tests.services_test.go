@@ -0,0 +1,1087 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestBookService_GetAll ensures the primary storage is queried only
+// when fetching all books from the backup storage failed.
+func TestBookService_GetAll(t *testing.T) {
+	primaryBooks := []Book{{ID: "b:1"}}
+	testCases := []struct {
+		name          string
+		backupBooks   []Book
+		backupErr     error
+		expected      []Book
+		primaryCalled bool
+	}{
+		{"empty backup without error", nil, nil, []Book{}, false},
+		{"backup with books", []Book{{ID: "b:2"}}, nil, []Book{{ID: "b:2"}}, false},
+		{"backup error", nil, errors.New("bolt: failure"), primaryBooks, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryCalled := false
+			pstorage := &MockBookStorage{
+				GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+					primaryCalled = true
+					return primaryBooks, "", nil
+				},
+			}
+			bstorage := &MockBookStorage{
+				GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+					return tc.backupBooks, "", tc.backupErr
+				},
+			}
+			bs := NewBookService(zap.NewNop(), nil, NewMockClocker(), pstorage, bstorage, nil)
+			books, _, err := bs.GetAll(context.Background(), DefaultBooksPageLimit, "", DefaultBookSort)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, books)
+			assert.Equal(t, tc.primaryCalled, primaryCalled)
+		})
+	}
+}
+
+// TestBookService_Cache ensures cached books are served without storage
+// calls, invalidated on update and delete, and expire after their TTL.
+func TestBookService_Cache(t *testing.T) {
+	calls := 0
+	pstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			calls++
+			return Book{ID: id, Title: "title"}, nil
+		},
+		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) {
+			return book, nil
+		},
+		DeleteFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	clock := NewMockClocker()
+	config := &Config{Cache: CacheConfig{Enable: true, Size: 2, TTL: time.Minute}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, nil, queue)
+	ctx := context.Background()
+
+	_, err := bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	book, err := bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, "title", book.Title)
+	assert.Equal(t, 1, calls, "cache hit must avoid the storage call")
+
+	_, err = bs.Update(ctx, "b:1", Book{ID: "b:1", Title: "new"})
+	require.NoError(t, err)
+	_, err = bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls, "update must invalidate the cached book")
+
+	require.NoError(t, bs.Delete(ctx, "b:1"))
+	_, err = bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls, "delete must invalidate the cached book")
+
+	clock.MockNow = clock.MockNow.Add(time.Minute)
+	_, err = bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, 4, calls, "expired book must be fetched again")
+}
+
+// TestBookCache_Eviction ensures the least recently used book is evicted when full.
+func TestBookCache_Eviction(t *testing.T) {
+	cache := NewBookCache(NewMockClocker(), 2, time.Minute)
+	cache.Put("b:1", Book{ID: "b:1"})
+	cache.Put("b:2", Book{ID: "b:2"})
+	_, found := cache.Get("b:1")
+	require.True(t, found)
+	cache.Put("b:3", Book{ID: "b:3"})
+
+	assert.Equal(t, 2, cache.Len())
+	_, found = cache.Get("b:2")
+	assert.False(t, found)
+	_, found = cache.Get("b:1")
+	assert.True(t, found)
+	_, found = cache.Get("b:3")
+	assert.True(t, found)
+}
+
+// TestBookService_CacheFill ensures books found only into backup storage are returned
+// without waiting on their re-caching and that concurrent re-caching is bounded.
+func TestBookService_CacheFill(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	added := 0
+	pstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return Book{}, ErrBookNotFound
+		},
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			mu.Lock()
+			added++
+			mu.Unlock()
+			<-release
+			return nil
+		},
+	}
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return Book{ID: id}, nil
+		},
+	}
+	config := &Config{Cache: CacheConfig{FillConcurrency: 2}}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), pstorage, bstorage, nil)
+
+	for i := 0; i < 5; i++ {
+		id := "b:" + strconv.Itoa(i)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			book, err := bs.GetOne(context.Background(), id)
+			assert.NoError(t, err)
+			assert.Equal(t, id, book.ID)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("response waited on the cache fill")
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return added == 2
+	}, time.Second, 5*time.Millisecond)
+	close(release)
+}
+
+// TestBookService_NegativeCache ensures a second lookup of a missing book is
+// answered from its redis tombstone without reaching the backup storage, and
+// that creating the book clears the tombstone.
+func TestBookService_NegativeCache(t *testing.T) {
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	backupCalls := 0
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			backupCalls++
+			return Book{}, ErrBookNotFound
+		},
+	}
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	config := &Config{Cache: CacheConfig{NegativeTTL: time.Minute}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	ctx := context.Background()
+
+	_, err := bs.GetOne(ctx, "b:1")
+	assert.Equal(t, ErrBookNotFound, err)
+	assert.Equal(t, 1, backupCalls)
+
+	_, err = bs.GetOne(ctx, "b:1")
+	assert.Equal(t, ErrBookNotFound, err)
+	assert.Equal(t, 1, backupCalls, "tombstoned book must not reach the backup storage")
+
+	require.NoError(t, bs.Add(ctx, "b:1", Book{ID: "b:1"}))
+	absent, err := pstorage.(BookTombstoner).HasTombstone(ctx, "b:1")
+	require.NoError(t, err)
+	assert.False(t, absent, "creating the book must clear its tombstone")
+	book, err := bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", book.ID)
+
+	t.Run("disabled", func(t *testing.T) {
+		backupCalls = 0
+		bs := NewBookService(zap.NewNop(), &Config{}, clock, pstorage, bstorage, queue)
+		for i := 0; i < 2; i++ {
+			_, err := bs.GetOne(ctx, "b:2")
+			assert.Equal(t, ErrBookNotFound, err)
+		}
+		assert.Equal(t, 2, backupCalls)
+	})
+}
+
+// TestBookService_Outbox ensures a book written into redis reaches the backup
+// consumer through the outbox relay even if the app crashed right after the
+// primary write, before anything was pushed to the queue.
+func TestBookService_Outbox(t *testing.T) {
+	client := newMiniRedisClient(t)
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, client)
+	crashed := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			t.Fatal("book must not be pushed directly to the queue")
+			return nil
+		},
+	}
+	config := &Config{Outbox: OutboxConfig{Enable: true, Interval: time.Second}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, &MockBookStorage{}, crashed)
+	ctx := context.Background()
+	require.NoError(t, bs.Add(ctx, "b:1", Book{ID: "b:1", Title: "Outbox"}))
+	require.NoError(t, bs.Delete(ctx, "b:1"))
+	assert.Equal(t, ErrBookNotFound, bs.Delete(ctx, "b:1"))
+
+	// restarted app: the relay and the consumer share the redis queue.
+	queue := NewRedisQueue(client)
+	relayed, err := NewOutboxRelay(zap.NewNop(), client, queue, time.Second).Relay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, relayed)
+	assert.Zero(t, client.LLen(ctx, OutboxQueue).Val())
+
+	var applied []string
+	repo := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			applied = append(applied, CreateQueue+":"+book.Title)
+			return nil
+		},
+		DeleteFunc: func(ctx context.Context, id string) error {
+			applied = append(applied, DeleteQueue+":"+id)
+			return nil
+		},
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pops := 0
+	consumerQueue := &MockQueuer{
+		PopFunc: func(ctx context.Context, qids ...string) (string, Book, error) {
+			qid, book, err := queue.Pop(ctx, qids...)
+			if pops++; pops == 2 {
+				cancel()
+			}
+			return qid, book, err
+		},
+	}
+	require.NoError(t, NewBoltDBConsumer(zap.NewNop(), consumerQueue, repo).Consume(cctx, CreateQueue, UpdateQueue, DeleteQueue))
+	assert.Equal(t, []string{CreateQueue + ":Outbox", DeleteQueue + ":b:1"}, applied)
+}
+
+// TestBookService_GetAllOrdering ensures books are listed in the same order
+// whether the page is served by boltdb or by redis as fallback.
+func TestBookService_GetAllOrdering(t *testing.T) {
+	bolt, err := newTestBoltStore()
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, bolt.closeTestBoltStore())
+	}()
+	clock := NewMockClocker()
+	redis := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	ctx := context.Background()
+	for _, id := range []string{"b:7", "b:2", "b:9", "b:0", "b:5", "b:3"} {
+		require.NoError(t, bolt.Add(ctx, id, Book{ID: id}))
+		require.NoError(t, redis.Add(ctx, id, Book{ID: id}))
+	}
+	failing := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return nil, "", errors.New("bolt: failure")
+		},
+	}
+
+	fromBolt, _, err := NewBookService(zap.NewNop(), nil, clock, redis, bolt, nil).GetAll(ctx, DefaultBooksPageLimit, "", DefaultBookSort)
+	require.NoError(t, err)
+	fromRedis, _, err := NewBookService(zap.NewNop(), nil, clock, redis, failing, nil).GetAll(ctx, DefaultBooksPageLimit, "", DefaultBookSort)
+	require.NoError(t, err)
+	assert.Equal(t, []Book{{ID: "b:0"}, {ID: "b:2"}, {ID: "b:3"}, {ID: "b:5"}, {ID: "b:7"}, {ID: "b:9"}}, fromBolt)
+	assert.Equal(t, fromBolt, fromRedis)
+}
+
+// TestBookService_GetAllSorted ensures the first limit books of the whole catalog are
+// returned in order, ties included, whatever their page, and only among the filtered ones.
+func TestBookService_GetAllSorted(t *testing.T) {
+	var all []Book
+	pages := map[string][]Book{}
+	cursors := []string{"", "p2", "p3"}
+	for i := 0; i < 30; i++ {
+		book := Book{ID: "b:" + strconv.Itoa(i), Title: "title " + strconv.Itoa((i*7)%10), Price: Price{Amount: int64((i * 13) % 17), Currency: "USD"}}
+		all = append(all, book)
+		cursor := cursors[i%len(cursors)]
+		pages[cursor] = append(pages[cursor], book)
+	}
+	next := map[string]string{"": "p2", "p2": "p3", "p3": ""}
+	repo := &MockBookStorage{
+		GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			return append([]Book{}, pages[cursor]...), next[cursor], nil
+		},
+	}
+	bs := NewBookService(zap.NewNop(), &Config{}, NewMockClocker(), repo, repo, nil)
+	cheap := func(books []Book) []Book {
+		max := 0.1
+		return FilterBooksByPrice(books, nil, &max)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sorting BookSort
+		limit   int64
+		filter  func([]Book) []Book
+	}{
+		{"title", BookSort{Field: BookFieldTitle}, 5, nil},
+		{"title descending", BookSort{Field: BookFieldTitle, Desc: true}, 7, nil},
+		{"price filtered", BookSort{Field: BookFieldPrice}, 4, cheap},
+		{"beyond the catalog", BookSort{Field: BookFieldPrice, Desc: true}, 100, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expected := append([]Book{}, all...)
+			if tc.filter != nil {
+				expected = tc.filter(expected)
+			}
+			SortBooks(expected, tc.sorting)
+			expected = expected[:min(int(tc.limit), len(expected))]
+			books, err := bs.GetAllSorted(context.Background(), tc.sorting, tc.limit, tc.filter)
+			require.NoError(t, err)
+			assert.Equal(t, expected, books)
+		})
+	}
+}
+
+// TestBookService_UpdateKeepsCreatedAt ensures the stored creation time is kept
+// whatever the client sent, while a new book is inserted with the provided one.
+func TestBookService_UpdateKeepsCreatedAt(t *testing.T) {
+	client := newMiniRedisClient(t)
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, client)
+	var pushed []Book
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error {
+		pushed = append(pushed, book)
+		return nil
+	}}
+	bs := NewBookService(zap.NewNop(), nil, clock, pstorage, pstorage, queue)
+	ctx := context.Background()
+	createdAt := "2023-07-01T00:00:00Z"
+	require.NoError(t, pstorage.Add(ctx, "b:1", Book{ID: "b:1", Title: "title", CreatedAt: createdAt}))
+
+	book, err := bs.Update(ctx, "b:1", Book{ID: "b:1", Title: "new", CreatedAt: "1999-01-01T00:00:00Z"})
+	require.NoError(t, err)
+	assert.Equal(t, createdAt, book.CreatedAt)
+	stored, err := pstorage.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	assert.Equal(t, createdAt, stored.CreatedAt)
+	assert.Equal(t, "new", stored.Title)
+	require.Len(t, pushed, 1)
+	assert.Equal(t, createdAt, pushed[0].CreatedAt)
+
+	book, err = bs.Update(ctx, "b:2", Book{ID: "b:2", Title: "inserted", CreatedAt: createdAt})
+	require.NoError(t, err)
+	assert.Equal(t, createdAt, book.CreatedAt)
+
+	require.NoError(t, pstorage.Add(ctx, "b:3", Book{ID: "b:3", Title: "legacy", CreatedAt: "2023-07-01 00:00:00 +0000 UTC"}))
+	book, err = bs.Update(ctx, "b:3", Book{ID: "b:3", Title: "new", CreatedAt: createdAt})
+	require.NoError(t, err)
+	assert.Equal(t, createdAt, book.CreatedAt)
+}
+
+// TestBookService_GetOneLegacyTimes ensures the books stored with the legacy
+// times format are served with RFC3339 times from both storages.
+func TestBookService_GetOneLegacyTimes(t *testing.T) {
+	legacy := Book{ID: "b:1", CreatedAt: "2023-07-01 10:00:00 +0200 CEST", UpdatedAt: "2023-07-02 00:00:00 +0000 UTC m=+0.5"}
+	testCases := []struct {
+		name       string
+		primaryErr error
+	}{
+		{"from primary storage", nil},
+		{"from backup storage", ErrBookNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pstorage := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) { return legacy, tc.primaryErr },
+				AddFunc:    func(ctx context.Context, id string, book Book) error { return nil },
+			}
+			bstorage := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) { return legacy, nil },
+			}
+			bs := NewBookService(zap.NewNop(), &Config{}, NewMockClocker(), pstorage, bstorage, nil)
+			book, err := bs.GetOne(context.Background(), "b:1")
+			require.NoError(t, err)
+			assert.Equal(t, "2023-07-01T10:00:00+02:00", book.CreatedAt)
+			assert.Equal(t, "2023-07-02T00:00:00Z", book.UpdatedAt)
+			created, err := book.CreatedTime()
+			require.NoError(t, err)
+			assert.True(t, created.Equal(time.Date(2023, 7, 1, 8, 0, 0, 0, time.UTC)))
+		})
+	}
+}
+
+// pushCounter counts the redis round-trips of the pushes to the queues.
+type pushCounter struct {
+	pushes    int
+	pipelines int
+}
+
+func (pc *pushCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (pc *pushCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "rpush" {
+			pc.pushes++
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (pc *pushCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		pc.pipelines++
+		return next(ctx, cmds)
+	}
+}
+
+// TestBookService_BatchedPush ensures rapid writes are pushed to the queues in fewer
+// pipelines, in order, and that the books still buffered are flushed on exit.
+func TestBookService_BatchedPush(t *testing.T) {
+	client := newMiniRedisClient(t)
+	counter := &pushCounter{}
+	client.AddHook(counter)
+	clock := NewMockClocker()
+	pstorage := &MockBookStorage{AddFunc: func(ctx context.Context, id string, book Book) error { return nil }}
+	queue := NewBatchQueue(zap.NewNop(), client, NewRedisQueue(client), time.Hour, 4, 100, CurrentQueueMessageVersion)
+	bs := NewBookService(zap.NewNop(), nil, clock, pstorage, nil, queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- queue.Run(ctx) }()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, bs.Add(context.Background(), "b:"+strconv.Itoa(i), Book{ID: "b:" + strconv.Itoa(i)}))
+	}
+	require.Eventually(t, func() bool { return client.LLen(context.Background(), CreateQueue).Val() >= 8 }, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	items := client.LRange(context.Background(), CreateQueue, 0, -1).Val()
+	require.Len(t, items, 10)
+	for i, item := range items {
+		assert.Contains(t, item, `"b:`+strconv.Itoa(i)+`"`)
+	}
+	assert.Zero(t, counter.pushes, "books must not be pushed one by one")
+	assert.Less(t, counter.pipelines, 10)
+}
+
+// TestBatchQueue_MaxPending ensures the buffer does not grow beyond its cap while the
+// flushes fail: the extra books are dropped and counted while the buffered ones are
+// kept in order for the next flush.
+func TestBatchQueue_MaxPending(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	queue := NewBatchQueue(zap.NewNop(), client, NewRedisQueue(client), time.Hour, 100, 5, CurrentQueueMessageVersion)
+	ctx := context.Background()
+
+	server.SetError("LOADING redis is loading the dataset in memory")
+	for i := 0; i < 5; i++ {
+		require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:" + strconv.Itoa(i)}))
+	}
+	assert.Equal(t, ErrBatchQueueFull, queue.Push(ctx, CreateQueue, Book{ID: "b:5"}))
+	require.Error(t, queue.Flush(ctx))
+	assert.Equal(t, ErrBatchQueueFull, queue.Push(ctx, CreateQueue, Book{ID: "b:6"}))
+	assert.Equal(t, uint64(2), queue.Dropped())
+
+	server.SetError("")
+	require.NoError(t, queue.Flush(ctx))
+	items := client.LRange(ctx, CreateQueue, 0, -1).Val()
+	require.Len(t, items, 5)
+	for i, item := range items {
+		assert.Contains(t, item, `"b:`+strconv.Itoa(i)+`"`)
+	}
+	require.NoError(t, queue.Push(ctx, CreateQueue, Book{ID: "b:7"}))
+}
+
+// TestBookService_PrimaryBreaker ensures the reads fall straight through to the backup
+// storage once the primary storage circuit opened, then a single read probes the primary
+// storage after the cooldown and closes the circuit when it succeeds.
+func TestBookService_PrimaryBreaker(t *testing.T) {
+	clock := NewMockClocker()
+	var primaryCalls int
+	primaryErr := errors.New("redis: connection pool timeout")
+	pstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			primaryCalls++
+			return Book{ID: id, Title: "primary"}, primaryErr
+		},
+		AddFunc: func(ctx context.Context, id string, book Book) error { return nil },
+	}
+	bstorage := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) { return Book{ID: id, Title: "backup"}, nil },
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	config := &Config{Redis: RedisConfig{Breaker: BreakerConfig{Enable: true, Threshold: 2, Cooldown: time.Minute}}}
+	bs := NewBookService(zap.New(core), config, clock, pstorage, bstorage, nil)
+	breaker := bs.(PrimaryBreakerProvider).PrimaryBreaker()
+	require.NotNil(t, breaker)
+
+	for i := 0; i < 4; i++ {
+		book, err := bs.GetOne(context.Background(), "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "backup", book.Title)
+	}
+	assert.Equal(t, 2, primaryCalls)
+	state, failures, opened := breaker.State()
+	assert.Equal(t, CircuitOpen, state)
+	assert.Equal(t, 2, failures)
+	assert.Equal(t, clock.Now(), opened)
+	require.Equal(t, 1, logs.FilterMessage("breaker: storage circuit opened").Len())
+
+	t.Run("probe fails", func(t *testing.T) {
+		clock.MockNow = clock.MockNow.Add(time.Minute)
+		_, err := bs.GetOne(context.Background(), "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, 3, primaryCalls)
+		state, _, _ := breaker.State()
+		assert.Equal(t, CircuitOpen, state)
+		_, err = bs.GetOne(context.Background(), "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, 3, primaryCalls)
+	})
+
+	t.Run("probe succeeds", func(t *testing.T) {
+		clock.MockNow = clock.MockNow.Add(time.Minute)
+		primaryErr = nil
+		book, err := bs.GetOne(context.Background(), "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "primary", book.Title)
+		state, failures, _ := breaker.State()
+		assert.Equal(t, CircuitClosed, state)
+		assert.Equal(t, 0, failures)
+		changes := logs.FilterMessage("breaker: storage circuit changed")
+		assert.Equal(t, 2, changes.FilterField(zap.String("to", CircuitHalfOpen)).Len())
+		assert.Equal(t, 1, changes.FilterField(zap.String("to", CircuitClosed)).Len())
+	})
+}
+
+// TestStorageBreaker_HalfOpen ensures a half-open circuit lets through a single probe
+// call and that the not found errors do not trip the circuit.
+func TestStorageBreaker_HalfOpen(t *testing.T) {
+	clock := NewMockClocker()
+	sb := NewStorageBreaker(zap.NewNop(), clock, "redis", 1, time.Second)
+	for i := 0; i < 3; i++ {
+		require.True(t, sb.Allow())
+		sb.Record(ErrBookNotFound)
+	}
+	require.True(t, sb.Allow())
+	sb.Record(errors.New("redis: i/o timeout"))
+	assert.False(t, sb.Allow())
+
+	clock.MockNow = clock.MockNow.Add(time.Second)
+	assert.True(t, sb.Allow())
+	assert.False(t, sb.Allow())
+	sb.Record(context.Canceled)
+	state, _, _ := sb.State()
+	assert.Equal(t, CircuitHalfOpen, state)
+	assert.True(t, sb.Allow())
+	sb.Record(nil)
+	state, _, _ = sb.State()
+	assert.Equal(t, CircuitClosed, state)
+}
+
+// TestBookService_DelayedDelete ensures a deleted book is not served anymore while
+// its delete is pending, survives when restored within the grace period, and is
+// pushed to the deletion queue once the grace period elapsed otherwise. A missing
+// book or a book already pending its delete is not found.
+func TestBookService_DelayedDelete(t *testing.T) {
+	for _, delayPrimary := range []bool{false, true} {
+		t.Run("delay primary "+strconv.FormatBool(delayPrimary), func(t *testing.T) {
+			clock := NewMockClocker()
+			pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+			stored := Book{ID: "b:1", Title: "Delayed"}
+			bstorage := &MockBookStorage{
+				GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+					if id != stored.ID {
+						return Book{}, ErrBookNotFound
+					}
+					return stored, nil
+				},
+				GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+					return []Book{stored, {ID: "b:2"}}, "", nil
+				},
+			}
+			var pushed []string
+			queue := &MockQueuer{
+				PushFunc: func(ctx context.Context, qid string, book Book) error {
+					pushed = append(pushed, qid+":"+book.ID)
+					return nil
+				},
+			}
+			config := &Config{Deletes: DeletesConfig{Enable: true, Grace: time.Minute, DelayPrimary: delayPrimary, Interval: time.Second}}
+			bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+			var primary BookStorage
+			if delayPrimary {
+				primary = pstorage
+			}
+			scheduler := NewDeleteScheduler(zap.NewNop(), clock, pstorage.(BookDeleteScheduler), primary, queue, time.Second)
+			ctx := context.Background()
+			require.NoError(t, pstorage.Add(ctx, "b:1", stored))
+
+			deleteBook := func(t *testing.T) {
+				require.NoError(t, bs.Delete(ctx, "b:1"))
+				assert.Equal(t, ErrBookNotFound, bs.Delete(ctx, "b:1"))
+				_, err := bs.GetOne(ctx, "b:1")
+				assert.Equal(t, ErrBookNotFound, err)
+				books, _, err := bs.GetAll(ctx, 10, "", BookSort{})
+				require.NoError(t, err)
+				require.Len(t, books, 1)
+				assert.Equal(t, "b:2", books[0].ID)
+				_, err = pstorage.GetOne(ctx, "b:1")
+				if delayPrimary {
+					assert.NoError(t, err)
+				} else {
+					assert.Equal(t, ErrBookNotFound, err)
+				}
+				deleted, err := scheduler.Drain(ctx)
+				require.NoError(t, err)
+				assert.Zero(t, deleted)
+				assert.Empty(t, pushed)
+			}
+
+			t.Run("missing book", func(t *testing.T) {
+				assert.Equal(t, ErrBookNotFound, bs.Delete(ctx, "b:404"))
+				pending, err := pstorage.(BookDeleteScheduler).DeletePending(ctx, "b:404")
+				require.NoError(t, err)
+				assert.False(t, pending)
+			})
+
+			t.Run("cancelled within the grace period", func(t *testing.T) {
+				deleteBook(t)
+				clock.MockNow = clock.MockNow.Add(30 * time.Second)
+				book, err := bs.Restore(ctx, "b:1")
+				require.NoError(t, err)
+				assert.Equal(t, "Delayed", book.Title)
+
+				clock.MockNow = clock.MockNow.Add(time.Minute)
+				deleted, err := scheduler.Drain(ctx)
+				require.NoError(t, err)
+				assert.Zero(t, deleted)
+				assert.Empty(t, pushed)
+				book, err = bs.GetOne(ctx, "b:1")
+				require.NoError(t, err)
+				assert.Equal(t, "Delayed", book.Title)
+			})
+
+			t.Run("carried out after the grace period", func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					_, err := pstorage.GetOne(ctx, "b:1")
+					return err == nil
+				}, time.Second, 10*time.Millisecond, "book must be cached again into primary storage")
+				deleteBook(t)
+				clock.MockNow = clock.MockNow.Add(time.Minute)
+				deleted, err := scheduler.Drain(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, 1, deleted)
+				assert.Equal(t, []string{DeleteQueue + ":b:1"}, pushed)
+				_, err = pstorage.GetOne(ctx, "b:1")
+				assert.Equal(t, ErrBookNotFound, err)
+				_, err = bs.Restore(ctx, "b:1")
+				assert.Equal(t, ErrBookNotFound, err)
+			})
+		})
+	}
+}
+
+// TestBookService_SyncWrites ensures the sync write mode writes the books into backup
+// storage within Add and Update and rolls back the primary storage write when that failed,
+// so a book is either written into both storages and pushed or left as it was.
+func TestBookService_SyncWrites(t *testing.T) {
+	clock := NewMockClocker()
+	pstorage := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, clock, newMiniRedisClient(t))
+	backup := map[string]Book{}
+	backupErr := errors.New("boltdb: database not open")
+	failing := false
+	bstorage := &MockBookStorage{
+		AddFunc: func(ctx context.Context, id string, book Book) error {
+			if failing {
+				return backupErr
+			}
+			backup[id] = book
+			return nil
+		},
+		UpdateFunc: func(ctx context.Context, id string, book Book) (Book, error) {
+			if failing {
+				return book, backupErr
+			}
+			backup[id] = book
+			return book, nil
+		},
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			if book, found := backup[id]; found {
+				return book, nil
+			}
+			return Book{}, ErrBookNotFound
+		},
+	}
+	var pushed []string
+	queue := &MockQueuer{
+		PushFunc: func(ctx context.Context, qid string, book Book) error {
+			pushed = append(pushed, qid+":"+book.ID)
+			return nil
+		},
+	}
+	config := &Config{Backup: BackupConfig{WriteMode: WriteModeSync}}
+	bs := NewBookService(zap.NewNop(), config, clock, pstorage, bstorage, queue)
+	ctx := context.Background()
+
+	t.Run("add written into both storages", func(t *testing.T) {
+		require.NoError(t, bs.Add(ctx, "b:1", Book{ID: "b:1", Title: "Sync"}))
+		assert.Equal(t, "Sync", backup["b:1"].Title)
+		book, err := pstorage.GetOne(ctx, "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "Sync", book.Title)
+		assert.Equal(t, []string{CreateQueue + ":b:1"}, pushed)
+	})
+
+	t.Run("add rolled back", func(t *testing.T) {
+		failing, pushed = true, nil
+		err := bs.Add(ctx, "b:2", Book{ID: "b:2", Title: "Lost"})
+		assert.ErrorIs(t, err, ErrBackupWrite)
+		assert.ErrorContains(t, err, backupErr.Error())
+		_, err = pstorage.GetOne(ctx, "b:2")
+		assert.Equal(t, ErrBookNotFound, err)
+		assert.NotContains(t, backup, "b:2")
+		assert.Empty(t, pushed)
+	})
+
+	t.Run("update rolled back", func(t *testing.T) {
+		failing, pushed = true, nil
+		_, err := bs.Update(ctx, "b:1", Book{ID: "b:1", Title: "Changed"})
+		assert.ErrorIs(t, err, ErrBackupWrite)
+		book, err := pstorage.GetOne(ctx, "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "Sync", book.Title)
+		assert.Equal(t, "Sync", backup["b:1"].Title)
+		assert.Empty(t, pushed)
+	})
+
+	t.Run("update of a book missing from primary storage rolled back", func(t *testing.T) {
+		failing, pushed = true, nil
+		backup["b:3"] = Book{ID: "b:3", Title: "Backup only"}
+		_, err := bs.Update(ctx, "b:3", Book{ID: "b:3", Title: "Changed"})
+		assert.ErrorIs(t, err, ErrBackupWrite)
+		_, err = pstorage.GetOne(ctx, "b:3")
+		assert.Equal(t, ErrBookNotFound, err)
+		assert.Equal(t, "Backup only", backup["b:3"].Title)
+		assert.Empty(t, pushed)
+	})
+
+	t.Run("update written into both storages", func(t *testing.T) {
+		failing, pushed = false, nil
+		_, err := bs.Update(ctx, "b:1", Book{ID: "b:1", Title: "Changed"})
+		require.NoError(t, err)
+		book, err := pstorage.GetOne(ctx, "b:1")
+		require.NoError(t, err)
+		assert.Equal(t, "Changed", book.Title)
+		assert.Equal(t, "Changed", backup["b:1"].Title)
+		assert.Equal(t, []string{UpdateQueue + ":b:1"}, pushed)
+	})
+
+	t.Run("failed rollback reported", func(t *testing.T) {
+		failing, pushed = true, nil
+		rollbackErr := errors.New("redis: connection refused")
+		primary := &MockBookStorage{
+			AddFunc:    func(ctx context.Context, id string, book Book) error { return nil },
+			DeleteFunc: func(ctx context.Context, id string) error { return rollbackErr },
+		}
+		bs := NewBookService(zap.NewNop(), config, clock, primary, bstorage, queue)
+		err := bs.Add(ctx, "b:4", Book{ID: "b:4"})
+		assert.ErrorIs(t, err, ErrBackupWrite)
+		assert.ErrorIs(t, err, ErrBackupRollback)
+		assert.ErrorIs(t, err, rollbackErr)
+		assert.Empty(t, pushed)
+	})
+}
+
+// TestBookService_GetAllPrecedence ensures the storage serving the first page of books
+// for each preference and each outcome of the primary storage (books, error or empty)
+// and of the backup storage (books or error).
+func TestBookService_GetAllPrecedence(t *testing.T) {
+	primaryBooks, backupBooks := []Book{{ID: "b:1"}}, []Book{{ID: "b:2"}}
+	primaryErr, backupErr := errors.New("redis: failure"), errors.New("bolt: failure")
+	testCases := []struct {
+		prefer        string
+		primary       string // ok, err or empty.
+		backup        string // ok or err.
+		expected      []Book
+		expectedErr   error
+		primaryCalled bool
+		backupCalled  bool
+	}{
+		{ListsPreferPrimary, "ok", "ok", primaryBooks, nil, true, false},
+		{ListsPreferPrimary, "ok", "err", primaryBooks, nil, true, false},
+		{ListsPreferPrimary, "err", "ok", backupBooks, nil, true, true},
+		{ListsPreferPrimary, "err", "err", nil, backupErr, true, true},
+		{ListsPreferPrimary, "empty", "ok", backupBooks, nil, true, true},
+		{ListsPreferPrimary, "empty", "err", []Book{}, nil, true, true},
+		{ListsPreferBackup, "ok", "ok", backupBooks, nil, false, true},
+		{ListsPreferBackup, "ok", "err", primaryBooks, nil, true, true},
+		{ListsPreferBackup, "err", "ok", backupBooks, nil, false, true},
+		{ListsPreferBackup, "err", "err", nil, primaryErr, true, true},
+		{ListsPreferBackup, "empty", "ok", backupBooks, nil, false, true},
+		{ListsPreferBackup, "empty", "err", []Book{}, nil, true, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.prefer+" with primary "+tc.primary+" and backup "+tc.backup, func(t *testing.T) {
+			primaryCalled, backupCalled := false, false
+			pstorage := &MockBookStorage{
+				GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+					primaryCalled = true
+					switch tc.primary {
+					case "err":
+						return nil, "", primaryErr
+					case "empty":
+						return []Book{}, "", nil
+					}
+					return primaryBooks, "", nil
+				},
+			}
+			bstorage := &MockBookStorage{
+				GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+					backupCalled = true
+					if tc.backup == "err" {
+						return nil, "", backupErr
+					}
+					return backupBooks, "", nil
+				},
+			}
+			config := &Config{Lists: ListsConfig{Prefer: tc.prefer}}
+			bs := NewBookService(zap.NewNop(), config, NewMockClocker(), pstorage, bstorage, nil)
+			books, _, err := bs.GetAll(context.Background(), DefaultBooksPageLimit, "", DefaultBookSort)
+			assert.Equal(t, tc.expectedErr, err)
+			assert.Equal(t, tc.expected, books)
+			assert.Equal(t, tc.primaryCalled, primaryCalled)
+			assert.Equal(t, tc.backupCalled, backupCalled)
+		})
+	}
+
+	t.Run("primary circuit open", func(t *testing.T) {
+		pstorage := &MockBookStorage{
+			GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+				return nil, "", primaryErr
+			},
+		}
+		bstorage := &MockBookStorage{
+			GetAllFunc: func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+				return backupBooks, "", nil
+			},
+		}
+		config := &Config{Lists: ListsConfig{Prefer: ListsPreferPrimary}, Redis: RedisConfig{Breaker: BreakerConfig{Enable: true, Threshold: 1, Cooldown: time.Minute}}}
+		bs := NewBookService(zap.NewNop(), config, NewMockClocker(), pstorage, bstorage, nil)
+		_, _, err := bs.GetAll(context.Background(), DefaultBooksPageLimit, "", DefaultBookSort)
+		require.NoError(t, err)
+		pstorage.GetAllFunc = func(ctx context.Context, limit int64, cursor string) ([]Book, string, error) {
+			t.Fatal("primary storage must be skipped while its circuit is open")
+			return nil, "", nil
+		}
+		books, _, err := bs.GetAll(context.Background(), DefaultBooksPageLimit, "", DefaultBookSort)
+		require.NoError(t, err)
+		assert.Equal(t, backupBooks, books)
+	})
+
+	t.Run("next page from the storage of its cursor", func(t *testing.T) {
+		bolt, err := newTestBoltStore()
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, bolt.closeTestBoltStore())
+		}()
+		redis := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), newMiniRedisClient(t))
+		ctx := context.Background()
+		// the empty redis makes boltdb serve the first page even when redis is preferred.
+		for _, id := range []string{"b:1", "b:2", "b:3"} {
+			require.NoError(t, bolt.Add(ctx, id, Book{ID: id}))
+		}
+		for _, prefer := range []string{ListsPreferPrimary, ListsPreferBackup} {
+			bs := NewBookService(zap.NewNop(), &Config{Lists: ListsConfig{Prefer: prefer}}, NewMockClocker(), redis, bolt, nil)
+			var all []Book
+			books, next, err := bs.GetAll(ctx, 2, "", DefaultBookSort)
+			for ; err == nil && next != ""; books, next, err = bs.GetAll(ctx, 2, next, DefaultBookSort) {
+				all = append(all, books...)
+			}
+			require.NoError(t, err, prefer)
+			all = append(all, books...)
+			assert.Len(t, all, 3, prefer)
+		}
+		bs := NewBookService(zap.NewNop(), &Config{Lists: ListsConfig{Prefer: ListsPreferPrimary}}, NewMockClocker(), redis, bolt, nil)
+		_, _, err = bs.GetAll(ctx, 2, EncodeCursor("other", "1"), DefaultBookSort)
+		assert.Equal(t, ErrInvalidCursor, err)
+	})
+}
+
+// TestBookService_ShadowReads ensures the books read from primary storage are compared
+// with the backup storage ones without affecting the returned book.
+func TestBookService_ShadowReads(t *testing.T) {
+	primary := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return Book{ID: id, Title: "Primary"}, nil
+		},
+	}
+	backupBooks := map[string]Book{"b:1": {ID: "b:1", Title: "Backup"}, "b:2": {ID: "b:2", Title: "Primary"}}
+	backup := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			if id == "b:4" {
+				return Book{}, errors.New("boltdb: timeout")
+			}
+			book, found := backupBooks[id]
+			if !found {
+				return Book{}, ErrBookNotFound
+			}
+			return book, nil
+		},
+	}
+	core, logs := observer.New(zap.WarnLevel)
+	config := &Config{Backup: BackupConfig{Shadow: ShadowConfig{Enable: true, SampleRate: 1, Timeout: time.Second}}}
+	bs := NewBookService(zap.New(core), config, NewMockClocker(), primary, backup, &MockQueuer{})
+	shadow := bs.(ShadowReaderProvider).ShadowReader()
+	ctx := context.Background()
+
+	for i, id := range []string{"b:1", "b:2", "b:3", "b:4"} {
+		book, err := bs.GetOne(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, Book{ID: id, Title: "Primary"}, book)
+		assert.Eventually(t, func() bool {
+			compared, _, failures := shadow.Stats()
+			return compared+failures == uint64(i+1)
+		}, time.Second, 10*time.Millisecond)
+	}
+	compared, mismatches, failures := shadow.Stats()
+	assert.Equal(t, uint64(3), compared)
+	assert.Equal(t, uint64(2), mismatches)
+	assert.Equal(t, uint64(1), failures)
+	assert.Equal(t, 1, logs.FilterMessage("shadow: book mismatch").FilterField(zap.String("id", "b:1")).Len())
+	assert.Equal(t, 1, logs.FilterMessage("shadow: book missing into bstorage").FilterField(zap.String("id", "b:3")).Len())
+	assert.Equal(t, 1, logs.FilterMessage("shadow: failed to read book from bstorage").Len())
+}
+
+// TestBookService_ShadowReadsLag ensures the books updated within the lag are not
+// verified since the backup storage may not have been written yet.
+func TestBookService_ShadowReadsLag(t *testing.T) {
+	clock := NewMockClocker()
+	books := map[string]Book{
+		"b:1": {ID: "b:1", UpdatedAt: clock.Now().Add(-time.Second).Format(time.RFC3339)},
+		"b:2": {ID: "b:2", UpdatedAt: clock.Now().Add(-time.Minute).Format(time.RFC3339)},
+	}
+	primary := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			return books[id], nil
+		},
+	}
+	var reads atomic.Int32
+	backup := &MockBookStorage{
+		GetOneFunc: func(ctx context.Context, id string) (Book, error) {
+			reads.Add(1)
+			return Book{}, ErrBookNotFound
+		},
+	}
+	config := &Config{Backup: BackupConfig{Shadow: ShadowConfig{Enable: true, SampleRate: 1, Timeout: time.Second, Lag: 5 * time.Second}}}
+	bs := NewBookService(zap.NewNop(), config, clock, primary, backup, &MockQueuer{})
+	shadow := bs.(ShadowReaderProvider).ShadowReader()
+	ctx := context.Background()
+
+	for _, id := range []string{"b:1", "b:2"} {
+		_, err := bs.GetOne(ctx, id)
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		compared, _, _ := shadow.Stats()
+		return compared == 1
+	}, time.Second, 10*time.Millisecond)
+	compared, mismatches, _ := shadow.Stats()
+	assert.Equal(t, uint64(1), compared)
+	assert.Equal(t, uint64(1), mismatches)
+	assert.Equal(t, int32(1), reads.Load())
+}
+
+// TestBookService_ConcurrentUpdates ensures the concurrent updates of a same book are
+// serialized with the locks so each replaced version is recorded once into the history
+// and none is lost. Run it with -race to check the locks are safe for concurrent use.
+func TestBookService_ConcurrentUpdates(t *testing.T) {
+	const updates = 20
+	client := newMiniRedisClient(t)
+	config := &Config{History: HistoryConfig{Enable: true, Size: updates + 1}}
+	repo := NewRedisBookStorage(zap.NewNop(), &RedisConfig{}, NewMockClocker(), client)
+	queue := &MockQueuer{PushFunc: func(ctx context.Context, qid string, book Book) error { return nil }}
+	bs := NewBookService(zap.NewNop(), config, NewMockClocker(), repo, repo, queue)
+	ctx := context.Background()
+	require.NoError(t, bs.Add(ctx, "b:1", Book{ID: "b:1", Title: "v0"}))
+
+	var wg sync.WaitGroup
+	for i := 1; i <= updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := bs.Update(ctx, "b:1", Book{ID: "b:1", Title: "v" + strconv.Itoa(i)})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	final, err := bs.GetOne(ctx, "b:1")
+	require.NoError(t, err)
+	history, err := bs.History(ctx, "b:1")
+	require.NoError(t, err)
+	require.Len(t, history, updates, "each update must record the version it replaced")
+	titles := map[string]bool{final.Title: true}
+	for _, book := range history {
+		assert.False(t, titles[book.Title], "version %s recorded twice", book.Title)
+		titles[book.Title] = true
+	}
+	assert.Len(t, titles, updates+1, "all the versions must be either stored or into the history")
+	assert.Equal(t, "v0", history[0].Title)
+}
+
+// TestKeyedMutex ensures a same key is held by one caller at a time, including when locked
+// along with other keys, while distinct keys of distinct shards are held concurrently.
+func TestKeyedMutex(t *testing.T) {
+	km := NewKeyedMutex(0)
+	assert.Len(t, km.shards, DefaultLockShards)
+
+	var holders, maxHolders int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys := []string{"b:1"}
+			if i%2 == 0 {
+				keys = append(keys, "b:"+strconv.Itoa(i), "b:1")
+			}
+			unlock := km.Lock(keys...)
+			defer unlock()
+			mu.Lock()
+			holders++
+			maxHolders = max(maxHolders, holders)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), maxHolders)
+
+	km = NewKeyedMutex(2)
+	a, b := "b:1", "b:2"
+	for km.shard(a) == km.shard(b) {
+		b += "0"
+	}
+	unlock := km.Lock(a)
+	done := make(chan struct{})
+	go func() {
+		km.Lock(b)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keys of distinct shards must not block each other")
+	}
+	unlock()
+}